@@ -12,13 +12,18 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
 	"peer-wan/pkg/agent"
 	"peer-wan/pkg/api"
+	"peer-wan/pkg/dataplane"
 	"peer-wan/pkg/model"
 	"peer-wan/pkg/version"
+	"peer-wan/pkg/wireguard"
 )
 
 func main() {
@@ -31,6 +36,7 @@ func main() {
 	defaultCA := os.Getenv("CA_FILE")
 	defaultProvision := os.Getenv("PROVISION_TOKEN")
 	defaultOut := os.Getenv("OUT_DIR")
+	defaultLabels := os.Getenv("LABELS")
 
 	nodeID := flag.String("id", defaultID, "node id (overrides NODE_ID env)")
 	showVersion := flag.Bool("v", false, "print version and exit")
@@ -44,7 +50,8 @@ func main() {
 	iface := flag.String("iface", "wg0", "wireguard interface name")
 	asn := flag.Int("asn", 65000, "BGP ASN for FRR config")
 	routerID := flag.String("router-id", "", "override BGP router-id (defaults to overlay IP)")
-	apply := flag.Bool("apply", false, "attempt to apply configs (wg-quick + vtysh -b)")
+	apply := flag.Bool("apply", false, "attempt to apply configs (wireguard/routes via --dataplane + vtysh -b)")
+	dataplaneName := flag.String("dataplane", firstNonEmpty(os.Getenv("DATAPLANE"), dataplane.Native), "native (wgctrl/netlink) or shell (wg-quick/ip, e.g. for wireguard-go hosts) (env DATAPLANE)")
 	controller := flag.String("controller", defaultController, "controller base URL")
 	authToken := flag.String("token", defaultToken, "auth token matching controller --token (env AUTH_TOKEN)")
 	caFile := flag.String("ca", defaultCA, "CA file for controller TLS (optional)")
@@ -55,6 +62,10 @@ func main() {
 	planInterval := flag.Duration("plan-interval", 0, "if >0, poll controller plan and re-render/apply on change (e.g., 30s)")
 	provisionToken := flag.String("provision-token", defaultProvision, "one-time provision token from controller (env PROVISION_TOKEN)")
 	autoEndpoint := flag.Bool("auto-endpoint", true, "auto-detect endpoint when provision-token is set")
+	labels := flag.String("labels", defaultLabels, "comma separated key=value node labels for peering intents (env LABELS)")
+	relay := flag.String("relay", os.Getenv("RELAY"), "true/false: offer this node as relay for peers without a reachable endpoint (env RELAY; empty keeps the controller setting)")
+	agentKeys := flag.Bool("agent-keys", os.Getenv("AGENT_KEYS") != "false", "keep the wireguard private key on this node (--key-file) and register only its public key with a proof (env AGENT_KEYS)")
+	keyFile := flag.String("key-file", agent.DefaultKeyFile, "wireguard private key file used with --agent-keys")
 	flag.Parse()
 
 	if *showVersion {
@@ -65,9 +76,19 @@ func main() {
 	if *nodeID == "" {
 		log.Fatal("node id is required (flag --id or env NODE_ID)")
 	}
+	if *apply {
+		if err := agent.SetDataplane(*dataplaneName); err != nil {
+			log.Fatalf("dataplane: %v", err)
+		}
+	}
 	if *controller == "" {
 		log.Fatal("controller base URL is required")
 	}
+	if agent.IsDecommissioned(*nodeID) {
+		// stay idle instead of exiting so supervisors (Restart=always) don't loop on a deleted node
+		log.Printf("node %s was decommissioned by the controller; remove /var/lib/peer-wan/decommissioned to provision again", *nodeID)
+		select {}
+	}
 
 	client, err := buildHTTPClient(*caFile, *clientCert, *clientKey, *insecure)
 	if err != nil {
@@ -84,6 +105,14 @@ func main() {
 		ASN:            *asn,
 		RouterID:       *routerID,
 		ProvisionToken: *provisionToken,
+		Labels:         parseLabels(*labels),
+	}
+	if *relay != "" {
+		on, err := strconv.ParseBool(*relay)
+		if err != nil {
+			log.Fatalf("invalid --relay %q: %v", *relay, err)
+		}
+		req.Relay = &on
 	}
 	if *provisionToken != "" && *overlayIP == "10.10.1.1/32" {
 		req.OverlayIP = ""
@@ -91,24 +120,41 @@ func main() {
 	if *autoEndpoint {
 		if eps := detectEndpoints(*listenPort); len(eps) > 0 {
 			req.Endpoints = eps
+		} else if *endpoints == "127.0.0.1:51820" {
+			// behind NAT/CGNAT: register without the placeholder so the controller relays us
+			req.Endpoints = nil
+			log.Printf("no public endpoint detected; peers without endpoints will be reached via relays")
 		}
 	}
 
-	cfg, err := register(client, *controller, *authToken, req)
+	var cfg api.NodeConfigResponse
+	localPriv := ""
+	if *agentKeys && (*privateKey == "" || *privateKey == "stub-private-key") {
+		cfg, localPriv, err = registerWithLocalKey(client, *controller, *authToken, req, *keyFile)
+	} else {
+		cfg, err = register(client, *controller, *authToken, req)
+	}
 	if err != nil {
 		log.Fatalf("register failed: %v", err)
 	}
 
+	agent.SetOverlayPools(cfg.OverlayPools, cfg.OverlayPool6)
+	agent.SetRelay(cfg.Relay)
 	selectedOverlay := firstNonEmpty(cfg.OverlayIP, *overlayIP)
 	selectedListen := chooseInt(cfg.ListenPort, *listenPort)
 	selectedASN := chooseInt(cfg.ASN, *asn)
 	selectedRouterID := firstNonEmpty(cfg.RouterID, *routerID, ipFromCIDR(selectedOverlay))
-	selectedPriv := firstNonEmpty(cfg.PrivateKey, *privateKey)
+	selectedPriv := firstNonEmpty(localPriv, cfg.PrivateKey, *privateKey)
+	if localPriv != "" {
+		agent.SetKeyFile(*keyFile)
+	}
 
 	node := model.Node{
 		ID:         cfg.ID,
 		CIDRs:      cfg.Routes,
 		OverlayIP:  selectedOverlay,
+		OverlayIP6: cfg.OverlayIP6,
+		Relay:      cfg.Relay,
 		ListenPort: selectedListen,
 		ASN:        selectedASN,
 		RouterID:   selectedRouterID,
@@ -179,13 +225,65 @@ func register(client *http.Client, controller, token string, req api.NodeRegistr
 
 	log.Printf("registered node=%s version=%s routes=%v message=%s", cfg.ID, cfg.ConfigVersion, cfg.Routes, cfg.Message)
 	if len(cfg.WireGuardPeers) > 0 {
-		log.Printf("peer plan: %+v", cfg.WireGuardPeers)
+		// ids only: delivered peers carry preshared keys
+		ids := make([]string, 0, len(cfg.WireGuardPeers))
+		for _, p := range cfg.WireGuardPeers {
+			ids = append(ids, p.ID)
+		}
+		log.Printf("peer plan: %v", ids)
 	} else {
 		log.Printf("peer plan empty (expected in stub), controller will populate once topology is enabled")
 	}
 	return cfg, nil
 }
 
+// registerWithLocalKey registers with the private key kept in keyFile and proves possession
+// of it instead of receiving it. Without a key file yet, the key the controller still holds
+// for an existing node is adopted (its peers keep working) or, when the controller no
+// longer hands out keys, a new one is generated. It returns the private key in use.
+func registerWithLocalKey(client *http.Client, controller, token string, req api.NodeRegistrationRequest, keyFile string) (api.NodeConfigResponse, string, error) {
+	proofPub, agentGenerated, ok, err := agent.FetchProofKey(client, controller)
+	if err != nil {
+		return api.NodeConfigResponse{}, "", fmt.Errorf("fetch proof key: %w", err)
+	}
+	if !ok {
+		log.Printf("controller does not support agent-generated keys; using the controller-issued key")
+		cfg, err := register(client, controller, token, req)
+		return cfg, "", err
+	}
+	key, ok, err := agent.LoadKey(keyFile)
+	if err != nil {
+		return api.NodeConfigResponse{}, "", err
+	}
+	if !ok {
+		if !agentGenerated {
+			cfg, err := register(client, controller, token, req)
+			if err != nil {
+				return cfg, "", err
+			}
+			if k, errKey := wgtypes.ParseKey(cfg.PrivateKey); errKey == nil {
+				key, ok = k, true
+				log.Printf("adopting the controller-issued wireguard key")
+			}
+		}
+		if !ok {
+			if key, err = wgtypes.GeneratePrivateKey(); err != nil {
+				return api.NodeConfigResponse{}, "", fmt.Errorf("generate key: %w", err)
+			}
+			log.Printf("generated a new wireguard key")
+		}
+		if err := agent.SaveKey(keyFile, key); err != nil {
+			return api.NodeConfigResponse{}, "", fmt.Errorf("store key (use --key-file or --agent-keys=false): %w", err)
+		}
+	}
+	req.PublicKey = key.PublicKey().String()
+	if req.KeyProof, err = wireguard.KeyProof(key, proofPub, req.ID); err != nil {
+		return api.NodeConfigResponse{}, "", fmt.Errorf("key proof: %w", err)
+	}
+	cfg, err := register(client, controller, token, req)
+	return cfg, key.String(), err
+}
+
 func buildHTTPClient(caFile, certFile, keyFile string, insecure bool) (*http.Client, error) {
 	tlsConfig := &tls.Config{InsecureSkipVerify: insecure} //nolint:gosec
 	if caFile != "" {
@@ -223,6 +321,20 @@ func splitAndTrim(s string) []string {
 	return out
 }
 
+// parseLabels turns "region=eu,tier=edge" into a map; nil when empty so the controller keeps
+// labels set through the API.
+func parseLabels(s string) map[string]string {
+	var out map[string]string
+	for _, kv := range splitAndTrim(s) {
+		k, v, _ := strings.Cut(kv, "=")
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out
+}
+
 func detectEndpoints(listenPort int) []string {
 	var eps []string
 	// 1) best-effort via UDP dial to discover default egress
@@ -2,31 +2,54 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"peer-wan/assets"
 	"peer-wan/pkg/api"
 	"peer-wan/pkg/db"
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/series"
+	"peer-wan/pkg/snapshot"
 	"peer-wan/pkg/store"
 	"peer-wan/pkg/version"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
 	addr := flag.String("addr", ":8080", "listen address")
 	showVersion := flag.Bool("v", false, "print version and exit")
-	storeType := flag.String("store", getenv("STORE", "memory"), "store backend: memory|consul (requires build tag consul)")
+	storeType := flag.String("store", getenv("STORE", "memory"), "store backend: memory|consul|sql (consul requires build tag consul; sql uses DB_DRIVER connection)")
 	consulAddr := flag.String("consul-addr", getenv("CONSUL_HTTP_ADDR", "127.0.0.1:8500"), "consul address (when store=consul)")
 	//consulAddr := flag.String("consul-addr", getenv("CONSUL_HTTP_ADDR", "8.222.155.32:8500"), "consul address (when store=consul)")
 	tlsCert := flag.String("tls-cert", "", "TLS cert path (enables HTTPS if set with --tls-key)")
 	tlsKey := flag.String("tls-key", "", "TLS key path (enables HTTPS if set with --tls-cert)")
 	clientCA := flag.String("client-ca", "", "require and verify client certs using this CA (optional)")
 	lockKey := flag.String("lock-key", "peer-wan/locks/leader", "Consul lock key for leader election")
+	advertiseAddr := flag.String("advertise-addr", getenv("ADVERTISE_ADDR", ""), "base URL other replicas forward API requests to while this one leads (store=consul; defaults to http(s)://<hostname><addr>)")
 	publicAddr := flag.String("public-addr", getenv("PUBLIC_ADDR", ""), "controller external base URL for agent bootstrap (e.g. https://ctrl.example.com:8080)")
+	snapshotDir := flag.String("snapshot-dir", getenv("SNAPSHOT_DIR", ""), "directory for scheduled state snapshots (disabled when empty)")
+	snapshotInterval := flag.Duration("snapshot-interval", 6*time.Hour, "interval between scheduled snapshots (with --snapshot-dir)")
+	snapshotRetain := flag.Int("snapshot-retain", 7, "number of scheduled snapshots to keep")
+	dataDir := flag.String("data-dir", getenv("DATA_DIR", ""), "persist the memory store to this directory (write-ahead log + compacted snapshot)")
+	walFsync := flag.String("wal-fsync", getenv("WAL_FSYNC", "always"), "memory store fsync policy: always|interval|never (with --data-dir)")
+	retentionInterval := flag.Duration("retention-interval", 10*time.Minute, "how often the janitor enforces history retention (0 disables)")
+	walRepair := flag.Bool("wal-repair", false, "truncate a corrupt memory store WAL at the first bad record instead of refusing to start")
 	flag.Parse()
 
 	if *showVersion {
@@ -46,10 +69,33 @@ func main() {
 	case "consul":
 		nodeStore = store.NewConsulStore(*consulAddr)
 	case "memory":
-		nodeStore = store.NewMemoryStore()
+		if *dataDir == "" {
+			nodeStore = store.NewMemoryStore()
+			break
+		}
+		mode, errMode := store.ParseFsyncMode(*walFsync)
+		if errMode != nil {
+			log.Fatalf("%v", errMode)
+		}
+		nodeStore, err = store.OpenDurableMemoryStore(*dataDir, store.DurableOptions{Fsync: mode, Repair: *walRepair})
+		if err != nil {
+			log.Fatalf("failed to open memory store in %s: %v", *dataDir, err)
+		}
+		log.Printf("memory store persisted in %s (fsync=%s)", *dataDir, mode)
+	case "sql":
+		nodeStore, err = store.NewSQLStore(dbConn)
+		if err != nil {
+			log.Fatalf("failed to init sql store: %v", err)
+		}
 	default:
 		log.Fatalf("unsupported store type: %s", *storeType)
 	}
+	if *storeType != "consul" {
+		// replicas load it when they win the election instead
+		if err := api.LoadRoutingState(nodeStore); err != nil {
+			log.Printf("load routing state failed: %v", err)
+		}
+	}
 	wsHub := api.NewWSHub()
 	wsHub.AttachStore(nodeStore)
 	log.Printf("starting controller version=%s store=%s consul=%s publicAddr=%s", version.BuildCN(), *storeType, *consulAddr, *publicAddr)
@@ -67,40 +113,76 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Only the elected leader recomputes plans on watch events; the flag stays false
+	// until LeaderGuard hands us the lock (or forever when running without consul).
+	var isLeader atomic.Bool
+	var handler http.Handler = mux
+	if fw, ok := nodeStore.(interface {
+		SetAdvertiseAddr(string)
+		LeaderAddr(string) (string, error)
+	}); ok && *storeType == "consul" {
+		self := *advertiseAddr
+		if self == "" {
+			self = defaultAdvertiseAddr(*addr, *tlsCert != "" && *tlsKey != "")
+		}
+		fw.SetAdvertiseAddr(self)
+		var transport http.RoundTripper
+		if *tlsCert != "" && *tlsKey != "" {
+			if transport, err = api.ForwardTransport(*tlsCert, *tlsKey, *clientCA); err != nil {
+				log.Fatalf("leader forwarding transport: %v", err)
+			}
+		}
+		// followers only proxy: plans, pushes and link state live on the leader
+		handler = api.NewLeaderForwarder(mux, isLeader.Load, func() (string, error) { return fw.LeaderAddr(*lockKey) }, transport)
+		log.Printf("advertising %s to replicas; followers forward /api/ to the leader", self)
+	}
 	if w, ok := nodeStore.(interface {
 		StartWatch(context.Context, func())
 	}); ok && *storeType == "consul" {
 		w.StartWatch(ctx, func() {
+			if !isLeader.Load() {
+				return
+			}
 			if err := api.RecomputeAllPlans(nodeStore, &planVersion); err != nil {
 				log.Printf("consul watch recompute failed: %v", err)
 			}
 			api.BumpPlanVersion(&planVersion)
-			log.Printf("consul watch triggered; planVersion=%d", planVersion)
+			log.Printf("consul watch triggered; planVersion=%d", atomic.LoadInt64(&planVersion))
 		})
 	}
-	// periodic prune health history (>24h)
-	go func() {
-		t := time.NewTicker(1 * time.Hour)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				if pruner, ok := nodeStore.(interface{ PruneHealthBefore(time.Time) error }); ok {
-					cutoff := time.Now().Add(-24 * time.Hour)
-					if err := pruner.PruneHealthBefore(cutoff); err != nil {
-						log.Printf("prune health history failed: %v", err)
-					}
-				}
-			}
+	if *snapshotDir != "" {
+		box, errBox := secret.FromEnv()
+		if errBox != nil {
+			log.Fatalf("snapshot secret key: %v", errBox)
 		}
-	}()
+		snapshot.StartScheduler(ctx, nodeStore, box, *snapshotDir, *snapshotInterval, *snapshotRetain)
+		log.Printf("scheduled snapshots every %s into %s (retain %d)", *snapshotInterval, *snapshotDir, *snapshotRetain)
+	}
+	// retention janitor: enforces the per-collection limits from settings (see /api/v1/settings/retention)
+	var janitorActive func() bool
+	if *storeType == "consul" {
+		janitorActive = isLeader.Load
+	}
+	store.StartJanitor(ctx, nodeStore, *retentionInterval, janitorActive)
+	// health rollup: raw reports -> 1m -> 5m -> 1h buckets (see /api/v1/health/series)
+	series.StartRollup(ctx, nodeStore, janitorActive)
+	// per-link preshared keys: stage keys for new pairs and due rotations (see /api/v1/settings/preshared-keys)
+	api.StartKeyRotation(ctx, nodeStore, &planVersion, janitorActive)
 	if lg, ok := nodeStore.(interface {
 		LeaderGuard(context.Context, string, time.Duration, func(context.Context))
 	}); ok && *storeType == "consul" {
 		go lg.LeaderGuard(ctx, *lockKey, 15*time.Second, func(lctx context.Context) {
 			log.Printf("leader acquired lock %s; watching for plan changes", *lockKey)
+			// continue from the link state the previous leader saved, not our stale copy
+			if err := api.LoadRoutingState(nodeStore); err != nil {
+				log.Printf("load routing state failed: %v", err)
+			}
+			isLeader.Store(true)
+			defer isLeader.Store(false)
+			// catch up on anything changed while another replica (or nobody) was leader
+			if err := api.RecomputeAllPlans(nodeStore, &planVersion); err != nil {
+				log.Printf("leader recompute failed: %v", err)
+			}
 			ticker := time.NewTicker(30 * time.Second)
 			defer ticker.Stop()
 			for {
@@ -119,10 +201,21 @@ func main() {
 
 	srv := &http.Server{
 		Addr:              *addr,
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	// shut down cleanly on SIGINT/SIGTERM so stores can flush (memory WAL writes a final snapshot)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), 10*time.Second)
+		defer done()
+		srv.Shutdown(shutdownCtx)
+	}()
+
 	log.Printf("controller listening on %s", *addr)
 	if *tlsCert != "" && *tlsKey != "" {
 		if *clientCA != "" {
@@ -138,9 +231,31 @@ func main() {
 	} else {
 		err = srv.ListenAndServe()
 	}
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server error: %v", err)
 	}
+	if c, ok := nodeStore.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("close store: %v", err)
+		}
+	}
+	log.Printf("controller stopped")
+}
+
+// defaultAdvertiseAddr turns the listen address into a URL other replicas can reach.
+func defaultAdvertiseAddr(listen string, tls bool) string {
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return scheme + "://" + listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host, _ = os.Hostname()
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
 }
 
 func getenv(k, def string) string {
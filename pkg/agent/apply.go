@@ -1,15 +1,16 @@
 package agent
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"net"
 	"os/exec"
+
+	"peer-wan/pkg/dataplane"
 )
 
 // ApplyConfigs tries to apply the generated configs.
-// It assumes wg-quick and vtysh are installed and the caller has sufficient privileges.
+// It assumes vtysh (and wg-quick for the shell dataplane) is installed and the caller has sufficient privileges.
 func ApplyConfigs(wgConfPath, iface string, bgpConfPath string) error {
 	if iface == "" {
 		iface = "wg0"
@@ -21,34 +22,47 @@ func ApplyConfigs(wgConfPath, iface string, bgpConfPath string) error {
 	if err := ensureNAT(iface); err != nil {
 		log.Printf("ensure NAT failed: %v", err)
 	}
+	ensureRelayForward(iface)
 	if err := run("vtysh", "-b", "-f", bgpConfPath); err != nil {
 		return fmt.Errorf("vtysh apply bgp: %w", err)
 	}
 	return nil
 }
 
+// dp configures the interface, routes and policy rules; see SetDataplane.
+var dp dataplane.Dataplane = dataplane.ShellDataplane{}
+
+// SetDataplane selects the dataplane backend (dataplane.Native or dataplane.Shell).
+func SetDataplane(name string) error {
+	d, err := dataplane.New(name)
+	if err != nil {
+		return err
+	}
+	dp = d
+	return nil
+}
+
 // applyWireGuard updates the interface without tearing it down when possible to avoid flaps.
 func applyWireGuard(wgConfPath, iface string) error {
-	if !ifaceExists(iface) {
-		if err := run("wg-quick", "up", wgConfPath); err != nil {
-			return fmt.Errorf("wg-quick up: %w", err)
-		}
-		return nil
-	}
+	return dp.ApplyInterface(iface, wgConfPath)
+}
 
-	// Interface exists: update peers using wg syncconf + wg-quick strip to avoid removing the interface.
-	stripCmd := exec.Command("wg-quick", "strip", wgConfPath)
-	conf, err := stripCmd.Output()
+// ifaceHasIPv6 reports whether iface carries a global IPv6 address (dual-stack overlay).
+func ifaceHasIPv6(iface string) bool {
+	ifi, err := net.InterfaceByName(iface)
 	if err != nil {
-		return fmt.Errorf("wg-quick strip: %w", err)
+		return false
 	}
-
-	cmd := exec.Command("wg", "syncconf", iface, "/dev/stdin")
-	cmd.Stdin = bytes.NewReader(conf)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("wg syncconf: %w output=%s", err, string(out))
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return false
 	}
-	return nil
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() == nil && ipn.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
 }
 
 func ifaceExists(iface string) bool {
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// decommissionMarker records that the controller deleted this node, so a restarted
+// agent does not try to register (and rebuild the dataplane) again.
+const decommissionMarker = "/var/lib/peer-wan/decommissioned"
+
+// managed ip rule priorities installed by applyStaticRoutes.
+var managedRulePriorities = []int{100, 140, 150, 200}
+
+var decommissioned atomic.Bool
+
+// IsDecommissioned reports whether nodeID was removed by the controller on a previous run.
+func IsDecommissioned(nodeID string) bool {
+	data, err := os.ReadFile(decommissionMarker)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == nodeID
+}
+
+// handleWSDecommission tears down everything the agent installed once the controller deleted the node.
+func handleWSDecommission(payload map[string]interface{}) {
+	if !decommissioned.CompareAndSwap(false, true) {
+		return
+	}
+	wsStateMu.RLock()
+	ctx := wsCtx
+	wsStateMu.RUnlock()
+	reason, _ := payload["reason"].(string)
+	log.Printf("decommission requested for node %s (%s); tearing down dataplane", ctx.nodeID, reason)
+	wsLog("decommission: tearing down %s", ctx.iface)
+	wsTunMgr.Shutdown()
+	if ctx.apply {
+		teardownDataplane(ctx.iface, ctx.outDir, ctx.asn)
+	}
+	if err := os.MkdirAll(filepath.Dir(decommissionMarker), 0o755); err == nil {
+		_ = os.WriteFile(decommissionMarker, []byte(ctx.nodeID+"\n"), 0o644)
+	}
+	log.Printf("node %s decommissioned; remove %s to provision it again", ctx.nodeID, decommissionMarker)
+	if agentWS != nil {
+		agentWS.close()
+	}
+}
+
+// teardownDataplane removes the WireGuard interface, policy routes/rules, NAT and BGP config (best effort).
+func teardownDataplane(iface, outDir string, asn int) {
+	if iface == "" {
+		iface = "wg0"
+	}
+	wgPath := filepath.Join(outDir, fmt.Sprintf("%s.conf", iface))
+	// routes bound to the device (main/table 52/table 100) disappear with it
+	logErr(dp.DeleteInterface(iface, wgPath))
+	logErr(dp.FlushTable(100))
+	for _, prio := range managedRulePriorities {
+		logErr(dp.DeleteRules(prio))
+	}
+	_ = dp.FlushRouteCache()
+
+	st := loadNatState()
+	if err := cleanupNatRules(st.Iface, st.Egress, st.CIDR); err != nil {
+		log.Printf("cleanup NAT rules failed: %v", err)
+	}
+	_ = os.Remove(natStatePath)
+
+	if asn > 0 {
+		if _, err := exec.LookPath("vtysh"); err == nil {
+			if err := run("vtysh", "-c", "configure terminal", "-c", fmt.Sprintf("no router bgp %d", asn)); err != nil {
+				log.Printf("remove bgp config failed: %v", err)
+			}
+		}
+	}
+	_ = os.Remove(wgPath)
+	_ = os.Remove(filepath.Join(outDir, "bgpd.conf"))
+	log.Printf("dataplane teardown finished for %s", iface)
+}
@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+const (
+	// handshakeTimeout marks a session dead: WireGuard re-handshakes every 2 minutes
+	// while keepalives flow, so an older handshake means the endpoint stopped working.
+	handshakeTimeout = 180 * time.Second
+	// endpointGrace is how long a freshly selected endpoint gets to complete a handshake.
+	endpointGrace = 30 * time.Second
+	// maxEndpointGrace caps the backoff once every candidate of a peer has failed.
+	maxEndpointGrace = 10 * time.Minute
+	// endpointCheckInterval is how often handshakes are inspected.
+	endpointCheckInterval = 10 * time.Second
+)
+
+// peerEndpoints is the failover state of one peer.
+type peerEndpoints struct {
+	publicKey  string
+	candidates []string
+	current    int
+	since      time.Time // when candidates[current] was selected
+	rounds     int       // full passes over the candidates without a handshake
+	active     bool      // last check saw a fresh handshake on candidates[current]
+}
+
+// endpointFailover remembers which endpoint candidate is in use for every peer.
+type endpointFailover struct {
+	mu    sync.Mutex
+	peers map[string]*peerEndpoints // by peer id
+}
+
+var endpointFO = &endpointFailover{peers: map[string]*peerEndpoints{}}
+
+// choose returns peers with Endpoint set to the selected candidate. A peer whose candidate
+// list changed starts over at the controller's preferred (first) endpoint; peers with a
+// manual PeerEndpoints override are not rotated.
+func (f *endpointFailover) choose(peers []model.Peer, overrides map[string]string) []model.Peer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := append([]model.Peer(nil), peers...)
+	seen := map[string]bool{}
+	for i, p := range out {
+		cands := p.Endpoints
+		if len(cands) == 0 && p.Endpoint != "" {
+			cands = []string{p.Endpoint}
+		}
+		if ov := overrides[p.ID]; ov != "" {
+			cands = []string{ov}
+		}
+		if len(cands) == 0 {
+			continue
+		}
+		seen[p.ID] = true
+		st, ok := f.peers[p.ID]
+		if !ok || st.publicKey != p.PublicKey || strings.Join(st.candidates, ",") != strings.Join(cands, ",") {
+			st = &peerEndpoints{publicKey: p.PublicKey, candidates: cands, since: time.Now()}
+			f.peers[p.ID] = st
+		}
+		out[i].Endpoint = st.candidates[st.current]
+	}
+	for id := range f.peers {
+		if !seen[id] {
+			delete(f.peers, id)
+		}
+	}
+	return out
+}
+
+// check updates the state from the latest handshakes (public key -> time) and rotates
+// peers whose current endpoint has not handshaken within its grace period. It reports
+// whether any selection changed.
+func (f *endpointFailover) check(handshakes map[string]time.Time, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed := false
+	for id, st := range f.peers {
+		hs := handshakes[st.publicKey]
+		if !hs.IsZero() && now.Sub(hs) < handshakeTimeout {
+			st.active = true
+			st.rounds = 0
+			continue
+		}
+		st.active = false
+		if len(st.candidates) < 2 {
+			continue
+		}
+		grace := endpointGrace << st.rounds
+		if grace > maxEndpointGrace {
+			grace = maxEndpointGrace
+		}
+		if now.Sub(st.since) < grace {
+			continue
+		}
+		prev := st.candidates[st.current]
+		st.current = (st.current + 1) % len(st.candidates)
+		if st.current == 0 {
+			st.rounds++
+		}
+		st.since = now
+		changed = true
+		log.Printf("endpoint failover: peer %s %s -> %s (no handshake)", id, prev, st.candidates[st.current])
+	}
+	return changed
+}
+
+// active returns peer id -> endpoint for peers with a fresh handshake.
+func (f *endpointFailover) active() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]string{}
+	for id, st := range f.peers {
+		if st.active {
+			out[id] = st.candidates[st.current]
+		}
+	}
+	return out
+}
+
+// freshHandshakes returns the ids of the planned peers with a WireGuard handshake newer
+// than handshakeTimeout, endpoint or not; the controller stops relaying a pair once one
+// side reports the other here.
+func freshHandshakes() []string {
+	wsStateMu.RLock()
+	peers := latestCfg.WireGuardPeers
+	iface := wsCtx.iface
+	wsStateMu.RUnlock()
+	if iface == "" || len(peers) == 0 {
+		return nil
+	}
+	hs, err := readHandshakes(iface)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	now := time.Now()
+	for _, p := range peers {
+		if ts := hs[p.PublicKey]; !ts.IsZero() && now.Sub(ts) < handshakeTimeout {
+			out = append(out, p.ID)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// startEndpointFailover watches handshakes on iface and re-renders/applies the latest plan
+// when an endpoint is rotated.
+func startEndpointFailover(iface string) {
+	go func() {
+		ticker := time.NewTicker(endpointCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if decommissioned.Load() {
+				return
+			}
+			hs, err := readHandshakes(iface)
+			if err != nil {
+				continue
+			}
+			if endpointFO.check(hs, time.Now()) {
+				reapplyPeers()
+			}
+		}
+	}()
+}
+
+// reapplyPeers renders and applies the latest plan so rotated endpoints take effect.
+func reapplyPeers() {
+	wsStateMu.RLock()
+	cfg := latestCfg
+	base := latestNode
+	ctx := wsCtx
+	wsStateMu.RUnlock()
+	if cfg.ConfigVersion == "" || !ctx.apply {
+		return
+	}
+	n, nextASN := mergePlanIntoNode(base, cfg, ctx.asn)
+	wgPath, bgpPath, err := RenderAndWrite(ctx.outDir, ctx.iface, n, cfg.WireGuardPeers, ctx.private, nextASN)
+	if err != nil {
+		log.Printf("endpoint failover render failed: %v", err)
+		return
+	}
+	if err := ApplyConfigs(wgPath, ctx.iface, bgpPath); err != nil {
+		log.Printf("endpoint failover apply failed: %v", err)
+	}
+}
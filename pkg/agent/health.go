@@ -23,11 +23,14 @@ func StartHealthReporter(client *http.Client, controller, authToken, provisionTo
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
-		for {
+		for !decommissioned.Load() {
 			if err := reportOnce(client, controller, authToken, provisionToken, nodeID, peers); err != nil {
 				log.Printf("health report failed: %v", err)
 			}
-			<-ticker.C
+			select {
+			case <-ticker.C:
+			case <-healthNow:
+			}
 		}
 	}()
 }
@@ -45,6 +48,8 @@ func reportOnce(client *http.Client, controller, authToken, provisionToken, node
 		}
 		ms, pct, err := ping(ip, 1*time.Second)
 		if err != nil {
+			// unreachable: report full loss without a latency so outages show up in the series
+			loss[ip] = 100
 			continue
 		}
 		latency[ip] = int(ms)
@@ -58,11 +63,64 @@ func reportOnce(client *http.Client, controller, authToken, provisionToken, node
 		PacketLoss: loss,
 		FRRState:   frrState,
 		Timestamp:  time.Now(),
+
+		ActiveEndpoints: endpointFO.active(),
+		Handshakes:      freshHandshakes(),
+		StagedKeys:      stagedKeys(),
+		StagedPeerKeys:  stagedPeerKeys(),
+		// read after the pings, which refresh the handshakes of idle links
+		WireGuard: wireguardStats(),
 	}
+	addKeyRotation(client, controller, &report)
 	wsSend("health", report)
 	return postJSON(client, controller+"/api/v1/health", authToken, provisionToken, report)
 }
 
+// stagedKeys acknowledges the next preshared keys of the latest plan, so the controller
+// can commit a rotation once both ends of a link hold the new key.
+func stagedKeys() map[string]int {
+	wsStateMu.RLock()
+	defer wsStateMu.RUnlock()
+	var out map[string]int
+	for _, p := range latestCfg.WireGuardPeers {
+		if p.NextPresharedKey == "" {
+			continue
+		}
+		if out == nil {
+			out = map[string]int{}
+		}
+		out[p.ID] = p.KeyGeneration + 1
+	}
+	return out
+}
+
+// stagedPeerKeys acknowledges the next public keys of rotating peers in the latest plan.
+func stagedPeerKeys() map[string]string {
+	wsStateMu.RLock()
+	defer wsStateMu.RUnlock()
+	var out map[string]string
+	for _, p := range latestCfg.WireGuardPeers {
+		if p.NextPublicKey == "" {
+			continue
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[p.ID] = p.NextPublicKey
+	}
+	return out
+}
+
+// healthNow asks the health reporter for an immediate report.
+var healthNow = make(chan struct{}, 1)
+
+func requestHealthReport() {
+	select {
+	case healthNow <- struct{}{}:
+	default:
+	}
+}
+
 func peerOverlayIP(p model.Peer) string {
 	for _, ip := range p.AllowedIPs {
 		if strings.Contains(ip, "/") {
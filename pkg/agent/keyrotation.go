@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/wireguard"
+)
+
+// nodeKey is the file holding the node's private key when the agent generated it. During a
+// rotation the next key waits in <file>.next until the switch, and the previous key stays
+// in <file>.prev until the controller completes or rolls back the rotation.
+var nodeKey struct {
+	sync.Mutex
+	path string
+}
+
+// SetKeyFile lets the agent take part in rotations of the node key kept at path.
+func SetKeyFile(path string) {
+	nodeKey.Lock()
+	defer nodeKey.Unlock()
+	nodeKey.path = path
+}
+
+// followKeyRotation carries out the agent's part of the rotation phase in rot and returns
+// the private key the interface runs from now on.
+func followKeyRotation(rot *model.KeyRotation, privateKey string) string {
+	nodeKey.Lock()
+	defer nodeKey.Unlock()
+	path := nodeKey.path
+	if path == "" {
+		return privateKey
+	}
+	next, prev := path+".next", path+".prev"
+	switch {
+	case rot == nil:
+		// nothing in flight: drop what a finished or abandoned rotation left behind
+		_ = os.Remove(next)
+		_ = os.Remove(prev)
+	case rot.Phase == model.KeyRotationGenerate:
+		if _, ok, err := LoadKey(next); err != nil || !ok {
+			k, err := wgtypes.GeneratePrivateKey()
+			if err == nil {
+				err = SaveKey(next, k)
+			}
+			if err != nil {
+				log.Printf("key rotation %s: generate next key: %v", rot.TaskID, err)
+				break
+			}
+			log.Printf("key rotation %s: generated next key", rot.TaskID)
+			requestHealthReport()
+		}
+	case rot.Phase == model.KeyRotationSwitch || rot.Phase == model.KeyRotationVerify:
+		k, ok, err := LoadKey(next)
+		if err != nil || !ok || k.PublicKey().String() != rot.NextPublicKey {
+			break // switched already
+		}
+		cur, ok, err := LoadKey(path)
+		if err == nil && ok {
+			err = SaveKey(prev, cur)
+		}
+		if err == nil {
+			err = SaveKey(path, k)
+		}
+		if err != nil {
+			log.Printf("key rotation %s: switch: %v", rot.TaskID, err)
+			break
+		}
+		_ = os.Remove(next)
+		log.Printf("key rotation %s: switched to the next key", rot.TaskID)
+		requestHealthReport()
+	case rot.Phase == model.KeyRotationRollback:
+		k, ok, err := LoadKey(prev)
+		if err != nil || !ok || k.PublicKey().String() != rot.PreviousPublicKey {
+			break // never switched or rolled back already
+		}
+		if err := SaveKey(path, k); err != nil {
+			log.Printf("key rotation %s: rollback: %v", rot.TaskID, err)
+			break
+		}
+		_ = os.Remove(prev)
+		log.Printf("key rotation %s: rolled back to the previous key", rot.TaskID)
+		requestHealthReport()
+	}
+	// the key file is authoritative, also after a restart in the middle of a rotation
+	if k, ok, err := LoadKey(path); err == nil && ok {
+		privateKey = k.String()
+	}
+	wsStateMu.Lock()
+	wsCtx.private = privateKey
+	wsStateMu.Unlock()
+	return privateKey
+}
+
+// addKeyRotation adds the agent's part of a rotation in flight to report: the key its
+// interface runs, the next key with a proof of possession while the controller waits for
+// it, and the peers that handshook since the switch while it verifies.
+func addKeyRotation(client *http.Client, controller string, report *model.HealthReport) {
+	wsStateMu.RLock()
+	rot := latestCfg.KeyRotation
+	peers := latestCfg.WireGuardPeers
+	iface := wsCtx.iface
+	wsStateMu.RUnlock()
+	nodeKey.Lock()
+	path := nodeKey.path
+	nodeKey.Unlock()
+	if rot == nil || path == "" {
+		return
+	}
+	cur, ok, err := LoadKey(path)
+	if err != nil || !ok {
+		return
+	}
+	report.PublicKey = cur.PublicKey().String()
+	switch rot.Phase {
+	case model.KeyRotationGenerate:
+		next, ok, err := LoadKey(path + ".next")
+		if err != nil || !ok {
+			return
+		}
+		proofPub, _, ok, err := FetchProofKey(client, controller)
+		if err != nil || !ok {
+			log.Printf("key rotation %s: fetch proof key: %v", rot.TaskID, err)
+			return
+		}
+		proof, err := wireguard.KeyProof(next, proofPub, report.NodeID)
+		if err != nil {
+			return
+		}
+		report.NextPublicKey, report.NextKeyProof = next.PublicKey().String(), proof
+	case model.KeyRotationVerify:
+		fi, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		hs, err := readHandshakes(iface)
+		if err != nil {
+			return
+		}
+		// written at the switch; wg reports whole seconds
+		switched := fi.ModTime().Unix()
+		for _, p := range peers {
+			if ts := hs[p.PublicKey]; !ts.IsZero() && ts.Unix() > switched {
+				report.KeyHandshakes = append(report.KeyHandshakes, p.ID)
+			}
+		}
+	}
+}
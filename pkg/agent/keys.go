@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultKeyFile holds the node's WireGuard private key when the agent manages it.
+const DefaultKeyFile = "/var/lib/peer-wan/wireguard.key"
+
+// LoadKey reads the private key at path; ok is false when there is none yet.
+func LoadKey(path string) (key wgtypes.Key, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return wgtypes.Key{}, false, nil
+	}
+	if err != nil {
+		return wgtypes.Key{}, false, err
+	}
+	key, err = wgtypes.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return wgtypes.Key{}, false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return key, true, nil
+}
+
+// SaveKey writes key to path, readable by root only.
+func SaveKey(path string, key wgtypes.Key) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(key.String()+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// FetchProofKey returns the controller's key-proof public key and whether it enforces
+// agent-generated keys. ok is false for controllers without support for them.
+func FetchProofKey(client *http.Client, controller string) (pub wgtypes.Key, agentGenerated, ok bool, err error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(controller + "/api/v1/nodes/proof-key")
+	if err != nil {
+		return wgtypes.Key{}, false, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return wgtypes.Key{}, false, false, nil
+	}
+	if resp.StatusCode >= 300 {
+		return wgtypes.Key{}, false, false, fmt.Errorf("controller returned %s", resp.Status)
+	}
+	var body struct {
+		PublicKey      string `json:"publicKey"`
+		AgentGenerated bool   `json:"agentGenerated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return wgtypes.Key{}, false, false, fmt.Errorf("decode proof key: %w", err)
+	}
+	if pub, err = wgtypes.ParseKey(body.PublicKey); err != nil {
+		return wgtypes.Key{}, false, false, fmt.Errorf("parse proof key: %w", err)
+	}
+	return pub, body.AgentGenerated, true, nil
+}
@@ -9,11 +9,50 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"peer-wan/pkg/model"
 )
 
-const defaultOverlayCIDR = "10.10.0.0/16"
 const natStatePath = "/var/lib/peer-wan/nat_state.json"
 
+// overlayNet is the overlay address space NAT rules are scoped to, as assigned by the
+// controller; the defaults cover controllers that do not send pools.
+var overlayNet = struct {
+	sync.Mutex
+	pools []string
+	pool6 string
+}{pools: []string{model.DefaultOverlayPool}, pool6: model.DefaultOverlay6Prefix}
+
+// SetOverlayPools records the overlay pools from a NodeConfigResponse; empty values keep
+// the current ones.
+func SetOverlayPools(pools []string, pool6 string) {
+	overlayNet.Lock()
+	defer overlayNet.Unlock()
+	if len(pools) > 0 {
+		overlayNet.pools = append([]string(nil), pools...)
+	}
+	if pool6 != "" {
+		overlayNet.pool6 = pool6
+	}
+}
+
+// relayMode is set while the controller has flagged this node as a relay.
+var relayMode atomic.Bool
+
+// SetRelay records whether this node relays traffic between peers that cannot reach each other.
+func SetRelay(on bool) {
+	relayMode.Store(on)
+}
+
+// overlayCIDRs returns the IPv4 pools as an iptables source list and the IPv6 prefix.
+func overlayCIDRs() (string, string) {
+	overlayNet.Lock()
+	defer overlayNet.Unlock()
+	return strings.Join(overlayNet.pools, ","), overlayNet.pool6
+}
+
 // ensureNAT best-effort installs forwarding + MASQUERADE so overlay traffic can egress without manual iptables.
 // It mirrors the bootstrap script behavior but runs every apply to keep rules present.
 func ensureNAT(iface string) error {
@@ -32,10 +71,7 @@ func ensureNAT(iface string) error {
 		return nil
 	}
 
-	cidr := os.Getenv("WG_CIDR")
-	if cidr == "" {
-		cidr = defaultOverlayCIDR
-	}
+	cidr, cidr6 := overlayCIDRs()
 	egress := os.Getenv("NAT_EGRESS_IF")
 	if egress == "" {
 		egress = os.Getenv("WAN_IF")
@@ -75,19 +111,67 @@ func ensureNAT(iface string) error {
 	); err != nil {
 		return fmt.Errorf("iptables masquerade %s via %s: %w", cidr, egress, err)
 	}
-	_ = saveNatState(natState{Iface: iface, Egress: egress, CIDR: cidr})
-	log.Printf("NAT ensured for %s via %s (cidr=%s)", iface, egress, cidr)
+	state := natState{Iface: iface, Egress: egress, CIDR: cidr, Relay: prev.Relay}
+	if ifaceHasIPv6(iface) {
+		state.CIDR6, state.Mode6 = ensureNAT66(iface, egress, cidr6, prev)
+	} else if prev.Mode6 != "" {
+		cleanupNat66Rules(prev.Iface, prev.Egress, prev.CIDR6, prev.Mode6)
+	}
+	_ = saveNatState(state)
+	log.Printf("NAT ensured for %s via %s (cidr=%s cidr6=%s mode6=%s)", iface, egress, cidr, state.CIDR6, state.Mode6)
 	return nil
 }
 
+// ensureNAT66 sets up IPv6 forwarding for a dual-stack overlay. NAT66=masquerade (default)
+// hides the ULA overlay behind the egress address; NAT66=routed only forwards, for pools
+// that are routed to this node upstream; NAT66=off leaves IPv6 alone. It returns the
+// managed cidr and mode ("" when nothing is managed).
+func ensureNAT66(iface, egress, cidr string, prev natState) (string, string) {
+	mode := strings.ToLower(os.Getenv("NAT66"))
+	if mode == "" {
+		mode = "masquerade"
+	}
+	if prev.Mode6 != "" && (prev.Iface != iface || prev.Egress != egress || prev.CIDR6 != cidr || prev.Mode6 != mode) {
+		cleanupNat66Rules(prev.Iface, prev.Egress, prev.CIDR6, prev.Mode6)
+	}
+	if mode == "off" {
+		return "", ""
+	}
+	if _, err := exec.LookPath("ip6tables"); err != nil {
+		log.Printf("ip6tables not found, skip NAT66 setup")
+		return "", ""
+	}
+	_ = exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1").Run()
+	if err := ensureRule("ip6tables", []string{"-C", "FORWARD", "-i", iface, "-o", egress, "-j", "ACCEPT"}, []string{"-A", "FORWARD", "-i", iface, "-o", egress, "-j", "ACCEPT"}); err != nil {
+		log.Printf("ip6tables forward wg->%s: %v", egress, err)
+	}
+	if err := ensureRule("ip6tables", []string{"-C", "FORWARD", "-i", egress, "-o", iface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"}, []string{"-A", "FORWARD", "-i", egress, "-o", iface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"}); err != nil {
+		log.Printf("ip6tables forward %s->wg: %v", egress, err)
+	}
+	if mode == "masquerade" {
+		if err := ensureRule("ip6tables",
+			[]string{"-t", "nat", "-C", "POSTROUTING", "-s", cidr, "-o", egress, "-j", "MASQUERADE"},
+			[]string{"-t", "nat", "-A", "POSTROUTING", "-s", cidr, "-o", egress, "-j", "MASQUERADE"},
+		); err != nil {
+			log.Printf("ip6tables masquerade %s via %s: %v", cidr, egress, err)
+		}
+	}
+	return cidr, mode
+}
+
 func ensureIptablesRule(checkArgs, addArgs []string) error {
+	return ensureRule("iptables", checkArgs, addArgs)
+}
+
+// ensureRule runs addArgs with bin (iptables or ip6tables) unless checkArgs finds the rule.
+func ensureRule(bin string, checkArgs, addArgs []string) error {
 	if len(checkArgs) == 0 || len(addArgs) == 0 {
 		return fmt.Errorf("missing args")
 	}
-	if err := exec.Command("iptables", checkArgs...).Run(); err == nil {
+	if err := exec.Command(bin, checkArgs...).Run(); err == nil {
 		return nil
 	}
-	if out, err := exec.Command("iptables", addArgs...).CombinedOutput(); err != nil {
+	if out, err := exec.Command(bin, addArgs...).CombinedOutput(); err != nil {
 		return fmt.Errorf("add %v: %v (%s)", addArgs, err, string(out))
 	}
 	return nil
@@ -97,6 +181,9 @@ type natState struct {
 	Iface  string `json:"iface"`
 	Egress string `json:"egress"`
 	CIDR   string `json:"cidr"`
+	CIDR6  string `json:"cidr6,omitempty"`
+	Mode6  string `json:"mode6,omitempty"` // masquerade or routed; empty = no IPv6 rules managed
+	Relay  string `json:"relay,omitempty"` // interface with managed relay forwarding rules
 }
 
 func loadNatState() natState {
@@ -135,3 +222,63 @@ func cleanupNatRules(iface, egress, cidr string) error {
 	del([]string{"-D", "FORWARD", "-i", egress, "-o", iface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"})
 	return nil
 }
+
+// cleanupNat66Rules removes previously managed ip6tables rules.
+func cleanupNat66Rules(iface, egress, cidr, mode string) {
+	if iface == "" || egress == "" || mode == "" {
+		return
+	}
+	del := func(args []string) {
+		_ = exec.Command("ip6tables", args...).Run()
+	}
+	if mode == "masquerade" && cidr != "" {
+		del([]string{"-t", "nat", "-D", "POSTROUTING", "-s", cidr, "-o", egress, "-j", "MASQUERADE"})
+	}
+	del([]string{"-D", "FORWARD", "-i", iface, "-o", egress, "-j", "ACCEPT"})
+	del([]string{"-D", "FORWARD", "-i", egress, "-o", iface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"})
+}
+
+// relayForwardRule is the FORWARD rule letting a relay send overlay traffic back out of
+// iface, from one peer to another; the comment keeps it apart from the NAT rules.
+func relayForwardRule(op, iface string) []string {
+	return []string{op, "FORWARD", "-i", iface, "-o", iface, "-m", "comment", "--comment", "peer-wan-relay", "-j", "ACCEPT"}
+}
+
+// ensureRelayForward installs forwarding between peers on iface while the node is a relay
+// and removes it once it is not (or the interface changed).
+func ensureRelayForward(iface string) {
+	if runtime.GOOS == "darwin" {
+		return
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return
+	}
+	state := loadNatState()
+	want := ""
+	if relayMode.Load() {
+		want = iface
+	}
+	if state.Relay != "" && state.Relay != want {
+		for _, bin := range []string{"iptables", "ip6tables"} {
+			_ = exec.Command(bin, relayForwardRule("-D", state.Relay)...).Run()
+		}
+		log.Printf("relay forwarding removed from %s", state.Relay)
+	}
+	if want != "" {
+		_ = exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1").Run()
+		if err := ensureRule("iptables", relayForwardRule("-C", iface), relayForwardRule("-A", iface)); err != nil {
+			log.Printf("relay forwarding on %s failed: %v", iface, err)
+			return
+		}
+		if ifaceHasIPv6(iface) {
+			_ = exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1").Run()
+			if err := ensureRule("ip6tables", relayForwardRule("-C", iface), relayForwardRule("-A", iface)); err != nil {
+				log.Printf("relay forwarding (ipv6) on %s failed: %v", iface, err)
+			}
+		}
+	}
+	if state.Relay != want {
+		state.Relay = want
+		_ = saveNatState(state)
+	}
+}
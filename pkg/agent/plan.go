@@ -71,11 +71,15 @@ func StartPlanPoller(client *http.Client, controller, authToken, provisionToken,
 	wsCtx.nodeID = nodeID
 	latestNode = node
 	wsStateMu.Unlock()
+	if apply {
+		startEndpointFailover(iface)
+	}
 	agentWS = newWSClient(controller, nodeID, authToken, provisionToken)
 	if agentWS != nil {
 		agentWS.on("command", func(payload map[string]interface{}) { handleWSCommand(payload, client) })
 		agentWS.on("plan", handleWSPlan)
 		agentWS.on("task", func(p map[string]interface{}) { handleWSTask(p, client) })
+		agentWS.on("decommission", handleWSDecommission)
 		agentWS.start()
 	}
 	// WS 模式：禁用 HTTP 轮询，仅定期自愈
@@ -87,9 +91,10 @@ func StartPlanPoller(client *http.Client, controller, authToken, provisionToken,
 				wsStateMu.RLock()
 				cfg := latestCfg
 				currentNode := latestNode
+				currentKey := wsCtx.private // follows node key rotations
 				wsStateMu.RUnlock()
-				if apply && cfg.ConfigVersion != "" {
-					if err := ensureRuntimeState(cfg, currentNode, iface, asn, outDir, privateKey, apply, client, controller, authToken, provisionToken); err != nil {
+				if apply && cfg.ConfigVersion != "" && !decommissioned.Load() {
+					if err := ensureRuntimeState(cfg, currentNode, iface, asn, outDir, currentKey, apply, client, controller, authToken, provisionToken); err != nil {
 						log.Printf("runtime ensure failed: %v", err)
 					}
 				}
@@ -100,6 +105,7 @@ func StartPlanPoller(client *http.Client, controller, authToken, provisionToken,
 }
 
 func handlePlan(cfg api.NodeConfigResponse, node model.Node, outDir, iface, privateKey string, asn int, apply bool, client *http.Client, controller, authToken, provisionToken string) (model.Node, error) {
+	privateKey = followKeyRotation(cfg.KeyRotation, privateKey)
 	n, nextASN := mergePlanIntoNode(node, cfg, asn)
 	wsStateMu.Lock()
 	latestCfg = cfg
@@ -149,6 +155,9 @@ func ensureRuntimeState(cfg api.NodeConfigResponse, base model.Node, iface strin
 
 // handleWSCommand executes controller-pushed commands via websocket.
 func handleWSCommand(payload map[string]interface{}, client *http.Client) {
+	if decommissioned.Load() {
+		return
+	}
 	action, _ := payload["action"].(string)
 	wsStateMu.RLock()
 	cfg := latestCfg
@@ -189,6 +198,9 @@ func handleWSCommand(payload map[string]interface{}, client *http.Client) {
 
 // handleWSPlan applies a plan pushed via WS (fully替代轮询).
 func handleWSPlan(payload map[string]interface{}) {
+	if decommissioned.Load() {
+		return
+	}
 	wsStateMu.RLock()
 	ctx := wsCtx
 	wsStateMu.RUnlock()
@@ -209,6 +221,9 @@ func handleWSPlan(payload map[string]interface{}) {
 
 // handleWSTask drives a multi-step task pipeline for policy apply/diagnose.
 func handleWSTask(payload map[string]interface{}, client *http.Client) {
+	if decommissioned.Load() {
+		return
+	}
 	wsStateMu.RLock()
 	ctx := wsCtx
 	cfg := latestCfg
@@ -281,10 +296,15 @@ func mergePlanIntoNode(node model.Node, cfg api.NodeConfigResponse, asn int) (mo
 			CacheTTL: cfg.GeoIPConfig.CacheTTL,
 		})
 	}
+	SetOverlayPools(cfg.OverlayPools, cfg.OverlayPool6)
+	SetRelay(cfg.Relay)
 	n := node
+	n.Relay = cfg.Relay
 	if cfg.OverlayIP != "" {
 		n.OverlayIP = cfg.OverlayIP
 	}
+	// dual-stack is controller-wide; an empty value means IPv6 was disabled
+	n.OverlayIP6 = cfg.OverlayIP6
 	if cfg.ListenPort > 0 {
 		n.ListenPort = cfg.ListenPort
 	} else if n.ListenPort == 0 {
@@ -374,7 +394,8 @@ func runPolicyDiag(client *http.Client, controller, authToken, provisionToken st
 	}
 
 	// iptables nat rule
-	if err := exec.Command("iptables", "-t", "nat", "-C", "POSTROUTING", "-s", defaultOverlayCIDR, "-o", iface, "-j", "MASQUERADE").Run(); err == nil {
+	cidr, _ := overlayCIDRs()
+	if err := exec.Command("iptables", "-t", "nat", "-C", "POSTROUTING", "-s", cidr, "-o", iface, "-j", "MASQUERADE").Run(); err == nil {
 		add("NAT MASQUERADE", "ok", "存在 POSTROUTING 掩码规则")
 	} else {
 		add("NAT MASQUERADE", "warn", "缺少 POSTROUTING 掩码规则")
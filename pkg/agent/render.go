@@ -1,15 +1,14 @@
 package agent
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"peer-wan/pkg/dataplane"
 	"peer-wan/pkg/frr"
 	"peer-wan/pkg/model"
 	"peer-wan/pkg/policy"
@@ -25,6 +24,8 @@ func RenderAndWrite(outputDir, iface string, node model.Node, peers []model.Peer
 	if node.ListenPort == 0 {
 		node.ListenPort = 8082
 	}
+	// pick the endpoint candidate currently in use for every peer (see endpointFailover)
+	peers = endpointFO.choose(peers, node.PeerEndpoints)
 
 	peersWithPolicy := append([]model.Peer(nil), peers...)
 	hostToLocal := allocateLocalPorts(peersWithPolicy, 30000)
@@ -98,12 +99,17 @@ func augmentEgressAllowedIPs(peers *[]model.Peer, node model.Node) {
 		if target == "" {
 			continue
 		}
+		target = relayedVia(target, *peers)
 		targets[target] = append(targets[target], pfx...)
 	}
 
-	// 2) default route: add 0/0 only to the configured egress peer
+	// 2) default route: add 0/0 (and ::/0 when the egress is dual-stack) only to the configured egress peer
 	if node.DefaultRoute && node.EgressPeerID != "" {
-		targets[node.EgressPeerID] = append(targets[node.EgressPeerID], "0.0.0.0/0")
+		egress := relayedVia(node.EgressPeerID, *peers)
+		targets[egress] = append(targets[egress], "0.0.0.0/0")
+		if frrOverlay6ForPeer(node.EgressPeerID, *peers) != "" {
+			targets[egress] = append(targets[egress], "::/0")
+		}
 	}
 
 	for i, p := range *peers {
@@ -166,16 +172,12 @@ func applyStaticRoutes(plan model.Plan, iface string) error {
 		}
 		nhIP := strings.Split(nh, "/")[0]
 		// ensure next-hop host route exists (scope link) so kernel accepts it
-		if out, err := exec.Command("ip", "route", "replace", nhIP+"/32", "dev", iface, "scope", "link").CombinedOutput(); err != nil {
-			log.Printf("ensure nexthop %s link route failed: %v (%s)", nhIP, err, string(out))
-		}
-		cmds := [][]string{
-			{"ip", "route", "replace", prefix, "via", nhIP, "dev", iface},
-			{"ip", "route", "replace", prefix, "via", nhIP, "dev", iface, "table", "100"},
+		if err := dp.ReplaceRoute(dataplane.Route{Dst: policy.HostPrefix(nhIP), Dev: iface}); err != nil {
+			log.Printf("ensure nexthop %s link route failed: %v", nhIP, err)
 		}
-		for _, args := range cmds {
-			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
-				return fmt.Errorf("%s: %v (%s)", strings.Join(args, " "), err, string(out))
+		for _, table := range []int{0, 100} {
+			if err := dp.ReplaceRoute(dataplane.Route{Dst: prefix, Via: nhIP, Dev: iface, Table: table}); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -188,14 +190,21 @@ func applyStaticRoutes(plan model.Plan, iface string) error {
 		}
 		if nh := frrOverlayForPeer(targetPeer, plan.Peers); nh != "" {
 			nhIP := strings.Split(nh, "/")[0]
-			_ = exec.Command("ip", "route", "replace", "default", "via", nhIP, "dev", iface, "table", "100").Run()
+			logErr(dp.ReplaceRoute(dataplane.Route{Dst: "0.0.0.0/0", Via: nhIP, Dev: iface, Table: 100}))
 			bypass := plan.BypassCIDRs
 			for _, c := range bypass {
-				_ = exec.Command("ip", "rule", "add", "from", c, "lookup", "main", "priority", "100").Run()
+				logErr(dp.AddRule(dataplane.Rule{From: c, Table: dataplane.MainTable, Priority: 100}))
 			}
-			_ = exec.Command("ip", "rule", "add", "priority", "200", "lookup", "100").Run()
+			logErr(dp.AddRule(dataplane.Rule{Table: 100, Priority: 200}))
 			log.Printf("default route via %s table100; bypass=%v", nhIP, bypass)
 		}
+		// IPv6 default only when the egress peer is dual-stack
+		if nh6 := frrOverlay6ForPeer(targetPeer, plan.Peers); nh6 != "" {
+			nhIP := strings.Split(nh6, "/")[0]
+			logErr(dp.ReplaceRoute(dataplane.Route{Dst: "::/0", Via: nhIP, Dev: iface, Table: 100}))
+			logErr(dp.AddRule(dataplane.Rule{Table: 100, Priority: 200, V6: true}))
+			log.Printf("ipv6 default route via %s table100", nhIP)
+		}
 	}
 	// 策略前缀
 	for _, pr := range plan.PolicyRules {
@@ -208,13 +217,18 @@ func applyStaticRoutes(plan model.Plan, iface string) error {
 		// 本地直出：对匹配前缀加规则走主路由，避免兜底表100
 		if pr.ViaNode == "local" || pr.ViaNode == "main" {
 			for _, pfx := range pfxList {
-				if out, err := exec.Command("ip", "rule", "add", "to", pfx, "lookup", "main", "priority", "150").CombinedOutput(); err != nil {
-					log.Printf("apply policy local rule %s failed: %v (%s)", pfx, err, string(out))
+				v6 := policy.IsIPv6(pfx)
+				if err := dp.AddRule(dataplane.Rule{To: pfx, Table: dataplane.MainTable, Priority: 150}); err != nil {
+					log.Printf("apply policy local rule %s failed: %v", pfx, err)
+				}
+				gw, dev := primaryGW, primaryDev
+				if v6 {
+					gw, dev = detectPrimaryRoute6()
 				}
-				if primaryGW != "" && primaryDev != "" {
+				if gw != "" && dev != "" {
 					// 明确在主路由表里放一条非 wg 下一跳，避免默认表被 wg 覆盖
-					if out, err := exec.Command("ip", "route", "replace", pfx, "via", primaryGW, "dev", primaryDev).CombinedOutput(); err != nil {
-						log.Printf("apply policy local route %s via %s dev %s failed: %v (%s)", pfx, primaryGW, primaryDev, err, string(out))
+					if err := dp.ReplaceRoute(dataplane.Route{Dst: pfx, Via: gw, Dev: dev}); err != nil {
+						log.Printf("apply policy local route %s via %s dev %s failed: %v", pfx, gw, dev, err)
 					}
 				}
 				recordPolicyOp(ruleHash, "apply_rule", "local main rule "+pfx)
@@ -227,32 +241,60 @@ func applyStaticRoutes(plan model.Plan, iface string) error {
 			nextID = pr.Path[0]
 		}
 		nextHop := frrOverlayForPeer(nextID, plan.Peers)
+		nextHop6 := frrOverlay6ForPeer(nextID, plan.Peers)
 		if nextHop == "" {
 			continue
 		}
-		log.Printf("policy rule applying: prefix=%s domains=%v via=%s path=%v nextHop=%s targets=%d", pr.Prefix, pr.Domains, pr.ViaNode, pr.Path, nextHop, len(pfxList))
+		log.Printf("policy rule applying: prefix=%s domains=%v via=%s path=%v nextHop=%s nextHop6=%s targets=%d", pr.Prefix, pr.Domains, pr.ViaNode, pr.Path, nextHop, nextHop6, len(pfxList))
 		for _, pfx := range pfxList {
+			v6 := policy.IsIPv6(pfx)
+			nextHop := nextHop
+			if v6 {
+				if nextHop6 == "" {
+					log.Printf("skip policy route %s: next hop %s has no ipv6 overlay address", pfx, nextID)
+					continue
+				}
+				nextHop = nextHop6
+			}
 			if err := apply(pfx, nextHop); err != nil {
 				log.Printf("apply policy route %s -> %s failed: %v", pfx, nextHop, err)
 			} else {
 				log.Printf("applied policy route %s -> %s (main+table100)", pfx, nextHop)
 				recordPolicyOp(ruleHash, "apply_route", pfx+" via "+nextHop)
 				// Add a policy rule to prefer main for this prefix (before other rules like table 52)
-				if out, err := exec.Command("ip", "rule", "add", "to", pfx, "lookup", "main", "priority", "140").CombinedOutput(); err != nil && !strings.Contains(string(out), "File exists") {
-					log.Printf("apply policy rule %s -> main failed: %v (%s)", pfx, err, string(out))
+				if err := dp.AddRule(dataplane.Rule{To: pfx, Table: dataplane.MainTable, Priority: 140}); err != nil {
+					log.Printf("apply policy rule %s -> main failed: %v", pfx, err)
 				}
 			}
 		}
 	}
 	purgeMissingHashes(ruleHashes)
 	// flush route cache so new rules/routes take effect immediately
-	_ = exec.Command("ip", "route", "flush", "cache").Run()
+	_ = dp.FlushRouteCache()
 
 	return nil
 }
 
+// logErr logs a best-effort dataplane failure.
+func logErr(err error) {
+	if err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// relayedVia returns the relay carrying peer id's prefixes, or id itself.
+func relayedVia(id string, peers []model.Peer) string {
+	for _, p := range peers {
+		if p.ID == id && p.Relay != "" {
+			return p.Relay
+		}
+	}
+	return id
+}
+
 // frrOverlayForPeer mirrors frr.overlayForPeer but is local to avoid import cycle.
 func frrOverlayForPeer(id string, peers []model.Peer) string {
+	id = relayedVia(id, peers)
 	for _, p := range peers {
 		if p.ID == id {
 			for _, ip := range p.AllowedIPs {
@@ -263,6 +305,17 @@ func frrOverlayForPeer(id string, peers []model.Peer) string {
 	return ""
 }
 
+// frrOverlay6ForPeer returns the IPv6 overlay address of a dual-stack peer.
+func frrOverlay6ForPeer(id string, peers []model.Peer) string {
+	id = relayedVia(id, peers)
+	for _, p := range peers {
+		if p.ID == id {
+			return p.OverlayIP6
+		}
+	}
+	return ""
+}
+
 func containsCIDR(list []string, cidr string) bool {
 	for _, v := range list {
 		if v == cidr {
@@ -272,9 +325,9 @@ func containsCIDR(list []string, cidr string) bool {
 	return false
 }
 
-// syncPeerRoutes ensures allowed prefixes of peers are present in main and table 52,
-// and prunes stale entries in table 52. This keeps multi-hop overlay reachability working
-// even when policy routing directs lookups to non-main tables.
+// syncPeerRoutes ensures allowed prefixes of peers (IPv4 and IPv6) are present in main and
+// table 52, and prunes stale entries in table 52. This keeps multi-hop overlay reachability
+// working even when policy routing directs lookups to non-main tables.
 func syncPeerRoutes(peers []model.Peer, iface string) error {
 	if iface == "" {
 		iface = "wg0"
@@ -282,113 +335,72 @@ func syncPeerRoutes(peers []model.Peer, iface string) error {
 	desired := map[string]struct{}{}
 	for _, p := range peers {
 		for _, pref := range p.AllowedIPs {
-			if pref == "" || pref == "0.0.0.0/0" {
+			if pref == "" || pref == "0.0.0.0/0" || pref == "::/0" {
 				continue
 			}
-			if _, ipNet, err := net.ParseCIDR(pref); err != nil || ipNet.IP.To4() == nil {
+			if _, _, err := net.ParseCIDR(pref); err != nil {
 				continue
 			}
 			desired[pref] = struct{}{}
 		}
 	}
-	ensure := func(table string) error {
+	for _, table := range []int{0, 52} {
 		for pref := range desired {
-			args := []string{"ip", "route", "replace", pref, "dev", iface}
-			if table != "main" {
-				args = append(args, "table", table)
-			}
-			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
-				return fmt.Errorf("%s: %v (%s)", strings.Join(args, " "), err, string(out))
+			if err := dp.ReplaceRoute(dataplane.Route{Dst: pref, Dev: iface, Table: table}); err != nil {
+				return err
 			}
 		}
-		return nil
-	}
-	if err := ensure("main"); err != nil {
-		return err
-	}
-	if err := ensure("52"); err != nil {
-		return err
 	}
 
-	// prune stale routes in table 52 for this iface
-	out, err := exec.Command("ip", "route", "show", "table", "52", "dev", iface).Output()
-	if err == nil {
-		scanner := bufio.NewScanner(strings.NewReader(string(out)))
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" {
-				continue
-			}
-			fields := strings.Fields(line)
-			if len(fields) == 0 {
-				continue
-			}
-			pref := fields[0]
-			if _, ok := desired[pref]; ok {
-				continue
-			}
-			// only clean 10.0.0.0/8-style overlay to avoid touching unrelated routes
-			if !strings.HasPrefix(pref, "10.") {
-				continue
-			}
-			_ = exec.Command("ip", "route", "del", pref, "dev", iface, "table", "52").Run()
-		}
-	}
-	_ = exec.Command("ip", "route", "flush", "cache").Run()
+	pruneTable52(iface, false, desired)
+	pruneTable52(iface, true, desired)
+	_ = dp.FlushRouteCache()
 	return nil
 }
 
-// detectPrimaryCIDR best-effort: find primary interface CIDR for default route.
-func detectPrimaryCIDR() string {
-	out, err := exec.Command("sh", "-c", "ip route get 1.1.1.1 | awk '/dev/{print $5}'").Output()
+// pruneTable52 removes overlay routes of one address family from table 52 that are no
+// longer wanted. Only 10.0.0.0/8 and ULA (fc00::/7) routes are touched.
+func pruneTable52(iface string, v6 bool, desired map[string]struct{}) {
+	routes, err := dp.Routes(v6, 52, iface)
 	if err != nil {
-		return ""
-	}
-	iface := strings.TrimSpace(string(out))
-	if iface == "" {
-		return ""
+		return
 	}
-	j, err := exec.Command("sh", "-c", "ip -j addr show dev "+iface+" | jq -r '.[0].addr_info[] | select(.family==\"inet\") | .local+\"/\"+.prefixlen'").Output()
-	if err != nil {
-		return ""
-	}
-	lines := strings.Split(strings.TrimSpace(string(j)), "\n")
-	if len(lines) > 0 && lines[0] != "" {
-		return lines[0]
+	for _, r := range routes {
+		if _, ok := desired[r.Dst]; ok {
+			continue
+		}
+		// only clean 10.0.0.0/8-style or ULA overlay to avoid touching unrelated routes
+		if !strings.HasPrefix(r.Dst, "10.") && !strings.HasPrefix(r.Dst, "fd") && !strings.HasPrefix(r.Dst, "fc") {
+			continue
+		}
+		logErr(dp.DeleteRoute(r))
 	}
-	return ""
 }
 
 // detectPrimaryRoute returns the first non-WireGuard default route (gw, dev).
 func detectPrimaryRoute() (string, string) {
-	out, err := exec.Command("ip", "route", "show", "default").Output()
+	return detectDefaultRoute(false)
+}
+
+// detectPrimaryRoute6 is detectPrimaryRoute for the IPv6 default route.
+func detectPrimaryRoute6() (string, string) {
+	return detectDefaultRoute(true)
+}
+
+func detectDefaultRoute(v6 bool) (string, string) {
+	routes, err := dp.Routes(v6, 0, "")
 	if err != nil {
 		return "", ""
 	}
-	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) < 5 {
-			continue
-		}
-		// expected: default via <gw> dev <dev> ...
-		if fields[0] != "default" {
+	for _, r := range routes {
+		if r.Dst != "0.0.0.0/0" && r.Dst != "::/0" {
 			continue
 		}
-		var gw, dev string
-		for i := 1; i < len(fields)-1; i++ {
-			if fields[i] == "via" {
-				gw = fields[i+1]
-			}
-			if fields[i] == "dev" {
-				dev = fields[i+1]
-			}
-		}
-		if strings.HasPrefix(dev, "wg") {
+		if strings.HasPrefix(r.Dev, "wg") {
 			continue
 		}
-		if gw != "" && dev != "" {
-			return gw, dev
+		if r.Via != "" && r.Dev != "" {
+			return r.Via, r.Dev
 		}
 	}
 	return "", ""
@@ -47,14 +47,21 @@ func collectVerifyTargets(rules []model.PolicyRule) []string {
 	return targets
 }
 
+// runCurlVerify fetches every target over the address family it names; IPv6 literals are
+// checked with -6, everything else (IPv4 literals, domains) with -4.
 func runCurlVerify(targets []string) error {
 	for _, t := range targets {
 		arg := t
+		family := "-4"
+		if policy.IsIPv6(arg) {
+			family = "-6"
+			arg = "[" + arg + "]"
+		}
 		// prefer http:// if no scheme
 		if !strings.Contains(arg, "://") {
 			arg = "http://" + arg
 		}
-		cmd := exec.Command("curl", "-4", "-m", "5", "-sSf", arg)
+		cmd := exec.Command("curl", family, "-m", "5", "-sSf", arg)
 		if out, err := cmd.CombinedOutput(); err != nil {
 			return fmt.Errorf("curl %s failed: %v (%s)", arg, err, string(out))
 		}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"peer-wan/pkg/model"
+)
+
+// readDevice reads the runtime state of iface through wgctrl, which covers kernel and
+// userspace (wireguard-go) interfaces alike.
+func readDevice(iface string) (*wgtypes.Device, error) {
+	c, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Device(iface)
+}
+
+// handshakeTime is the latest handshake of p, zero when it never completed one.
+func handshakeTime(p wgtypes.Peer) time.Time {
+	if p.LastHandshakeTime.Unix() <= 0 {
+		return time.Time{}
+	}
+	return p.LastHandshakeTime
+}
+
+// readHandshakes maps the public keys of iface's peers to their latest handshake
+// (zero time when the peer never completed a handshake).
+func readHandshakes(iface string) (map[string]time.Time, error) {
+	dev, err := readDevice(iface)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Time, len(dev.Peers))
+	for _, p := range dev.Peers {
+		res[p.PublicKey.String()] = handshakeTime(p)
+	}
+	return res, nil
+}
+
+// wireguardStats reports the runtime state of every planned peer found on the interface.
+// Standby entries of rotating peers are left out.
+func wireguardStats() map[string]model.WireGuardPeerStats {
+	wsStateMu.RLock()
+	peers := latestCfg.WireGuardPeers
+	iface := wsCtx.iface
+	wsStateMu.RUnlock()
+	if iface == "" || len(peers) == 0 {
+		return nil
+	}
+	dev, err := readDevice(iface)
+	if err != nil {
+		return nil
+	}
+	live := make(map[string]wgtypes.Peer, len(dev.Peers))
+	for _, p := range dev.Peers {
+		live[p.PublicKey.String()] = p
+	}
+	out := map[string]model.WireGuardPeerStats{}
+	for _, p := range peers {
+		lp, ok := live[p.PublicKey]
+		if !ok {
+			continue
+		}
+		st := model.WireGuardPeerStats{
+			PublicKey:     p.PublicKey,
+			LastHandshake: handshakeTime(lp),
+			RxBytes:       lp.ReceiveBytes,
+			TxBytes:       lp.TransmitBytes,
+		}
+		if lp.Endpoint != nil {
+			st.Endpoint = lp.Endpoint.String()
+		}
+		for _, ipn := range lp.AllowedIPs {
+			st.AllowedIPs = append(st.AllowedIPs, ipn.String())
+		}
+		out[p.ID] = st
+	}
+	return out
+}
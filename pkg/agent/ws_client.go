@@ -21,6 +21,7 @@ type wsClient struct {
 	handlers map[string]func(map[string]interface{})
 	logs     chan string
 	stopLogs chan struct{}
+	closed   bool
 }
 
 func newWSClient(controller, nodeID, authToken, provisionToken string) *wsClient {
@@ -60,7 +61,7 @@ func (c *wsClient) start() {
 }
 
 func (c *wsClient) loop() {
-	for {
+	for !c.isClosed() {
 		dialer := websocket.DefaultDialer
 		header := http.Header{}
 		if c.token != "" {
@@ -84,6 +85,9 @@ func (c *wsClient) loop() {
 		c.mu.Unlock()
 		log.Printf("ws connected to controller url=%s", c.endpoint)
 		c.readLoop(conn)
+		if c.isClosed() {
+			return
+		}
 		log.Printf("ws disconnected, retrying in 5s")
 		time.Sleep(5 * time.Second)
 	}
@@ -104,6 +108,27 @@ func (c *wsClient) readLoop(conn *websocket.Conn) {
 	}
 }
 
+// close drops the connection for good (used after decommission); no reconnect follows.
+func (c *wsClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stopLogs)
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *wsClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
 func (c *wsClient) send(msg interface{}) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/snapshot"
+	"peer-wan/pkg/store"
+)
+
+// maxRestoreBytes caps uploaded snapshot archives.
+const maxRestoreBytes = 256 << 20
+
+// RegisterAdminRoutes exposes snapshot export and restore.
+func RegisterAdminRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/admin/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		box, err := secret.FromEnv()
+		if err != nil {
+			http.Error(w, "secret key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snap, err := snapshot.Export(st, box)
+		if err != nil {
+			http.Error(w, "export failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := fmt.Sprintf("peer-wan-snapshot-%s.json.gz", snap.CreatedAt.Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if err := snapshot.Write(w, snap); err != nil {
+			log.Printf("write snapshot failed: %v", err)
+		}
+	})
+
+	mux.HandleFunc("/api/v1/admin/restore", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		snap, err := snapshot.Read(http.MaxBytesReader(w, r.Body, maxRestoreBytes))
+		if err != nil {
+			http.Error(w, "invalid snapshot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		box, err := secret.FromEnv()
+		if err != nil {
+			http.Error(w, "secret key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		opts := snapshot.RestoreOptions{Replace: r.URL.Query().Get("replace") == "true"}
+		if err := snapshot.Restore(st, snap, box, opts); err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, snapshot.ErrTargetNotEmpty):
+				status = http.StatusConflict
+			case errors.Is(err, secret.ErrDecrypt), errors.Is(err, snapshot.ErrInvalidSnapshot):
+				status = http.StatusBadRequest
+			}
+			http.Error(w, "restore failed: "+err.Error(), status)
+			return
+		}
+		// the live damping, auto-path and egress state would otherwise overwrite the restored one
+		if err := LoadRoutingState(st); err != nil {
+			http.Error(w, "reload routing state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := RecomputeAllPlans(st, planVersion); err != nil {
+			log.Printf("recompute plans failed after restore: %v", err)
+		} else {
+			BumpPlanVersion(planVersion)
+		}
+		sum := snap.Summary()
+		_ = st.AppendAudit(model.AuditEntry{
+			Actor:     "controller",
+			Action:    "restore_snapshot",
+			Target:    "store",
+			Detail:    fmt.Sprintf("restored snapshot from %s: %d nodes, %d plans", snap.CreatedAt.Format(time.RFC3339), sum.Nodes, sum.Plans),
+			Timestamp: time.Now(),
+		})
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    "ok",
+			"createdAt": snap.CreatedAt,
+			"summary":   sum,
+		})
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -13,6 +14,7 @@ import (
 
 	"peer-wan/pkg/model"
 	"peer-wan/pkg/policy"
+	"peer-wan/pkg/series"
 	"peer-wan/pkg/store"
 	"peer-wan/pkg/topology"
 	"peer-wan/pkg/version"
@@ -27,12 +29,24 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 	RegisterPolicyRoutes(mux, store, auth, planVersion)
 	RegisterPolicyStatusRoutes(mux, store, auth)
 	RegisterPolicyDiagRoutes(mux, store, auth)
+	RegisterRetentionRoutes(mux, store, auth)
+	RegisterSeriesRoutes(mux, store, auth)
+	RegisterTopologyRoutes(mux, store, auth, planVersion)
+	RegisterIPv6Routes(mux, store, auth, planVersion)
+	RegisterIPAMRoutes(mux, store, auth, planVersion)
+	RegisterValidateRoutes(mux, store, auth)
+	RegisterDampingRoutes(mux, store, auth, planVersion)
+	RegisterEgressRoutes(mux, store, auth, planVersion)
+	RegisterLinkKeyRoutes(mux, store, auth, planVersion)
+	RegisterNodeKeyRoutes(mux, store, auth)
 	if wsHub != nil {
 		RegisterPolicyCommandRoutes(mux, auth, wsHub)
 		RegisterTaskRoutes(mux, store, auth, wsHub)
 	}
 	RegisterPrepareRoute(mux, store, planVersion, auth, controllerAddr)
 	RegisterStatusRoutes(mux, store, auth)
+	RegisterNodeRoutes(mux, store, auth, planVersion)
+	RegisterAdminRoutes(mux, store, auth, planVersion)
 	RegisterDiagnoseRoutes(mux, store, auth)
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
@@ -182,6 +196,14 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			http.Error(w, "id is required", http.StatusBadRequest)
 			return
 		}
+		if !validRole(req.Role) {
+			http.Error(w, "role must be hub or spoke", http.StatusBadRequest)
+			return
+		}
+		if err := validLabels(req.Labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		allowWithoutJWT := req.ProvisionToken != ""
 		if !allowWithoutJWT && !auth(r) {
@@ -189,119 +211,66 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			return
 		}
 
+		ipamMu.Lock()
+		defer ipamMu.Unlock()
 		existing, ok, _ := store.GetNode(req.ID)
-		if allowWithoutJWT {
-			// provisioning path: validate one-time token and merge controller-assigned fields
-			if !ok || existing.ProvisionToken == "" || existing.ProvisionToken != req.ProvisionToken {
-				http.Error(w, "invalid provision token", http.StatusUnauthorized)
-				return
-			}
-		}
-
-		// treat placeholder public key as empty so we prefer stored value
-		pub := req.PublicKey
-		if pub == "stub-public-key" {
-			pub = ""
-		}
-
-		node := model.Node{
-			ID:             req.ID,
-			PublicKey:      pub,
-			Endpoints:      req.Endpoints,
-			CIDRs:          req.CIDRs,
-			ListenPort:     req.ListenPort,
-			OverlayIP:      req.OverlayIP,
-			ASN:            req.ASN,
-			RouterID:       req.RouterID,
-			PeerEndpoints:  req.PeerEndpoints,
-			ProvisionToken: req.ProvisionToken,
-		}
-
-		if allowWithoutJWT {
-			// populate from prepared record; agent can override by sending non-empty fields.
-			if node.PublicKey == "" {
-				node.PublicKey = existing.PublicKey
-			}
-			if node.PrivateKey == "" {
-				node.PrivateKey = existing.PrivateKey
-			}
-			if existing.OverlayIP != "" {
-				node.OverlayIP = existing.OverlayIP
-			} else if node.OverlayIP == "" || (isPlaceholderOverlay(node.OverlayIP) && existing.OverlayIP != "") {
-				node.OverlayIP = existing.OverlayIP
-			}
-			// always keep existing token once assigned
-			node.ProvisionToken = existing.ProvisionToken
-			if node.ListenPort == 0 {
-				node.ListenPort = existing.ListenPort
-			}
-			if node.ASN == 0 {
-				node.ASN = existing.ASN
-			}
-			if node.RouterID == "" {
-				node.RouterID = existing.RouterID
-			}
-			if len(node.Endpoints) == 0 {
-				node.Endpoints = existing.Endpoints
-			}
-			if len(node.CIDRs) == 0 {
-				node.CIDRs = existing.CIDRs
-			}
-			if len(node.PeerEndpoints) == 0 {
-				node.PeerEndpoints = existing.PeerEndpoints
-			}
-		} else if ok {
-			// UI/API 编辑路径：合并已有字段，保留未提交的值
-			if node.PublicKey == "" {
-				node.PublicKey = existing.PublicKey
-			}
-			if node.PrivateKey == "" {
-				node.PrivateKey = existing.PrivateKey
-			}
-			if existing.OverlayIP != "" {
-				node.OverlayIP = existing.OverlayIP
-			} else if node.OverlayIP == "" || (isPlaceholderOverlay(node.OverlayIP) && existing.OverlayIP != "") {
-				node.OverlayIP = existing.OverlayIP
-			}
-			// always keep existing token once assigned
-			node.ProvisionToken = existing.ProvisionToken
-			if node.ListenPort == 0 {
-				node.ListenPort = existing.ListenPort
+		var saved model.Node
+		for attempt := 1; ; attempt++ {
+			if allowWithoutJWT {
+				// provisioning path: validate one-time token and merge controller-assigned fields
+				if !ok || existing.ProvisionToken == "" || existing.ProvisionToken != req.ProvisionToken {
+					http.Error(w, "invalid provision token", http.StatusUnauthorized)
+					return
+				}
 			}
-			if node.ASN == 0 {
-				node.ASN = existing.ASN
+			node := mergeRegistration(req, existing, ok, allowWithoutJWT)
+			if err := applyNodeKey(&node, req, allowWithoutJWT, loadSettingsOrDefault(store).NodeKeys); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, errInvalidKeyProof) {
+					status = http.StatusUnauthorized
+				}
+				http.Error(w, err.Error(), status)
+				return
 			}
-			if node.RouterID == "" {
-				node.RouterID = existing.RouterID
+			if err := resolveOverlay(store, &node, existing); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
 			}
-			if len(node.Endpoints) == 0 {
-				node.Endpoints = existing.Endpoints
+			settings := loadSettingsOrDefault(store)
+			if bad := newOverlapping(settings.IPAM, node.CIDRs, existing.CIDRs); len(bad) > 0 {
+				http.Error(w, "cidrs overlap the overlay pool: "+strings.Join(bad, ","), http.StatusBadRequest)
+				return
 			}
-			if len(node.CIDRs) == 0 {
-				node.CIDRs = existing.CIDRs
+			deriveOverlay6(&node, settings.IPv6)
+			if ok && !req.Force && nodeEqual(existing, node) {
+				saved = existing
+				break
 			}
-			if len(node.PeerEndpoints) == 0 {
-				node.PeerEndpoints = existing.PeerEndpoints
+			issues, err := introducedErrors(store, node)
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
 			}
-			// always keep existing token once assigned
-			node.ProvisionToken = existing.ProvisionToken
-		}
-		if node.RouterID == "" && node.OverlayIP != "" {
-			if idx := strings.Index(node.OverlayIP, "/"); idx > 0 {
-				node.RouterID = node.OverlayIP[:idx]
+			if len(issues) > 0 {
+				writeValidationConflict(w, issues)
+				return
 			}
-		}
-
-		var saved model.Node
-		if ok && !req.Force && nodeEqual(existing, node) {
-			saved = existing
-		} else {
-			var err error
 			saved, err = store.UpsertNode(node)
-			if err != nil {
+			if err == nil {
+				break
+			}
+			if !isConflict(err) {
 				http.Error(w, "failed to persist node", http.StatusInternalServerError)
 				return
 			}
+			// a caller-supplied revision means "I edited what I saw": surface the conflict.
+			// Agents (no revision) re-merge on top of the fresh record instead.
+			if req.Revision != 0 || attempt >= maxWriteRetries {
+				current, _, _ := store.GetNode(req.ID)
+				writeConflict(w, current)
+				return
+			}
+			existing, ok, _ = store.GetNode(req.ID)
 		}
 		_ = store.AppendAudit(model.AuditEntry{
 			Actor:     "controller",
@@ -313,13 +282,19 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 
 		// recompute plans for all nodes to propagate new peer
 		allNodes, _ := store.ListNodes()
-		policyMap := expandPolicyRules(allNodes)
-		healthList, _ := store.ListHealth()
-		hmap := make(map[string]model.HealthReport)
-		for _, h := range healthList {
-			hmap[h.NodeID] = h
+		hmap := plannedHealth(store, allNodes)
+		graph := policyGraph(store, allNodes, hmap)
+		allNodes = plannedNodes(store, allNodes, graph)
+		policyMap := expandPolicyRules(allNodes, graph)
+		localPlan := topology.BuildPeerPlan(saved.ID, allNodes, hmap, topologyOptions(store))
+		egressPeer, defaultNextHop := saved.EgressPeerID, saved.DefaultRouteNextHop
+		for _, n := range allNodes {
+			if n.ID == saved.ID {
+				// egress groups resolved to their active member
+				egressPeer, defaultNextHop = n.EgressPeerID, n.DefaultRouteNextHop
+				break
+			}
 		}
-		localPlan := topology.BuildPeerPlan(saved.ID, allNodes, hmap)
 		if err := RecomputeAllPlans(store, planVersion); err != nil {
 			log.Printf("recompute plans failed after register: %v", err)
 		} else {
@@ -330,26 +305,32 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 		if saved.ConfigVersion == "" {
 			saved.ConfigVersion = version.Build
 		}
+		pools, pool6 := overlayPools(loadSettingsOrDefault(store))
 		resp := NodeConfigResponse{
 			ID:                  saved.ID,
 			ConfigVersion:       saved.ConfigVersion,
-			WireGuardPeers:      localPlan,
+			WireGuardPeers:      withLinkKeys(store, saved.ID, localPlan),
 			Routes:              saved.CIDRs,
 			OverlayIP:           saved.OverlayIP,
+			OverlayIP6:          saved.OverlayIP6,
+			OverlayPools:        pools,
+			OverlayPool6:        pool6,
 			ListenPort:          saved.ListenPort,
 			ASN:                 saved.ASN,
 			RouterID:            saved.RouterID,
 			Endpoints:           saved.Endpoints,
 			PrivateKey:          saved.PrivateKey,
 			PublicKey:           saved.PublicKey,
-			EgressPeerID:        saved.EgressPeerID,
+			EgressPeerID:        egressPeer,
 			PolicyRules:         policyMap[saved.ID],
 			PeerEndpoints:       saved.PeerEndpoints,
 			GeoIPConfig:         ptrGeoIP(loadSettingsOrDefault(store).GeoIP),
 			DefaultRoute:        saved.DefaultRoute,
 			BypassCIDRs:         saved.BypassCIDRs,
-			DefaultRouteNextHop: saved.DefaultRouteNextHop,
+			DefaultRouteNextHop: defaultNextHop,
 			HealthIntervalSec:   diagIntervalSeconds(store),
+			Relay:               saved.Relay,
+			KeyRotation:         saved.KeyRotation,
 			Message:             "registered; peer plan derived from currently known nodes",
 		}
 		writeJSON(w, http.StatusOK, resp)
@@ -375,13 +356,44 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 				http.Error(w, "failed to save health", http.StatusInternalServerError)
 				return
 			}
+			recordActiveEndpoints(store, report)
+			keysCommitted := ackLinkKeys(store, report)
+			keysRotated := advanceKeyRotations(store, report)
 			// recalc plan for this node and store
 			nodes, _ := store.ListNodes()
-			policyMap := expandPolicyRules(nodes)
-			hmap := map[string]model.HealthReport{report.NodeID: report}
-			peerPlan := topology.BuildPeerPlan(report.NodeID, nodes, hmap)
-			savePlanWithRules(store, model.Node{ID: report.NodeID}, peerPlan, policyMap[report.NodeID], planVersion)
+			flipped := observeHealth(store, report, nodes)
+			all := plannedHealth(store, nodes)
+			graph := policyGraph(store, nodes, all)
+			nodes, egress := resolveEgressGroups(nodes, loadSettingsOrDefault(store).EgressGroups, graph)
+			failedOver := egressFailovers.refresh(store, egress, true)
+			if pathsMoved, relaysMoved := autoPaths.refresh(nodes, graph), relaysChanged(graph); flipped || failedOver || pathsMoved || relaysMoved || keysCommitted || keysRotated {
+				// a link went down or came back, an egress group failed over, or an auto path
+				// or a relay moved: every hop along the old and new path needs new rules.
+				// A committed preshared key has to reach both ends of its link, a node key
+				// rotation phase the node and all its neighbours.
+				if err := RecomputeAllPlans(store, planVersion); err != nil {
+					log.Printf("recompute plans failed after path change: %v", err)
+				}
+			}
+			policyMap := expandPolicyRules(nodes, graph)
+			hmap := map[string]model.HealthReport{report.NodeID: all[report.NodeID]}
+			opts := topologyOptions(store)
+			if opts.Mode == model.TopologyIntent {
+				// intent adjacency is global: rank with everyone's health so both ends agree
+				opts = opts.Resolve(nodes, all)
+			}
+			peerPlan := topology.BuildPeerPlan(report.NodeID, nodes, hmap, opts)
+			// push the stored record so node-level fields (dual-stack, relay, default route) survive
+			self := model.Node{ID: report.NodeID}
+			for _, n := range nodes {
+				if n.ID == report.NodeID {
+					self = n
+					break
+				}
+			}
+			savePlanWithRules(store, self, peerPlan, policyMap[report.NodeID], planVersion)
 			BumpPlanVersion(planVersion)
+			saveRoutingState(store)
 			_ = store.AppendAudit(model.AuditEntry{
 				Actor:     report.NodeID,
 				Action:    "health_report",
@@ -430,6 +442,17 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			http.Error(w, "failed to list history", http.StatusInternalServerError)
 			return
 		}
+		// raw samples are kept briefly; fill the older part of the window from 1m buckets
+		rawFrom := time.Now()
+		if len(hist) > 0 {
+			rawFrom = hist[0].Timestamp
+		}
+		if rawFrom.Sub(since) > time.Minute {
+			buckets, err := store.ListHealthBuckets(nodeID, "1m", since, rawFrom.Truncate(time.Minute))
+			if err == nil && len(buckets) > 0 {
+				hist = append(series.ToReports(nodeID, buckets), hist...)
+			}
+		}
 		writeJSON(w, http.StatusOK, hist)
 	})
 
@@ -442,12 +465,24 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		entries, err := store.ListAudit(50)
+		pq, err := parsePageQuery(r, 50)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		page, more, err := store.QueryAudit(model.AuditQuery{
+			Actor:       q.Get("actor"),
+			Action:      q.Get("action"),
+			Target:      q.Get("target"),
+			HistoryPage: pq.history(),
+		})
 		if err != nil {
 			http.Error(w, "failed to list audit", http.StatusInternalServerError)
 			return
 		}
-		writeJSON(w, http.StatusOK, entries)
+		setNextCursor(w, nextCursor(pq, page, func(e model.AuditEntry) time.Time { return e.Timestamp }, more))
+		writeJSON(w, http.StatusOK, page)
 	})
 
 	mux.HandleFunc("/api/v1/plan", func(w http.ResponseWriter, r *http.Request) {
@@ -473,13 +508,19 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			http.Error(w, "failed to list nodes", http.StatusInternalServerError)
 			return
 		}
-		policyMap := expandPolicyRules(nodes)
-		healthList, _ := store.ListHealth()
-		hmap := make(map[string]model.HealthReport)
-		for _, h := range healthList {
-			hmap[h.NodeID] = h
+		hmap := plannedHealth(store, nodes)
+		graph := policyGraph(store, nodes, hmap)
+		nodes = plannedNodes(store, nodes, graph)
+		if autoPaths.refresh(nodes, graph) {
+			// only this node's plan is saved below; the hops of a moved path need theirs too
+			if err := RecomputeAllPlans(store, planVersion); err != nil {
+				log.Printf("recompute plans failed after path change: %v", err)
+			} else {
+				BumpPlanVersion(planVersion)
+			}
 		}
-		peerPlan := topology.BuildPeerPlan(nodeID, nodes, hmap)
+		policyMap := expandPolicyRules(nodes, graph)
+		peerPlan := topology.BuildPeerPlan(nodeID, nodes, hmap, topologyOptions(store))
 		var target model.Node
 		for _, n := range nodes {
 			if n.ID == nodeID {
@@ -495,12 +536,16 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			}
 		}
 		savePlanWithRules(store, target, peerPlan, policyMap[nodeID], planVersion)
+		pools, pool6 := overlayPools(loadSettingsOrDefault(store))
 		resp := NodeConfigResponse{
 			ID:                  nodeID,
 			ConfigVersion:       version,
-			WireGuardPeers:      peerPlan,
+			WireGuardPeers:      withLinkKeys(store, nodeID, peerPlan),
 			Routes:              target.CIDRs,
 			OverlayIP:           target.OverlayIP,
+			OverlayIP6:          target.OverlayIP6,
+			OverlayPools:        pools,
+			OverlayPool6:        pool6,
 			ListenPort:          target.ListenPort,
 			ASN:                 target.ASN,
 			RouterID:            target.RouterID,
@@ -513,6 +558,8 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			BypassCIDRs:         target.BypassCIDRs,
 			DefaultRouteNextHop: target.DefaultRouteNextHop,
 			HealthIntervalSec:   diagIntervalSeconds(store),
+			Relay:               target.Relay,
+			KeyRotation:         target.KeyRotation,
 			Message:             "dynamic plan based on current health",
 		}
 		writeJSON(w, http.StatusOK, resp)
@@ -532,12 +579,18 @@ func RegisterRoutes(mux *http.ServeMux, store store.NodeStore, token string, pla
 			http.Error(w, "nodeId is required", http.StatusBadRequest)
 			return
 		}
-		plans, err := store.ListPlanHistory(nodeID, 20)
+		pq, err := parsePageQuery(r, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, more, err := store.QueryPlanHistory(model.PlanHistoryQuery{NodeID: nodeID, HistoryPage: pq.history()})
 		if err != nil {
 			http.Error(w, "failed to list plan history", http.StatusInternalServerError)
 			return
 		}
-		writeJSON(w, http.StatusOK, plans)
+		setNextCursor(w, nextCursor(pq, page, func(p model.Plan) time.Time { return p.CreatedAt }, more))
+		writeJSON(w, http.StatusOK, page)
 	})
 
 	mux.HandleFunc("/api/v1/plan/rollback", func(w http.ResponseWriter, r *http.Request) {
@@ -614,12 +667,16 @@ func savePlanWithRules(store store.NodeStore, node model.Node, peers []model.Pee
 	_ = store.SavePlan(p)
 	_ = store.SetGlobalPlanVersion(version)
 	if wsHubGlobal != nil {
+		pools, pool6 := overlayPools(loadSettingsOrDefault(store))
 		resp := NodeConfigResponse{
 			ID:                  node.ID,
 			ConfigVersion:       cv,
-			WireGuardPeers:      peers,
+			WireGuardPeers:      withLinkKeys(store, node.ID, peers),
 			Routes:              node.CIDRs,
 			OverlayIP:           node.OverlayIP,
+			OverlayIP6:          node.OverlayIP6,
+			OverlayPools:        pools,
+			OverlayPool6:        pool6,
 			ListenPort:          node.ListenPort,
 			ASN:                 node.ASN,
 			RouterID:            node.RouterID,
@@ -632,6 +689,8 @@ func savePlanWithRules(store store.NodeStore, node model.Node, peers []model.Pee
 			BypassCIDRs:         node.BypassCIDRs,
 			DefaultRouteNextHop: node.DefaultRouteNextHop,
 			HealthIntervalSec:   diagIntervalSeconds(store),
+			Relay:               node.Relay,
+			KeyRotation:         node.KeyRotation,
 			Message:             "ws plan push",
 		}
 		wsHubGlobal.Send(node.ID, WSMessage{Type: "plan", NodeID: node.ID, Payload: resp})
@@ -644,16 +703,16 @@ func RecomputeAllPlans(store store.NodeStore, planVersion *int64) error {
 	if err != nil {
 		return err
 	}
-	policyMap := expandPolicyRules(nodes)
-	healthList, _ := store.ListHealth()
-	hmap := make(map[string]model.HealthReport)
-	for _, h := range healthList {
-		hmap[h.NodeID] = h
-	}
+	hmap := plannedHealth(store, nodes)
+	graph := policyGraph(store, nodes, hmap)
+	nodes = plannedNodes(store, nodes, graph)
+	policyMap := expandPolicyRules(nodes, graph)
+	opts := topologyOptions(store).Resolve(nodes, hmap)
 	for _, n := range nodes {
-		peers := topology.BuildPeerPlan(n.ID, nodes, hmap)
+		peers := topology.BuildPeerPlan(n.ID, nodes, hmap, opts)
 		savePlanWithRules(store, n, peers, policyMap[n.ID], planVersion)
 	}
+	saveRoutingState(store)
 	return nil
 }
 
@@ -687,16 +746,124 @@ func waitForVersion(planVersion *int64, waitStr string) {
 	}
 }
 
+// mergeRegistration builds the node to persist from a registration request, keeping
+// stored values for anything the caller left empty. The result carries the revision
+// the write must match.
+func mergeRegistration(req NodeRegistrationRequest, existing model.Node, ok, provisioning bool) model.Node {
+	// treat placeholder public key as empty so we prefer stored value
+	pub := req.PublicKey
+	if pub == "stub-public-key" {
+		pub = ""
+	}
+
+	node := model.Node{
+		ID:             req.ID,
+		PublicKey:      pub,
+		Endpoints:      req.Endpoints,
+		CIDRs:          req.CIDRs,
+		ListenPort:     req.ListenPort,
+		OverlayIP:      req.OverlayIP,
+		OverlayIP6:     req.OverlayIP6,
+		ASN:            req.ASN,
+		RouterID:       req.RouterID,
+		PeerEndpoints:  req.PeerEndpoints,
+		ProvisionToken: req.ProvisionToken,
+		Role:           req.Role,
+		Labels:         req.Labels,
+		Relay:          req.Relay != nil && *req.Relay,
+	}
+
+	if provisioning || ok {
+		// provisioning: populate from prepared record; agent can override by sending non-empty fields.
+		// UI/API 编辑路径：合并已有字段，保留未提交的值
+		if node.PublicKey == "" {
+			node.PublicKey = existing.PublicKey
+		}
+		if node.PrivateKey == "" {
+			node.PrivateKey = existing.PrivateKey
+		}
+		if node.PublicKey == existing.PublicKey {
+			node.KeyOrigin = existing.KeyOrigin
+		}
+		node.KeyRotation = existing.KeyRotation
+		node.KeyRotatedAt = existing.KeyRotatedAt
+		if existing.OverlayIP != "" {
+			node.OverlayIP = existing.OverlayIP
+		} else if node.OverlayIP == "" || (isPlaceholderOverlay(node.OverlayIP) && existing.OverlayIP != "") {
+			node.OverlayIP = existing.OverlayIP
+		}
+		if node.OverlayIP6 == "" {
+			node.OverlayIP6 = existing.OverlayIP6
+		}
+		// always keep existing token once assigned
+		node.ProvisionToken = existing.ProvisionToken
+		if node.ListenPort == 0 {
+			node.ListenPort = existing.ListenPort
+		}
+		if node.ASN == 0 {
+			node.ASN = existing.ASN
+		}
+		if node.RouterID == "" {
+			node.RouterID = existing.RouterID
+		}
+		if len(node.Endpoints) == 0 {
+			node.Endpoints = existing.Endpoints
+		}
+		if len(node.CIDRs) == 0 {
+			node.CIDRs = existing.CIDRs
+		}
+		if len(node.PeerEndpoints) == 0 {
+			node.PeerEndpoints = existing.PeerEndpoints
+		}
+		// agents do not know their role; only explicit edits change it
+		if node.Role == "" {
+			node.Role = existing.Role
+		}
+		if node.Labels == nil {
+			node.Labels = existing.Labels
+		}
+		if req.Relay == nil {
+			node.Relay = existing.Relay
+		}
+		// learned from health reports, never part of a registration
+		node.LinkEndpoints = existing.LinkEndpoints
+		// registration does not touch policy; carry it over so the write doesn't drop it
+		node.EgressPeerID = existing.EgressPeerID
+		node.PolicyRules = existing.PolicyRules
+		node.DefaultRoute = existing.DefaultRoute
+		node.BypassCIDRs = existing.BypassCIDRs
+		node.DefaultRouteNextHop = existing.DefaultRouteNextHop
+	}
+	if node.RouterID == "" && node.OverlayIP != "" {
+		if idx := strings.Index(node.OverlayIP, "/"); idx > 0 {
+			node.RouterID = node.OverlayIP[:idx]
+		}
+	}
+	node.Revision = existing.Revision
+	if req.Revision != 0 && !provisioning {
+		node.Revision = req.Revision
+	}
+	return node
+}
+
 func nodeEqual(a, b model.Node) bool {
-	if a.ID != b.ID || a.PublicKey != b.PublicKey || a.ListenPort != b.ListenPort || a.OverlayIP != b.OverlayIP {
+	if a.ID != b.ID || a.PublicKey != b.PublicKey || a.ListenPort != b.ListenPort || a.OverlayIP != b.OverlayIP || a.OverlayIP6 != b.OverlayIP6 {
 		return false
 	}
-	if a.ASN != b.ASN || a.RouterID != b.RouterID {
+	if a.PrivateKey != b.PrivateKey || a.KeyOrigin != b.KeyOrigin {
 		return false
 	}
-	if len(a.Endpoints) != len(b.Endpoints) || len(a.CIDRs) != len(b.CIDRs) {
+	if a.ASN != b.ASN || a.RouterID != b.RouterID || a.Role != b.Role || a.Relay != b.Relay {
 		return false
 	}
+	if len(a.Endpoints) != len(b.Endpoints) || len(a.CIDRs) != len(b.CIDRs) || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for k, v := range a.Labels {
+		if bv, ok := b.Labels[k]; !ok || bv != v {
+			return false
+		}
+	}
 	for i := range a.Endpoints {
 		if a.Endpoints[i] != b.Endpoints[i] {
 			return false
@@ -736,10 +903,35 @@ func firstNonZero(vals ...int) int {
 
 // expandPolicyRules takes nodes' policy definitions and distributes hop-by-hop rules to path intermediates.
 // For a rule with path [A,B], source node gets via=A, node A gets via=B, final hop has no extra rule.
-func expandPolicyRules(nodes []model.Node) map[string][]model.PolicyRule {
+// Rules that only name an egress get their path computed over g; unreachable ones are left out.
+// Hops that cannot reach each other get their relay inserted.
+// The auto paths chosen are remembered; use previewPolicyRules where nothing is published.
+func expandPolicyRules(nodes []model.Node, g *topology.Graph) map[string][]model.PolicyRule {
+	return expandPolicyRulesWith(nodes, g, autoPaths.resolve)
+}
+
+// previewPolicyRules expands policy rules like expandPolicyRules but only peeks at the
+// remembered auto paths, so validating a candidate state cannot move them.
+func previewPolicyRules(nodes []model.Node, g *topology.Graph) map[string][]model.PolicyRule {
+	return expandPolicyRulesWith(nodes, g, autoPaths.peek)
+}
+
+func expandPolicyRulesWith(nodes []model.Node, g *topology.Graph, resolve func(*topology.Graph, string, model.PolicyRule) (topology.Route, error)) map[string][]model.PolicyRule {
 	out := make(map[string][]model.PolicyRule)
 	for _, n := range nodes {
 		for _, pr := range n.PolicyRules {
+			if pr.AutoPath() {
+				route, err := resolve(g, n.ID, pr)
+				if err != nil {
+					continue
+				}
+				pr.Path = route.Hops
+				pr.ViaNode = ""
+			} else if len(pr.Path) > 0 {
+				pr.Path = g.WithRelays(n.ID, pr.Path)
+			} else if hops := g.WithRelays(n.ID, []string{pr.ViaNode}); len(hops) > 1 {
+				pr.Path = hops
+			}
 			if len(pr.Path) == 0 {
 				out[n.ID] = append(out[n.ID], pr)
 				continue
@@ -809,18 +1001,13 @@ func authFunc(token string) func(r *http.Request) bool {
 	}
 }
 
+// topologyOptions reads the plan topology (mesh, hub-spoke or intents) from the settings.
+func topologyOptions(st store.NodeStore) topology.Options {
+	return topology.FromSettings(loadSettingsOrDefault(st))
+}
+
 func loadSettingsOrDefault(st store.NodeStore) model.Settings {
-	def := model.Settings{
-		GeoIP: model.GeoIPConfig{
-			CacheDir: policy.DefaultCacheDir(),
-			SourceV4: policy.DefaultSourceV4(),
-			SourceV6: policy.DefaultSourceV6(),
-			CacheTTL: "24h",
-		},
-		Diag: model.DiagConfig{
-			PingInterval: "3s",
-		},
-	}
+	def := policy.DefaultSettings()
 	if st == nil {
 		return def
 	}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"peer-wan/pkg/damping"
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// linkDamping holds the per-link state machines fed by health reports. Plans are built
+// from its damped view of the stored health, so a single lost probe does not move routes.
+// It is persisted with the rest of the routing state (see saveRoutingState).
+var linkDamping = damping.NewTracker()
+
+// plannedHealth returns the stored health reports as the planner should see them.
+func plannedHealth(st store.NodeStore, nodes []model.Node) map[string]model.HealthReport {
+	healthList, _ := st.ListHealth()
+	hmap := make(map[string]model.HealthReport)
+	for _, h := range healthList {
+		hmap[h.NodeID] = h
+	}
+	return linkDamping.Apply(loadSettingsOrDefault(st).Damping, hmap, nodes)
+}
+
+// observeHealth runs report through the damping state machines, audits the transitions
+// that move a link into or out of plans and reports whether any did.
+func observeHealth(st store.NodeStore, report model.HealthReport, nodes []model.Node) bool {
+	flipped := false
+	for _, ev := range linkDamping.Observe(loadSettingsOrDefault(st).Damping, report, nodes) {
+		if !ev.Flipped() {
+			continue
+		}
+		flipped = true
+		action := "link_down"
+		if ev.Usable {
+			action = "link_up"
+		}
+		log.Printf("link %s %s -> %s (%s)", ev.Link, ev.Prev, ev.State, ev.Reason)
+		_ = st.AppendAudit(model.AuditEntry{
+			Actor:     report.NodeID,
+			Action:    action,
+			Target:    ev.Link,
+			Detail:    ev.Prev + " -> " + ev.State + ": " + ev.Reason,
+			Timestamp: ev.Timestamp,
+		})
+	}
+	return flipped
+}
+
+// RegisterDampingRoutes exposes the damping settings, the damped link states and the
+// link state transitions.
+func RegisterDampingRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/settings/damping", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s := loadSettingsOrDefault(st)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"configured": s.Damping,
+				"effective":  damping.Effective(s.Damping),
+			})
+		case http.MethodPost:
+			// body replaces the damping settings; unset fields fall back to the defaults
+			var cfg model.DampingConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := damping.Validate(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			toggled := s.Damping.Disabled != cfg.Disabled
+			s.Damping = cfg
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			if toggled {
+				// plans switch between raw and damped health
+				if err := RecomputeAllPlans(st, planVersion); err != nil {
+					http.Error(w, "failed to recompute plans", http.StatusInternalServerError)
+					return
+				}
+				BumpPlanVersion(planVersion)
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"configured": s.Damping,
+				"effective":  damping.Effective(s.Damping),
+			})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/v1/status/links", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nodes, err := st.ListNodes()
+		if err != nil {
+			http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+			return
+		}
+		known := map[string]bool{"": true}
+		for _, n := range nodes {
+			known[n.ID] = true
+		}
+		nodeID := r.URL.Query().Get("nodeId")
+		out := []damping.Link{}
+		for _, l := range linkDamping.Links(loadSettingsOrDefault(st).Damping) {
+			// deleted nodes keep their state machines; leave them out
+			if !known[l.From] || !known[l.To] {
+				continue
+			}
+			if nodeID != "" && l.From != nodeID && l.To != nodeID {
+				continue
+			}
+			out = append(out, l)
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	mux.HandleFunc("/api/v1/status/links/events", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pq, err := parsePageQuery(r, 50)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		nodeID, link := q.Get("nodeId"), q.Get("link")
+		page, next := paginate(linkDamping.Events(), func(e damping.Event) time.Time { return e.Timestamp }, func(e damping.Event) bool {
+			return (nodeID == "" || e.From == nodeID || e.To == nodeID) && (link == "" || e.Link == link)
+		}, pq)
+		setNextCursor(w, next)
+		writeJSON(w, http.StatusOK, page)
+	})
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -130,6 +131,47 @@ func diagnoseNode(st store.NodeStore, nodeID string) DiagnoseResponse {
 		}
 	}
 
+	// WireGuard runtime state reported by the agent
+	if len(plan.Peers) > 0 {
+		if health.WireGuard == nil {
+			results = append(results, DiagnoseResult{Check: "WireGuard 握手", Status: "info", Severity: "info", Detail: "agent 未上报 WireGuard 运行状态（版本较旧或无法读取接口）"})
+		} else {
+			stale := []string{}
+			moved := []string{}
+			for _, p := range plan.Peers {
+				if p.Relay != "" {
+					// relayed: the entry only waits for a direct handshake
+					continue
+				}
+				planned := []string{}
+				for _, ep := range append([]string{node.PeerEndpoints[p.ID], p.Endpoint}, p.Endpoints...) {
+					if ep != "" && !slices.Contains(planned, ep) {
+						planned = append(planned, ep)
+					}
+				}
+				c := checkWireGuardPeer(health, p.ID, planned)
+				if c.Stale {
+					if c.Handshake == 0 {
+						stale = append(stale, p.ID+"(从未握手)")
+					} else {
+						stale = append(stale, fmt.Sprintf("%s(%s 前)", p.ID, c.Handshake))
+					}
+				}
+				if c.Mismatch != "" {
+					moved = append(moved, fmt.Sprintf("%s 实际 %s，计划 %s", p.ID, c.Mismatch, strings.Join(planned, "/")))
+				}
+			}
+			if len(stale) > 0 {
+				results = append(results, DiagnoseResult{Check: "WireGuard 握手", Status: "fail", Severity: "fail", Detail: "握手超时，隧道未建立或已中断: " + strings.Join(stale, ", ")})
+			} else {
+				results = append(results, DiagnoseResult{Check: "WireGuard 握手", Status: "ok", Severity: "ok", Detail: "所有直连 peer 均有近期握手"})
+			}
+			if len(moved) > 0 {
+				results = append(results, DiagnoseResult{Check: "WireGuard Endpoint", Status: "warn", Severity: "warn", Detail: "对端实际 endpoint 与计划不一致（NAT/漫游或旧地址）: " + strings.Join(moved, "; ")})
+			}
+		}
+	}
+
 	// FRR check
 	if len(health.FRRState) > 0 {
 		bad := []string{}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/topology"
+)
+
+// egressSelection is the member an egress group resolved to for one source node.
+type egressSelection = model.EgressSelection
+
+// pickEgress returns the member of grp that src should use among those usable accepts:
+// the first in failover mode, the weighted rendezvous winner in weighted mode, so every
+// source sticks to one member and the sources spread by weight.
+func pickEgress(grp model.EgressGroup, src string, usable func(string) bool) string {
+	best, bestScore := "", 0.0
+	for _, m := range grp.Members {
+		if !usable(m.NodeID) {
+			continue
+		}
+		if grp.Mode != model.EgressWeighted {
+			return m.NodeID
+		}
+		w := float64(m.Weight)
+		if w <= 0 {
+			w = 1
+		}
+		h := fnv.New64a()
+		h.Write([]byte(src + "|" + m.NodeID))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -w / math.Log(u); best == "" || score > bestScore {
+			best, bestScore = m.NodeID, score
+		}
+	}
+	return best
+}
+
+// resolveEgressGroups returns nodes with every egress group reference replaced by the
+// member active for that node, and the selections made. Node-level egress, default route
+// next hops and rule via nodes need a member the node peers with; a rule egress only needs
+// a path to it. With no usable member the group falls back to the member it would pick
+// regardless of health. References to unknown groups are left for validation to report.
+func resolveEgressGroups(nodes []model.Node, groups []model.EgressGroup, g *topology.Graph) ([]model.Node, []egressSelection) {
+	if len(groups) == 0 {
+		return nodes, nil
+	}
+	byID := make(map[string]model.EgressGroup, len(groups))
+	for _, grp := range groups {
+		byID[grp.ID] = grp
+	}
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		known[n.ID] = true
+	}
+	peered := func(src, id string) bool {
+		_, ok := g.Node(id)
+		return ok && g.Linked(src, id)
+	}
+	reachable := func(src, id string) bool {
+		_, ok := g.ShortestPath(src, func(n model.Node) bool { return n.ID == id })
+		return ok
+	}
+	var sel []egressSelection
+	resolve := func(ref, src string, usable func(src, id string) bool) string {
+		id, isGroup := model.EgressGroupRef(ref)
+		grp, ok := byID[id]
+		if !isGroup || !ok {
+			return ref
+		}
+		member := pickEgress(grp, src, func(m string) bool { return m != src && usable(src, m) })
+		healthy := member != ""
+		if !healthy {
+			member = pickEgress(grp, src, func(m string) bool { return m != src && known[m] })
+		}
+		if member == "" {
+			return ref
+		}
+		sel = append(sel, egressSelection{Group: grp.ID, Source: src, Member: member, Healthy: healthy})
+		return member
+	}
+	out := make([]model.Node, 0, len(nodes))
+	for _, n := range nodes {
+		n.EgressPeerID = resolve(n.EgressPeerID, n.ID, peered)
+		n.DefaultRouteNextHop = resolve(n.DefaultRouteNextHop, n.ID, peered)
+		if len(n.PolicyRules) > 0 {
+			rules := make([]model.PolicyRule, len(n.PolicyRules))
+			for i, rule := range n.PolicyRules {
+				rule.ViaNode = resolve(rule.ViaNode, n.ID, peered)
+				rule.Egress = resolve(rule.Egress, n.ID, reachable)
+				rules[i] = rule
+			}
+			n.PolicyRules = rules
+		}
+		out = append(out, n)
+	}
+	return out, sel
+}
+
+// plannedNodes returns nodes as plans see them: egress group references resolved over g.
+func plannedNodes(st store.NodeStore, nodes []model.Node, g *topology.Graph) []model.Node {
+	out, _ := resolveEgressGroups(nodes, loadSettingsOrDefault(st).EgressGroups, g)
+	return out
+}
+
+// egressGroupRefs lists the egress groups n references.
+func egressGroupRefs(n model.Node) []string {
+	refs := []string{n.EgressPeerID, n.DefaultRouteNextHop}
+	for _, rule := range n.PolicyRules {
+		refs = append(refs, rule.ViaNode, rule.Egress)
+	}
+	var out []string
+	for _, ref := range refs {
+		if id, ok := model.EgressGroupRef(ref); ok {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// unknownEgressGroups returns the groups n references that groups does not define.
+func unknownEgressGroups(n model.Node, groups []model.EgressGroup) []string {
+	defined := map[string]bool{}
+	for _, grp := range groups {
+		defined[grp.ID] = true
+	}
+	var out []string
+	for _, id := range egressGroupRefs(n) {
+		if !defined[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// validEgressGroups checks ids, modes, members and weights of groups.
+func validEgressGroups(groups []model.EgressGroup) error {
+	seen := map[string]bool{}
+	for _, grp := range groups {
+		if grp.ID == "" || strings.ContainsAny(grp.ID, " ,") {
+			return fmt.Errorf("invalid egress group id %q", grp.ID)
+		}
+		if seen[grp.ID] {
+			return fmt.Errorf("duplicate egress group %q", grp.ID)
+		}
+		seen[grp.ID] = true
+		if grp.Mode != "" && grp.Mode != model.EgressFailover && grp.Mode != model.EgressWeighted {
+			return fmt.Errorf("egress group %s: mode must be failover or weighted", grp.ID)
+		}
+		if len(grp.Members) == 0 {
+			return fmt.Errorf("egress group %s has no members", grp.ID)
+		}
+		members := map[string]bool{}
+		for _, m := range grp.Members {
+			if m.NodeID == "" || members[m.NodeID] {
+				return fmt.Errorf("egress group %s: empty or duplicate member %q", grp.ID, m.NodeID)
+			}
+			members[m.NodeID] = true
+			if m.Weight < 0 {
+				return fmt.Errorf("egress group %s: weight of %s must not be negative", grp.ID, m.NodeID)
+			}
+		}
+	}
+	return nil
+}
+
+// egressCache remembers the active member of every group per source node, so a change
+// of member is recorded as a failover.
+type egressCache struct {
+	mu     sync.Mutex
+	active map[string]egressSelection // group|source
+}
+
+var egressFailovers = &egressCache{active: map[string]egressSelection{}}
+
+// egressMove is a member change of one group for one source.
+type egressMove struct {
+	egressSelection
+	From string
+}
+
+// refresh stores sel as the active members and, when record is set, audits every member
+// change and files it as an egress_failover task. It reports whether any member changed.
+func (c *egressCache) refresh(st store.NodeStore, sel []egressSelection, record bool) bool {
+	c.mu.Lock()
+	var moves []egressMove
+	seen := map[string]bool{}
+	for _, s := range sel {
+		key := s.Group + "|" + s.Source
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if old, ok := c.active[key]; ok && old.Member != s.Member {
+			moves = append(moves, egressMove{egressSelection: s, From: old.Member})
+		}
+		c.active[key] = s
+	}
+	for key := range c.active {
+		if !seen[key] {
+			delete(c.active, key)
+		}
+	}
+	c.mu.Unlock()
+	if len(moves) == 0 {
+		return false
+	}
+	if record {
+		recordEgressFailover(st, moves)
+	}
+	return true
+}
+
+// snapshot returns the active members, grouped by group and sorted by source.
+func (c *egressCache) snapshot() map[string][]egressSelection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string][]egressSelection{}
+	for _, s := range c.active {
+		out[s.Group] = append(out[s.Group], s)
+	}
+	for _, list := range out {
+		sort.Slice(list, func(i, j int) bool { return list[i].Source < list[j].Source })
+	}
+	return out
+}
+
+// state returns the active members in key order.
+func (c *egressCache) state() []egressSelection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]egressSelection, 0, len(c.active))
+	for _, s := range c.active {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Group != out[j].Group {
+			return out[i].Group < out[j].Group
+		}
+		return out[i].Source < out[j].Source
+	})
+	return out
+}
+
+// restore replaces the active members with sel.
+func (c *egressCache) restore(sel []egressSelection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = make(map[string]egressSelection, len(sel))
+	for _, s := range sel {
+		c.active[s.Group+"|"+s.Source] = s
+	}
+}
+
+func recordEgressFailover(st store.NodeStore, moves []egressMove) {
+	now := time.Now()
+	var targets []string
+	steps := make([]model.TaskStep, 0, len(moves))
+	for _, m := range moves {
+		msg := fmt.Sprintf("egress group %s: %s -> %s", m.Group, m.From, m.Member)
+		if !m.Healthy {
+			msg += " (no healthy member, falling back)"
+		}
+		_ = st.AppendAudit(model.AuditEntry{
+			Actor:     "controller",
+			Action:    "egress_failover",
+			Target:    m.Source,
+			Detail:    msg,
+			Timestamp: now,
+		})
+		targets = append(targets, m.Source)
+		steps = append(steps, model.TaskStep{Name: "failover", Status: "success", Message: msg, NodeID: m.Source, Timestamp: now})
+	}
+	task := model.Task{
+		ID:            uuid.NewString(),
+		Targets:       targets,
+		Type:          "egress_failover",
+		Status:        "success",
+		OverallStatus: "success",
+		Steps:         steps,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if len(targets) == 1 {
+		task.NodeID = targets[0]
+	}
+	_ = st.SaveTask(task)
+}
+
+// RegisterEgressRoutes exposes the egress groups that egressPeerId, defaultRouteNextHop and
+// policy rules can reference as "group:<id>", together with the member active per node.
+func RegisterEgressRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/settings/egress-groups", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"groups": loadSettingsOrDefault(st).EgressGroups,
+				"active": egressFailovers.snapshot(),
+			})
+		case http.MethodPost:
+			// body replaces every group
+			var groups []model.EgressGroup
+			if err := json.NewDecoder(r.Body).Decode(&groups); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := validEgressGroups(groups); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			nodes, err := st.ListNodes()
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
+			}
+			for _, n := range nodes {
+				if missing := unknownEgressGroups(n, groups); len(missing) > 0 {
+					http.Error(w, fmt.Sprintf("node %s references egress group %s", n.ID, missing[0]), http.StatusConflict)
+					return
+				}
+			}
+			s := loadSettingsOrDefault(st)
+			s.EgressGroups = groups
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			// an edited group is not a failover: take its members as the new baseline
+			_, sel := resolveEgressGroups(nodes, groups, policyGraph(st, nodes, plannedHealth(st, nodes)))
+			egressFailovers.refresh(st, sel, false)
+			if err := RecomputeAllPlans(st, planVersion); err != nil {
+				http.Error(w, "failed to recompute plans", http.StatusInternalServerError)
+				return
+			}
+			BumpPlanVersion(planVersion)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"groups": groups,
+				"active": egressFailovers.snapshot(),
+			})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
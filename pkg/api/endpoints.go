@@ -0,0 +1,59 @@
+package api
+
+import (
+	"log"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// recordActiveEndpoints remembers, on the reporting node, which endpoint of each peer
+// currently completes handshakes so later plans offer it first. Endpoints that are not
+// registered for the peer are ignored; nothing is written when nothing changed.
+func recordActiveEndpoints(st store.NodeStore, report model.HealthReport) {
+	if len(report.ActiveEndpoints) == 0 {
+		return
+	}
+	for attempt := 1; attempt <= maxWriteRetries; attempt++ {
+		n, ok, err := st.GetNode(report.NodeID)
+		if err != nil || !ok {
+			return
+		}
+		updated := make(map[string]string, len(n.LinkEndpoints)+len(report.ActiveEndpoints))
+		for k, v := range n.LinkEndpoints {
+			updated[k] = v
+		}
+		changed := false
+		for peerID, ep := range report.ActiveEndpoints {
+			if updated[peerID] == ep || !peerHasEndpoint(st, peerID, ep) {
+				continue
+			}
+			updated[peerID] = ep
+			changed = true
+		}
+		if !changed {
+			return
+		}
+		n.LinkEndpoints = updated
+		if _, err = st.UpsertNode(n); err == nil {
+			return
+		}
+		if !isConflict(err) {
+			log.Printf("record active endpoints for %s failed: %v", report.NodeID, err)
+			return
+		}
+	}
+}
+
+func peerHasEndpoint(st store.NodeStore, peerID, ep string) bool {
+	peer, ok, err := st.GetNode(peerID)
+	if err != nil || !ok {
+		return false
+	}
+	for _, cand := range peer.Endpoints {
+		if cand == ep {
+			return true
+		}
+	}
+	return false
+}
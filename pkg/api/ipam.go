@@ -0,0 +1,240 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"peer-wan/pkg/ipam"
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// ipamMu serializes overlay allocation so concurrent prepares/registrations cannot pick the
+// same free address.
+var ipamMu sync.Mutex
+
+// ipamStatus is the address plan with the current allocations and any conflicts.
+type ipamStatus struct {
+	Pools        []string              `json:"pools"`
+	Pool6        string                `json:"pool6,omitempty"` // IPv6 overlay prefix when dual-stack is enabled
+	Reservations []model.IPReservation `json:"reservations"`
+	Allocations  []ipam.Allocation     `json:"allocations"`
+	Free         map[string]int        `json:"free"` // allocatable addresses left per pool
+	Conflicts    []ipam.Conflict       `json:"conflicts"`
+}
+
+// overlayPools returns the IPv4 pools and, when dual-stack is enabled, the IPv6 prefix that
+// agents scope NAT to.
+func overlayPools(s model.Settings) ([]string, string) {
+	pool6 := ""
+	if s.IPv6.Enabled {
+		pool6 = overlay6Prefix(s.IPv6)
+	}
+	return ipam.Pools(s.IPAM), pool6
+}
+
+// allocateOverlay picks the overlay address for a new node. Callers hold ipamMu until the
+// node is stored.
+func allocateOverlay(st store.NodeStore, nodeID string) (string, error) {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return "", err
+	}
+	return ipam.Allocate(loadSettingsOrDefault(st).IPAM, nodes, nodeID)
+}
+
+// resolveOverlay settles the overlay address of a node being registered: a reservation always
+// wins, a missing address or the agent's placeholder default already held elsewhere is
+// allocated, and any other address held by another node is refused. Addresses the node
+// already had are never questioned. A router id or IPv6 address derived from the old
+// address follows it.
+func resolveOverlay(st store.NodeStore, node *model.Node, existing model.Node) error {
+	s := loadSettingsOrDefault(st)
+	cfg := s.IPAM
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return err
+	}
+	want := node.OverlayIP
+	if reserved := ipam.Reserved(cfg, node.ID); reserved != "" {
+		want = reserved
+	} else if want != existing.OverlayIP || want == "" {
+		holder := ipam.Holder(nodes, node.ID, want)
+		switch {
+		case want == "" || (holder != "" && isPlaceholderOverlay(want)):
+			if want, err = ipam.Allocate(cfg, nodes, node.ID); err != nil {
+				return err
+			}
+		case holder != "":
+			return fmt.Errorf("overlay ip %s is already assigned to node %s", want, holder)
+		}
+	}
+	if want != node.OverlayIP {
+		if node.RouterID == "" || node.RouterID == ipWithoutMask(node.OverlayIP) {
+			node.RouterID = ipWithoutMask(want)
+		}
+		if node.OverlayIP6 != "" && node.OverlayIP6 == overlay6For(overlay6Prefix(s.IPv6), node.OverlayIP) {
+			node.OverlayIP6 = "" // re-derived by the caller
+		}
+		node.OverlayIP = want
+	}
+	return nil
+}
+
+// newOverlapping returns the prefixes of next that overlap a pool and were not already
+// present in prev, so nodes registered before a pool change keep working.
+func newOverlapping(cfg model.IPAMConfig, next, prev []string) []string {
+	had := map[string]bool{}
+	for _, p := range prev {
+		had[p] = true
+	}
+	var out []string
+	for _, p := range ipam.Overlapping(cfg, next) {
+		if !had[p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func describeIPAM(st store.NodeStore) (ipamStatus, error) {
+	s := loadSettingsOrDefault(st)
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return ipamStatus{}, err
+	}
+	pools, pool6 := overlayPools(s)
+	res := s.IPAM.Reservations
+	if res == nil {
+		res = []model.IPReservation{}
+	}
+	return ipamStatus{
+		Pools:        pools,
+		Pool6:        pool6,
+		Reservations: res,
+		Allocations:  ipam.Allocations(s.IPAM, nodes),
+		Free:         ipam.Free(s.IPAM, nodes),
+		Conflicts:    ipam.Conflicts(s.IPAM, nodes),
+	}, nil
+}
+
+// applyReservations moves existing nodes onto their reserved addresses.
+func applyReservations(st store.NodeStore, s model.Settings) error {
+	for _, r := range s.IPAM.Reservations {
+		for attempt := 1; attempt <= maxWriteRetries; attempt++ {
+			n, ok, err := st.GetNode(r.NodeID)
+			if err != nil {
+				return err
+			}
+			want := ipam.Reserved(s.IPAM, r.NodeID)
+			if !ok || n.OverlayIP == want {
+				break
+			}
+			if n.RouterID == "" || n.RouterID == ipWithoutMask(n.OverlayIP) {
+				n.RouterID = ipWithoutMask(want)
+			}
+			if n.OverlayIP6 == overlay6For(overlay6Prefix(s.IPv6), n.OverlayIP) {
+				n.OverlayIP6 = ""
+			}
+			n.OverlayIP = want
+			deriveOverlay6(&n, s.IPv6)
+			if _, err = st.UpsertNode(n); err == nil {
+				break
+			}
+			if !isConflict(err) || attempt == maxWriteRetries {
+				return fmt.Errorf("update %s: %w", r.NodeID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterIPAMRoutes exposes the overlay address plan: /api/v1/settings/ipam holds the pools
+// and reservations, /api/v1/ipam lists allocations, free space and conflicts.
+func RegisterIPAMRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/ipam", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := describeIPAM(st)
+		if err != nil {
+			http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	mux.HandleFunc("/api/v1/settings/ipam", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			cfg := loadSettingsOrDefault(st).IPAM
+			cfg.Pools = ipam.Pools(cfg)
+			writeJSON(w, http.StatusOK, cfg)
+		case http.MethodPost:
+			// body replaces pools and reservations; pools are refused while they would
+			// overlap node CIDRs or take a reserved address from another node
+			var cfg model.IPAMConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := ipam.Validate(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ipamMu.Lock()
+			defer ipamMu.Unlock()
+			nodes, err := st.ListNodes()
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
+			}
+			var blocking []ipam.Conflict
+			for _, c := range ipam.Conflicts(cfg, nodes) {
+				if c.Blocking() {
+					blocking = append(blocking, c)
+				}
+			}
+			if len(blocking) > 0 {
+				writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "address plan conflicts with existing nodes", "conflicts": blocking})
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			s.IPAM = cfg
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			if err := applyReservations(st, s); err != nil {
+				http.Error(w, "failed to apply reservations: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// pools reach agents through their plans (NAT scope), so always republish
+			if err := RecomputeAllPlans(st, planVersion); err != nil {
+				log.Printf("recompute plans failed after ipam change: %v", err)
+			} else {
+				BumpPlanVersion(planVersion)
+			}
+			status, err := describeIPAM(st)
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, status)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
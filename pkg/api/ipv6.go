@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// overlay6Prefix returns the configured IPv6 overlay pool, or the default ULA pool.
+func overlay6Prefix(cfg model.IPv6Config) string {
+	if cfg.Prefix != "" {
+		return cfg.Prefix
+	}
+	return model.DefaultOverlay6Prefix
+}
+
+// validOverlay6Prefix accepts IPv6 prefixes that leave the low 32 bits for the IPv4 overlay address.
+func validOverlay6Prefix(prefix string) error {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() {
+		return fmt.Errorf("prefix must be an IPv6 CIDR")
+	}
+	if p.Bits() > 96 {
+		return fmt.Errorf("prefix must be /96 or shorter")
+	}
+	return nil
+}
+
+// overlay6For maps an IPv4 overlay address into the IPv6 pool, so both stacks of a node are
+// derived from the same allocation (10.10.3.1 -> fd10:10::a0a:301/128).
+func overlay6For(prefix, overlayIP string) string {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return ""
+	}
+	v4, err := netip.ParseAddr(ipWithoutMask(overlayIP))
+	if err != nil || !v4.Is4() {
+		return ""
+	}
+	a := p.Masked().Addr().As16()
+	b := v4.As4()
+	copy(a[12:], b[:])
+	return netip.AddrFrom16(a).String() + "/128"
+}
+
+// deriveOverlay6 assigns the node's IPv6 overlay address when dual-stack is enabled and the
+// node has none yet; explicitly registered addresses are kept.
+func deriveOverlay6(n *model.Node, cfg model.IPv6Config) {
+	if !cfg.Enabled || n.OverlayIP6 != "" {
+		return
+	}
+	n.OverlayIP6 = overlay6For(overlay6Prefix(cfg), n.OverlayIP)
+}
+
+// syncOverlay6 gives every node an IPv6 overlay address (enabled) or removes them (disabled).
+func syncOverlay6(st store.NodeStore, cfg model.IPv6Config) error {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		for attempt := 1; attempt <= maxWriteRetries; attempt++ {
+			want := n
+			if cfg.Enabled {
+				deriveOverlay6(&want, cfg)
+			} else {
+				want.OverlayIP6 = ""
+			}
+			if want.OverlayIP6 == n.OverlayIP6 {
+				break
+			}
+			if _, err = st.UpsertNode(want); err == nil {
+				break
+			}
+			if !isConflict(err) || attempt == maxWriteRetries {
+				return fmt.Errorf("update %s: %w", n.ID, err)
+			}
+			cur, ok, gerr := st.GetNode(n.ID)
+			if gerr != nil || !ok {
+				break
+			}
+			n = cur
+		}
+	}
+	return nil
+}
+
+// RegisterIPv6Routes exposes the dual-stack overlay setting. Enabling it assigns an IPv6
+// overlay address to every node, disabling it removes them; both recompute every plan.
+func RegisterIPv6Routes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/settings/ipv6", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			cfg := loadSettingsOrDefault(st).IPv6
+			cfg.Prefix = overlay6Prefix(cfg)
+			writeJSON(w, http.StatusOK, cfg)
+		case http.MethodPost:
+			var cfg model.IPv6Config
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if cfg.Prefix != "" {
+				if err := validOverlay6Prefix(cfg.Prefix); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			s := loadSettingsOrDefault(st)
+			prev := s.IPv6
+			s.IPv6 = cfg
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			if overlay6Prefix(prev) != overlay6Prefix(cfg) {
+				// addresses from the old pool are stale: clear them before re-deriving
+				if err := syncOverlay6(st, model.IPv6Config{}); err != nil {
+					http.Error(w, "failed to update nodes: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := syncOverlay6(st, cfg); err != nil {
+				http.Error(w, "failed to update nodes: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := RecomputeAllPlans(st, planVersion); err != nil {
+				log.Printf("recompute plans failed after ipv6 change: %v", err)
+			} else {
+				BumpPlanVersion(planVersion)
+			}
+			cfg.Prefix = overlay6Prefix(cfg)
+			writeJSON(w, http.StatusOK, cfg)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
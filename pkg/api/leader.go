@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// forwardedHeader marks a request a follower already sent to the leader.
+const forwardedHeader = "X-Peer-Wan-Forwarded"
+
+// LeaderForwarder hands API traffic that reaches a follower replica to the elected
+// leader, so only the leader recomputes and pushes plans and only it runs the
+// health-driven link state (damping, auto paths, egress failover). Agent websockets are
+// proxied as well, keeping plan pushes on the leader's hub. Everything outside /api/ (the
+// UI assets) is served locally.
+type LeaderForwarder struct {
+	next       http.Handler
+	isLeader   func() bool
+	leaderAddr func() (string, error)
+	transport  http.RoundTripper
+
+	mu      sync.Mutex
+	target  string
+	current *httputil.ReverseProxy
+}
+
+// NewLeaderForwarder wraps next. leaderAddr returns the base URL the leader advertised,
+// "" while no leader is elected; transport may be nil for http.DefaultTransport.
+func NewLeaderForwarder(next http.Handler, isLeader func() bool, leaderAddr func() (string, error), transport http.RoundTripper) *LeaderForwarder {
+	return &LeaderForwarder{next: next, isLeader: isLeader, leaderAddr: leaderAddr, transport: transport}
+}
+
+func (f *LeaderForwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.isLeader() || !strings.HasPrefix(r.URL.Path, "/api/") {
+		f.next.ServeHTTP(w, r)
+		return
+	}
+	if r.Header.Get(forwardedHeader) != "" {
+		// leadership moved while the request was in flight; let the sender retry
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	proxy, err := f.proxy()
+	if err != nil || proxy == nil {
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return
+	}
+	r.Header.Set(forwardedHeader, "1")
+	proxy.ServeHTTP(w, r)
+}
+
+// proxy returns the reverse proxy for the current leader, rebuilt when it changes.
+func (f *LeaderForwarder) proxy() (*httputil.ReverseProxy, error) {
+	addr, err := f.leaderAddr()
+	if err != nil || addr == "" {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if addr == f.target && f.current != nil {
+		return f.current, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		// a holder from before advertise URLs (plain hostname) cannot be reached
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(u)
+	p.Transport = f.transport
+	p.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		http.Error(w, "leader unreachable: "+err.Error(), http.StatusBadGateway)
+	}
+	f.target, f.current = addr, p
+	return p, nil
+}
@@ -0,0 +1,429 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/store"
+)
+
+// Per-link preshared keys rotate in two phases. Staging generates the next key of a pair
+// and delivers it to both ends as nextPresharedKey while they keep using the current one;
+// each agent acknowledges holding it through stagedKeys in its health reports. Once both
+// ends have, the commit promotes it and pushes new plans to both at once. wg syncconf
+// keeps the running session when a peer's key changes, so the ends only need to agree
+// before the next handshake. The first key of a pair is introduced the same way.
+
+const defaultKeyRotation = 24 * time.Hour
+
+// linkKeyMu serializes read-modify-write passes over link keys in this controller.
+// Acknowledgements are repeated with every health report, so a write lost to another
+// replica is made up by the next one.
+var linkKeyMu sync.Mutex
+
+// keyRotation returns the key lifetime of cfg; 0 means keys are never rotated.
+func keyRotation(cfg model.PresharedKeyConfig) (time.Duration, error) {
+	if cfg.RotateEvery == "" {
+		return defaultKeyRotation, nil
+	}
+	d, err := model.ParseRetentionAge(cfg.RotateEvery)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rotateEvery %q", cfg.RotateEvery)
+	}
+	return d, nil
+}
+
+// newSealedKey generates a preshared key sealed with box.
+func newSealedKey(box *secret.Box) (string, error) {
+	k, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return box.Seal(k.String())
+}
+
+// peeredPairs returns the node pairs (ordered as in model.LinkKey) that peer in the stored plans.
+func peeredPairs(st store.NodeStore) (map[[2]string]bool, error) {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		known[n.ID] = true
+	}
+	pairs := map[[2]string]bool{}
+	for _, n := range nodes {
+		p, ok, err := st.GetPlan(n.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		for _, peer := range p.Peers {
+			if peer.ID == n.ID || !known[peer.ID] {
+				continue
+			}
+			a, b := model.LinkKeyPair(n.ID, peer.ID)
+			pairs[[2]string{a, b}] = true
+		}
+	}
+	return pairs, nil
+}
+
+// stageLinkKeys brings the link keys in line with the settings and the peered pairs: keys of
+// pairs that no longer peer are dropped, new pairs and keys due for rotation get a staged
+// next key. force stages a next key for every pair with nodeID as an end (all pairs when
+// nodeID is empty). With preshared keys disabled every key is removed. It reports whether
+// delivered plans change.
+func stageLinkKeys(st store.NodeStore, now time.Time, force bool, nodeID string) (bool, error) {
+	cfg := loadSettingsOrDefault(st).PresharedKeys
+	linkKeyMu.Lock()
+	defer linkKeyMu.Unlock()
+	keys, err := st.ListLinkKeys()
+	if err != nil {
+		return false, err
+	}
+	if !cfg.Enabled {
+		for _, k := range keys {
+			if err := st.DeleteLinkKey(k.A, k.B); err != nil {
+				return false, err
+			}
+		}
+		return len(keys) > 0, nil
+	}
+	every, err := keyRotation(cfg)
+	if err != nil {
+		return false, err
+	}
+	pairs, err := peeredPairs(st)
+	if err != nil {
+		return false, err
+	}
+	box, err := secret.FromEnv()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	stage := func(k model.LinkKey) error {
+		next, err := newSealedKey(box)
+		if err != nil {
+			return err
+		}
+		k.Next, k.Staged, k.StagedAt = next, nil, now
+		if err := st.SaveLinkKey(k); err != nil {
+			return err
+		}
+		changed = true
+		return nil
+	}
+	for _, k := range keys {
+		pair := [2]string{k.A, k.B}
+		if !pairs[pair] {
+			if err := st.DeleteLinkKey(k.A, k.B); err != nil {
+				return changed, err
+			}
+			continue
+		}
+		delete(pairs, pair)
+		if k.Next != "" {
+			continue // waiting for both ends
+		}
+		due := every > 0 && now.Sub(k.RotatedAt) >= every
+		if force && (nodeID == "" || k.A == nodeID || k.B == nodeID) {
+			due = true
+		}
+		if due {
+			if err := stage(k); err != nil {
+				return changed, err
+			}
+		}
+	}
+	for pair := range pairs {
+		if err := stage(model.LinkKey{A: pair[0], B: pair[1]}); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// ackLinkKeys records the staged keys report acknowledges and commits every key both ends
+// now hold. It reports whether any key was committed.
+func ackLinkKeys(st store.NodeStore, report model.HealthReport) bool {
+	if len(report.StagedKeys) == 0 {
+		return false
+	}
+	linkKeyMu.Lock()
+	defer linkKeyMu.Unlock()
+	keys, err := st.ListLinkKeys()
+	if err != nil {
+		log.Printf("list link keys failed: %v", err)
+		return false
+	}
+	committed := false
+	for _, k := range keys {
+		if k.Next == "" || (k.A != report.NodeID && k.B != report.NodeID) || slices.Contains(k.Staged, report.NodeID) {
+			continue
+		}
+		other := k.A
+		if other == report.NodeID {
+			other = k.B
+		}
+		if report.StagedKeys[other] != k.Generation+1 {
+			continue
+		}
+		k.Staged = append(k.Staged, report.NodeID)
+		if len(k.Staged) == 2 {
+			now := time.Now()
+			k.Key, k.Generation, k.Next, k.Staged, k.RotatedAt = k.Next, k.Generation+1, "", nil, now
+			committed = true
+			_ = st.AppendAudit(model.AuditEntry{
+				Actor:     "controller",
+				Action:    "psk_rotated",
+				Target:    k.A + "-" + k.B,
+				Detail:    fmt.Sprintf("preshared key generation %d in use", k.Generation),
+				Timestamp: now,
+			})
+		}
+		if err := st.SaveLinkKey(k); err != nil {
+			log.Printf("save link key %s-%s failed: %v", k.A, k.B, err)
+		}
+	}
+	return committed
+}
+
+// withLinkKeys returns peers as delivered to nodeID: each carries the current and staged
+// preshared key of its link. Stored plans never hold key material.
+func withLinkKeys(st store.NodeStore, nodeID string, peers []model.Peer) []model.Peer {
+	if len(peers) == 0 || !loadSettingsOrDefault(st).PresharedKeys.Enabled {
+		return peers
+	}
+	keys, err := st.ListLinkKeys()
+	if err != nil || len(keys) == 0 {
+		return peers
+	}
+	byPeer := map[string]model.LinkKey{}
+	for _, k := range keys {
+		switch nodeID {
+		case k.A:
+			byPeer[k.B] = k
+		case k.B:
+			byPeer[k.A] = k
+		}
+	}
+	if len(byPeer) == 0 {
+		return peers
+	}
+	box, err := secret.FromEnv()
+	if err != nil {
+		log.Printf("link keys: %v", err)
+		return peers
+	}
+	out := make([]model.Peer, len(peers))
+	for i, p := range peers {
+		out[i] = p
+		k, ok := byPeer[p.ID]
+		if !ok {
+			continue
+		}
+		cur, err := box.Open(k.Key)
+		if err != nil {
+			log.Printf("link key %s-%s: %v", k.A, k.B, err)
+			continue
+		}
+		next, err := box.Open(k.Next)
+		if err != nil {
+			log.Printf("link key %s-%s: %v", k.A, k.B, err)
+			next = ""
+		}
+		out[i].PresharedKey, out[i].KeyGeneration, out[i].NextPresharedKey = cur, k.Generation, next
+	}
+	return out
+}
+
+// refreshLinkKeys runs a staging pass and pushes plans when delivered keys changed.
+func refreshLinkKeys(st store.NodeStore, planVersion *int64, force bool, nodeID string) error {
+	changed, err := stageLinkKeys(st, time.Now(), force, nodeID)
+	if err != nil || !changed {
+		return err
+	}
+	if err := RecomputeAllPlans(st, planVersion); err != nil {
+		return err
+	}
+	BumpPlanVersion(planVersion)
+	return nil
+}
+
+// StartKeyRotation stages new and due preshared keys and advances node key rotations every
+// minute until ctx is done. When active is non-nil passes are skipped while it returns
+// false (e.g. on non-leader replicas).
+func StartKeyRotation(ctx context.Context, st store.NodeStore, planVersion *int64, active func() bool) {
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if active != nil && !active() {
+					continue
+				}
+				if err := refreshLinkKeys(st, planVersion, false, ""); err != nil {
+					log.Printf("preshared key rotation failed: %v", err)
+				}
+				if err := refreshNodeKeys(st, planVersion, time.Now()); err != nil {
+					log.Printf("node key rotation failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// linkKeyStatus is a link key without key material.
+type linkKeyStatus struct {
+	A          string     `json:"a"`
+	B          string     `json:"b"`
+	Generation int        `json:"generation"`
+	State      string     `json:"state"` // active, staging (next key waiting for both ends) or pending (no key in use yet)
+	Staged     []string   `json:"staged,omitempty"`
+	StagedAt   *time.Time `json:"stagedAt,omitempty"`
+	RotatedAt  *time.Time `json:"rotatedAt,omitempty"`
+}
+
+func newLinkKeyStatus(k model.LinkKey) linkKeyStatus {
+	s := linkKeyStatus{A: k.A, B: k.B, Generation: k.Generation, State: "active", Staged: k.Staged}
+	if k.Next != "" {
+		s.State = "staging"
+		s.StagedAt = &k.StagedAt
+	}
+	if k.Generation == 0 {
+		s.State = "pending"
+	}
+	if !k.RotatedAt.IsZero() {
+		s.RotatedAt = &k.RotatedAt
+	}
+	return s
+}
+
+// RegisterLinkKeyRoutes exposes the preshared key settings, the state of every link key
+// and manual rotation.
+func RegisterLinkKeyRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	effective := func(cfg model.PresharedKeyConfig) map[string]interface{} {
+		every, _ := keyRotation(cfg)
+		return map[string]interface{}{"enabled": cfg.Enabled, "rotateEvery": every.String()}
+	}
+	mux.HandleFunc("/api/v1/settings/preshared-keys", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s := loadSettingsOrDefault(st)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"configured": s.PresharedKeys,
+				"effective":  effective(s.PresharedKeys),
+			})
+		case http.MethodPost:
+			// body replaces the preshared key settings
+			var cfg model.PresharedKeyConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if _, err := keyRotation(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			s.PresharedKeys = cfg
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			// enabling stages a key for every pair, disabling drops them from all plans
+			if err := refreshLinkKeys(st, planVersion, false, ""); err != nil {
+				http.Error(w, "failed to update link keys: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"configured": s.PresharedKeys,
+				"effective":  effective(s.PresharedKeys),
+			})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/v1/link-keys", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys, err := st.ListLinkKeys()
+		if err != nil {
+			http.Error(w, "failed to list link keys", http.StatusInternalServerError)
+			return
+		}
+		nodeID := r.URL.Query().Get("nodeId")
+		out := []linkKeyStatus{}
+		for _, k := range keys {
+			if nodeID == "" || k.A == nodeID || k.B == nodeID {
+				out = append(out, newLinkKeyStatus(k))
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	mux.HandleFunc("/api/v1/link-keys/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !loadSettingsOrDefault(st).PresharedKeys.Enabled {
+			http.Error(w, "preshared keys are disabled", http.StatusConflict)
+			return
+		}
+		// ?nodeId= limits the rotation to that node's links, e.g. after it was compromised
+		nodeID := r.URL.Query().Get("nodeId")
+		if err := refreshLinkKeys(st, planVersion, true, nodeID); err != nil {
+			http.Error(w, "rotation failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = st.AppendAudit(model.AuditEntry{
+			Actor:     "admin",
+			Action:    "psk_rotate",
+			Target:    nodeID,
+			Detail:    "staged new preshared keys",
+			Timestamp: time.Now(),
+		})
+		keys, _ := st.ListLinkKeys()
+		out := []linkKeyStatus{}
+		for _, k := range keys {
+			if nodeID == "" || k.A == nodeID || k.B == nodeID {
+				out = append(out, newLinkKeyStatus(k))
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+}
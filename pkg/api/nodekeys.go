@@ -0,0 +1,195 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/wireguard"
+)
+
+var (
+	errKeyProofRequired = errors.New("agent-generated keys are required: register with a key proof")
+	errInvalidKeyProof  = errors.New("invalid key proof")
+)
+
+// proofKey is the controller's X25519 key agents prove possession of their node key to.
+// It is derived from the secret key, so every replica sharing SECRET_KEY verifies alike.
+func proofKey() wgtypes.Key {
+	sum := sha256.Sum256(append([]byte("peer-wan-proof-key:"), secret.KeyFromEnv()...))
+	k, _ := wgtypes.NewKey(sum[:])
+	return k
+}
+
+// applyNodeKey settles node's key material before it is stored. A valid proof marks the
+// public key as agent-held and drops any private key the controller still has for it.
+// With agent-generated keys enforced, provisioning requires a proof and no private key is
+// kept either way.
+func applyNodeKey(node *model.Node, req NodeRegistrationRequest, provisioning bool, cfg model.NodeKeyConfig) error {
+	if req.KeyProof != "" {
+		pub, err := wgtypes.ParseKey(node.PublicKey)
+		if err != nil || !wireguard.VerifyKeyProof(proofKey(), pub, node.ID, req.KeyProof) {
+			return errInvalidKeyProof
+		}
+		node.KeyOrigin = model.KeyOriginAgent
+		node.PrivateKey = ""
+		return nil
+	}
+	if !cfg.AgentGenerated {
+		return nil
+	}
+	if provisioning {
+		return errKeyProofRequired
+	}
+	node.PrivateKey = ""
+	return nil
+}
+
+// nodeKeyStatus tells whether the controller still holds a node's private key and how
+// far its key rotation is.
+type nodeKeyStatus struct {
+	ID               string     `json:"id"`
+	KeyOrigin        string     `json:"keyOrigin"`
+	PrivateKeyStored bool       `json:"privateKeyStored"`
+	RotationPhase    string     `json:"rotationPhase,omitempty"`
+	RotationTask     string     `json:"rotationTask,omitempty"`
+	KeyRotatedAt     *time.Time `json:"keyRotatedAt,omitempty"`
+}
+
+func nodeKeyStatuses(nodes []model.Node) []nodeKeyStatus {
+	out := make([]nodeKeyStatus, 0, len(nodes))
+	for _, n := range nodes {
+		origin := n.KeyOrigin
+		if origin == "" {
+			origin = "controller"
+		}
+		s := nodeKeyStatus{ID: n.ID, KeyOrigin: origin, PrivateKeyStored: n.PrivateKey != ""}
+		if n.KeyRotation != nil {
+			s.RotationPhase, s.RotationTask = n.KeyRotation.Phase, n.KeyRotation.TaskID
+		}
+		if !n.KeyRotatedAt.IsZero() {
+			s.KeyRotatedAt = &n.KeyRotatedAt
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// purgePrivateKeys drops every private key the controller still stores and returns the
+// affected nodes. Their agents must hold the key locally or re-provision with a new one.
+func purgePrivateKeys(st store.NodeStore) ([]string, error) {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	for _, n := range nodes {
+		for attempt := 1; n.PrivateKey != ""; attempt++ {
+			n.PrivateKey = ""
+			if _, err = st.UpsertNode(n); err == nil {
+				purged = append(purged, n.ID)
+				break
+			}
+			if !isConflict(err) || attempt >= maxWriteRetries {
+				return purged, err
+			}
+			var ok bool
+			if n, ok, err = st.GetNode(n.ID); err != nil || !ok {
+				break
+			}
+		}
+	}
+	return purged, nil
+}
+
+// RegisterNodeKeyRoutes exposes the controller's proof key to agents and the node key mode.
+func RegisterNodeKeyRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool) {
+	// public: agents fetch it before they register
+	mux.HandleFunc("/api/v1/nodes/proof-key", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"publicKey":      proofKey().PublicKey().String(),
+			"agentGenerated": loadSettingsOrDefault(st).NodeKeys.AgentGenerated,
+		})
+	})
+
+	mux.HandleFunc("/api/v1/settings/node-keys", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			nodes, err := st.ListNodes()
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"configured": loadSettingsOrDefault(st).NodeKeys,
+				"nodes":      nodeKeyStatuses(nodes),
+			})
+		case http.MethodPost:
+			// body replaces the node key settings; ?purge=true also drops stored private keys
+			var cfg model.NodeKeyConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if _, err := nodeKeyRotation(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			purge := r.URL.Query().Get("purge") == "true"
+			if purge && !cfg.AgentGenerated {
+				http.Error(w, "purge requires agentGenerated", http.StatusBadRequest)
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			s.NodeKeys = cfg
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			resp := map[string]interface{}{"configured": s.NodeKeys}
+			if purge {
+				purged, err := purgePrivateKeys(st)
+				if err != nil {
+					http.Error(w, "purge failed: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				for _, id := range purged {
+					_ = st.AppendAudit(model.AuditEntry{
+						Actor:     "admin",
+						Action:    "private_key_purged",
+						Target:    id,
+						Detail:    "controller copy of the wireguard private key removed",
+						Timestamp: time.Now(),
+					})
+				}
+				resp["purged"] = purged
+			}
+			nodes, err := st.ListNodes()
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
+			}
+			resp["nodes"] = nodeKeyStatuses(nodes)
+			writeJSON(w, http.StatusOK, resp)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
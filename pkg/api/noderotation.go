@@ -0,0 +1,483 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/wireguard"
+)
+
+// Node keys rotate in phases, recorded in the node's keyRotation and a key_rotation task.
+// generate: the agent creates a next key and reports its public key with a proof of
+// possession. stage: every neighbour gets it as nextPublicKey, a standby peer entry without
+// allowed IPs, and confirms holding it through stagedPeerKeys. switch: the agent moves its
+// interface to the next key; once it reports running it the controller commits it as the
+// node's public key and the neighbours move the node's allowed IPs over. verify: a
+// handshake under the new key completes the rotation and the agent retires the old one;
+// without a handshake in time the node rolls back to its previous key. Any phase that
+// does not finish within keyRotationTimeout fails the task.
+
+const keyRotationTimeout = 5 * time.Minute
+
+// nodeKeyMu serializes rotation state changes in this controller; agents repeat their
+// reports, so a change lost to another replica is made up by the next one.
+var nodeKeyMu sync.Mutex
+
+var (
+	errKeyNotAgentHeld   = errors.New("the node's private key is held by the controller; only agent-generated keys can be rotated")
+	errRotationInFlight  = errors.New("a key rotation is already in progress")
+	errRotationNodeGone  = errors.New("node not found")
+	errRotationUnchanged = errors.New("unchanged")
+)
+
+// nodeKeyRotation returns the rotation interval of cfg; 0 means rotations only on request.
+func nodeKeyRotation(cfg model.NodeKeyConfig) (time.Duration, error) {
+	if cfg.RotateEvery == "" {
+		return 0, nil
+	}
+	d, err := model.ParseRetentionAge(cfg.RotateEvery)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rotateEvery %q", cfg.RotateEvery)
+	}
+	return d, nil
+}
+
+// mutateNode applies fn to the stored node id and writes it back, re-reading on revision
+// conflicts. fn works on a copy of the rotation and returns errRotationUnchanged to skip
+// the write.
+func mutateNode(st store.NodeStore, id string, fn func(n *model.Node) error) (model.Node, error) {
+	for attempt := 1; ; attempt++ {
+		n, ok, err := st.GetNode(id)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			return n, errRotationNodeGone
+		}
+		if n.KeyRotation != nil {
+			r := *n.KeyRotation
+			r.Confirmed = slices.Clone(r.Confirmed)
+			n.KeyRotation = &r
+		}
+		if err := fn(&n); err != nil {
+			return n, err
+		}
+		saved, err := st.UpsertNode(n)
+		if err == nil {
+			return saved, nil
+		}
+		if !isConflict(err) || attempt >= maxWriteRetries {
+			return n, err
+		}
+	}
+}
+
+// recordRotationStep appends step to the rotation task; taskStatus settles the task.
+func recordRotationStep(st store.NodeStore, taskID string, step model.TaskStep, taskStatus string) {
+	t, ok, err := st.GetTask(taskID)
+	if err != nil || !ok {
+		return
+	}
+	t.Steps = append(t.Steps, step)
+	t.Status, t.OverallStatus, t.UpdatedAt = taskStatus, taskStatus, step.Timestamp
+	_ = st.SaveTask(t)
+}
+
+// startNodeKeyRotation opens a key_rotation task for node id and asks its agent for a new key.
+func startNodeKeyRotation(st store.NodeStore, id, actor string, now time.Time) (model.Task, error) {
+	task := model.Task{
+		ID:            uuid.NewString(),
+		NodeID:        id,
+		Targets:       []string{id},
+		Type:          "key_rotation",
+		Status:        "running",
+		OverallStatus: "running",
+		Steps:         []model.TaskStep{{Name: "generate", Status: "running", Message: "waiting for the agent to generate a new key", NodeID: id, Timestamp: now}},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	nodeKeyMu.Lock()
+	_, err := mutateNode(st, id, func(n *model.Node) error {
+		if n.KeyOrigin != model.KeyOriginAgent {
+			return errKeyNotAgentHeld
+		}
+		if n.KeyRotation != nil {
+			return errRotationInFlight
+		}
+		n.KeyRotation = &model.KeyRotation{TaskID: task.ID, Phase: model.KeyRotationGenerate, PreviousPublicKey: n.PublicKey, StartedAt: now, PhaseAt: now}
+		return nil
+	})
+	nodeKeyMu.Unlock()
+	if err != nil {
+		return model.Task{}, err
+	}
+	_ = st.SaveTask(task)
+	_ = st.AppendAudit(model.AuditEntry{
+		Actor:     actor,
+		Action:    "node_key_rotate",
+		Target:    id,
+		Detail:    "key rotation " + task.ID + " started",
+		Timestamp: now,
+	})
+	return task, nil
+}
+
+// keyNeighbours returns the nodes whose stored plans peer with id and that reported health
+// recently; offline neighbours pick up the new key with their next plan instead.
+func keyNeighbours(st store.NodeStore, nodes []model.Node, id string, now time.Time) []string {
+	seen := map[string]time.Time{}
+	if reports, err := st.ListHealth(); err == nil {
+		for _, h := range reports {
+			seen[h.NodeID] = h.Timestamp
+		}
+	}
+	var out []string
+	for _, n := range nodes {
+		if n.ID == id || now.Sub(seen[n.ID]) > keyRotationTimeout {
+			continue
+		}
+		p, ok, err := st.GetPlan(n.ID)
+		if err != nil || !ok {
+			continue
+		}
+		if slices.ContainsFunc(p.Peers, func(peer model.Peer) bool { return peer.ID == id }) {
+			out = append(out, n.ID)
+		}
+	}
+	return out
+}
+
+// advanceKeyRotations moves the rotations report concerns to their next phase: the
+// rotating node's own progress and neighbours confirming its staged key. It reports
+// whether delivered plans change.
+func advanceKeyRotations(st store.NodeStore, report model.HealthReport) bool {
+	if report.PublicKey == "" && len(report.StagedPeerKeys) == 0 {
+		return false
+	}
+	nodeKeyMu.Lock()
+	defer nodeKeyMu.Unlock()
+	nodes, err := st.ListNodes()
+	if err != nil {
+		log.Printf("list nodes failed: %v", err)
+		return false
+	}
+	now := time.Now()
+	changed := false
+	for _, n := range nodes {
+		if n.KeyRotation == nil {
+			continue
+		}
+		var moved bool
+		if n.ID == report.NodeID {
+			moved = advanceOwnRotation(st, n, report, now)
+		} else if key := report.StagedPeerKeys[n.ID]; key != "" && key == n.KeyRotation.NextPublicKey {
+			moved = confirmStagedKey(st, nodes, n.ID, report.NodeID, now)
+		}
+		changed = changed || moved
+	}
+	return changed
+}
+
+// advanceOwnRotation applies what the rotating node n reports about itself.
+func advanceOwnRotation(st store.NodeStore, n model.Node, report model.HealthReport, now time.Time) bool {
+	rot := *n.KeyRotation
+	step := func(name, status, msg string) model.TaskStep {
+		return model.TaskStep{Name: name, Status: status, Message: msg, NodeID: n.ID, Timestamp: now}
+	}
+	switch {
+	case rot.Phase == model.KeyRotationGenerate && report.NextPublicKey != "":
+		pub, err := wgtypes.ParseKey(report.NextPublicKey)
+		if err != nil || !wireguard.VerifyKeyProof(proofKey(), pub, n.ID, report.NextKeyProof) {
+			abortKeyRotation(st, n.ID, rot, step("generate", "fail", "invalid proof for the new key"))
+			return true
+		}
+		if _, err := setRotationPhase(st, n.ID, rot.TaskID, func(r *model.KeyRotation) {
+			r.NextPublicKey, r.Confirmed = report.NextPublicKey, nil
+			r.Phase, r.PhaseAt = model.KeyRotationStage, now
+		}); err != nil {
+			return false
+		}
+		recordRotationStep(st, rot.TaskID, step("generate", "success", "new key "+shortKey(report.NextPublicKey)), "running")
+		recordRotationStep(st, rot.TaskID, step("stage", "running", "pushing the new key to neighbours"), "running")
+		nodes, err := st.ListNodes()
+		if err == nil {
+			confirmStagedKey(st, nodes, n.ID, "", now)
+		}
+		return true
+	case rot.Phase == model.KeyRotationSwitch && report.PublicKey == rot.NextPublicKey:
+		next, err := mutateNode(st, n.ID, func(cur *model.Node) error {
+			if cur.KeyRotation == nil || cur.KeyRotation.TaskID != rot.TaskID {
+				return errRotationUnchanged
+			}
+			cur.PublicKey = rot.NextPublicKey
+			cur.KeyRotation.Phase, cur.KeyRotation.PhaseAt = model.KeyRotationVerify, now
+			return nil
+		})
+		if err != nil {
+			return false
+		}
+		recordRotationStep(st, rot.TaskID, step("switch", "success", "interface runs the new key"), "running")
+		if len(rot.Confirmed) == 0 {
+			// nobody to handshake with: nothing left to verify
+			finishKeyRotation(st, next, step("verify", "success", "no online neighbours to verify with"))
+		} else {
+			recordRotationStep(st, rot.TaskID, step("verify", "running", "waiting for a handshake under the new key"), "running")
+		}
+		return true
+	case rot.Phase == model.KeyRotationVerify && len(report.KeyHandshakes) > 0:
+		finishKeyRotation(st, n, step("verify", "success", "handshake with "+strings.Join(report.KeyHandshakes, ",")))
+		return true
+	case rot.Phase == model.KeyRotationRollback && report.PublicKey == rot.PreviousPublicKey:
+		nodeDone(st, n.ID, rot.TaskID, false, now)
+		recordRotationStep(st, rot.TaskID, step("rollback", "success", "interface runs the previous key again"), "fail")
+		auditRotation(st, n.ID, "node_key_rollback", "key rotation "+rot.TaskID+" rolled back", now)
+		return true
+	}
+	return false
+}
+
+// confirmStagedKey records neighbour (if any) as holding the staged key of node id and
+// moves the rotation to the switch phase once every online neighbour does.
+func confirmStagedKey(st store.NodeStore, nodes []model.Node, id, neighbour string, now time.Time) bool {
+	pending := keyNeighbours(st, nodes, id, now)
+	var rot model.KeyRotation
+	n, err := mutateNode(st, id, func(cur *model.Node) error {
+		if cur.KeyRotation == nil || cur.KeyRotation.Phase != model.KeyRotationStage {
+			return errRotationUnchanged
+		}
+		r := cur.KeyRotation
+		changed := false
+		if neighbour != "" && !slices.Contains(r.Confirmed, neighbour) {
+			r.Confirmed = append(r.Confirmed, neighbour)
+			changed = true
+		}
+		if !slices.ContainsFunc(pending, func(nb string) bool { return !slices.Contains(r.Confirmed, nb) }) {
+			r.Phase, r.PhaseAt = model.KeyRotationSwitch, now
+			changed = true
+		}
+		if !changed {
+			return errRotationUnchanged
+		}
+		rot = *r
+		return nil
+	})
+	if err != nil || n.KeyRotation.Phase != model.KeyRotationSwitch {
+		return false
+	}
+	msg := "held by " + strings.Join(rot.Confirmed, ",")
+	if len(rot.Confirmed) == 0 {
+		msg = "no online neighbours"
+	}
+	recordRotationStep(st, rot.TaskID, model.TaskStep{Name: "stage", Status: "success", Message: msg, NodeID: id, Timestamp: now}, "running")
+	recordRotationStep(st, rot.TaskID, model.TaskStep{Name: "switch", Status: "running", Message: "agent switching its interface to the new key", NodeID: id, Timestamp: now}, "running")
+	return true
+}
+
+// setRotationPhase updates the rotation taskID of node id with fn.
+func setRotationPhase(st store.NodeStore, id, taskID string, fn func(r *model.KeyRotation)) (model.Node, error) {
+	return mutateNode(st, id, func(cur *model.Node) error {
+		if cur.KeyRotation == nil || cur.KeyRotation.TaskID != taskID {
+			return errRotationUnchanged
+		}
+		fn(cur.KeyRotation)
+		return nil
+	})
+}
+
+// finishKeyRotation completes the rotation of n: the agent retires its old key once the
+// rotation disappears from its plan.
+func finishKeyRotation(st store.NodeStore, n model.Node, verified model.TaskStep) {
+	rot := n.KeyRotation
+	if !nodeDone(st, n.ID, rot.TaskID, true, verified.Timestamp) {
+		return
+	}
+	recordRotationStep(st, rot.TaskID, verified, "running")
+	recordRotationStep(st, rot.TaskID, model.TaskStep{Name: "retire", Status: "success", Message: "previous key " + shortKey(rot.PreviousPublicKey) + " retired", NodeID: n.ID, Timestamp: verified.Timestamp}, "success")
+	auditRotation(st, n.ID, "node_key_rotated", "public key now "+shortKey(rot.NextPublicKey), verified.Timestamp)
+}
+
+// abortKeyRotation ends a rotation that never switched the interface.
+func abortKeyRotation(st store.NodeStore, id string, rot model.KeyRotation, failed model.TaskStep) {
+	if !nodeDone(st, id, rot.TaskID, false, failed.Timestamp) {
+		return
+	}
+	recordRotationStep(st, rot.TaskID, failed, "fail")
+	auditRotation(st, id, "node_key_rotate_failed", failed.Message, failed.Timestamp)
+}
+
+// nodeDone clears the rotation taskID of node id; completed also records the rotation time.
+func nodeDone(st store.NodeStore, id, taskID string, completed bool, now time.Time) bool {
+	_, err := mutateNode(st, id, func(cur *model.Node) error {
+		if cur.KeyRotation == nil || cur.KeyRotation.TaskID != taskID {
+			return errRotationUnchanged
+		}
+		cur.KeyRotation = nil
+		if completed {
+			cur.KeyRotatedAt = now
+		}
+		return nil
+	})
+	return err == nil
+}
+
+func auditRotation(st store.NodeStore, id, action, detail string, now time.Time) {
+	_ = st.AppendAudit(model.AuditEntry{Actor: "controller", Action: action, Target: id, Detail: detail, Timestamp: now})
+}
+
+// expireKeyRotations fails rotations stuck in a phase for longer than keyRotationTimeout.
+// Before the switch the rotation is abandoned; after it the node rolls back to its
+// previous key. A rollback that is not confirmed either is given up on.
+func expireKeyRotations(st store.NodeStore, nodes []model.Node, now time.Time) bool {
+	changed := false
+	for _, n := range nodes {
+		rot := n.KeyRotation
+		if rot == nil || now.Sub(rot.PhaseAt) < keyRotationTimeout {
+			continue
+		}
+		step := func(name, status, msg string) model.TaskStep {
+			return model.TaskStep{Name: name, Status: status, Message: msg, NodeID: n.ID, Timestamp: now}
+		}
+		switch rot.Phase {
+		case model.KeyRotationGenerate:
+			abortKeyRotation(st, n.ID, *rot, step("generate", "fail", "timed out waiting for the agent's new key"))
+		case model.KeyRotationStage:
+			var missing []string
+			for _, nb := range keyNeighbours(st, nodes, n.ID, now) {
+				if !slices.Contains(rot.Confirmed, nb) {
+					missing = append(missing, nb)
+				}
+			}
+			abortKeyRotation(st, n.ID, *rot, step("stage", "fail", "timed out waiting for "+strings.Join(missing, ",")))
+		case model.KeyRotationSwitch, model.KeyRotationVerify:
+			// the agent may have switched already: take the node back to its previous key
+			if _, err := mutateNode(st, n.ID, func(cur *model.Node) error {
+				if cur.KeyRotation == nil || cur.KeyRotation.TaskID != rot.TaskID {
+					return errRotationUnchanged
+				}
+				cur.PublicKey = rot.PreviousPublicKey
+				cur.KeyRotation.Phase, cur.KeyRotation.PhaseAt = model.KeyRotationRollback, now
+				return nil
+			}); err != nil {
+				continue
+			}
+			msg := "timed out waiting for the agent to switch"
+			if rot.Phase == model.KeyRotationVerify {
+				msg = "no handshake under the new key"
+			}
+			recordRotationStep(st, rot.TaskID, step(rot.Phase, "fail", msg), "running")
+			recordRotationStep(st, rot.TaskID, step("rollback", "running", "returning to key "+shortKey(rot.PreviousPublicKey)), "running")
+		case model.KeyRotationRollback:
+			if nodeDone(st, n.ID, rot.TaskID, false, now) {
+				recordRotationStep(st, rot.TaskID, step("rollback", "fail", "agent did not confirm the previous key; re-provision the node if its tunnels stay down"), "fail")
+				auditRotation(st, n.ID, "node_key_rollback", "rollback of "+rot.TaskID+" unconfirmed", now)
+			}
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// scheduleKeyRotation starts the rotation of the agent-held key that is due longest, one
+// node at a time, when node keys rotate periodically.
+func scheduleKeyRotation(st store.NodeStore, nodes []model.Node, now time.Time) bool {
+	every, err := nodeKeyRotation(loadSettingsOrDefault(st).NodeKeys)
+	if err != nil || every <= 0 {
+		return false
+	}
+	seen := map[string]time.Time{}
+	if reports, err := st.ListHealth(); err == nil {
+		for _, h := range reports {
+			seen[h.NodeID] = h.Timestamp
+		}
+	}
+	var due *model.Node
+	for i, n := range nodes {
+		if n.KeyRotation != nil {
+			return false
+		}
+		if n.KeyOrigin != model.KeyOriginAgent || now.Sub(n.KeyRotatedAt) < every || now.Sub(seen[n.ID]) > keyRotationTimeout {
+			continue
+		}
+		if due == nil || n.KeyRotatedAt.Before(due.KeyRotatedAt) {
+			due = &nodes[i]
+		}
+	}
+	if due == nil {
+		return false
+	}
+	if _, err := startNodeKeyRotation(st, due.ID, "controller", now); err != nil {
+		log.Printf("scheduled key rotation of %s failed: %v", due.ID, err)
+		return false
+	}
+	return true
+}
+
+// refreshNodeKeys expires stuck rotations and starts a scheduled one, pushing plans when
+// delivered plans change.
+func refreshNodeKeys(st store.NodeStore, planVersion *int64, now time.Time) error {
+	nodeKeyMu.Lock()
+	nodes, err := st.ListNodes()
+	if err != nil {
+		nodeKeyMu.Unlock()
+		return err
+	}
+	changed := expireKeyRotations(st, nodes, now)
+	nodeKeyMu.Unlock()
+	if !changed {
+		changed = scheduleKeyRotation(st, nodes, now)
+	}
+	if !changed {
+		return nil
+	}
+	if err := RecomputeAllPlans(st, planVersion); err != nil {
+		return err
+	}
+	BumpPlanVersion(planVersion)
+	return nil
+}
+
+func shortKey(k string) string {
+	if len(k) > 8 {
+		return k[:8] + "…"
+	}
+	return k
+}
+
+// handleRotateKey serves POST /api/v1/nodes/{id}/rotate-key.
+func handleRotateKey(w http.ResponseWriter, r *http.Request, st store.NodeStore, id string, planVersion *int64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	task, err := startNodeKeyRotation(st, id, "admin", time.Now())
+	switch {
+	case errors.Is(err, errRotationNodeGone):
+		http.Error(w, "node not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errKeyNotAgentHeld), errors.Is(err, errRotationInFlight):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "failed to start key rotation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := RecomputeAllPlans(st, planVersion); err != nil {
+		log.Printf("recompute plans failed after key rotation start: %v", err)
+	} else {
+		BumpPlanVersion(planVersion)
+	}
+	writeJSON(w, http.StatusOK, task)
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"peer-wan/pkg/ipam"
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// maxWriteRetries bounds how often handlers re-read and re-apply a change after a revision conflict.
+const maxWriteRetries = 3
+
+// NodeConflictResponse is returned with 409 when a write carried a stale revision.
+type NodeConflictResponse struct {
+	Error   string     `json:"error"`
+	Current model.Node `json:"current"`
+}
+
+func isConflict(err error) bool {
+	return errors.Is(err, store.ErrConflict)
+}
+
+// writeConflict answers 409 with the node as currently stored so the client can rebase its edit.
+func writeConflict(w http.ResponseWriter, current model.Node) {
+	writeJSON(w, http.StatusConflict, NodeConflictResponse{Error: "revision conflict; reload and retry", Current: current})
+}
+
+// NodeDependency describes a reference another node holds on the node being deleted.
+type NodeDependency struct {
+	NodeID string `json:"nodeId"`
+	Field  string `json:"field"` // egressPeerId / defaultRouteNextHop / policyRules / peerEndpoints
+	Detail string `json:"detail,omitempty"`
+}
+
+// NodeDeleteResponse reports what a delete did (or why it was refused).
+type NodeDeleteResponse struct {
+	Status        string           `json:"status"`
+	NodeID        string           `json:"nodeId"`
+	Dependencies  []NodeDependency `json:"dependencies,omitempty"`
+	UpdatedNodes  []string         `json:"updatedNodes,omitempty"`
+	ReleasedIP    string           `json:"releasedOverlayIp,omitempty"` // overlay address returned to the pool
+	AgentNotified bool             `json:"agentNotified"`
+	Message       string           `json:"message,omitempty"`
+}
+
+// RegisterNodeRoutes exposes per-node operations under /api/v1/nodes/{id}, and key rotation
+// under /api/v1/nodes/{id}/rotate-key.
+// Exact paths such as /api/v1/nodes/register and /api/v1/nodes/prepare keep precedence.
+func RegisterNodeRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/"), "/")
+		if id == "" || (action != "" && action != "rotate-key") {
+			http.NotFound(w, r)
+			return
+		}
+		if action == "rotate-key" {
+			handleRotateKey(w, r, st, id, planVersion)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			n, ok, err := st.GetNode(id)
+			if err != nil {
+				http.Error(w, "failed to load node", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "node not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, n)
+		case http.MethodDelete:
+			force := r.URL.Query().Get("force") == "true"
+			status, resp := deleteNode(st, id, force, planVersion)
+			writeJSON(w, status, resp)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// deleteNode decommissions a node. Without force it refuses (409) while other nodes still
+// route through it; with force those references are stripped first.
+func deleteNode(st store.NodeStore, id string, force bool, planVersion *int64) (int, NodeDeleteResponse) {
+	resp := NodeDeleteResponse{NodeID: id}
+	target, ok, err := st.GetNode(id)
+	if err != nil {
+		resp.Status, resp.Message = "error", "failed to load node"
+		return http.StatusInternalServerError, resp
+	} else if !ok {
+		resp.Status, resp.Message = "error", "node not found"
+		return http.StatusNotFound, resp
+	}
+	nodes, err := st.ListNodes()
+	if err != nil {
+		resp.Status, resp.Message = "error", "failed to list nodes"
+		return http.StatusInternalServerError, resp
+	}
+	resp.Dependencies = nodeDependencies(nodes, id)
+	if len(resp.Dependencies) > 0 && !force {
+		resp.Status = "conflict"
+		resp.Message = "node is still referenced by other nodes; retry with ?force=true to strip references"
+		return http.StatusConflict, resp
+	}
+
+	for _, n := range nodes {
+		if n.ID == id {
+			continue
+		}
+		updated, err := stripNodeRefsWithRetry(st, n, id)
+		if err != nil {
+			resp.Status, resp.Message = "error", fmt.Sprintf("failed to update node %s: %v", n.ID, err)
+			return http.StatusInternalServerError, resp
+		}
+		if updated {
+			resp.UpdatedNodes = append(resp.UpdatedNodes, n.ID)
+		}
+	}
+
+	if err := st.DeleteNode(id); err != nil {
+		resp.Status, resp.Message = "error", "failed to delete node: "+err.Error()
+		return http.StatusInternalServerError, resp
+	}
+	// allocations are derived from stored nodes, so the address is free again unless reserved
+	if target.OverlayIP != "" && ipam.Reserved(loadSettingsOrDefault(st).IPAM, id) == "" {
+		resp.ReleasedIP = ipWithoutMask(target.OverlayIP)
+	}
+	if wsHubGlobal != nil {
+		resp.AgentNotified = wsHubGlobal.Connected(id)
+		wsHubGlobal.Send(id, WSMessage{Type: "decommission", NodeID: id, Payload: map[string]interface{}{"nodeId": id, "reason": "deleted by controller"}})
+	}
+	if err := RecomputeAllPlans(st, planVersion); err != nil {
+		log.Printf("recompute plans failed after delete: %v", err)
+	} else {
+		BumpPlanVersion(planVersion)
+	}
+	detail := "node deleted"
+	if len(resp.UpdatedNodes) > 0 {
+		detail = fmt.Sprintf("node deleted; references stripped from %s", strings.Join(resp.UpdatedNodes, ","))
+	}
+	if resp.ReleasedIP != "" {
+		detail += "; overlay " + resp.ReleasedIP + " released"
+	}
+	_ = st.AppendAudit(model.AuditEntry{
+		Actor:     "controller",
+		Action:    "delete_node",
+		Target:    id,
+		Detail:    detail,
+		Timestamp: time.Now(),
+	})
+	resp.Status = "ok"
+	return http.StatusOK, resp
+}
+
+// stripNodeRefsWithRetry persists stripNodeRefs for n, re-reading the node on revision conflicts.
+func stripNodeRefsWithRetry(st store.NodeStore, n model.Node, id string) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		stripped, changed, peerEpChanged := stripNodeRefs(n, id)
+		if !changed {
+			return false, nil
+		}
+		var err error
+		if peerEpChanged {
+			_, err = st.UpsertNode(stripped)
+		} else {
+			err = st.UpdatePolicy(n.ID, stripped.EgressPeerID, stripped.PolicyRules, stripped.DefaultRoute, stripped.BypassCIDRs, stripped.DefaultRouteNextHop, n.Revision)
+		}
+		if err == nil {
+			return true, nil
+		}
+		if !isConflict(err) || attempt >= maxWriteRetries {
+			return false, err
+		}
+		fresh, ok, errGet := st.GetNode(n.ID)
+		if errGet != nil {
+			return false, errGet
+		}
+		if !ok {
+			return false, nil
+		}
+		n = fresh
+	}
+}
+
+// nodeDependencies lists every place other nodes refer to id.
+func nodeDependencies(nodes []model.Node, id string) []NodeDependency {
+	var deps []NodeDependency
+	for _, n := range nodes {
+		if n.ID == id {
+			continue
+		}
+		if n.EgressPeerID == id {
+			deps = append(deps, NodeDependency{NodeID: n.ID, Field: "egressPeerId"})
+		}
+		if n.DefaultRouteNextHop == id {
+			deps = append(deps, NodeDependency{NodeID: n.ID, Field: "defaultRouteNextHop"})
+		}
+		for _, rule := range n.PolicyRules {
+			if ruleUsesNode(rule, id) {
+				deps = append(deps, NodeDependency{NodeID: n.ID, Field: "policyRules", Detail: ruleLabel(rule)})
+			}
+		}
+		if _, ok := n.PeerEndpoints[id]; ok {
+			deps = append(deps, NodeDependency{NodeID: n.ID, Field: "peerEndpoints"})
+		}
+	}
+	return deps
+}
+
+// stripNodeRefs removes references to id from n. Rules egressing via id are dropped,
+// rules merely transiting id lose that hop (and a ViaNode naming it). peerEp reports a PeerEndpoints change,
+// which UpdatePolicy cannot persist.
+func stripNodeRefs(n model.Node, id string) (out model.Node, changed, peerEp bool) {
+	out = n
+	if out.EgressPeerID == id {
+		out.EgressPeerID = ""
+		changed = true
+	}
+	if out.DefaultRouteNextHop == id {
+		out.DefaultRouteNextHop = ""
+		changed = true
+	}
+	if len(n.PolicyRules) > 0 {
+		rules := make([]model.PolicyRule, 0, len(n.PolicyRules))
+		for _, rule := range n.PolicyRules {
+			if !ruleUsesNode(rule, id) {
+				rules = append(rules, rule)
+				continue
+			}
+			changed = true
+			egress := rule.ViaNode
+			if len(rule.Path) > 0 {
+				egress = rule.Path[len(rule.Path)-1]
+			} else if rule.AutoPath() {
+				egress = rule.Egress
+			}
+			if egress == id {
+				continue
+			}
+			path := make([]string, 0, len(rule.Path))
+			for _, hop := range rule.Path {
+				if hop != id {
+					path = append(path, hop)
+				}
+			}
+			rule.Path = path
+			if rule.ViaNode == id {
+				// ViaNode mirrors the egress: the new last hop, or the egress an auto path
+				// resolves to (empty for a selector)
+				switch {
+				case len(path) > 0:
+					rule.ViaNode = path[len(path)-1]
+				case rule.AutoPath():
+					rule.ViaNode = rule.Egress
+				default:
+					continue
+				}
+			}
+			rules = append(rules, rule)
+		}
+		out.PolicyRules = rules
+	}
+	if _, ok := n.PeerEndpoints[id]; ok {
+		pe := make(map[string]string, len(n.PeerEndpoints))
+		for k, v := range n.PeerEndpoints {
+			if k != id {
+				pe[k] = v
+			}
+		}
+		out.PeerEndpoints = pe
+		changed, peerEp = true, true
+	}
+	return out, changed, peerEp
+}
+
+func ruleUsesNode(rule model.PolicyRule, id string) bool {
+	if rule.ViaNode == id || rule.Egress == id {
+		return true
+	}
+	for _, hop := range rule.Path {
+		if hop == id {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleLabel(rule model.PolicyRule) string {
+	target := rule.Prefix
+	if target == "" && len(rule.Domains) > 0 {
+		target = strings.Join(rule.Domains, ",")
+	}
+	if len(rule.Path) > 0 {
+		return target + " via " + strings.Join(rule.Path, ">")
+	}
+	if rule.AutoPath() {
+		return target + " via auto>" + rule.Egress + rule.EgressSelector
+	}
+	return target + " via " + rule.ViaNode
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// maxPageLimit caps ?limit= on paginated history endpoints.
+const maxPageLimit = 1000
+
+// pageQuery holds the common paging and filter parameters of history endpoints:
+//
+//	limit   page size (endpoint default, at most maxPageLimit)
+//	cursor  opaque value from the previous page's nextCursor / X-Next-Cursor
+//	since   RFC3339 timestamp or Go duration ("2h" = last two hours), inclusive
+//	until   RFC3339 timestamp, exclusive
+//
+// Pages walk from newest to oldest; entries inside a page stay oldest-first like the
+// unpaginated responses did.
+type pageQuery struct {
+	Limit  int
+	Cursor pageCursor
+	Since  time.Time
+	Until  time.Time
+}
+
+// pageCursor points just past the oldest entry of the previous page: entries newer than
+// TS were returned, as were the first Skip entries (newest-first) stamped exactly TS.
+type pageCursor struct {
+	TS   time.Time
+	Skip int
+}
+
+func (c pageCursor) IsZero() bool { return c.TS.IsZero() }
+
+func (c pageCursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	raw := strconv.FormatInt(c.TS.UnixNano(), 10) + ":" + strconv.Itoa(c.Skip)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (pageCursor, error) {
+	if s == "" {
+		return pageCursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	tsStr, skipStr, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	ns, err1 := strconv.ParseInt(tsStr, 10, 64)
+	skip, err2 := strconv.Atoi(skipStr)
+	if err1 != nil || err2 != nil || skip < 0 {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return pageCursor{TS: time.Unix(0, ns), Skip: skip}, nil
+}
+
+func parsePageQuery(r *http.Request, defLimit int) (pageQuery, error) {
+	q := r.URL.Query()
+	pq := pageQuery{Limit: defLimit}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return pq, fmt.Errorf("invalid limit")
+		}
+		pq.Limit = n
+	}
+	if pq.Limit > maxPageLimit {
+		pq.Limit = maxPageLimit
+	}
+	var err error
+	if pq.Cursor, err = parseCursor(q.Get("cursor")); err != nil {
+		return pq, err
+	}
+	if pq.Since, err = parseTimeParam(q.Get("since")); err != nil {
+		return pq, fmt.Errorf("invalid since: %w", err)
+	}
+	if pq.Until, err = parseTimeParam(q.Get("until")); err != nil {
+		return pq, fmt.Errorf("invalid until: %w", err)
+	}
+	return pq, nil
+}
+
+// parseTimeParam accepts RFC3339 or a duration meaning "that long ago".
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("want RFC3339 time or duration, got %q", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// history converts pq into the store's page selector.
+func (pq pageQuery) history() model.HistoryPage {
+	return model.HistoryPage{Limit: pq.Limit, Since: pq.Since, Until: pq.Until, Before: pq.Cursor.TS, Skip: pq.Cursor.Skip}
+}
+
+// paginate filters items by time range and keep, then returns one page plus the cursor
+// for the next (older) page, empty when there is none.
+func paginate[T any](items []T, ts func(T) time.Time, keep func(T) bool, pq pageQuery) ([]T, string) {
+	sorted := make([]T, 0, len(items))
+	for _, it := range items {
+		if keep == nil || keep(it) {
+			sorted = append(sorted, it)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return ts(sorted[i]).Before(ts(sorted[j])) })
+	page, more := model.SelectPage(sorted, ts, pq.history())
+	return page, nextCursor(pq, page, ts, more)
+}
+
+// nextCursor points past page (oldest first) when more entries remain, "" otherwise.
+func nextCursor[T any](pq pageQuery, page []T, ts func(T) time.Time, more bool) string {
+	if !more || len(page) == 0 {
+		return ""
+	}
+	oldest := ts(page[0])
+	c := pageCursor{TS: oldest}
+	for _, it := range page {
+		if ts(it).Equal(oldest) {
+			c.Skip++
+		}
+	}
+	if !pq.Cursor.IsZero() && pq.Cursor.TS.Equal(oldest) {
+		c.Skip += pq.Cursor.Skip
+	}
+	return c.String()
+}
+
+// setNextCursor exposes the cursor for endpoints that return a bare JSON array.
+func setNextCursor(w http.ResponseWriter, next string) {
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/topology"
+)
+
+// autoPathSwitchMargin is how much cheaper (relative) a new route must be before an
+// established auto path is replaced, so latency jitter does not make paths flap.
+const autoPathSwitchMargin = 0.2
+
+// policyPathStatus describes how one policy rule of a node is routed right now.
+type policyPathStatus struct {
+	Index  int      `json:"index"`
+	Prefix string   `json:"prefix,omitempty"`
+	Auto   bool     `json:"auto"`
+	Egress string   `json:"egress,omitempty"`
+	Path   []string `json:"path,omitempty"`
+	Cost   float64  `json:"cost"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// autoPathCache remembers the route chosen for every auto-path rule.
+type autoPathCache struct {
+	mu     sync.Mutex
+	routes map[string]topology.Route
+}
+
+var autoPaths = &autoPathCache{routes: map[string]topology.Route{}}
+
+// lastRelays remembers the relayed pairs of the latest graph, so a direct handshake
+// appearing (or going stale) republishes the plans of every node along relayed paths.
+var lastRelays struct {
+	sync.Mutex
+	pairs string
+}
+
+// relaysChanged reports whether g relays other pairs (or through other relays) than the
+// graph it was last called with.
+func relaysChanged(g *topology.Graph) bool {
+	pairs := strings.Join(g.RelayedPairs(), ",")
+	lastRelays.Lock()
+	defer lastRelays.Unlock()
+	changed := pairs != lastRelays.pairs
+	lastRelays.pairs = pairs
+	return changed
+}
+
+func autoPathKey(nodeID string, rule model.PolicyRule) string {
+	return strings.Join([]string{nodeID, rule.Prefix, strings.Join(rule.Domains, ","), rule.Egress, rule.EgressSelector}, "|")
+}
+
+// egressMatcher returns the predicate for the egress nodes a rule accepts.
+func egressMatcher(rule model.PolicyRule) (func(model.Node) bool, error) {
+	sel, err := topology.ParseSelector(rule.EgressSelector)
+	if err != nil {
+		return nil, err
+	}
+	return func(n model.Node) bool {
+		if rule.Egress != "" && n.ID != rule.Egress {
+			return false
+		}
+		return sel.Matches(n.Labels)
+	}, nil
+}
+
+// resolve returns the route for an auto-path rule of node src and remembers it. The
+// previous route is kept while it is still usable and within autoPathSwitchMargin of the
+// best one. Only plan computation resolves; everything else peeks.
+func (c *autoPathCache) resolve(g *topology.Graph, src string, rule model.PolicyRule) (topology.Route, error) {
+	key := autoPathKey(src, rule)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	route, err := chooseAutoPath(g, src, rule, c.routes[key])
+	if err != nil || len(route.Hops) == 0 {
+		delete(c.routes, key)
+	} else {
+		c.routes[key] = route
+	}
+	return route, err
+}
+
+// peek returns the route resolve would pick without remembering it, for read-only callers
+// (policy status, validation) that must not move the paths plans were built on.
+func (c *autoPathCache) peek(g *topology.Graph, src string, rule model.PolicyRule) (topology.Route, error) {
+	c.mu.Lock()
+	prev := c.routes[autoPathKey(src, rule)]
+	c.mu.Unlock()
+	return chooseAutoPath(g, src, rule, prev)
+}
+
+// chooseAutoPath picks the route for an auto-path rule of src given the route it had before.
+func chooseAutoPath(g *topology.Graph, src string, rule model.PolicyRule, prev topology.Route) (topology.Route, error) {
+	match, err := egressMatcher(rule)
+	if err != nil {
+		return topology.Route{}, err
+	}
+	best, ok := g.ShortestPath(src, match)
+	if len(prev.Hops) > 0 {
+		egress, inGraph := g.Node(prev.Hops[len(prev.Hops)-1])
+		if cost, usable := g.PathCost(src, prev.Hops); usable && inGraph && match(egress) &&
+			(!ok || cost <= best.Cost*(1+autoPathSwitchMargin)) {
+			return topology.Route{Hops: prev.Hops, Cost: cost}, nil
+		}
+	}
+	if !ok {
+		return topology.Route{}, fmt.Errorf("no usable path to egress")
+	}
+	return best, nil
+}
+
+// refresh re-resolves every auto-path rule against g, forgets rules that no longer exist
+// and reports whether any hop sequence changed.
+func (c *autoPathCache) refresh(nodes []model.Node, g *topology.Graph) bool {
+	c.mu.Lock()
+	before := make(map[string]topology.Route, len(c.routes))
+	for k, v := range c.routes {
+		before[k] = v
+	}
+	c.mu.Unlock()
+
+	changed := false
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		for _, rule := range n.PolicyRules {
+			if !rule.AutoPath() {
+				continue
+			}
+			key := autoPathKey(n.ID, rule)
+			seen[key] = true
+			route, _ := c.resolve(g, n.ID, rule)
+			if strings.Join(route.Hops, ">") != strings.Join(before[key].Hops, ">") {
+				changed = true
+			}
+		}
+	}
+	c.mu.Lock()
+	for k := range c.routes {
+		if !seen[k] {
+			delete(c.routes, k)
+		}
+	}
+	c.mu.Unlock()
+	return changed
+}
+
+// state returns the remembered routes by rule key.
+func (c *autoPathCache) state() map[string]model.AutoPath {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]model.AutoPath, len(c.routes))
+	for k, r := range c.routes {
+		out[k] = model.AutoPath{Hops: append([]string(nil), r.Hops...), Cost: r.Cost}
+	}
+	return out
+}
+
+// restore replaces the remembered routes with paths.
+func (c *autoPathCache) restore(paths map[string]model.AutoPath) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = make(map[string]topology.Route, len(paths))
+	for k, p := range paths {
+		c.routes[k] = topology.Route{Hops: append([]string(nil), p.Hops...), Cost: p.Cost}
+	}
+}
+
+// policyGraph builds the weighted peer graph auto paths are computed on.
+func policyGraph(st store.NodeStore, nodes []model.Node, health map[string]model.HealthReport) *topology.Graph {
+	return topology.NewGraph(nodes, health, topologyOptions(st))
+}
+
+// describePolicyPaths reports the path and cost of every rule of n; auto paths are resolved
+// the same way plans resolve them, without touching the remembered routes.
+func describePolicyPaths(n model.Node, g *topology.Graph) []policyPathStatus {
+	out := make([]policyPathStatus, 0, len(n.PolicyRules))
+	for i, rule := range n.PolicyRules {
+		st := policyPathStatus{Index: i, Prefix: rule.Prefix, Auto: rule.AutoPath()}
+		switch {
+		case st.Auto:
+			route, err := autoPaths.peek(g, n.ID, rule)
+			if err != nil {
+				st.Error = err.Error()
+				break
+			}
+			st.Path, st.Cost = route.Hops, route.Cost
+		case len(rule.Path) > 0:
+			st.Path = g.WithRelays(n.ID, rule.Path)
+		case rule.ViaNode != "" && rule.ViaNode != "local" && rule.ViaNode != "main":
+			st.Path = g.WithRelays(n.ID, []string{rule.ViaNode})
+		}
+		if len(st.Path) > 0 {
+			st.Egress = st.Path[len(st.Path)-1]
+			if !st.Auto {
+				cost, ok := g.PathCost(n.ID, st.Path)
+				if !ok {
+					st.Error = "path is not usable: a link is down or not peered"
+				}
+				st.Cost = cost
+			}
+		}
+		out = append(out, st)
+	}
+	return out
+}
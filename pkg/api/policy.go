@@ -3,14 +3,15 @@ package api
 import (
 	"encoding/json"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 
+	"peer-wan/pkg/ipam"
 	"peer-wan/pkg/model"
 	"peer-wan/pkg/store"
+	"peer-wan/pkg/topology"
 )
 
 type PolicyRequest struct {
@@ -20,6 +21,8 @@ type PolicyRequest struct {
 	DefaultRoute        bool               `json:"defaultRoute,omitempty"`
 	BypassCIDRs         []string           `json:"bypassCidrs,omitempty"`
 	DefaultRouteNextHop string             `json:"defaultRouteNextHop,omitempty"`
+	Revision            int64              `json:"revision,omitempty"` // node revision the edit is based on; 0 = apply to latest
+	Force               bool               `json:"force,omitempty"`    // save even if validation finds new errors
 }
 
 func RegisterPolicyRoutes(mux *http.ServeMux, store store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
@@ -44,6 +47,10 @@ func RegisterPolicyRoutes(mux *http.ServeMux, store store.NodeStore, auth func(r
 					if req.PolicyRules[i].ViaNode == "" && len(req.PolicyRules[i].Path) > 0 {
 						req.PolicyRules[i].ViaNode = req.PolicyRules[i].Path[len(req.PolicyRules[i].Path)-1]
 					}
+					if _, err := topology.ParseSelector(req.PolicyRules[i].EgressSelector); err != nil {
+						http.Error(w, "invalid egressSelector: "+err.Error(), http.StatusBadRequest)
+						return
+					}
 					if req.PolicyRules[i].Validate() {
 						valid++
 					}
@@ -53,10 +60,58 @@ func RegisterPolicyRoutes(mux *http.ServeMux, store store.NodeStore, auth func(r
 					return
 				}
 			}
-			if err := store.UpdatePolicy(req.NodeID, req.EgressPeer, req.PolicyRules, req.DefaultRoute, req.BypassCIDRs, req.DefaultRouteNextHop); err != nil {
-				http.Error(w, "failed to update policy", http.StatusInternalServerError)
+			refs := model.Node{EgressPeerID: req.EgressPeer, DefaultRouteNextHop: req.DefaultRouteNextHop, PolicyRules: req.PolicyRules}
+			if missing := unknownEgressGroups(refs, loadSettingsOrDefault(store).EgressGroups); len(missing) > 0 {
+				http.Error(w, "unknown egress group: "+strings.Join(missing, ","), http.StatusBadRequest)
+				return
+			}
+			if bad := ipam.Overlapping(loadSettingsOrDefault(store).IPAM, req.BypassCIDRs); len(bad) > 0 {
+				http.Error(w, "bypassCidrs overlap the overlay pool: "+strings.Join(bad, ","), http.StatusBadRequest)
 				return
 			}
+			if !req.Force {
+				cur, ok, err := store.GetNode(req.NodeID)
+				if err != nil || !ok {
+					http.Error(w, "node not found", http.StatusNotFound)
+					return
+				}
+				cur.EgressPeerID, cur.PolicyRules, cur.DefaultRoute = req.EgressPeer, req.PolicyRules, req.DefaultRoute
+				cur.BypassCIDRs, cur.DefaultRouteNextHop = req.BypassCIDRs, req.DefaultRouteNextHop
+				issues, err := introducedErrors(store, cur)
+				if err != nil {
+					http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+					return
+				}
+				if len(issues) > 0 {
+					writeValidationConflict(w, issues)
+					return
+				}
+			}
+			for attempt := 1; ; attempt++ {
+				rev := req.Revision
+				if rev == 0 {
+					cur, ok, err := store.GetNode(req.NodeID)
+					if err != nil || !ok {
+						http.Error(w, "node not found", http.StatusNotFound)
+						return
+					}
+					rev = cur.Revision
+				}
+				err := store.UpdatePolicy(req.NodeID, req.EgressPeer, req.PolicyRules, req.DefaultRoute, req.BypassCIDRs, req.DefaultRouteNextHop, rev)
+				if err == nil {
+					break
+				}
+				if !isConflict(err) {
+					http.Error(w, "failed to update policy", http.StatusInternalServerError)
+					return
+				}
+				// an explicit revision is a stale edit; without one we only lost a race and retry
+				if req.Revision != 0 || attempt >= maxWriteRetries {
+					current, _, _ := store.GetNode(req.NodeID)
+					writeConflict(w, current)
+					return
+				}
+			}
 			BumpPlanVersion(planVersion)
 			if wsHubGlobal != nil {
 				// create a task to push apply via WS
@@ -77,6 +132,7 @@ func RegisterPolicyRoutes(mux *http.ServeMux, store store.NodeStore, auth func(r
 			if n, ok, _ := store.GetNode(req.NodeID); ok {
 				writeJSON(w, http.StatusOK, map[string]interface{}{
 					"status":              "ok",
+					"revision":            n.Revision,
 					"egressPeerId":        n.EgressPeerID,
 					"policyRules":         n.PolicyRules,
 					"defaultRoute":        n.DefaultRoute,
@@ -97,13 +153,37 @@ func RegisterPolicyRoutes(mux *http.ServeMux, store store.NodeStore, auth func(r
 				http.Error(w, "node not found", http.StatusNotFound)
 				return
 			}
-			writeJSON(w, http.StatusOK, map[string]interface{}{
+			nodes, err := store.ListNodes()
+			if err != nil {
+				http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+				return
+			}
+			hmap := plannedHealth(store, nodes)
+			graph := policyGraph(store, nodes, hmap)
+			active := n
+			for _, p := range plannedNodes(store, nodes, graph) {
+				if p.ID == n.ID {
+					active = p
+					break
+				}
+			}
+			resp := map[string]interface{}{
+				"revision":            n.Revision,
 				"egressPeerId":        n.EgressPeerID,
 				"policyRules":         n.PolicyRules,
+				"paths":               describePolicyPaths(active, graph),
 				"defaultRoute":        n.DefaultRoute,
 				"bypassCidrs":         n.BypassCIDRs,
 				"defaultRouteNextHop": n.DefaultRouteNextHop,
-			})
+			}
+			// egress group references: the member currently active
+			if active.EgressPeerID != n.EgressPeerID {
+				resp["activeEgressPeerId"] = active.EgressPeerID
+			}
+			if active.DefaultRouteNextHop != n.DefaultRouteNextHop {
+				resp["activeDefaultRouteNextHop"] = active.DefaultRouteNextHop
+			}
+			writeJSON(w, http.StatusOK, resp)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -168,18 +248,23 @@ func RegisterPolicyStatusRoutes(mux *http.ServeMux, store store.NodeStore, auth
 				http.Error(w, "nodeId is required", http.StatusBadRequest)
 				return
 			}
-			limit := 20
-			if l := r.URL.Query().Get("limit"); l != "" {
-				if n, err := strconv.Atoi(l); err == nil && n > 0 {
-					limit = n
-				}
+			pq, err := parsePageQuery(r, 20)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			items, err := store.ListPolicyStatus(nodeID, limit)
+			page, more, err := store.QueryPolicyStatus(model.PolicyStatusQuery{
+				NodeID:      nodeID,
+				Status:      r.URL.Query().Get("status"),
+				HistoryPage: pq.history(),
+			})
 			if err != nil {
 				http.Error(w, "failed to list status", http.StatusInternalServerError)
 				return
 			}
-			writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+			next := nextCursor(pq, page, func(l model.PolicyInstallLog) time.Time { return l.Timestamp }, more)
+			setNextCursor(w, next)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"items": page, "nextCursor": next})
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -214,18 +299,19 @@ func RegisterPolicyDiagRoutes(mux *http.ServeMux, store store.NodeStore, auth fu
 				http.Error(w, "nodeId is required", http.StatusBadRequest)
 				return
 			}
-			limit := 10
-			if l := r.URL.Query().Get("limit"); l != "" {
-				if n, err := strconv.Atoi(l); err == nil && n > 0 {
-					limit = n
-				}
+			pq, err := parsePageQuery(r, 10)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			items, err := store.ListPolicyDiag(nodeID, limit)
+			page, more, err := store.QueryPolicyDiag(model.PolicyDiagQuery{NodeID: nodeID, HistoryPage: pq.history()})
 			if err != nil {
 				http.Error(w, "failed to list diag", http.StatusInternalServerError)
 				return
 			}
-			writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+			next := nextCursor(pq, page, func(d model.PolicyDiagReport) time.Time { return d.Timestamp }, more)
+			setNextCursor(w, next)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"items": page, "nextCursor": next})
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -16,8 +16,9 @@ import (
 type PrepareResponse struct {
 	ID             string `json:"id"`
 	PublicKey      string `json:"publicKey"`
-	PrivateKey     string `json:"privateKey"`
+	PrivateKey     string `json:"privateKey,omitempty"` // empty with agent-generated keys
 	OverlayIP      string `json:"overlayIp"`
+	OverlayIP6     string `json:"overlayIp6,omitempty"`
 	ListenPort     int    `json:"listenPort"`
 	ProvisionToken string `json:"provisionToken"`
 	Command        string `json:"command"`
@@ -34,12 +35,23 @@ func RegisterPrepareRoute(mux *http.ServeMux, store store.NodeStore, planVersion
 			return
 		}
 		var req struct {
-			ID string `json:"id"`
+			ID   string `json:"id"`
+			Role   string            `json:"role,omitempty"`   // hub/spoke, used in hub-spoke topology
+			Labels map[string]string `json:"labels,omitempty"` // matched by peering intents
+			Relay  bool              `json:"relay,omitempty"`  // relay-capable node
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
 			http.Error(w, "invalid payload", http.StatusBadRequest)
 			return
 		}
+		if !validRole(req.Role) {
+			http.Error(w, "role must be hub or spoke", http.StatusBadRequest)
+			return
+		}
+		if err := validLabels(req.Labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		addr := controllerAddr
 		if addr == "" {
 			scheme := "http"
@@ -48,31 +60,52 @@ func RegisterPrepareRoute(mux *http.ServeMux, store store.NodeStore, planVersion
 			}
 			addr = fmt.Sprintf("%s://%s", scheme, r.Host)
 		}
+		ipamMu.Lock()
+		defer ipamMu.Unlock()
 		existing, ok, _ := store.GetNode(req.ID)
+		agentKeys := loadSettingsOrDefault(store).NodeKeys.AgentGenerated
 		var node model.Node
 		if ok && existing.ProvisionToken != "" {
 			node = existing
 		} else {
-			priv, err := wgtypes.GeneratePrivateKey()
+			// with agent-generated keys the node stays keyless until its agent registers one
+			var pub, privKey string
+			if !agentKeys {
+				priv, err := wgtypes.GeneratePrivateKey()
+				if err != nil {
+					http.Error(w, "failed to generate key", http.StatusInternalServerError)
+					return
+				}
+				pub, privKey = priv.PublicKey().String(), priv.String()
+			}
+			overlay, err := allocateOverlay(store, req.ID)
 			if err != nil {
-				http.Error(w, "failed to generate key", http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusConflict)
 				return
 			}
-			pub := priv.PublicKey()
-			overlay := assignOverlay(store)
 			token := fmt.Sprintf("pt-%d", time.Now().UnixNano())
 			node = model.Node{
 				ID:             req.ID,
-				PublicKey:      pub.String(),
-				PrivateKey:     priv.String(),
+				PublicKey:      pub,
+				PrivateKey:     privKey,
 				OverlayIP:      overlay,
 				// 默认使用 wg over wss 监听端口
 				ListenPort:     8082,
 				ASN:            65000,
 				RouterID:       ipWithoutMask(overlay),
 				ProvisionToken: token,
+				Role:           req.Role,
+				Labels:         req.Labels,
+				Relay:          req.Relay,
+				Revision:       existing.Revision,
 			}
+			deriveOverlay6(&node, loadSettingsOrDefault(store).IPv6)
 			if _, err := store.UpsertNode(node); err != nil {
+				if isConflict(err) {
+					current, _, _ := store.GetNode(req.ID)
+					writeConflict(w, current)
+					return
+				}
 				http.Error(w, "failed to save node", http.StatusInternalServerError)
 				return
 			}
@@ -83,35 +116,19 @@ func RegisterPrepareRoute(mux *http.ServeMux, store store.NodeStore, planVersion
 		resp := PrepareResponse{
 			ID:             req.ID,
 			PublicKey:      node.PublicKey,
-			PrivateKey:     node.PrivateKey,
 			OverlayIP:      node.OverlayIP,
+			OverlayIP6:     node.OverlayIP6,
 			ListenPort:     node.ListenPort,
 			ProvisionToken: node.ProvisionToken,
 			Command:        cmd,
 		}
+		if !agentKeys {
+			resp.PrivateKey = node.PrivateKey
+		}
 		writeJSON(w, http.StatusOK, resp)
 	})
 }
 
-func assignOverlay(store store.NodeStore) string {
-	nodes, _ := store.ListNodes()
-	used := make(map[int]bool)
-	for _, n := range nodes {
-		ip := ipWithoutMask(n.OverlayIP)
-		var third int
-		if _, err := fmt.Sscanf(ip, "10.10.%d.", &third); err == nil {
-			used[third] = true
-		}
-	}
-	for i := 1; i < 254; i++ {
-		if !used[i] {
-			return fmt.Sprintf("10.10.%d.1/32", i)
-		}
-	}
-	// fallback
-	return "10.10.250.1/32"
-}
-
 func ipWithoutMask(cidr string) string {
 	if idx := strings.Index(cidr, "/"); idx > 0 {
 		return cidr[:idx]
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// RegisterRetentionRoutes exposes the history retention settings enforced by the janitor.
+// POST ?apply=true additionally runs a retention pass immediately.
+func RegisterRetentionRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool) {
+	mux.HandleFunc("/api/v1/settings/retention", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s := loadSettingsOrDefault(st)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"configured": s.Retention,
+				"effective":  store.EffectiveRetention(s.Retention),
+			})
+		case http.MethodPost:
+			// body replaces the retention settings; unset bounds fall back to the defaults
+			var cfg model.RetentionConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := store.ValidateRetention(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			s.Retention = cfg
+			if err := st.UpdateSettings(s); err != nil {
+				http.Error(w, "failed to save settings", http.StatusInternalServerError)
+				return
+			}
+			resp := map[string]interface{}{
+				"configured": s.Retention,
+				"effective":  store.EffectiveRetention(s.Retention),
+			}
+			if r.URL.Query().Get("apply") == "true" {
+				stats, err := st.ApplyRetention(store.EffectiveRetention(s.Retention), time.Now())
+				if err != nil {
+					http.Error(w, "retention failed: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				resp["removed"] = stats
+			}
+			writeJSON(w, http.StatusOK, resp)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// savedRouting is the routing state last written to the store, so unchanged state is
+// not written again on every recompute.
+var savedRouting struct {
+	sync.Mutex
+	data []byte
+}
+
+// routingState collects linkDamping, autoPaths and egressFailovers.
+func routingState() model.RoutingState {
+	links, bgp := linkDamping.State()
+	return model.RoutingState{
+		Links:     links,
+		BGP:       bgp,
+		AutoPaths: autoPaths.state(),
+		Egress:    egressFailovers.state(),
+	}
+}
+
+// saveRoutingState persists the health-driven routing state when it changed since the
+// last save. Plans are only built by the controller holding this state (the leader when
+// replicated), which saves it after every health report and recompute.
+func saveRoutingState(st store.NodeStore) {
+	rs := routingState()
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return
+	}
+	savedRouting.Lock()
+	defer savedRouting.Unlock()
+	if bytes.Equal(data, savedRouting.data) {
+		return
+	}
+	rs.UpdatedAt = time.Now()
+	if err := st.SaveRoutingState(rs); err != nil {
+		log.Printf("save routing state failed: %v", err)
+		return
+	}
+	savedRouting.data = data
+}
+
+// LoadRoutingState replaces the in-memory link damping, auto paths and egress members
+// with the state saved in st. The controller calls it before it starts computing plans:
+// at startup, and on every election it wins, since the state it held as a follower is stale.
+func LoadRoutingState(st store.NodeStore) error {
+	rs, ok, err := st.GetRoutingState()
+	if err != nil || !ok {
+		return err
+	}
+	linkDamping.Restore(rs.Links, rs.BGP)
+	autoPaths.restore(rs.AutoPaths)
+	egressFailovers.restore(rs.Egress)
+	data, err := json.Marshal(routingState())
+	if err != nil {
+		return err
+	}
+	savedRouting.Lock()
+	savedRouting.data = data
+	savedRouting.Unlock()
+	log.Printf("restored routing state from %s: %d links, %d auto paths, %d egress selections",
+		rs.UpdatedAt.Format(time.RFC3339), len(rs.Links), len(rs.AutoPaths), len(rs.Egress))
+	return nil
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/series"
+	"peer-wan/pkg/store"
+)
+
+// seriesSummary is the SLA view of one peer over the requested range.
+type seriesSummary struct {
+	Samples      int     `json:"samples"`
+	Availability float64 `json:"availability"` // 1 - mean loss
+	LossRatio    float64 `json:"lossRatio"`
+	MinMs        float64 `json:"minMs"`
+	AvgMs        float64 `json:"avgMs"`
+	P50Ms        float64 `json:"p50Ms"`
+	P95Ms        float64 `json:"p95Ms"`
+	MaxMs        float64 `json:"maxMs"`
+}
+
+type seriesPeer struct {
+	Peer       string               `json:"peer"`
+	PeerNodeID string               `json:"peerNodeId,omitempty"`
+	Points     []model.HealthBucket `json:"points"`
+	Summary    seriesSummary        `json:"summary"`
+}
+
+// RegisterSeriesRoutes serves the rolled-up latency/loss series:
+//
+//	GET /api/v1/health/series?nodeId=&peer=&step=&from=&to=
+//
+// peer is an overlay IP or node id (repeatable, default all peers), step is auto or a
+// multiple of 1m/5m/1h ("15m", "1d"), from/to accept RFC3339 or a duration ago
+// (default: the last hour).
+func RegisterSeriesRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool) {
+	mux.HandleFunc("/api/v1/health/series", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		nodeID := q.Get("nodeId")
+		if nodeID == "" {
+			http.Error(w, "nodeId is required", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		from, err := parseTimeParam(q.Get("from"))
+		if err != nil {
+			http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeParam(q.Get("to"))
+		if err != nil {
+			http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to.IsZero() {
+			to = now
+		}
+		if from.IsZero() {
+			from = to.Add(-time.Hour)
+		}
+		nodes, err := st.ListNodes()
+		if err != nil {
+			http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+			return
+		}
+		// series are keyed by the probed overlay IP; map both ways for node ids
+		ipToNode := map[string]string{}
+		nodeToIP := map[string]string{}
+		for _, n := range nodes {
+			if ip := ipWithoutMask(n.OverlayIP); ip != "" {
+				ipToNode[ip] = n.ID
+				nodeToIP[n.ID] = ip
+			}
+		}
+		var peers []string
+		for _, p := range q["peer"] {
+			for _, p := range strings.Split(p, ",") {
+				p = strings.TrimSpace(p)
+				if p == "" {
+					continue
+				}
+				if net.ParseIP(p) == nil {
+					ip, ok := nodeToIP[p]
+					if !ok {
+						http.Error(w, "unknown peer "+p, http.StatusBadRequest)
+						return
+					}
+					p = ip
+				}
+				peers = append(peers, p)
+			}
+		}
+		settings := loadSettingsOrDefault(st)
+		step, list, err := series.Fetch(st, series.Query{NodeID: nodeID, Peers: peers, Step: q.Get("step"), From: from, To: to},
+			store.EffectiveRetention(settings.Retention), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := make([]seriesPeer, 0, len(list))
+		for _, s := range list {
+			out = append(out, seriesPeer{
+				Peer:       s.Peer,
+				PeerNodeID: ipToNode[s.Peer],
+				Points:     s.Points,
+				Summary: seriesSummary{
+					Samples:      s.Summary.Samples,
+					Availability: 1 - s.Summary.LossRatio,
+					LossRatio:    s.Summary.LossRatio,
+					MinMs:        s.Summary.MinMs,
+					AvgMs:        s.Summary.AvgMs,
+					P50Ms:        s.Summary.P50Ms,
+					P95Ms:        s.Summary.P95Ms,
+					MaxMs:        s.Summary.MaxMs,
+				},
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"nodeId": nodeID,
+			"step":   step,
+			"from":   from,
+			"to":     to,
+			"series": out,
+		})
+	})
+}
@@ -2,14 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"peer-wan/pkg/damping"
 	"peer-wan/pkg/model"
 	"peer-wan/pkg/store"
+	"peer-wan/pkg/topology"
 )
 
 // GeoLocation carries best-effort IP geolocation.
@@ -36,6 +39,12 @@ type LinkStatus struct {
 	PacketLoss float64 `json:"packetLoss,omitempty"`
 	ProbeIP    string  `json:"probeIp,omitempty"`
 	Reason     string  `json:"reason,omitempty"`
+	Relay      string  `json:"relay,omitempty"` // node relaying the link when neither end has an endpoint
+	State      string  `json:"state,omitempty"` // damped state plans use (see /api/v1/status/links)
+
+	// from the WireGuard telemetry of either end
+	StaleHandshake   bool   `json:"staleHandshake,omitempty"`
+	EndpointMismatch string `json:"endpointMismatch,omitempty"` // "<node> sees <peer> at <endpoint>", not a planned endpoint
 }
 
 type MeshStatusResponse struct {
@@ -59,9 +68,21 @@ func RegisterStatusRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *h
 
 		resp := MeshStatusResponse{
 			Nodes:           buildNodeStatuses(nodes),
-			Links:           buildLinkStatuses(nodes, health),
+			Links:           buildLinkStatuses(nodes, health, topologyOptions(st)),
 			PingIntervalSec: diagIntervalSeconds(st),
 		}
+		damped := map[string]string{}
+		for _, l := range linkDamping.Links(loadSettingsOrDefault(st).Damping) {
+			damped[l.ID] = l.State
+		}
+		for i, l := range resp.Links {
+			// prefer the probe of the first end, like the telemetry above
+			if state := damped[damping.LinkID(l.From, l.To)]; state != "" {
+				resp.Links[i].State = state
+			} else {
+				resp.Links[i].State = damped[damping.LinkID(l.To, l.From)]
+			}
+		}
 		writeJSON(w, http.StatusOK, resp)
 	})
 }
@@ -78,23 +99,34 @@ func buildNodeStatuses(nodes []model.Node) []NodeStatus {
 	return out
 }
 
-func buildLinkStatuses(nodes []model.Node, health []model.HealthReport) []LinkStatus {
+// buildLinkStatuses reports every pair of nodes that peer directly under opts.
+func buildLinkStatuses(nodes []model.Node, health []model.HealthReport, opts topology.Options) []LinkStatus {
 	healthMap := map[string]model.HealthReport{}
 	for _, h := range health {
 		healthMap[h.NodeID] = h
 	}
+	opts = opts.Resolve(nodes, healthMap)
 	var links []LinkStatus
 	for i := 0; i < len(nodes); i++ {
 		for j := i + 1; j < len(nodes); j++ {
 			a := nodes[i]
 			b := nodes[j]
+			if !opts.Adjacent(a, b) {
+				continue
+			}
 			from, to := a.ID, b.ID
 			status := LinkStatus{From: from, To: to}
 			aip := ipWithoutMask(a.OverlayIP)
 			bip := ipWithoutMask(b.OverlayIP)
-			if len(a.Endpoints) == 0 || len(b.Endpoints) == 0 {
-				status.OK = false
-				status.Reason = "missing endpoint"
+			// one endpoint is enough: the other side dials it
+			if topology.NeedsRelay(a, b, healthMap) {
+				status.Relay = topology.PickRelay(a, b, nodes, healthMap, opts)
+				if status.Relay == "" {
+					status.Reason = "missing endpoint, no relay available"
+				} else {
+					status.OK = true
+					status.Reason = "relayed via " + status.Relay
+				}
 				links = append(links, status)
 				continue
 			}
@@ -130,12 +162,36 @@ func buildLinkStatuses(nodes []model.Node, health []model.HealthReport) []LinkSt
 				status.OK = false
 				status.Reason = "no telemetry"
 			}
+			applyWireGuardChecks(&status, a, b, healthMap)
 			links = append(links, status)
 		}
 	}
 	return links
 }
 
+// applyWireGuardChecks flags the link from both ends' WireGuard telemetry: a stale
+// handshake takes it down, a live endpoint outside the plan is reported alongside.
+func applyWireGuardChecks(status *LinkStatus, a, b model.Node, healthMap map[string]model.HealthReport) {
+	for _, end := range [][2]model.Node{{a, b}, {b, a}} {
+		self, peer := end[0], end[1]
+		h, ok := healthMap[self.ID]
+		if !ok {
+			continue
+		}
+		c := checkWireGuardPeer(h, peer.ID, plannedEndpoints(self, peer))
+		if c.Stale && !status.StaleHandshake {
+			status.StaleHandshake = true
+			if status.OK || status.Reason == "no telemetry" {
+				status.Reason = c.staleReason()
+			}
+			status.OK = false
+		}
+		if c.Mismatch != "" && status.EndpointMismatch == "" {
+			status.EndpointMismatch = fmt.Sprintf("%s sees %s at %s", self.ID, peer.ID, c.Mismatch)
+		}
+	}
+}
+
 // --- Geo lookup with simple in-memory cache ---
 
 var (
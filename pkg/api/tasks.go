@@ -67,13 +67,25 @@ func RegisterTaskRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *htt
 			}
 			writeJSON(w, http.StatusOK, task)
 		case http.MethodGet:
-			nodeID := r.URL.Query().Get("nodeId")
-			items, err := st.ListTasks(nodeID, 50)
+			pq, err := parsePageQuery(r, 50)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			q := r.URL.Query()
+			page, more, err := st.QueryTasks(model.TaskQuery{
+				NodeID:      q.Get("nodeId"),
+				Type:        q.Get("type"),
+				Status:      q.Get("status"),
+				HistoryPage: pq.history(),
+			})
 			if err != nil {
 				http.Error(w, "failed to list", http.StatusInternalServerError)
 				return
 			}
-			writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+			next := nextCursor(pq, page, func(t model.Task) time.Time { return t.CreatedAt }, more)
+			setNextCursor(w, next)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"items": page, "nextCursor": next})
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net/http"
 	"os"
 )
 
@@ -31,3 +32,34 @@ func ServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
 	}
 	return cfg, nil
 }
+
+// ForwardTransport is the transport followers use to reach the leader when replicas serve
+// TLS: it presents the replica's own certificate (for --client-ca deployments) and trusts
+// the system roots plus clientCA.
+func ForwardTransport(certFile, keyFile, clientCA string) (http.RoundTripper, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load cert/key: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		caData, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("invalid client ca")
+		}
+		cfg.RootCAs = pool
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return t, nil
+}
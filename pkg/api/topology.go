@@ -0,0 +1,349 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/topology"
+)
+
+// topologyResponse is the topology setting plus the resulting role of every node.
+type topologyResponse struct {
+	Mode    string                `json:"mode"`
+	Hubs    []string              `json:"hubs,omitempty"`
+	Spokes  []string              `json:"spokes,omitempty"`
+	Intents []model.PeeringIntent `json:"intents,omitempty"`
+}
+
+// topologyLink is one undirected adjacency, From < To.
+type topologyLink struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// topologyPreview is the adjacency a topology config would produce, compared with the
+// one currently applied.
+type topologyPreview struct {
+	Mode     string         `json:"mode"`
+	Nodes    []string       `json:"nodes"`
+	Matrix   [][]int        `json:"matrix"` // Matrix[i][j] = 1 when Nodes[i] and Nodes[j] peer
+	Links    []topologyLink `json:"links"`
+	Added    []topologyLink `json:"added,omitempty"`
+	Removed  []topologyLink `json:"removed,omitempty"`
+	Isolated []string       `json:"isolated,omitempty"` // nodes left without any peer
+}
+
+func validRole(role string) bool {
+	return role == "" || role == model.RoleHub || role == model.RoleSpoke
+}
+
+// validLabels rejects label keys that cannot be expressed in a selector.
+func validLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, ",=! ") || strings.ContainsAny(v, ",=!") {
+			return fmt.Errorf("invalid label %q=%q", k, v)
+		}
+	}
+	return nil
+}
+
+func validMode(mode string) bool {
+	return mode == model.TopologyMesh || mode == model.TopologyHubSpoke || mode == model.TopologyIntent
+}
+
+// RegisterTopologyRoutes exposes the topology mode, the peering intents and a preview of the
+// adjacency they produce. Changes that affect the applied topology recompute every plan;
+// node roles and labels are set through /api/v1/nodes/register or /api/v1/nodes/prepare.
+func RegisterTopologyRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool, planVersion *int64) {
+	mux.HandleFunc("/api/v1/settings/topology", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, describeTopology(st))
+		case http.MethodPost:
+			// body {"mode":...}; intents are only replaced when the body carries them
+			var cfg struct {
+				Mode    string                 `json:"mode"`
+				Intents *[]model.PeeringIntent `json:"intents"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if cfg.Mode == "" {
+				cfg.Mode = model.TopologyMesh
+			}
+			if !validMode(cfg.Mode) {
+				http.Error(w, "mode must be mesh, hub-spoke or intent", http.StatusBadRequest)
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			s.Topology.Mode = cfg.Mode
+			if cfg.Intents != nil {
+				if err := topology.ValidateIntents(*cfg.Intents); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				s.Topology.Intents = *cfg.Intents
+			}
+			if !saveTopology(w, st, s, true, planVersion) {
+				return
+			}
+			writeJSON(w, http.StatusOK, describeTopology(st))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// intents collection: GET lists, POST creates (id required, unique)
+	mux.HandleFunc("/api/v1/topology/intents", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			intents := loadSettingsOrDefault(st).Topology.Intents
+			if intents == nil {
+				intents = []model.PeeringIntent{}
+			}
+			writeJSON(w, http.StatusOK, intents)
+		case http.MethodPost:
+			var in model.PeeringIntent
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			s := loadSettingsOrDefault(st)
+			for _, cur := range s.Topology.Intents {
+				if cur.ID == in.ID {
+					http.Error(w, "intent "+in.ID+" already exists", http.StatusConflict)
+					return
+				}
+			}
+			intents := append(append([]model.PeeringIntent{}, s.Topology.Intents...), in)
+			if err := topology.ValidateIntents(intents); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.Topology.Intents = intents
+			if !saveTopology(w, st, s, s.Topology.Mode == model.TopologyIntent, planVersion) {
+				return
+			}
+			writeJSON(w, http.StatusCreated, in)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// single intent: GET, PUT (replace), DELETE
+	mux.HandleFunc("/api/v1/topology/intents/", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/topology/intents/"), "/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		s := loadSettingsOrDefault(st)
+		idx := -1
+		for i, cur := range s.Topology.Intents {
+			if cur.ID == id {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			http.Error(w, "intent not found", http.StatusNotFound)
+			return
+		}
+		intents := append([]model.PeeringIntent{}, s.Topology.Intents...)
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, intents[idx])
+			return
+		case http.MethodPut:
+			var in model.PeeringIntent
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			in.ID = id
+			intents[idx] = in
+		case http.MethodDelete:
+			intents = append(intents[:idx], intents[idx+1:]...)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := topology.ValidateIntents(intents); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Topology.Intents = intents
+		if !saveTopology(w, st, s, s.Topology.Mode == model.TopologyIntent, planVersion) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "id": id})
+			return
+		}
+		writeJSON(w, http.StatusOK, intents[idx])
+	})
+
+	// preview: GET evaluates the stored config, POST a candidate {"mode","intents"} without saving
+	mux.HandleFunc("/api/v1/topology/preview", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		current := loadSettingsOrDefault(st).Topology
+		candidate := current
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&candidate); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if candidate.Mode == "" {
+				candidate.Mode = model.TopologyIntent
+			}
+			if !validMode(candidate.Mode) {
+				http.Error(w, "mode must be mesh, hub-spoke or intent", http.StatusBadRequest)
+				return
+			}
+			if err := topology.ValidateIntents(candidate.Intents); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nodes, err := st.ListNodes()
+		if err != nil {
+			http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+			return
+		}
+		hmap := plannedHealth(st, nodes)
+		writeJSON(w, http.StatusOK, previewTopology(nodes, hmap, current, candidate))
+	})
+}
+
+// saveTopology persists s and, when the applied topology changed, recomputes every plan.
+// It writes the error response itself and reports whether the caller may continue.
+func saveTopology(w http.ResponseWriter, st store.NodeStore, s model.Settings, recompute bool, planVersion *int64) bool {
+	if err := st.UpdateSettings(s); err != nil {
+		http.Error(w, "failed to save settings", http.StatusInternalServerError)
+		return false
+	}
+	if !recompute {
+		return true
+	}
+	if err := RecomputeAllPlans(st, planVersion); err != nil {
+		log.Printf("recompute plans failed after topology change: %v", err)
+	} else {
+		BumpPlanVersion(planVersion)
+	}
+	return true
+}
+
+// previewTopology evaluates candidate over the plannable nodes and diffs it against current.
+func previewTopology(nodes []model.Node, health map[string]model.HealthReport, current, candidate model.TopologyConfig) topologyPreview {
+	var planned []model.Node
+	for _, n := range nodes {
+		if len(n.CIDRs) > 0 && n.PublicKey != "" {
+			planned = append(planned, n)
+		}
+	}
+	sort.Slice(planned, func(i, j int) bool { return planned[i].ID < planned[j].ID })
+	links := func(cfg model.TopologyConfig) map[topologyLink]bool {
+		opts := topology.FromSettings(model.Settings{Topology: cfg}).Resolve(planned, health)
+		out := map[topologyLink]bool{}
+		for i := range planned {
+			for j := i + 1; j < len(planned); j++ {
+				if opts.Adjacent(planned[i], planned[j]) {
+					out[topologyLink{From: planned[i].ID, To: planned[j].ID}] = true
+				}
+			}
+		}
+		return out
+	}
+	next, prev := links(candidate), links(current)
+	resp := topologyPreview{Mode: candidate.Mode, Links: []topologyLink{}}
+	if resp.Mode == "" {
+		resp.Mode = model.TopologyMesh
+	}
+	index := map[string]int{}
+	for i, n := range planned {
+		resp.Nodes = append(resp.Nodes, n.ID)
+		index[n.ID] = i
+	}
+	resp.Matrix = make([][]int, len(planned))
+	for i := range resp.Matrix {
+		resp.Matrix[i] = make([]int, len(planned))
+	}
+	for l := range next {
+		i, j := index[l.From], index[l.To]
+		resp.Matrix[i][j], resp.Matrix[j][i] = 1, 1
+		resp.Links = append(resp.Links, l)
+		if !prev[l] {
+			resp.Added = append(resp.Added, l)
+		}
+	}
+	for l := range prev {
+		if !next[l] {
+			resp.Removed = append(resp.Removed, l)
+		}
+	}
+	for i, row := range resp.Matrix {
+		degree := 0
+		for _, v := range row {
+			degree += v
+		}
+		if degree == 0 {
+			resp.Isolated = append(resp.Isolated, resp.Nodes[i])
+		}
+	}
+	for _, list := range [][]topologyLink{resp.Links, resp.Added, resp.Removed} {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].From != list[j].From {
+				return list[i].From < list[j].From
+			}
+			return list[i].To < list[j].To
+		})
+	}
+	return resp
+}
+
+func describeTopology(st store.NodeStore) topologyResponse {
+	opts := topologyOptions(st)
+	resp := topologyResponse{Mode: opts.Mode, Intents: opts.Intents}
+	if resp.Mode == "" {
+		resp.Mode = model.TopologyMesh
+	}
+	nodes, _ := st.ListNodes()
+	for _, n := range nodes {
+		switch opts.Role(n) {
+		case model.RoleHub:
+			resp.Hubs = append(resp.Hubs, n.ID)
+		case model.RoleSpoke:
+			resp.Spokes = append(resp.Spokes, n.ID)
+		}
+	}
+	sort.Strings(resp.Hubs)
+	sort.Strings(resp.Spokes)
+	return resp
+}
@@ -12,10 +12,16 @@ type NodeRegistrationRequest struct {
 	Force          bool              `json:"force,omitempty"`          // force refresh even if unchanged
 	ListenPort     int               `json:"listenPort,omitempty"`     // WireGuard listen port
 	OverlayIP      string            `json:"overlayIp,omitempty"`      // WireGuard interface address (/32 recommended)
+	OverlayIP6     string            `json:"overlayIp6,omitempty"`     // optional IPv6 interface address (/128); derived when dual-stack is enabled
 	ASN            int               `json:"asn,omitempty"`            // optional BGP ASN
 	RouterID       string            `json:"routerId,omitempty"`       // optional BGP router-id (defaults to overlay IP)
 	ProvisionToken string            `json:"provisionToken,omitempty"` // one-time token from controller
 	PeerEndpoints  map[string]string `json:"peerEndpoints,omitempty"`  // per-peer endpoint override
+	Revision       int64             `json:"revision,omitempty"`       // expected node revision for UI/API edits; 0 = merge onto latest
+	Role           string            `json:"role,omitempty"`           // hub/spoke for hub-spoke topology; empty keeps the current role
+	Labels         map[string]string `json:"labels,omitempty"`         // node labels for peering intents; omitted keeps the current labels
+	Relay          *bool             `json:"relay,omitempty"`          // relay-capable node; omitted keeps the current flag
+	KeyProof       string            `json:"keyProof,omitempty"`       // wireguard.KeyProof for PublicKey: the agent holds the private key
 }
 
 // NodeConfigResponse carries the config the agent should apply.
@@ -25,6 +31,9 @@ type NodeConfigResponse struct {
 	WireGuardPeers      []model.Peer       `json:"wireGuardPeers"`
 	Routes              []string           `json:"routes"`
 	OverlayIP           string             `json:"overlayIp,omitempty"`
+	OverlayIP6          string             `json:"overlayIp6,omitempty"`
+	OverlayPools        []string           `json:"overlayPools,omitempty"` // IPv4 overlay pools; agents scope NAT to them
+	OverlayPool6        string             `json:"overlayPool6,omitempty"` // IPv6 overlay prefix when dual-stack is enabled
 	ListenPort          int                `json:"listenPort,omitempty"`
 	ASN                 int                `json:"asn,omitempty"`
 	RouterID            string             `json:"routerId,omitempty"`
@@ -40,4 +49,6 @@ type NodeConfigResponse struct {
 	BypassCIDRs         []string           `json:"bypassCidrs,omitempty"`
 	DefaultRouteNextHop string             `json:"defaultRouteNextHop,omitempty"`
 	HealthIntervalSec   int                `json:"healthIntervalSec,omitempty"`
+	Relay               bool               `json:"relay,omitempty"`       // forward traffic between peers that are relayed through this node
+	KeyRotation         *model.KeyRotation `json:"keyRotation,omitempty"` // key rotation the agent takes part in; absent once it finished
 }
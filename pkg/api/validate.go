@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/validate"
+)
+
+// validateNodes runs the validation engine over nodes with the current health and
+// topology, resolving egress groups and expanding policy rules the way plans do.
+func validateNodes(st store.NodeStore, nodes []model.Node) validate.Report {
+	hmap := plannedHealth(st, nodes)
+	graph := policyGraph(st, nodes, hmap)
+	nodes = plannedNodes(st, nodes, graph)
+	return validate.Run(validate.Input{
+		Nodes:   nodes,
+		Health:  hmap,
+		Options: topologyOptions(st),
+		Rules:   previewPolicyRules(nodes, graph),
+	})
+}
+
+// introducedErrors validates the stored nodes with candidate in place of (or added to) its
+// stored record and returns the errors that the current state does not already have, so an
+// edit is only refused for problems it causes.
+func introducedErrors(st store.NodeStore, candidate model.Node) ([]validate.Issue, error) {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	before := map[string]bool{}
+	for _, is := range validateNodes(st, nodes).Issues {
+		before[is.Key()] = true
+	}
+	next := make([]model.Node, 0, len(nodes)+1)
+	replaced := false
+	for _, n := range nodes {
+		if n.ID == candidate.ID {
+			n, replaced = candidate, true
+		}
+		next = append(next, n)
+	}
+	if !replaced {
+		next = append(next, candidate)
+	}
+	var out []validate.Issue
+	for _, is := range validateNodes(st, next).Issues {
+		if is.Severity == validate.SeverityError && !before[is.Key()] {
+			out = append(out, is)
+		}
+	}
+	return out, nil
+}
+
+// writeValidationConflict refuses an edit that would introduce validation errors.
+func writeValidationConflict(w http.ResponseWriter, issues []validate.Issue) {
+	writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "change fails validation", "issues": issues})
+}
+
+// RegisterValidateRoutes exposes the validation engine: overlapping sites, AllowedIPs
+// collisions, broken policy references, routing loops and shadowed rules.
+func RegisterValidateRoutes(mux *http.ServeMux, st store.NodeStore, auth func(r *http.Request) bool) {
+	mux.HandleFunc("/api/v1/validate", func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nodes, err := st.ListNodes()
+		if err != nil {
+			http.Error(w, "failed to list nodes", http.StatusInternalServerError)
+			return
+		}
+		rep := validateNodes(st, nodes)
+		if nodeID := r.URL.Query().Get("nodeId"); nodeID != "" {
+			// narrow to the issues concerning one node
+			filtered := validate.Report{Issues: []validate.Issue{}}
+			for _, is := range rep.Issues {
+				if !is.Involves(nodeID) {
+					continue
+				}
+				filtered.Issues = append(filtered.Issues, is)
+				if is.Severity == validate.SeverityError {
+					filtered.Errors++
+				} else {
+					filtered.Warnings++
+				}
+			}
+			filtered.Valid = filtered.Errors == 0
+			rep = filtered
+		}
+		writeJSON(w, http.StatusOK, rep)
+	})
+}
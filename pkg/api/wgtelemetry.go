@@ -0,0 +1,87 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// wgHandshakeStale is how old the latest handshake of a peer may be when a node reports
+// it. Agents ping every peer right before reading the interface, and WireGuard drops a
+// session 180s after its last handshake, so an older one means the tunnel is down.
+const wgHandshakeStale = 180 * time.Second
+
+// wgPeerCheck is what a node's WireGuard telemetry says about one of its peers.
+type wgPeerCheck struct {
+	Reported  bool          // the node reported runtime state for the peer
+	Stale     bool          // no handshake, or one older than wgHandshakeStale
+	Handshake time.Duration // age of the latest handshake, 0 when there was none
+	Mismatch  string        // live endpoint that is none of the planned ones
+}
+
+// checkWireGuardPeer inspects h's telemetry for peerID against the endpoints the plan
+// gives for it. Loopback endpoints (wstunnel) and hostnames are not compared.
+func checkWireGuardPeer(h model.HealthReport, peerID string, planned []string) wgPeerCheck {
+	stats, ok := h.WireGuard[peerID]
+	if !ok {
+		return wgPeerCheck{}
+	}
+	c := wgPeerCheck{Reported: true, Stale: true}
+	if !stats.LastHandshake.IsZero() {
+		c.Handshake = h.Timestamp.Sub(stats.LastHandshake).Round(time.Second)
+		c.Stale = c.Handshake > wgHandshakeStale
+	}
+	if stats.Endpoint != "" && !endpointPlanned(stats.Endpoint, planned) {
+		c.Mismatch = stats.Endpoint
+	}
+	return c
+}
+
+// staleReason describes a stale handshake for link status reasons.
+func (c wgPeerCheck) staleReason() string {
+	if c.Handshake == 0 {
+		return "no wireguard handshake"
+	}
+	return fmt.Sprintf("last wireguard handshake %s ago", c.Handshake)
+}
+
+func endpointPlanned(live string, planned []string) bool {
+	host, port, err := net.SplitHostPort(live)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+	compared := false
+	for _, ep := range planned {
+		h, p, err := net.SplitHostPort(ep)
+		if err != nil {
+			continue
+		}
+		compared = true
+		pip := net.ParseIP(h)
+		if pip == nil {
+			// a hostname: the controller cannot tell what the agent resolved it to
+			return true
+		}
+		if pip.Equal(ip) && p == port {
+			return true
+		}
+	}
+	// nothing planned: the peer dials in from wherever it is
+	return !compared
+}
+
+// plannedEndpoints lists the endpoints self may use to reach peer: the peer's candidates
+// and a per-peer override on self.
+func plannedEndpoints(self, peer model.Node) []string {
+	out := append([]string(nil), peer.Endpoints...)
+	if ep := self.PeerEndpoints[peer.ID]; ep != "" {
+		out = append(out, ep)
+	}
+	return out
+}
@@ -83,6 +83,13 @@ func (h *WSHub) Send(nodeID string, msg WSMessage) {
 	}
 }
 
+// Connected reports whether the agent of nodeID currently holds a WS connection.
+func (h *WSHub) Connected(nodeID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.agents[nodeID] != nil
+}
+
 func (h *WSHub) readLoop(nodeID string, c *websocket.Conn) {
 	defer func() {
 		c.Close()
@@ -0,0 +1,146 @@
+//go:build consul
+
+package consul_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKV is an in-process stand-in for the parts of the Consul HTTP API the store uses:
+// KV get/list/keys, put with check-and-set, delete (recursive) and the leader status.
+// Blocking queries return immediately.
+type fakeKV struct {
+	mu    sync.Mutex
+	index uint64
+	data  map[string]*fakePair
+}
+
+type fakePair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+}
+
+// newFakeConsul starts a fake Consul agent and returns its address.
+func newFakeConsul(t *testing.T) string {
+	f := &fakeKV{data: map[string]*fakePair{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", f.serveKV)
+	mux.HandleFunc("/v1/status/leader", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `"127.0.0.1:8300"`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func (f *fakeKV) serveKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index+1, 10))
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := q["keys"]; ok {
+			sep := q.Get("separator")
+			seen := map[string]bool{}
+			var keys []string
+			for _, k := range f.sortedKeys(key) {
+				if sep != "" {
+					if i := strings.Index(k[len(key):], sep); i >= 0 {
+						k = k[:len(key)+i+len(sep)]
+					}
+				}
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+			if len(keys) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+		var out []*fakePair
+		if _, ok := q["recurse"]; ok {
+			for _, k := range f.sortedKeys(key) {
+				out = append(out, f.data[k])
+			}
+		} else if p, ok := f.data[key]; ok {
+			out = append(out, p)
+		}
+		if len(out) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		existing := f.data[key]
+		if cas := q.Get("cas"); cas != "" {
+			want, _ := strconv.ParseUint(cas, 10, 64)
+			if (want == 0 && existing != nil) || (want != 0 && (existing == nil || existing.ModifyIndex != want)) {
+				io.WriteString(w, "false")
+				return
+			}
+		}
+		f.index++
+		p := &fakePair{Key: key, Value: body, CreateIndex: f.index, ModifyIndex: f.index}
+		if existing != nil {
+			p.CreateIndex = existing.CreateIndex
+		}
+		f.data[key] = p
+		io.WriteString(w, "true")
+	case http.MethodDelete:
+		if _, ok := q["recurse"]; ok {
+			for _, k := range f.sortedKeys(key) {
+				delete(f.data, k)
+			}
+		} else {
+			if cas := q.Get("cas"); cas != "" {
+				want, _ := strconv.ParseUint(cas, 10, 64)
+				if p, ok := f.data[key]; !ok || p.ModifyIndex != want {
+					io.WriteString(w, "false")
+					return
+				}
+			}
+			delete(f.data, key)
+		}
+		f.index++
+		io.WriteString(w, "true")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeKV) sortedKeys(prefix string) []string {
+	var keys []string
+	for k := range f.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,316 @@
+//go:build consul
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"peer-wan/pkg/model"
+)
+
+// timeIndex orders a collection whose keys do not sort by time. Index keys
+// <index><group>/<ns, 20 digits>-<id> with empty values point at <data><group>/<id>;
+// flat collections use the empty group and drop the slash. Paging walks the index
+// instead of reading every entry.
+type timeIndex struct {
+	index string
+	data  string
+	ts    func([]byte) time.Time // creation time of a data value, for backfilling
+}
+
+var (
+	taskIndex = timeIndex{index: "peer-wan/task-index/", data: taskPref, ts: func(b []byte) time.Time {
+		var t model.Task
+		_ = json.Unmarshal(b, &t)
+		return t.CreatedAt
+	}}
+	planIndex = timeIndex{index: "peer-wan/plan-index/", data: planPrefix, ts: func(b []byte) time.Time {
+		var p model.Plan
+		_ = json.Unmarshal(b, &p)
+		return p.CreatedAt
+	}}
+)
+
+func groupPrefix(group string) string {
+	if group == "" {
+		return ""
+	}
+	return group + "/"
+}
+
+func (x timeIndex) key(group string, ts time.Time, id string) string {
+	return fmt.Sprintf("%s%s%020d-%s", x.index, groupPrefix(group), ts.UnixNano(), id)
+}
+
+// parse splits an index key into the data key it points at and its time.
+func (x timeIndex) parse(key string) (string, time.Time, bool) {
+	rest := strings.TrimPrefix(key, x.index)
+	group := ""
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		group, rest = rest[:i], rest[i+1:]
+	}
+	ns, id, ok := splitTimeKey(rest, "")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	return x.data + groupPrefix(group) + id, time.Unix(0, ns), true
+}
+
+// entries lists a group's index as data keys with their times.
+func (x timeIndex) entries(s *Store, group string) ([]kvEntry, error) {
+	keys, _, err := s.cli.KV().Keys(x.index+groupPrefix(group), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var out []kvEntry
+	for _, k := range keys {
+		if dataKey, ts, ok := x.parse(k); ok {
+			out = append(out, kvEntry{key: dataKey, ts: ts})
+		}
+	}
+	return out, nil
+}
+
+// ensure indexes a group's entries saved before the index existed, once per Store.
+func (x timeIndex) ensure(s *Store, group string) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	done := x.index + groupPrefix(group)
+	if s.indexed[done] {
+		return nil
+	}
+	entries, err := x.entries(s, group)
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		indexed[e.key] = true
+	}
+	keys, _, err := s.cli.KV().Keys(x.data+groupPrefix(group), "", nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		id := strings.TrimPrefix(k, x.data+groupPrefix(group))
+		if indexed[k] || strings.Contains(id, "/") {
+			continue
+		}
+		kv, _, err := s.cli.KV().Get(k, nil)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			continue
+		}
+		if _, err := s.cli.KV().Put(&consulapi.KVPair{Key: x.key(group, x.ts(kv.Value), id)}, nil); err != nil {
+			return err
+		}
+	}
+	if s.indexed == nil {
+		s.indexed = map[string]bool{}
+	}
+	s.indexed[done] = true
+	return nil
+}
+
+// prune drops index keys whose entry is gone.
+func (x timeIndex) prune(s *Store) error {
+	keys, _, err := s.cli.KV().Keys(x.index, "", nil)
+	if err != nil {
+		return err
+	}
+	data, _, err := s.cli.KV().Keys(x.data, "", nil)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool, len(data))
+	for _, k := range data {
+		live[k] = true
+	}
+	for _, k := range keys {
+		if dataKey, _, ok := x.parse(k); ok && live[dataKey] {
+			continue
+		}
+		if _, err := s.cli.KV().Delete(k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryAudit pages audit keys by the timestamp they start with and reads only the values
+// of candidates, newest first, until the page is full.
+func (s *Store) QueryAudit(q model.AuditQuery) ([]model.AuditEntry, bool, error) {
+	if s.cli == nil {
+		return nil, false, fmt.Errorf("consul client not configured")
+	}
+	keys, _, err := s.cli.KV().Keys(auditPrefix, "", nil)
+	if err != nil {
+		return nil, false, err
+	}
+	var entries []kvEntry
+	for _, k := range keys {
+		ns, target, ok := splitTimeKey(k, auditPrefix)
+		if !ok || (q.Target != "" && target != q.Target) {
+			continue
+		}
+		entries = append(entries, kvEntry{key: k, ts: time.Unix(0, ns)})
+	}
+	return readPage(s, entries, q.HistoryPage, func(_ kvEntry, b []byte) (model.AuditEntry, bool) {
+		var e model.AuditEntry
+		return e, json.Unmarshal(b, &e) == nil && q.Match(e)
+	})
+}
+
+// QueryTasks pages the task index and reads only the tasks it needs.
+func (s *Store) QueryTasks(q model.TaskQuery) ([]model.Task, bool, error) {
+	if s.cli == nil {
+		return nil, false, fmt.Errorf("consul client not configured")
+	}
+	if err := taskIndex.ensure(s, ""); err != nil {
+		return nil, false, err
+	}
+	entries, err := taskIndex.entries(s, "")
+	if err != nil {
+		return nil, false, err
+	}
+	return readPage(s, entries, q.HistoryPage, func(e kvEntry, b []byte) (model.Task, bool) {
+		var t model.Task
+		if json.Unmarshal(b, &t) != nil {
+			return t, false
+		}
+		// skip an index key left behind by a task re-saved with another CreatedAt
+		return t, t.CreatedAt.Equal(e.ts) && q.Match(t)
+	})
+}
+
+// QueryPlanHistory pages the node's plan index; history keys are plan versions.
+func (s *Store) QueryPlanHistory(q model.PlanHistoryQuery) ([]model.Plan, bool, error) {
+	if s.cli == nil {
+		return nil, false, fmt.Errorf("consul client not configured")
+	}
+	if err := planIndex.ensure(s, q.NodeID); err != nil {
+		return nil, false, err
+	}
+	entries, err := planIndex.entries(s, q.NodeID)
+	if err != nil {
+		return nil, false, err
+	}
+	return readPage(s, entries, q.HistoryPage, func(e kvEntry, b []byte) (model.Plan, bool) {
+		var p model.Plan
+		return p, json.Unmarshal(b, &p) == nil && p.CreatedAt.Equal(e.ts)
+	})
+}
+
+// QueryPolicyStatus pages the node's install logs, whose keys end in their timestamp.
+func (s *Store) QueryPolicyStatus(q model.PolicyStatusQuery) ([]model.PolicyInstallLog, bool, error) {
+	if s.cli == nil {
+		return nil, false, fmt.Errorf("consul client not configured")
+	}
+	entries, err := timeKeyed(s, policyStatusPref+q.NodeID+"/")
+	if err != nil {
+		return nil, false, err
+	}
+	return readPage(s, entries, q.HistoryPage, func(_ kvEntry, b []byte) (model.PolicyInstallLog, bool) {
+		var l model.PolicyInstallLog
+		return l, json.Unmarshal(b, &l) == nil && q.Match(l)
+	})
+}
+
+// QueryPolicyDiag pages the node's diagnostic reports, whose keys end in their timestamp.
+func (s *Store) QueryPolicyDiag(q model.PolicyDiagQuery) ([]model.PolicyDiagReport, bool, error) {
+	if s.cli == nil {
+		return nil, false, fmt.Errorf("consul client not configured")
+	}
+	entries, err := timeKeyed(s, policyDiagPref+q.NodeID+"/")
+	if err != nil {
+		return nil, false, err
+	}
+	return readPage(s, entries, q.HistoryPage, func(_ kvEntry, b []byte) (model.PolicyDiagReport, bool) {
+		var d model.PolicyDiagReport
+		return d, json.Unmarshal(b, &d) == nil
+	})
+}
+
+// timeKeyed lists the keys prefix<unix ns> with their times.
+func timeKeyed(s *Store, prefix string) ([]kvEntry, error) {
+	keys, _, err := s.cli.KV().Keys(prefix, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var out []kvEntry
+	for _, k := range keys {
+		ns, err := strconv.ParseInt(strings.TrimPrefix(k, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, kvEntry{key: k, ts: time.Unix(0, ns)})
+	}
+	return out, nil
+}
+
+// splitTimeKey parses prefix<unix ns>-<rest>.
+func splitTimeKey(key, prefix string) (int64, string, bool) {
+	nsStr, rest, ok := strings.Cut(strings.TrimPrefix(key, prefix), "-")
+	if !ok {
+		return 0, "", false
+	}
+	ns, err := strconv.ParseInt(nsStr, 10, 64)
+	return ns, rest, err == nil
+}
+
+// readPage applies p's time window to entries, then reads their values newest first,
+// keeping those decode accepts, until the page is full. It returns the page oldest first
+// and whether older matches remain. Keys deleted in the meantime are skipped.
+func readPage[T any](s *Store, entries []kvEntry, p model.HistoryPage, decode func(kvEntry, []byte) (T, bool)) ([]T, bool, error) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].ts.Equal(entries[j].ts) {
+			return entries[i].ts.Before(entries[j].ts)
+		}
+		return entries[i].key < entries[j].key
+	})
+	// the cursor skips matching entries, so it is applied while decoding
+	window := p
+	window.Limit, window.Skip = 0, 0
+	candidates, _ := model.SelectPage(entries, func(e kvEntry) time.Time { return e.ts }, window)
+	skip := p.Skip
+	page := []T{}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		kv, _, err := s.cli.KV().Get(candidates[i].key, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		if kv == nil {
+			continue
+		}
+		v, ok := decode(candidates[i], kv.Value)
+		if !ok {
+			continue
+		}
+		if skip > 0 && candidates[i].ts.Equal(p.Before) {
+			skip--
+			continue
+		}
+		if p.Limit > 0 && len(page) == p.Limit {
+			reverse(page)
+			return page, true, nil
+		}
+		page = append(page, v)
+	}
+	reverse(page)
+	return page, false, nil
+}
+
+func reverse[T any](s []T) {
+	for l, r := 0, len(s)-1; l < r; l, r = l+1, r-1 {
+		s[l], s[r] = s[r], s[l]
+	}
+}
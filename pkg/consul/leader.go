@@ -0,0 +1,115 @@
+//go:build consul
+
+package consul
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// minSessionTTL is the smallest TTL Consul accepts for a session.
+const minSessionTTL = 10 * time.Second
+
+// LeaderGuard competes for the lock at key using a Consul session with the given TTL.
+// While the lock is held cb runs with a context that is cancelled as soon as the
+// lock is lost (session invalidated, key taken over, renewal failing) or ctx ends.
+// After losing the lock it keeps campaigning until ctx is cancelled. Blocks.
+func (s *Store) LeaderGuard(ctx context.Context, key string, ttl time.Duration, cb func(context.Context)) {
+	if s.cli == nil {
+		log.Printf("leader election disabled: consul client not configured")
+		return
+	}
+	if ttl < minSessionTTL {
+		ttl = minSessionTTL
+	}
+	holder := s.advertise
+	if holder == "" {
+		holder, _ = os.Hostname()
+	}
+	retry := time.Second
+	for ctx.Err() == nil {
+		lock, err := s.cli.LockOpts(&consulapi.LockOptions{
+			Key:              key,
+			Value:            []byte(holder),
+			SessionName:      "peer-wan-controller",
+			SessionTTL:       ttl.String(),
+			MonitorRetries:   3,
+			MonitorRetryTime: 2 * time.Second,
+		})
+		if err != nil {
+			log.Printf("leader lock %s setup failed: %v", key, err)
+			if !sleepCtx(ctx, retry) {
+				return
+			}
+			continue
+		}
+		// Lock blocks until acquired, ctx is done (nil channel) or an error occurs.
+		lostCh, err := lock.Lock(ctx.Done())
+		if err != nil {
+			log.Printf("leader lock %s acquire failed: %v", key, err)
+			if !sleepCtx(ctx, retry) {
+				return
+			}
+			if retry < 30*time.Second {
+				retry *= 2
+			}
+			continue
+		}
+		if lostCh == nil {
+			return
+		}
+		retry = time.Second
+		lctx, lcancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cb(lctx)
+		}()
+		select {
+		case <-lostCh:
+			log.Printf("leader lock %s lost", key)
+		case <-done:
+		}
+		lcancel()
+		<-done
+		// Unlock releases the key and destroys the session created by the lock.
+		if err := lock.Unlock(); err != nil && err != consulapi.ErrLockNotHeld {
+			log.Printf("leader lock %s release failed: %v", key, err)
+		}
+		// give the lock-delay window a chance to pass before campaigning again
+		if !sleepCtx(ctx, retry) {
+			return
+		}
+	}
+}
+
+// SetAdvertiseAddr sets the URL LeaderGuard publishes in the lock key while it leads.
+func (s *Store) SetAdvertiseAddr(addr string) {
+	s.advertise = addr
+}
+
+// LeaderAddr returns the URL the current holder of the lock at key advertised, or ""
+// while nobody holds it.
+func (s *Store) LeaderAddr(key string) (string, error) {
+	if s.cli == nil {
+		return "", nil
+	}
+	pair, _, err := s.cli.KV().Get(key, nil)
+	if err != nil || pair == nil || pair.Session == "" {
+		return "", err
+	}
+	return string(pair.Value), nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
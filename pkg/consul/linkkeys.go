@@ -0,0 +1,77 @@
+//go:build consul
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"peer-wan/pkg/model"
+)
+
+// Link keys live at peer-wan/link-keys/<a>/<b>, already sealed by the controller.
+func linkKeyKey(a, b string) string { return linkKeyPref + a + "/" + b }
+
+func (s *Store) SaveLinkKey(k model.LinkKey) error {
+	if s.cli == nil {
+		return fmt.Errorf("consul client not configured")
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: linkKeyKey(k.A, k.B), Value: b}, nil)
+	return err
+}
+
+func (s *Store) ListLinkKeys() ([]model.LinkKey, error) {
+	if s.cli == nil {
+		return nil, fmt.Errorf("consul client not configured")
+	}
+	kvs, _, err := s.cli.KV().List(linkKeyPref, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]model.LinkKey, 0, len(kvs))
+	for _, kv := range kvs {
+		var k model.LinkKey
+		if err := json.Unmarshal(kv.Value, &k); err == nil {
+			out = append(out, k)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].A != out[j].A {
+			return out[i].A < out[j].A
+		}
+		return out[i].B < out[j].B
+	})
+	return out, nil
+}
+
+func (s *Store) DeleteLinkKey(a, b string) error {
+	if s.cli == nil {
+		return fmt.Errorf("consul client not configured")
+	}
+	_, err := s.cli.KV().Delete(linkKeyKey(a, b), nil)
+	return err
+}
+
+// deleteLinkKeysOf removes every link key id is an end of.
+func (s *Store) deleteLinkKeysOf(id string) error {
+	keys, err := s.ListLinkKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.A != id && k.B != id {
+			continue
+		}
+		if err := s.DeleteLinkKey(k.A, k.B); err != nil {
+			return err
+		}
+	}
+	return nil
+}
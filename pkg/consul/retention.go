@@ -0,0 +1,135 @@
+//go:build consul
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// kvEntry is one history key with the timestamp retention is judged by.
+type kvEntry struct {
+	key   string
+	group string // node id for per-node collections
+	ts    time.Time
+}
+
+// ApplyRetention deletes history keys outside cfg.
+func (s *Store) ApplyRetention(cfg model.RetentionConfig, now time.Time) (model.RetentionStats, error) {
+	var stats model.RetentionStats
+	if s.cli == nil {
+		return stats, fmt.Errorf("consul client not configured")
+	}
+	var err error
+	if stats.Audit, err = s.retainPrefix(auditPrefix, false, cfg.Audit, now, func(b []byte) time.Time {
+		var e model.AuditEntry
+		_ = json.Unmarshal(b, &e)
+		return e.Timestamp
+	}); err != nil {
+		return stats, fmt.Errorf("audit: %w", err)
+	}
+	if stats.Tasks, err = s.retainPrefix(taskPref, false, cfg.Tasks, now, func(b []byte) time.Time {
+		var t model.Task
+		_ = json.Unmarshal(b, &t)
+		if !t.UpdatedAt.IsZero() {
+			return t.UpdatedAt
+		}
+		return t.CreatedAt
+	}); err != nil {
+		return stats, fmt.Errorf("tasks: %w", err)
+	}
+	if stats.Tasks > 0 {
+		if err := taskIndex.prune(s); err != nil {
+			return stats, fmt.Errorf("task index: %w", err)
+		}
+	}
+	if stats.PolicyStatus, err = s.retainPrefix(policyStatusPref, true, cfg.PolicyStatus, now, func(b []byte) time.Time {
+		var l model.PolicyInstallLog
+		_ = json.Unmarshal(b, &l)
+		return l.Timestamp
+	}); err != nil {
+		return stats, fmt.Errorf("policy status: %w", err)
+	}
+	if stats.PolicyDiag, err = s.retainPrefix(policyDiagPref, true, cfg.PolicyDiag, now, func(b []byte) time.Time {
+		var d model.PolicyDiagReport
+		_ = json.Unmarshal(b, &d)
+		return d.Timestamp
+	}); err != nil {
+		return stats, fmt.Errorf("policy diag: %w", err)
+	}
+	if stats.PlanHistory, err = s.retainPrefix(planPrefix, true, cfg.PlanHistory, now, func(b []byte) time.Time {
+		var p model.Plan
+		_ = json.Unmarshal(b, &p)
+		return p.CreatedAt
+	}); err != nil {
+		return stats, fmt.Errorf("plan history: %w", err)
+	}
+	if stats.PlanHistory > 0 {
+		if err := planIndex.prune(s); err != nil {
+			return stats, fmt.Errorf("plan index: %w", err)
+		}
+	}
+	if stats.HealthHistory, err = s.retainPrefix(healthHistPrefix, true, cfg.HealthHistory, now, func(b []byte) time.Time {
+		var h model.HealthReport
+		_ = json.Unmarshal(b, &h)
+		return h.Timestamp
+	}); err != nil {
+		return stats, fmt.Errorf("health history: %w", err)
+	}
+	if stats.HealthSeries, err = s.retainSeries(cfg, now); err != nil {
+		return stats, fmt.Errorf("health series: %w", err)
+	}
+	return stats, nil
+}
+
+// retainPrefix applies p to the keys under prefix. Per-node collections are laid out as
+// prefix/<node>/<entry>; keys without that shape (latest plan, plan version) are left alone.
+func (s *Store) retainPrefix(prefix string, perNode bool, p model.RetentionPolicy, now time.Time, ts func([]byte) time.Time) (int, error) {
+	cutoff, maxCount, err := p.Limits(now)
+	if err != nil {
+		return 0, err
+	}
+	if cutoff.IsZero() && maxCount <= 0 {
+		return 0, nil
+	}
+	pairs, _, err := s.cli.KV().List(prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+	groups := map[string][]kvEntry{}
+	for _, kv := range pairs {
+		e := kvEntry{key: kv.Key, ts: ts(kv.Value)}
+		if perNode {
+			rest := strings.TrimPrefix(kv.Key, prefix)
+			i := strings.Index(rest, "/")
+			if i <= 0 {
+				continue
+			}
+			e.group = rest[:i]
+		}
+		groups[e.group] = append(groups[e.group], e)
+	}
+	removed := 0
+	for _, entries := range groups {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].ts.Before(entries[j].ts) })
+		drop := 0
+		for drop < len(entries) && !cutoff.IsZero() && entries[drop].ts.Before(cutoff) {
+			drop++
+		}
+		if maxCount > 0 && len(entries)-drop > maxCount {
+			drop = len(entries) - maxCount
+		}
+		for _, e := range entries[:drop] {
+			if _, err := s.cli.KV().Delete(e.key, nil); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,186 @@
+//go:build consul
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"peer-wan/pkg/model"
+)
+
+// Health buckets are packed seriesChunkSteps per key (all peers of a node) instead of
+// one key per sample: peer-wan/health-series/<node>/<step>/<chunk start unix>.
+const seriesChunkSteps = 60
+
+func seriesChunk(step string, start time.Time) (time.Time, time.Duration, error) {
+	d, ok := model.SeriesStepDuration(step)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("unknown series step %q", step)
+	}
+	span := d * seriesChunkSteps
+	return start.Truncate(span), span, nil
+}
+
+func seriesKey(nodeID, step string, chunk time.Time) string {
+	return fmt.Sprintf("%s%s/%s/%d", healthSeriesPref, nodeID, step, chunk.Unix())
+}
+
+// SaveHealthBuckets merges buckets into their chunk keys with check-and-set.
+func (s *Store) SaveHealthBuckets(buckets []model.HealthBucket) error {
+	if s.cli == nil {
+		return fmt.Errorf("consul client not configured")
+	}
+	byKey := map[string][]model.HealthBucket{}
+	for _, b := range buckets {
+		chunk, _, err := seriesChunk(b.Step, b.Start)
+		if err != nil {
+			return err
+		}
+		key := seriesKey(b.NodeID, b.Step, chunk)
+		byKey[key] = append(byKey[key], b)
+	}
+	for key, list := range byKey {
+		if err := s.mergeSeriesChunk(key, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) mergeSeriesChunk(key string, buckets []model.HealthBucket) error {
+	for attempt := 0; attempt < 5; attempt++ {
+		kv, _, err := s.cli.KV().Get(key, nil)
+		if err != nil {
+			return err
+		}
+		var existing []model.HealthBucket
+		var index uint64
+		if kv != nil {
+			index = kv.ModifyIndex
+			if err := json.Unmarshal(kv.Value, &existing); err != nil {
+				return fmt.Errorf("decode %s: %w", key, err)
+			}
+		}
+		merged := map[string]model.HealthBucket{}
+		for _, b := range existing {
+			merged[b.Start.Format(time.RFC3339)+"|"+b.Peer] = b
+		}
+		for _, b := range buckets {
+			merged[b.Start.Format(time.RFC3339)+"|"+b.Peer] = b
+		}
+		out := make([]model.HealthBucket, 0, len(merged))
+		for _, b := range merged {
+			out = append(out, b)
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if !out[i].Start.Equal(out[j].Start) {
+				return out[i].Start.Before(out[j].Start)
+			}
+			return out[i].Peer < out[j].Peer
+		})
+		val, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+		ok, _, err := s.cli.KV().CAS(&consulapi.KVPair{Key: key, Value: val, ModifyIndex: index}, nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("health series %s: too many concurrent updates", key)
+}
+
+// ListHealthBuckets reads only the chunks overlapping [from, to).
+func (s *Store) ListHealthBuckets(nodeID, step string, from, to time.Time) ([]model.HealthBucket, error) {
+	if s.cli == nil {
+		return nil, fmt.Errorf("consul client not configured")
+	}
+	_, span, err := seriesChunk(step, from)
+	if err != nil {
+		return nil, err
+	}
+	prefix := healthSeriesPref + nodeID + "/" + step + "/"
+	keys, _, err := s.cli.KV().Keys(prefix, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []int64
+	for _, k := range keys {
+		sec, err := strconv.ParseInt(strings.TrimPrefix(k, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		start := time.Unix(sec, 0)
+		if start.Add(span).After(from) && (to.IsZero() || start.Before(to)) {
+			chunks = append(chunks, sec)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i] < chunks[j] })
+	var out []model.HealthBucket
+	for _, sec := range chunks {
+		kv, _, err := s.cli.KV().Get(prefix+strconv.FormatInt(sec, 10), nil)
+		if err != nil {
+			return nil, err
+		}
+		if kv == nil {
+			continue
+		}
+		var list []model.HealthBucket
+		if err := json.Unmarshal(kv.Value, &list); err != nil {
+			continue
+		}
+		for _, b := range list {
+			if !b.Start.Before(from) && (to.IsZero() || b.Start.Before(to)) {
+				out = append(out, b)
+			}
+		}
+	}
+	return out, nil
+}
+
+// retainSeries drops whole chunks that ended before the step's age cutoff.
+// Count bounds are not applied to the packed Consul layout.
+func (s *Store) retainSeries(cfg model.RetentionConfig, now time.Time) (int, error) {
+	keys, _, err := s.cli.KV().Keys(healthSeriesPref, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, k := range keys {
+		parts := strings.Split(strings.TrimPrefix(k, healthSeriesPref), "/")
+		if len(parts) != 3 {
+			continue
+		}
+		step := parts[1]
+		sec, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		cutoff, _, err := cfg.HealthSeries(step).Limits(now)
+		if err != nil || cutoff.IsZero() {
+			continue
+		}
+		_, span, err := seriesChunk(step, now)
+		if err != nil {
+			continue
+		}
+		if time.Unix(sec, 0).Add(span).After(cutoff) {
+			continue
+		}
+		if _, err := s.cli.KV().Delete(k, nil); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -9,29 +9,39 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 
 	"peer-wan/pkg/model"
+	"peer-wan/pkg/policy"
 )
 
 // Store is a Consul-backed NodeStore implementation.
 type Store struct {
 	cli     *consulapi.Client
 	session *consulapi.Session
+	// advertise is the URL followers forward API requests to while this replica leads
+	advertise string
+
+	indexMu sync.Mutex
+	indexed map[string]bool // time index groups whose older entries have been indexed
 }
 
 type nodeRecord struct {
 	model.Node
 	PrivateKey     string `json:"privateKey,omitempty"`
 	ProvisionToken string `json:"provisionToken,omitempty"`
+	// Seq counts UpsertNode writes and drives Version/ConfigVersion like the other stores.
+	Seq int `json:"seq,omitempty"`
 }
 
 const (
 	nodePrefix       = "peer-wan/nodes/"
 	healthPrefix     = "peer-wan/health/"
 	healthHistPrefix = "peer-wan/health-history/"
+	healthSeriesPref = "peer-wan/health-series/"
 	policyStatusPref = "peer-wan/policy-status/"
 	policyDiagPref   = "peer-wan/policy-diag/"
 	taskPref         = "peer-wan/tasks/"
@@ -39,6 +49,8 @@ const (
 	planPrefix       = "peer-wan/plan/"
 	versionKey       = "peer-wan/plan/version"
 	settingsKey      = "peer-wan/settings"
+	linkKeyPref      = "peer-wan/link-keys/"
+	routingKey       = "peer-wan/routing-state"
 )
 
 func NewStore(addr string) *Store {
@@ -63,18 +75,55 @@ func (s *Store) UpsertNode(n model.Node) (model.Node, error) {
 	if s.cli == nil {
 		return n, fmt.Errorf("consul client not configured")
 	}
-	rec := nodeRecord{Node: n, PrivateKey: n.PrivateKey, ProvisionToken: n.ProvisionToken}
-	b, err := json.Marshal(rec)
+	kv, _, err := s.cli.KV().Get(nodePrefix+n.ID, nil)
 	if err != nil {
 		return n, err
 	}
-	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: nodePrefix + n.ID, Value: b}, nil)
-	if err != nil {
+	var index uint64
+	var current int64
+	var seq int
+	if kv != nil {
+		rec, err := decodeNodeRecord(kv.Value)
+		if err != nil {
+			return n, err
+		}
+		index, current, seq = kv.ModifyIndex, rec.Revision, rec.Seq
+		if seq == 0 {
+			// records written before Seq existed carry it only in the version string
+			_, _ = fmt.Sscanf(rec.Node.Version, "v0.0.%d", &seq)
+		}
+	}
+	if n.Revision != current {
+		return n, model.ErrRevisionConflict
+	}
+	seq++
+	n.Version = fmt.Sprintf("v0.0.%d", seq)
+	n.ConfigVersion = n.Version
+	n.Revision++
+	if err := s.casNode(n, index, seq); err != nil {
 		return n, err
 	}
 	return n, nil
 }
 
+// casNode writes the node record only if the key is unchanged since index was read
+// (index 0 means the key must not exist yet).
+func (s *Store) casNode(n model.Node, index uint64, seq int) error {
+	rec := nodeRecord{Node: n, PrivateKey: n.PrivateKey, ProvisionToken: n.ProvisionToken, Seq: seq}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ok, _, err := s.cli.KV().CAS(&consulapi.KVPair{Key: nodePrefix + n.ID, Value: b, ModifyIndex: index}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return model.ErrRevisionConflict
+	}
+	return nil
+}
+
 func (s *Store) ListNodes() ([]model.Node, error) {
 	if s.cli == nil {
 		return nil, fmt.Errorf("consul client not configured")
@@ -115,6 +164,43 @@ func (s *Store) GetNode(id string) (model.Node, bool, error) {
 	return n, true, nil
 }
 
+// DeleteNode removes a node together with its plans, health, policy logs, tasks and link keys.
+// Per-node trees are deleted with a trailing slash so ids sharing a prefix are untouched.
+func (s *Store) DeleteNode(id string) error {
+	if s.cli == nil {
+		return fmt.Errorf("consul client not configured")
+	}
+	kv, _, err := s.cli.KV().Get(nodePrefix+id, nil)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return fmt.Errorf("node not found")
+	}
+	for _, key := range []string{nodePrefix + id, planPrefix + id, healthPrefix + id} {
+		if _, err := s.cli.KV().Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range []string{planPrefix, planIndex.index, healthHistPrefix, healthSeriesPref, policyStatusPref, policyDiagPref} {
+		if _, err := s.cli.KV().DeleteTree(prefix+id+"/", nil); err != nil {
+			return err
+		}
+	}
+	tasks, err := s.ListTasks(id, 0)
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		for _, key := range []string{taskPref + t.ID, taskIndex.key("", t.CreatedAt, t.ID)} {
+			if _, err := s.cli.KV().Delete(key, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return s.deleteLinkKeysOf(id)
+}
+
 func (s *Store) SaveHealth(h model.HealthReport) error {
 	if s.cli == nil {
 		return fmt.Errorf("consul client not configured")
@@ -129,8 +215,6 @@ func (s *Store) SaveHealth(h model.HealthReport) error {
 	// history entry keyed by timestamp
 	histKey := fmt.Sprintf("%s%s/%d", healthHistPrefix, h.NodeID, h.Timestamp.UnixNano())
 	_, _ = s.cli.KV().Put(&consulapi.KVPair{Key: histKey, Value: b}, nil)
-	// best-effort prune >24h
-	go s.pruneHealthHistory(h.NodeID, time.Now().Add(-24*time.Hour))
 	return nil
 }
 
@@ -174,30 +258,6 @@ func (s *Store) ListHealthHistory(nodeID string, since time.Time) ([]model.Healt
 	return out, nil
 }
 
-// pruneHealthHistory deletes history entries older than cutoff.
-func (s *Store) pruneHealthHistory(nodeID string, cutoff time.Time) {
-	if s.cli == nil {
-		return
-	}
-	prefix := healthHistPrefix + nodeID + "/"
-	pairs, _, err := s.cli.KV().List(prefix, nil)
-	if err != nil {
-		return
-	}
-	for _, p := range pairs {
-		parts := strings.Split(p.Key, "/")
-		if len(parts) == 0 {
-			continue
-		}
-		tsStr := parts[len(parts)-1]
-		if ts, errParse := strconv.ParseInt(tsStr, 10, 64); errParse == nil {
-			if time.Unix(0, ts).Before(cutoff) {
-				_, _ = s.cli.KV().Delete(p.Key, nil)
-			}
-		}
-	}
-}
-
 // PruneHealthBefore removes health history older than cutoff for all nodes.
 func (s *Store) PruneHealthBefore(cutoff time.Time) error {
 	if s.cli == nil {
@@ -315,7 +375,10 @@ func (s *Store) SaveTask(t model.Task) error {
 		return err
 	}
 	key := fmt.Sprintf("%s%s", taskPref, t.ID)
-	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: key, Value: b}, nil)
+	if _, err := s.cli.KV().Put(&consulapi.KVPair{Key: key, Value: b}, nil); err != nil {
+		return err
+	}
+	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: taskIndex.key("", t.CreatedAt, t.ID)}, nil)
 	return err
 }
 
@@ -385,20 +448,16 @@ func (s *Store) SavePlan(p model.Plan) error {
 	if err != nil {
 		return err
 	}
-	// CAS on latest plan by ModifyIndex (best effort).
-	kv := &consulapi.KVPair{Key: planPrefix + p.NodeID, Value: b}
-	if p.Version > 0 {
-		kv.ModifyIndex = uint64(p.Version)
-	}
-	ok, _, err := s.cli.KV().CAS(kv, nil)
-	if err != nil {
+	// Plan versions are controller counters, not Consul indexes, so they cannot drive a CAS;
+	// the latest plan is simply overwritten.
+	if _, err := s.cli.KV().Put(&consulapi.KVPair{Key: planPrefix + p.NodeID, Value: b}, nil); err != nil {
 		return err
 	}
-	if !ok {
-		return fmt.Errorf("plan CAS failed")
-	}
 	histKey := fmt.Sprintf("%s%s/%d", planPrefix, p.NodeID, p.Version)
-	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: histKey, Value: b}, nil)
+	if _, err := s.cli.KV().Put(&consulapi.KVPair{Key: histKey, Value: b}, nil); err != nil {
+		return err
+	}
+	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: planIndex.key(p.NodeID, p.CreatedAt, strconv.FormatInt(p.Version, 10))}, nil)
 	return err
 }
 
@@ -433,6 +492,8 @@ func (s *Store) ListPlanHistory(nodeID string, limit int) ([]model.Plan, error)
 			out = append(out, plan)
 		}
 	}
+	// keys sort lexically ("10" < "9"); history is oldest first by version
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Version < out[j].Version })
 	if limit > 0 && len(out) > limit {
 		out = out[len(out)-limit:]
 	}
@@ -452,9 +513,12 @@ func (s *Store) RollbackPlan(nodeID string, version int64) (model.Plan, error) {
 	if err := json.Unmarshal(kv.Value, &p); err != nil {
 		return model.Plan{}, err
 	}
-	// write back as latest
-	p.Version = version
-	if err := s.SavePlan(p); err != nil {
+	// write back as latest; the history entry is already there
+	b := kv.Value
+	if _, err := s.cli.KV().Put(&consulapi.KVPair{Key: planPrefix + nodeID, Value: b}, nil); err != nil {
+		return model.Plan{}, err
+	}
+	if err := s.SetGlobalPlanVersion(version); err != nil {
 		return model.Plan{}, err
 	}
 	return p, nil
@@ -482,7 +546,7 @@ func (s *Store) GetGlobalPlanVersion() (int64, error) {
 	return v, nil
 }
 
-func (s *Store) UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string) error {
+func (s *Store) UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string, revision int64) error {
 	if s.cli == nil {
 		return fmt.Errorf("consul client not configured")
 	}
@@ -497,17 +561,19 @@ func (s *Store) UpdatePolicy(nodeID string, egressPeer string, rules []model.Pol
 	if err != nil {
 		return err
 	}
-	rec.Node.EgressPeerID = egressPeer
-	rec.Node.PolicyRules = rules
-	rec.Node.DefaultRoute = defaultRoute
-	rec.Node.BypassCIDRs = bypass
-	rec.Node.DefaultRouteNextHop = defaultRouteNextHop
-	b, err := json.Marshal(rec)
-	if err != nil {
-		return err
+	if rec.Node.Revision != revision {
+		return model.ErrRevisionConflict
 	}
-	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: nodePrefix + nodeID, Value: b}, nil)
-	return err
+	n := rec.Node
+	n.PrivateKey = rec.PrivateKey
+	n.ProvisionToken = rec.ProvisionToken
+	n.EgressPeerID = egressPeer
+	n.PolicyRules = rules
+	n.DefaultRoute = defaultRoute
+	n.BypassCIDRs = bypass
+	n.DefaultRouteNextHop = defaultRouteNextHop
+	n.Revision++
+	return s.casNode(n, nodeKV.ModifyIndex, rec.Seq)
 }
 
 func (s *Store) ListAudit(limit int) ([]model.AuditEntry, error) {
@@ -537,25 +603,48 @@ func (s *Store) Client() *consulapi.Client {
 }
 
 // WatchPrefix returns a blocking query channel for changes on a prefix.
+// The first delivery is the current state; later ones follow index changes.
+// The channel is closed once ctx is cancelled.
 func WatchPrefix(ctx context.Context, cli *consulapi.Client, prefix string, out chan<- []*consulapi.KVPair) error {
 	if cli == nil {
 		return fmt.Errorf("consul client not configured")
 	}
-	q := &consulapi.QueryOptions{}
 	go func() {
 		defer close(out)
+		var index uint64
+		backoff := time.Second
 		for {
+			q := (&consulapi.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute}).WithContext(ctx)
+			kv, meta, err := cli.KV().List(prefix, q)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if backoff < 30*time.Second {
+					backoff *= 2
+				}
+				continue
+			}
+			backoff = time.Second
+			// blocking query timed out without changes
+			if index != 0 && meta.LastIndex == index {
+				continue
+			}
+			// index went backwards (snapshot restore / leader change): resync from scratch
+			if meta.LastIndex < index {
+				index = 0
+				continue
+			}
+			index = meta.LastIndex
 			select {
 			case <-ctx.Done():
 				return
-			default:
-			}
-			kv, meta, err := cli.KV().List(prefix, q)
-			if err == nil && kv != nil {
-				out <- kv
-				q.WaitIndex = meta.LastIndex
-			} else {
-				time.Sleep(time.Second)
+			case out <- kv:
 			}
 		}
 	}()
@@ -598,14 +687,46 @@ func decodeNodeRecord(b []byte) (nodeRecord, error) {
 	return rec, nil
 }
 
+// SaveRoutingState writes the leader's link state. The key is not watched: the state
+// follows from health reports, it does not ask for plans to be recomputed.
+func (s *Store) SaveRoutingState(rs model.RoutingState) error {
+	if s.cli == nil {
+		return fmt.Errorf("consul client not configured")
+	}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	_, err = s.cli.KV().Put(&consulapi.KVPair{Key: routingKey, Value: b}, nil)
+	return err
+}
+
+func (s *Store) GetRoutingState() (model.RoutingState, bool, error) {
+	if s.cli == nil {
+		return model.RoutingState{}, false, fmt.Errorf("consul client not configured")
+	}
+	kv, _, err := s.cli.KV().Get(routingKey, nil)
+	if err != nil || kv == nil {
+		return model.RoutingState{}, false, err
+	}
+	var rs model.RoutingState
+	if err := json.Unmarshal(kv.Value, &rs); err != nil {
+		return model.RoutingState{}, false, err
+	}
+	return rs, true, nil
+}
+
 func (s *Store) GetSettings() (model.Settings, error) {
 	if s.cli == nil {
 		return model.Settings{}, fmt.Errorf("consul client not configured")
 	}
 	kv, _, err := s.cli.KV().Get(settingsKey, nil)
-	if err != nil || kv == nil {
+	if err != nil {
 		return model.Settings{}, err
 	}
+	if kv == nil {
+		return policy.DefaultSettings(), nil
+	}
 	var cfg model.Settings
 	if err := json.Unmarshal(kv.Value, &cfg); err != nil {
 		return model.Settings{}, err
@@ -0,0 +1,21 @@
+//go:build consul
+
+package consul_test
+
+import (
+	"testing"
+
+	"peer-wan/pkg/consul"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/store/storetest"
+)
+
+func TestConsulStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.NodeStore {
+		st := consul.NewStore(newFakeConsul(t))
+		if err := st.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	})
+}
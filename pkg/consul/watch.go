@@ -0,0 +1,79 @@
+//go:build consul
+
+package consul
+
+import (
+	"context"
+	"log"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// watchDebounce coalesces bursts of KV writes (e.g. several agents registering) into one callback.
+const watchDebounce = 2 * time.Second
+
+// watchedPrefixes are the keys whose changes require plans to be recomputed:
+// node records (registration, endpoints, per-node policy) and global settings.
+// Plan keys are deliberately excluded, otherwise recomputes would re-trigger themselves.
+var watchedPrefixes = []string{nodePrefix, settingsKey}
+
+// StartWatch runs blocking queries over node and policy keys and calls onChange
+// (debounced) whenever any of them changes. The initial snapshot of each prefix
+// does not trigger onChange. It returns immediately; watching stops with ctx.
+func (s *Store) StartWatch(ctx context.Context, onChange func()) {
+	if s.cli == nil || onChange == nil {
+		return
+	}
+	changed := make(chan string, len(watchedPrefixes))
+	for _, prefix := range watchedPrefixes {
+		ch := make(chan []*consulapi.KVPair)
+		if err := WatchPrefix(ctx, s.cli, prefix, ch); err != nil {
+			log.Printf("consul watch %s failed: %v", prefix, err)
+			continue
+		}
+		go func(prefix string, ch <-chan []*consulapi.KVPair) {
+			first := true
+			for range ch {
+				if first {
+					first = false
+					continue
+				}
+				select {
+				case changed <- prefix:
+				default:
+				}
+			}
+		}(prefix, ch)
+	}
+	go func() {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case prefix := <-changed:
+				log.Printf("consul watch: change under %s", prefix)
+				if timer == nil {
+					timer = time.NewTimer(watchDebounce)
+				} else {
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+					timer.Reset(watchDebounce)
+				}
+				fire = timer.C
+			case <-fire:
+				fire = nil
+				onChange()
+			}
+		}
+	}()
+}
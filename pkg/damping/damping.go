@@ -0,0 +1,538 @@
+// Package damping turns the stream of health reports into stable link states for the
+// planner. A link only goes down after sustained loss and only comes back after sustained
+// recovery and a hold-down; every down transition adds a flap penalty that decays over
+// time, and a link whose penalty crosses the suppress threshold stays down until it has
+// decayed below the reuse threshold. Latency and loss changes reach plans only when they
+// leave a hysteresis band, so jitter does not reorder peers.
+package damping
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// Link states. Failing links are still planned, recovering ones not yet.
+const (
+	StateUp         = "up"
+	StateFailing    = "failing"
+	StateDown       = "down"
+	StateRecovering = "recovering"
+)
+
+const (
+	// minLatencyStepMs is the smallest latency change plans follow, whatever the hysteresis.
+	minLatencyStepMs = 5
+	// lossStep is the smallest packet loss change (percentage points) plans follow.
+	lossStep = 5
+	// fullLoss is the packet loss reported for a link that is down.
+	fullLoss = 100
+	// maxEvents bounds the transition log kept in memory.
+	maxEvents = 1000
+)
+
+// Defaults returns the damping applied to unset fields.
+func Defaults() model.DampingConfig {
+	return model.DampingConfig{
+		LossThreshold:     50,
+		DownAfter:         3,
+		UpAfter:           3,
+		HoldDown:          "30s",
+		Penalty:           1000,
+		SuppressAt:        2000,
+		ReuseAt:           750,
+		HalfLife:          "5m",
+		LatencyHysteresis: 0.2,
+	}
+}
+
+// Effective fills the unset fields of cfg with the defaults.
+func Effective(cfg model.DampingConfig) model.DampingConfig {
+	def := Defaults()
+	if cfg.LossThreshold == 0 {
+		cfg.LossThreshold = def.LossThreshold
+	}
+	if cfg.DownAfter == 0 {
+		cfg.DownAfter = def.DownAfter
+	}
+	if cfg.UpAfter == 0 {
+		cfg.UpAfter = def.UpAfter
+	}
+	if cfg.HoldDown == "" {
+		cfg.HoldDown = def.HoldDown
+	}
+	if cfg.Penalty == 0 {
+		cfg.Penalty = def.Penalty
+	}
+	if cfg.SuppressAt == 0 {
+		cfg.SuppressAt = def.SuppressAt
+	}
+	if cfg.ReuseAt == 0 {
+		cfg.ReuseAt = def.ReuseAt
+	}
+	if cfg.HalfLife == "" {
+		cfg.HalfLife = def.HalfLife
+	}
+	if cfg.LatencyHysteresis == 0 {
+		cfg.LatencyHysteresis = def.LatencyHysteresis
+	}
+	return cfg
+}
+
+// Validate reports the first invalid field of cfg.
+func Validate(cfg model.DampingConfig) error {
+	eff := Effective(cfg)
+	if eff.LossThreshold < 0 || eff.LossThreshold > fullLoss {
+		return fmt.Errorf("lossThreshold must be between 0 and 100")
+	}
+	if eff.DownAfter < 0 || eff.UpAfter < 0 {
+		return fmt.Errorf("downAfter and upAfter must be positive")
+	}
+	for name, v := range map[string]string{"holdDown": eff.HoldDown, "halfLife": eff.HalfLife} {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q", name, v)
+		}
+	}
+	if eff.Penalty < 0 || eff.SuppressAt < 0 || eff.ReuseAt < 0 || eff.LatencyHysteresis < 0 {
+		return fmt.Errorf("penalty, suppressAt, reuseAt and latencyHysteresis must not be negative")
+	}
+	if eff.ReuseAt >= eff.SuppressAt {
+		return fmt.Errorf("reuseAt must be below suppressAt")
+	}
+	return nil
+}
+
+// params is an effective config with parsed durations.
+type params struct {
+	model.DampingConfig
+	holdDown time.Duration
+	halfLife time.Duration
+}
+
+func resolve(cfg model.DampingConfig) params {
+	p := params{DampingConfig: Effective(cfg)}
+	p.holdDown, _ = time.ParseDuration(p.HoldDown)
+	p.halfLife, _ = time.ParseDuration(p.HalfLife)
+	return p
+}
+
+// Link is the damped state of a node (To empty, fed by its reported status) or of the
+// link From->To as probed by From. LatencyMs and PacketLoss are the values plans use.
+type Link struct {
+	ID         string     `json:"id"`
+	From       string     `json:"from"`
+	To         string     `json:"to,omitempty"`
+	State      string     `json:"state"`
+	Usable     bool       `json:"usable"`
+	Suppressed bool       `json:"suppressed,omitempty"`
+	Penalty    float64    `json:"penalty"`
+	Flaps      int        `json:"flaps"`
+	Since      time.Time  `json:"since"`
+	HoldUntil  *time.Time `json:"holdUntil,omitempty"`
+	LatencyMs  int        `json:"latencyMs,omitempty"`
+	PacketLoss float64    `json:"packetLoss,omitempty"`
+
+	bad, good    int       // consecutive samples
+	decayed      time.Time // when Penalty was last decayed
+	planned      bool      // LatencyMs/PacketLoss hold a sample
+	latencyKnown bool
+}
+
+// Event is one state transition. Usable tells whether the link is planned afterwards;
+// plans only need recomputing when it differs from before the transition.
+type Event struct {
+	Link      string    `json:"link"`
+	From      string    `json:"from"`
+	To        string    `json:"to,omitempty"`
+	Prev      string    `json:"prev"`
+	State     string    `json:"state"`
+	Usable    bool      `json:"usable"`
+	Reason    string    `json:"reason,omitempty"`
+	Penalty   float64   `json:"penalty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Flipped reports whether the transition moved the link into or out of plans.
+func (e Event) Flipped() bool {
+	return usable(e.Prev) != e.Usable
+}
+
+func usable(state string) bool {
+	return state == StateUp || state == StateFailing
+}
+
+// LinkID names the link from -> to, or the node itself when to is empty.
+func LinkID(from, to string) string {
+	if to == "" {
+		return from
+	}
+	return from + ">" + to
+}
+
+// Tracker holds the state machines of all nodes and links and the recent transitions.
+// It is safe for concurrent use.
+type Tracker struct {
+	mu     sync.Mutex
+	links  map[string]*Link
+	frr    map[string]*sticky // reporter|neighbor -> BGP session state
+	events []Event
+}
+
+// NewTracker returns an empty tracker; every link starts up.
+func NewTracker() *Tracker {
+	return &Tracker{links: map[string]*Link{}, frr: map[string]*sticky{}}
+}
+
+// Observe feeds one health report into the state machines of the reporting node and of
+// every link it probed, and returns the transitions it caused.
+func (t *Tracker) Observe(cfg model.DampingConfig, report model.HealthReport, nodes []model.Node) []Event {
+	if cfg.Disabled {
+		return nil
+	}
+	p := resolve(cfg)
+	now := report.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var events []Event
+	self := t.link(report.NodeID, "", now)
+	if ev, ok := self.step(p, report.Status != "down", "status "+report.Status, now); ok {
+		events = append(events, ev)
+	}
+	for _, n := range nodes {
+		ip := overlayAddr(n)
+		if n.ID == report.NodeID || ip == "" {
+			continue
+		}
+		ms, hasLatency := report.LatencyMs[ip]
+		loss, hasLoss := report.PacketLoss[ip]
+		if !hasLatency && !hasLoss {
+			continue
+		}
+		good := loss < p.LossThreshold
+		reason := fmt.Sprintf("loss %.0f%%", loss)
+		if hasLatency {
+			reason += fmt.Sprintf(", latency %dms", ms)
+		}
+		l := t.link(report.NodeID, n.ID, now)
+		if ev, ok := l.step(p, good, reason, now); ok {
+			events = append(events, ev)
+		}
+		if l.Usable && good {
+			l.plan(p, ms, hasLatency, loss)
+		}
+	}
+	for neighbor, state := range report.FRRState {
+		key := report.NodeID + "|" + neighbor
+		s := t.frr[key]
+		if s == nil {
+			t.frr[key] = &sticky{value: state}
+			continue
+		}
+		after := p.DownAfter
+		if state == "Established" {
+			after = p.UpAfter
+		}
+		s.step(state, after)
+	}
+	t.events = append(t.events, events...)
+	if over := len(t.events) - maxEvents; over > 0 {
+		t.events = append(t.events[:0:0], t.events[over:]...)
+	}
+	return events
+}
+
+func (t *Tracker) link(from, to string, now time.Time) *Link {
+	id := LinkID(from, to)
+	l := t.links[id]
+	if l == nil {
+		l = &Link{ID: id, From: from, To: to, State: StateUp, Usable: true, Since: now, decayed: now}
+		t.links[id] = l
+	}
+	return l
+}
+
+// step advances l by one sample and returns the transition it caused, if any.
+func (l *Link) step(p params, good bool, reason string, now time.Time) (Event, bool) {
+	l.decay(p, now)
+	if good {
+		l.good, l.bad = l.good+1, 0
+	} else {
+		l.bad, l.good = l.bad+1, 0
+	}
+	prev := l.State
+	switch {
+	case l.State == StateUp && !good:
+		l.State = StateFailing
+	case l.State == StateFailing && good:
+		l.State = StateUp
+	case l.State == StateDown && good:
+		l.State = StateRecovering
+	case l.State == StateRecovering && !good:
+		l.State = StateDown
+	}
+	// the sample that started failing or recovering may already meet the threshold
+	switch {
+	case l.State == StateFailing && l.bad >= p.DownAfter:
+		l.State = StateDown
+		l.Flaps++
+		l.Penalty += p.Penalty
+		hold := now.Add(p.holdDown)
+		l.HoldUntil = &hold
+		l.planned = false
+		if l.Penalty >= p.SuppressAt {
+			l.Suppressed = true
+			reason += fmt.Sprintf(", suppressed until penalty < %.0f", p.ReuseAt)
+		}
+	case l.State == StateRecovering && l.good >= p.UpAfter && (l.HoldUntil == nil || !now.Before(*l.HoldUntil)) && !l.Suppressed:
+		l.State = StateUp
+	}
+	if l.State == prev {
+		return Event{}, false
+	}
+	l.Since = now
+	l.Usable = usable(l.State)
+	return Event{
+		Link:      l.ID,
+		From:      l.From,
+		To:        l.To,
+		Prev:      prev,
+		State:     l.State,
+		Usable:    l.Usable,
+		Reason:    reason,
+		Penalty:   math.Round(l.Penalty),
+		Timestamp: now,
+	}, true
+}
+
+// decay halves the flap penalty every half-life and lifts suppression once it fell
+// below the reuse threshold.
+func (l *Link) decay(p params, now time.Time) {
+	if dt := now.Sub(l.decayed); dt > 0 {
+		if p.halfLife > 0 {
+			l.Penalty *= math.Exp2(-dt.Seconds() / p.halfLife.Seconds())
+		} else {
+			l.Penalty = 0
+		}
+		if l.Penalty < 1 {
+			l.Penalty = 0
+		}
+		l.decayed = now
+	}
+	if l.Suppressed && l.Penalty < p.ReuseAt {
+		l.Suppressed = false
+	}
+}
+
+// plan moves the planned latency and loss to a good sample once it left the hysteresis band.
+func (l *Link) plan(p params, ms int, hasLatency bool, loss float64) {
+	if !l.planned {
+		l.planned = true
+		l.LatencyMs, l.latencyKnown, l.PacketLoss = ms, hasLatency, loss
+		return
+	}
+	step := math.Max(minLatencyStepMs, p.LatencyHysteresis*float64(l.LatencyMs))
+	if hasLatency != l.latencyKnown || math.Abs(float64(ms-l.LatencyMs)) >= step {
+		l.LatencyMs, l.latencyKnown = ms, hasLatency
+	}
+	if math.Abs(loss-l.PacketLoss) >= lossStep {
+		l.PacketLoss = loss
+	}
+}
+
+// Apply returns the damped view of health that plans are built from: nodes and links
+// that are down report status down or full loss, usable links carry their planned latency
+// and loss, and BGP session states only change once the new state persisted. health is
+// not modified; links the tracker has not seen pass through unchanged.
+func (t *Tracker) Apply(cfg model.DampingConfig, health map[string]model.HealthReport, nodes []model.Node) map[string]model.HealthReport {
+	if cfg.Disabled {
+		return health
+	}
+	byIP := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		if ip := overlayAddr(n); ip != "" {
+			byIP[ip] = n.ID
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]model.HealthReport, len(health))
+	for id, h := range health {
+		if l := t.links[id]; l != nil {
+			switch {
+			case !l.Usable:
+				h.Status = "down"
+			case h.Status == "down":
+				h.Status = "degraded"
+			}
+		}
+		h.LatencyMs = copyMap(h.LatencyMs)
+		h.PacketLoss = copyMap(h.PacketLoss)
+		probed := map[string]bool{}
+		for ip := range h.LatencyMs {
+			probed[ip] = true
+		}
+		for ip := range h.PacketLoss {
+			probed[ip] = true
+		}
+		for ip := range probed {
+			peer := byIP[ip]
+			l := t.links[LinkID(id, peer)]
+			if peer == "" || l == nil {
+				continue
+			}
+			delete(h.LatencyMs, ip)
+			delete(h.PacketLoss, ip)
+			switch {
+			case !l.Usable:
+				h.PacketLoss[ip] = fullLoss
+			case l.planned:
+				if l.latencyKnown {
+					h.LatencyMs[ip] = l.LatencyMs
+				}
+				h.PacketLoss[ip] = l.PacketLoss
+			}
+		}
+		if h.FRRState != nil {
+			h.FRRState = copyMap(h.FRRState)
+			for neighbor := range h.FRRState {
+				if s := t.frr[id+"|"+neighbor]; s != nil {
+					h.FRRState[neighbor] = s.value
+				}
+			}
+		}
+		out[id] = h
+	}
+	return out
+}
+
+// Links returns the current state of every tracked node and link, penalties decayed to now.
+func (t *Tracker) Links(cfg model.DampingConfig) []Link {
+	p := resolve(cfg)
+	now := time.Now()
+	t.mu.Lock()
+	out := make([]Link, 0, len(t.links))
+	for _, l := range t.links {
+		c := *l
+		c.decay(p, now)
+		c.Penalty = math.Round(c.Penalty)
+		out = append(out, c)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Events returns the recorded transitions, oldest first.
+func (t *Tracker) Events() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Event(nil), t.events...)
+}
+
+// State returns the state machines of every node and link and of every BGP session,
+// for persisting them; penalties are not decayed.
+func (t *Tracker) State() ([]model.LinkState, map[string]model.StickyState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	links := make([]model.LinkState, 0, len(t.links))
+	for _, l := range t.links {
+		links = append(links, model.LinkState{
+			ID:           l.ID,
+			From:         l.From,
+			To:           l.To,
+			State:        l.State,
+			Suppressed:   l.Suppressed,
+			Penalty:      l.Penalty,
+			Flaps:        l.Flaps,
+			Since:        l.Since,
+			HoldUntil:    l.HoldUntil,
+			LatencyMs:    l.LatencyMs,
+			PacketLoss:   l.PacketLoss,
+			Bad:          l.bad,
+			Good:         l.good,
+			Decayed:      l.decayed,
+			Planned:      l.planned,
+			LatencyKnown: l.latencyKnown,
+		})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	bgp := make(map[string]model.StickyState, len(t.frr))
+	for k, s := range t.frr {
+		bgp[k] = model.StickyState{Value: s.value, Pending: s.pending, Count: s.count}
+	}
+	return links, bgp
+}
+
+// Restore replaces the state machines with ones returned by State. Recorded transitions
+// are kept.
+func (t *Tracker) Restore(links []model.LinkState, bgp map[string]model.StickyState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.links = make(map[string]*Link, len(links))
+	for _, s := range links {
+		t.links[s.ID] = &Link{
+			ID:           s.ID,
+			From:         s.From,
+			To:           s.To,
+			State:        s.State,
+			Usable:       usable(s.State),
+			Suppressed:   s.Suppressed,
+			Penalty:      s.Penalty,
+			Flaps:        s.Flaps,
+			Since:        s.Since,
+			HoldUntil:    s.HoldUntil,
+			LatencyMs:    s.LatencyMs,
+			PacketLoss:   s.PacketLoss,
+			bad:          s.Bad,
+			good:         s.Good,
+			decayed:      s.Decayed,
+			planned:      s.Planned,
+			latencyKnown: s.LatencyKnown,
+		}
+	}
+	t.frr = make(map[string]*sticky, len(bgp))
+	for k, s := range bgp {
+		t.frr[k] = &sticky{value: s.Value, pending: s.Pending, count: s.Count}
+	}
+}
+
+// sticky is a value that only changes after a new value was seen a number of times in a row.
+type sticky struct {
+	value, pending string
+	count          int
+}
+
+func (s *sticky) step(v string, after int) {
+	if v == s.value {
+		s.pending, s.count = "", 0
+		return
+	}
+	if v != s.pending {
+		s.pending, s.count = v, 0
+	}
+	s.count++
+	if s.count >= after {
+		s.value, s.pending, s.count = v, "", 0
+	}
+}
+
+func copyMap[V any](m map[string]V) map[string]V {
+	out := make(map[string]V, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func overlayAddr(n model.Node) string {
+	ip, _, _ := strings.Cut(n.OverlayIP, "/")
+	return ip
+}
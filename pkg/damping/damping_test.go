@@ -0,0 +1,238 @@
+package damping
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+var (
+	t0    = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	nodes = []model.Node{{ID: "a", OverlayIP: "10.0.0.1/32"}, {ID: "b", OverlayIP: "10.0.0.2/32"}}
+)
+
+// sample is one report of a about its probe of b.
+type sample struct {
+	at      time.Duration
+	loss    float64
+	latency int
+	bgp     string // state of a's session with b, "" = not reported
+}
+
+func (s sample) report() model.HealthReport {
+	r := model.HealthReport{
+		NodeID:     "a",
+		Status:     "up",
+		LatencyMs:  map[string]int{"10.0.0.2": s.latency},
+		PacketLoss: map[string]float64{"10.0.0.2": s.loss},
+		Timestamp:  t0.Add(s.at),
+	}
+	if s.bgp != "" {
+		r.FRRState = map[string]string{"b": s.bgp}
+	}
+	return r
+}
+
+func feed(tr *Tracker, cfg model.DampingConfig, samples ...sample) []Event {
+	var events []Event
+	for _, s := range samples {
+		events = append(events, tr.Observe(cfg, s.report(), nodes)...)
+	}
+	return events
+}
+
+func TestStateMachine(t *testing.T) {
+	cfg := model.DampingConfig{DownAfter: 3, UpAfter: 2, HoldDown: "30s", SuppressAt: 5000}
+	down := []sample{{0, 100, 0, ""}, {time.Second, 100, 0, ""}, {2 * time.Second, 100, 0, ""}}
+	tests := []struct {
+		name    string
+		samples []sample
+		want    []string // state of a>b after each sample
+	}{
+		{"transient loss", []sample{{0, 100, 0, ""}, {time.Second, 0, 10, ""}}, []string{StateFailing, StateUp}},
+		{"below threshold", []sample{{0, 49, 10, ""}, {time.Second, 50, 10, ""}}, []string{StateUp, StateFailing}},
+		{"sustained loss", down, []string{StateFailing, StateFailing, StateDown}},
+		{
+			"hold-down delays recovery",
+			append(down[:3:3], sample{3 * time.Second, 0, 10, ""}, sample{4 * time.Second, 0, 10, ""}, sample{32 * time.Second, 0, 10, ""}),
+			[]string{StateFailing, StateFailing, StateDown, StateRecovering, StateRecovering, StateUp},
+		},
+		{
+			"relapse while recovering",
+			append(down[:3:3], sample{3 * time.Second, 0, 10, ""}, sample{4 * time.Second, 100, 0, ""}),
+			[]string{StateFailing, StateFailing, StateDown, StateRecovering, StateDown},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := NewTracker()
+			for i, s := range tc.samples {
+				feed(tr, cfg, s)
+				l := tr.links["a>b"]
+				if l.State != tc.want[i] {
+					t.Fatalf("after sample %d state = %s, want %s", i, l.State, tc.want[i])
+				}
+				if l.Usable != usable(tc.want[i]) {
+					t.Fatalf("after sample %d usable = %v in state %s", i, l.Usable, l.State)
+				}
+			}
+		})
+	}
+}
+
+func TestFlapSuppression(t *testing.T) {
+	cfg := model.DampingConfig{DownAfter: 1, UpAfter: 1, HoldDown: "1s", Penalty: 1100, SuppressAt: 2000, ReuseAt: 750, HalfLife: "5m"}
+	decay := func(p float64, d time.Duration) float64 { return p * math.Exp2(-d.Seconds()/300) }
+	second := decay(1100, 4*time.Second) + 1100
+	tests := []struct {
+		s            sample
+		state        string
+		suppressed   bool
+		penalty      float64
+		flipsPlanned bool
+	}{
+		{sample{0, 100, 0, ""}, StateDown, false, 1100, true},
+		{sample{2 * time.Second, 0, 10, ""}, StateUp, false, decay(1100, 2*time.Second), true},
+		{sample{4 * time.Second, 100, 0, ""}, StateDown, true, second, true},
+		{sample{6 * time.Second, 0, 10, ""}, StateRecovering, true, decay(second, 2*time.Second), false},
+		// one half-life later the penalty is still above reuseAt
+		{sample{306 * time.Second, 0, 10, ""}, StateRecovering, true, decay(second, 302*time.Second), false},
+		// two half-lives: decayed below reuseAt, suppression lifts and the link comes back
+		{sample{606 * time.Second, 0, 10, ""}, StateUp, false, decay(second, 602*time.Second), true},
+	}
+	tr := NewTracker()
+	for i, tc := range tests {
+		events := feed(tr, cfg, tc.s)
+		l := tr.links["a>b"]
+		if l.State != tc.state || l.Suppressed != tc.suppressed {
+			t.Fatalf("step %d: state %s suppressed %v, want %s suppressed %v", i, l.State, l.Suppressed, tc.state, tc.suppressed)
+		}
+		if math.Abs(l.Penalty-tc.penalty) > 1 {
+			t.Errorf("step %d: penalty %.1f, want %.1f", i, l.Penalty, tc.penalty)
+		}
+		flipped := false
+		for _, ev := range events {
+			flipped = flipped || (ev.Link == "a>b" && ev.Flipped())
+		}
+		if flipped != tc.flipsPlanned {
+			t.Errorf("step %d: flipped plans = %v, want %v (events %+v)", i, flipped, tc.flipsPlanned, events)
+		}
+	}
+	if l := tr.links["a>b"]; l.Flaps != 2 {
+		t.Errorf("flaps = %d, want 2", l.Flaps)
+	}
+}
+
+func TestHysteresis(t *testing.T) {
+	cfg := model.DampingConfig{LatencyHysteresis: 0.2}
+	tests := []struct {
+		latency     int
+		loss        float64
+		wantLatency int
+		wantLoss    float64
+	}{
+		{100, 0, 100, 0},
+		{115, 0, 100, 0}, // inside 20%
+		{121, 0, 121, 0},
+		{124, 3, 121, 0}, // loss moved less than lossStep
+		{124, 6, 121, 6},
+		{200, 60, 121, 6}, // a bad sample is not planned
+		{12, 0, 12, 0},
+		{16, 0, 12, 0}, // below the 5ms floor
+		{17, 0, 17, 0},
+	}
+	tr := NewTracker()
+	for i, tc := range tests {
+		s := sample{time.Duration(i) * time.Second, tc.loss, tc.latency, ""}
+		feed(tr, cfg, s)
+		h := tr.Apply(cfg, map[string]model.HealthReport{"a": s.report()}, nodes)["a"]
+		if got := h.LatencyMs["10.0.0.2"]; got != tc.wantLatency {
+			t.Errorf("sample %d: planned latency %d, want %d", i, got, tc.wantLatency)
+		}
+		if got := h.PacketLoss["10.0.0.2"]; got != tc.wantLoss {
+			t.Errorf("sample %d: planned loss %v, want %v", i, got, tc.wantLoss)
+		}
+	}
+}
+
+// roundTrip persists tr's state the way the controller does and loads it into a new tracker.
+func roundTrip(t *testing.T, tr *Tracker) *Tracker {
+	t.Helper()
+	links, bgp := tr.State()
+	b, err := json.Marshal(model.RoutingState{Links: links, BGP: bgp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs model.RoutingState
+	if err := json.Unmarshal(b, &rs); err != nil {
+		t.Fatal(err)
+	}
+	out := NewTracker()
+	out.Restore(rs.Links, rs.BGP)
+	return out
+}
+
+func TestRestoreResumes(t *testing.T) {
+	cfg := model.DampingConfig{DownAfter: 3, UpAfter: 2, HoldDown: "30s", Penalty: 1100, SuppressAt: 2000, ReuseAt: 750, HalfLife: "5m"}
+	s := func(sec int, loss float64, latency int, bgp string) sample {
+		return sample{time.Duration(sec) * time.Second, loss, latency, bgp}
+	}
+	tests := []struct {
+		name   string
+		before []sample
+		after  []sample
+	}{
+		{
+			"failing mid-count",
+			[]sample{s(0, 0, 10, "Established"), s(1, 100, 0, "Active"), s(2, 100, 0, "Active")},
+			[]sample{s(3, 100, 0, "Active"), s(4, 0, 10, "Active"), s(40, 0, 10, "Established")},
+		},
+		{
+			"down in hold-down",
+			[]sample{s(0, 100, 0, ""), s(1, 100, 0, ""), s(2, 100, 0, ""), s(3, 0, 10, "")},
+			[]sample{s(4, 0, 10, ""), s(20, 0, 10, ""), s(33, 0, 10, "")},
+		},
+		{
+			"suppressed",
+			[]sample{s(0, 100, 0, ""), s(1, 100, 0, ""), s(2, 100, 0, ""), s(33, 0, 10, ""), s(34, 0, 10, ""), s(35, 100, 0, ""), s(36, 100, 0, ""), s(37, 100, 0, "")},
+			[]sample{s(70, 0, 10, ""), s(71, 0, 10, ""), s(400, 0, 10, ""), s(700, 0, 10, "")},
+		},
+		{
+			"planned latency",
+			[]sample{s(0, 0, 100, ""), s(1, 0, 115, "")},
+			[]sample{s(2, 0, 118, ""), s(3, 0, 130, ""), s(4, 10, 130, "")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			orig := NewTracker()
+			feed(orig, cfg, tc.before...)
+			restored := roundTrip(t, orig)
+			wantLinks, wantBGP := orig.State()
+			gotLinks, gotBGP := restored.State()
+			if !reflect.DeepEqual(gotLinks, wantLinks) || !reflect.DeepEqual(gotBGP, wantBGP) {
+				t.Fatalf("Restore(State()) = %+v %+v, want %+v %+v", gotLinks, gotBGP, wantLinks, wantBGP)
+			}
+			for i, smp := range tc.after {
+				want := feed(orig, cfg, smp)
+				got := feed(restored, cfg, smp)
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("sample %d after restore: events %+v, want %+v", i, got, want)
+				}
+				health := map[string]model.HealthReport{"a": smp.report()}
+				if got, want := restored.Apply(cfg, health, nodes), orig.Apply(cfg, health, nodes); !reflect.DeepEqual(got, want) {
+					t.Fatalf("sample %d after restore: damped health %+v, want %+v", i, got, want)
+				}
+			}
+			gotLinks, gotBGP = restored.State()
+			wantLinks, wantBGP = orig.State()
+			if !reflect.DeepEqual(gotLinks, wantLinks) || !reflect.DeepEqual(gotBGP, wantBGP) {
+				t.Errorf("state after resuming = %+v %+v, want %+v %+v", gotLinks, gotBGP, wantLinks, wantBGP)
+			}
+		})
+	}
+}
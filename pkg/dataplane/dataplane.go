@@ -0,0 +1,130 @@
+// Package dataplane configures the WireGuard interface, routes and policy rules of a node.
+// The shell backend drives wg-quick, wg and ip(8); the native backend talks to the kernel
+// through wgctrl and netlink and only changes what differs from the live state.
+package dataplane
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Backend names accepted by New.
+const (
+	Shell  = "shell"
+	Native = "native"
+)
+
+// MainTable is the kernel's main routing table.
+const MainTable = 254
+
+// Dataplane is the set of kernel operations the agent performs.
+type Dataplane interface {
+	Name() string
+	// ApplyInterface creates iface from the wg-quick config at confPath, or updates an
+	// existing interface in place (keys, peers, addresses) without taking it down.
+	ApplyInterface(iface, confPath string) error
+	DeleteInterface(iface, confPath string) error
+	ReplaceRoute(r Route) error
+	DeleteRoute(r Route) error
+	// Routes lists the routes of one address family in table (0 for main), optionally only
+	// those through dev.
+	Routes(v6 bool, table int, dev string) ([]Route, error)
+	// FlushTable removes every route of both address families from table.
+	FlushTable(table int) error
+	// AddRule installs a policy rule; an identical existing rule is not an error.
+	AddRule(r Rule) error
+	// DeleteRules removes every rule of both address families with the given priority.
+	DeleteRules(priority int) error
+	FlushRouteCache() error
+}
+
+// Route is a unicast route. Routes without Via are link-scoped to Dev.
+type Route struct {
+	Dst   string // CIDR; 0.0.0.0/0 or ::/0 for the default route
+	Via   string
+	Dev   string
+	Table int // 0 for main
+}
+
+// V6 reports whether r is an IPv6 route.
+func (r Route) V6() bool { return strings.Contains(r.Dst, ":") }
+
+func (r Route) String() string {
+	s := r.Dst
+	if r.Via != "" {
+		s += " via " + r.Via
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	if r.Table != 0 && r.Table != MainTable {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+// Rule is a policy routing rule. From/To are CIDRs; V6 selects the family when both are empty.
+type Rule struct {
+	From     string
+	To       string
+	Table    int
+	Priority int
+	V6       bool
+}
+
+func (r Rule) family6() bool {
+	return r.V6 || strings.Contains(r.From, ":") || strings.Contains(r.To, ":")
+}
+
+func (r Rule) String() string {
+	s := fmt.Sprintf("priority %d", r.Priority)
+	if r.From != "" {
+		s += " from " + r.From
+	}
+	if r.To != "" {
+		s += " to " + r.To
+	}
+	return s + fmt.Sprintf(" lookup %d", r.Table)
+}
+
+// OpError is the failure of one dataplane operation.
+type OpError struct {
+	Backend string
+	Op      string // e.g. "route replace", "peer configure"
+	Target  string
+	Err     error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s dataplane: %s %s: %v", e.Backend, e.Op, e.Target, e.Err)
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// New returns the backend called name.
+func New(name string) (Dataplane, error) {
+	switch name {
+	case Shell:
+		return ShellDataplane{}, nil
+	case Native:
+		return newNative()
+	default:
+		return nil, fmt.Errorf("unknown dataplane %q (want %s or %s)", name, Native, Shell)
+	}
+}
+
+// hostPrefix turns a bare address into a host CIDR and leaves CIDRs alone.
+func hostPrefix(addr string) string {
+	if strings.Contains(addr, "/") {
+		return addr
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return addr + "/128"
+	}
+	return addr + "/32"
+}
+
+func isDefault(dst string) bool {
+	return dst == "0.0.0.0/0" || dst == "::/0"
+}
@@ -0,0 +1,445 @@
+//go:build linux
+
+package dataplane
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"peer-wan/pkg/wireguard"
+)
+
+// defaultMTU is what wg-quick picks on a 1500-byte path.
+const defaultMTU = 1420
+
+// nativeDataplane configures the kernel through wgctrl and netlink, changing only what
+// differs from the live state.
+type nativeDataplane struct{}
+
+func newNative() (Dataplane, error) {
+	c, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("native dataplane: %w", err)
+	}
+	c.Close()
+	return nativeDataplane{}, nil
+}
+
+func (nativeDataplane) Name() string { return Native }
+
+func (nativeDataplane) fail(op, target string, err error) error {
+	return &OpError{Backend: Native, Op: op, Target: target, Err: err}
+}
+
+// ApplyInterface creates iface when it is missing and then converges its WireGuard
+// device, addresses and link state on the config. Like wg-quick up, a freshly created
+// interface gets main-table routes for its peers' allowed IPs; default routes are left
+// to the policy tables.
+func (n nativeDataplane) ApplyInterface(iface, confPath string) error {
+	data, err := os.ReadFile(confPath)
+	if err != nil {
+		return n.fail("read config", confPath, err)
+	}
+	cfg, err := wireguard.ParseConfig(string(data))
+	if err != nil {
+		return n.fail("parse config", confPath, err)
+	}
+	created := false
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		if !errors.As(err, &netlink.LinkNotFoundError{}) {
+			return n.fail("link lookup", iface, err)
+		}
+		mtu := cfg.MTU
+		if mtu == 0 {
+			mtu = defaultMTU
+		}
+		if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: iface, MTU: mtu}}); err != nil {
+			return n.fail("link add", iface, err)
+		}
+		if link, err = netlink.LinkByName(iface); err != nil {
+			return n.fail("link lookup", iface, err)
+		}
+		created = true
+	}
+	if err := n.configureDevice(iface, cfg); err != nil {
+		if created {
+			// leave no half-configured interface behind, as wg-quick up does
+			_ = netlink.LinkDel(link)
+		}
+		return err
+	}
+	errs := []error{n.syncAddresses(link, cfg.Addresses)}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := netlink.LinkSetUp(link); err != nil {
+			errs = append(errs, n.fail("link up", iface, err))
+		}
+	}
+	if created {
+		for _, p := range cfg.Peers {
+			for _, pfx := range p.AllowedIPs {
+				if !isDefault(pfx) {
+					errs = append(errs, n.ReplaceRoute(Route{Dst: pfx, Dev: iface}))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configureDevice sends wgctrl only the key, port and peer changes between the live
+// device and cfg; peers missing from cfg are removed.
+func (n nativeDataplane) configureDevice(iface string, cfg wireguard.Config) error {
+	c, err := wgctrl.New()
+	if err != nil {
+		return n.fail("wgctrl open", iface, err)
+	}
+	defer c.Close()
+	dev, err := c.Device(iface)
+	if err != nil {
+		return n.fail("device read", iface, err)
+	}
+	var want wgtypes.Config
+	if cfg.PrivateKey != "" {
+		key, err := wgtypes.ParseKey(cfg.PrivateKey)
+		if err != nil {
+			return n.fail("parse private key", iface, err)
+		}
+		if key != dev.PrivateKey {
+			want.PrivateKey = &key
+		}
+	}
+	if cfg.ListenPort != 0 && cfg.ListenPort != dev.ListenPort {
+		port := cfg.ListenPort
+		want.ListenPort = &port
+	}
+	live := map[wgtypes.Key]wgtypes.Peer{}
+	for _, p := range dev.Peers {
+		live[p.PublicKey] = p
+	}
+	var errs []error
+	keep := map[wgtypes.Key]bool{}
+	for _, p := range cfg.Peers {
+		pc, err := peerConfig(p)
+		if pc.PublicKey != (wgtypes.Key{}) {
+			// a live peer whose entry failed to parse is left as it is
+			keep[pc.PublicKey] = true
+		}
+		if err != nil {
+			errs = append(errs, n.fail("peer config", shortKey(p.PublicKey), err))
+			continue
+		}
+		if cur, ok := live[pc.PublicKey]; ok && peerUpToDate(cur, pc) {
+			continue
+		}
+		want.Peers = append(want.Peers, pc)
+	}
+	for key := range live {
+		if !keep[key] {
+			want.Peers = append(want.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	if want.PrivateKey == nil && want.ListenPort == nil && len(want.Peers) == 0 {
+		return errors.Join(errs...)
+	}
+	if err := c.ConfigureDevice(iface, want); err != nil {
+		errs = append(errs, n.fail("device configure", iface, err))
+	}
+	return errors.Join(errs...)
+}
+
+// peerConfig converts a parsed [Peer] section into a full wgtypes peer update. The
+// public key is set even when a later field fails so the caller can identify the peer.
+func peerConfig(p wireguard.PeerConfig) (wgtypes.PeerConfig, error) {
+	var pc wgtypes.PeerConfig
+	key, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return pc, fmt.Errorf("public key: %w", err)
+	}
+	pc.PublicKey = key
+	// an absent preshared key clears the live one (the zero key)
+	var psk wgtypes.Key
+	if p.PresharedKey != "" {
+		if psk, err = wgtypes.ParseKey(p.PresharedKey); err != nil {
+			return pc, fmt.Errorf("preshared key: %w", err)
+		}
+	}
+	pc.PresharedKey = &psk
+	keepalive := time.Duration(p.Keepalive) * time.Second
+	pc.PersistentKeepaliveInterval = &keepalive
+	pc.ReplaceAllowedIPs = true
+	for _, a := range p.AllowedIPs {
+		_, ipn, err := net.ParseCIDR(hostPrefix(a))
+		if err != nil {
+			return pc, fmt.Errorf("allowed ip: %w", err)
+		}
+		pc.AllowedIPs = append(pc.AllowedIPs, *ipn)
+	}
+	if p.Endpoint != "" {
+		if pc.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
+			return pc, fmt.Errorf("endpoint: %w", err)
+		}
+	}
+	return pc, nil
+}
+
+// peerUpToDate reports whether applying pc would leave cur unchanged. Without a
+// configured endpoint the roamed one is kept, as wg syncconf does.
+func peerUpToDate(cur wgtypes.Peer, pc wgtypes.PeerConfig) bool {
+	if cur.PresharedKey != *pc.PresharedKey || cur.PersistentKeepaliveInterval != *pc.PersistentKeepaliveInterval {
+		return false
+	}
+	if pc.Endpoint != nil && (cur.Endpoint == nil || cur.Endpoint.String() != pc.Endpoint.String()) {
+		return false
+	}
+	if len(cur.AllowedIPs) != len(pc.AllowedIPs) {
+		return false
+	}
+	have := map[string]bool{}
+	for _, ipn := range cur.AllowedIPs {
+		have[ipn.String()] = true
+	}
+	for _, ipn := range pc.AllowedIPs {
+		if !have[ipn.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncAddresses adds missing addresses and removes unlisted ones, keeping IPv6 link-local.
+func (n nativeDataplane) syncAddresses(link netlink.Link, addrs []string) error {
+	iface := link.Attrs().Name
+	var errs []error
+	want := map[string]*netlink.Addr{}
+	for _, a := range addrs {
+		addr, err := netlink.ParseAddr(hostPrefix(a))
+		if err != nil {
+			errs = append(errs, n.fail("parse address", a, err))
+			continue
+		}
+		want[addr.IPNet.String()] = addr
+	}
+	live, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return n.fail("address list", iface, err)
+	}
+	have := map[string]bool{}
+	for _, a := range live {
+		key := a.IPNet.String()
+		if _, ok := want[key]; ok {
+			have[key] = true
+			continue
+		}
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err := netlink.AddrDel(link, &a); err != nil {
+			errs = append(errs, n.fail("address delete", key, err))
+		}
+	}
+	for key, a := range want {
+		if have[key] {
+			continue
+		}
+		if err := netlink.AddrAdd(link, a); err != nil && !errors.Is(err, unix.EEXIST) {
+			errs = append(errs, n.fail("address add", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n nativeDataplane) DeleteInterface(iface, _ string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		if errors.As(err, &netlink.LinkNotFoundError{}) {
+			return nil
+		}
+		return n.fail("link lookup", iface, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return n.fail("link delete", iface, err)
+	}
+	return nil
+}
+
+func family(v6 bool) int {
+	if v6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+func tableID(table int) int {
+	if table == 0 {
+		return MainTable
+	}
+	return table
+}
+
+func (n nativeDataplane) route(r Route) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(hostPrefix(r.Dst))
+	if err != nil {
+		return nil, err
+	}
+	nr := &netlink.Route{Dst: dst, Table: tableID(r.Table)}
+	if r.Dev != "" {
+		link, err := netlink.LinkByName(r.Dev)
+		if err != nil {
+			return nil, err
+		}
+		nr.LinkIndex = link.Attrs().Index
+	}
+	if r.Via == "" {
+		nr.Scope = netlink.SCOPE_LINK
+	} else if nr.Gw = net.ParseIP(r.Via); nr.Gw == nil {
+		return nil, fmt.Errorf("invalid gateway %q", r.Via)
+	}
+	return nr, nil
+}
+
+// ReplaceRoute leaves an identical live route alone.
+func (n nativeDataplane) ReplaceRoute(r Route) error {
+	nr, err := n.route(r)
+	if err != nil {
+		return n.fail("route replace", r.String(), err)
+	}
+	live, err := netlink.RouteListFiltered(family(r.V6()), &netlink.Route{Dst: nr.Dst, Table: nr.Table}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+	if err == nil {
+		for _, cur := range live {
+			if cur.LinkIndex == nr.LinkIndex && cur.Gw.Equal(nr.Gw) && cur.Scope == nr.Scope && len(cur.MultiPath) == 0 {
+				return nil
+			}
+		}
+	}
+	if err := netlink.RouteReplace(nr); err != nil {
+		return n.fail("route replace", r.String(), err)
+	}
+	return nil
+}
+
+func (n nativeDataplane) DeleteRoute(r Route) error {
+	nr, err := n.route(r)
+	if err == nil {
+		err = netlink.RouteDel(nr)
+	}
+	if err != nil {
+		return n.fail("route delete", r.String(), err)
+	}
+	return nil
+}
+
+func (n nativeDataplane) Routes(v6 bool, table int, dev string) ([]Route, error) {
+	filter := &netlink.Route{Table: tableID(table)}
+	mask := netlink.RT_FILTER_TABLE
+	if dev != "" {
+		link, err := netlink.LinkByName(dev)
+		if err != nil {
+			return nil, n.fail("route list", dev, err)
+		}
+		filter.LinkIndex = link.Attrs().Index
+		mask |= netlink.RT_FILTER_OIF
+	}
+	live, err := netlink.RouteListFiltered(family(v6), filter, mask)
+	if err != nil {
+		return nil, n.fail("route list", fmt.Sprintf("table %d", filter.Table), err)
+	}
+	names := map[int]string{}
+	var routes []Route
+	for _, nr := range live {
+		if nr.Dst == nil || nr.Type != unix.RTN_UNICAST {
+			continue
+		}
+		r := Route{Dst: nr.Dst.String(), Table: table, Dev: dev}
+		if nr.Gw != nil {
+			r.Via = nr.Gw.String()
+		}
+		if r.Dev == "" && nr.LinkIndex > 0 {
+			if _, ok := names[nr.LinkIndex]; !ok {
+				if link, err := netlink.LinkByIndex(nr.LinkIndex); err == nil {
+					names[nr.LinkIndex] = link.Attrs().Name
+				}
+			}
+			r.Dev = names[nr.LinkIndex]
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (n nativeDataplane) FlushTable(table int) error {
+	var errs []error
+	for _, v6 := range []bool{false, true} {
+		live, err := netlink.RouteListFiltered(family(v6), &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			errs = append(errs, n.fail("route list", fmt.Sprintf("table %d", table), err))
+			continue
+		}
+		for i := range live {
+			if err := netlink.RouteDel(&live[i]); err != nil && !errors.Is(err, unix.ESRCH) {
+				errs = append(errs, n.fail("route delete", live[i].String(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n nativeDataplane) AddRule(r Rule) error {
+	nr := netlink.NewRule()
+	nr.Family = family(r.family6())
+	nr.Table = r.Table
+	nr.Priority = r.Priority
+	var err error
+	if r.From != "" {
+		_, nr.Src, err = net.ParseCIDR(hostPrefix(r.From))
+	}
+	if err == nil && r.To != "" {
+		_, nr.Dst, err = net.ParseCIDR(hostPrefix(r.To))
+	}
+	if err == nil {
+		err = netlink.RuleAdd(nr)
+	}
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return n.fail("rule add", r.String(), err)
+	}
+	return nil
+}
+
+func (n nativeDataplane) DeleteRules(priority int) error {
+	var errs []error
+	for _, v6 := range []bool{false, true} {
+		live, err := netlink.RuleListFiltered(family(v6), &netlink.Rule{Priority: priority}, netlink.RT_FILTER_PRIORITY)
+		if err != nil {
+			errs = append(errs, n.fail("rule list", fmt.Sprintf("priority %d", priority), err))
+			continue
+		}
+		for i := range live {
+			live[i].Family = family(v6)
+			if err := netlink.RuleDel(&live[i]); err != nil && !errors.Is(err, unix.ENOENT) {
+				errs = append(errs, n.fail("rule delete", live[i].String(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FlushRouteCache only matters for IPv6; IPv4 has had no route cache since Linux 3.6.
+func (n nativeDataplane) FlushRouteCache() error {
+	_ = os.WriteFile("/proc/sys/net/ipv6/route/flush", []byte("1"), 0o200)
+	return nil
+}
+
+func shortKey(k string) string {
+	if len(k) > 8 {
+		return k[:8]
+	}
+	return k
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package dataplane
+
+import "errors"
+
+func newNative() (Dataplane, error) {
+	return nil, errors.New("native dataplane requires linux; use the shell dataplane")
+}
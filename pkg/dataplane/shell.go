@@ -0,0 +1,238 @@
+package dataplane
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"peer-wan/pkg/wireguard"
+)
+
+// ShellDataplane drives wg-quick, wg and ip(8). It suits hosts that run wireguard-go or
+// otherwise rely on wg-quick's own handling of the interface.
+type ShellDataplane struct{}
+
+func (ShellDataplane) Name() string { return Shell }
+
+func (s ShellDataplane) fail(op, target string, err error, out []byte) error {
+	if len(bytes.TrimSpace(out)) > 0 {
+		err = fmt.Errorf("%w (%s)", err, strings.TrimSpace(string(out)))
+	}
+	return &OpError{Backend: Shell, Op: op, Target: target, Err: err}
+}
+
+// ApplyInterface brings iface up with wg-quick, or syncs an existing interface with
+// wg syncconf so established sessions survive.
+func (s ShellDataplane) ApplyInterface(iface, confPath string) error {
+	if _, err := net.InterfaceByName(iface); err != nil {
+		if out, err := exec.Command("wg-quick", "up", confPath).CombinedOutput(); err != nil {
+			return s.fail("wg-quick up", iface, err, out)
+		}
+		return nil
+	}
+	conf, err := exec.Command("wg-quick", "strip", confPath).Output()
+	if err != nil {
+		return s.fail("wg-quick strip", confPath, err, nil)
+	}
+	cmd := exec.Command("wg", "syncconf", iface, "/dev/stdin")
+	cmd.Stdin = bytes.NewReader(conf)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return s.fail("wg syncconf", iface, err, out)
+	}
+	// syncconf ignores Address; keep the interface addresses in line (dual-stack toggles)
+	return s.syncAddresses(iface, confPath)
+}
+
+// syncAddresses adds the Address entries of the config to iface and removes global IPv6
+// addresses that are no longer listed.
+func (s ShellDataplane) syncAddresses(iface, confPath string) error {
+	data, err := os.ReadFile(confPath)
+	if err != nil {
+		return s.fail("read config", confPath, err, nil)
+	}
+	cfg, err := wireguard.ParseConfig(string(data))
+	if err != nil {
+		return s.fail("parse config", confPath, err, nil)
+	}
+	want := map[string]bool{}
+	for _, addr := range cfg.Addresses {
+		want[hostPrefix(addr)] = true
+		if out, err := exec.Command("ip", ipArgs(strings.Contains(addr, ":"), "address", "replace", addr, "dev", iface)...).CombinedOutput(); err != nil {
+			return s.fail("address replace", addr, err, out)
+		}
+	}
+	out, err := exec.Command("ip", "-6", "-o", "address", "show", "dev", iface, "scope", "global").Output()
+	if err != nil {
+		return nil
+	}
+	var errs []error
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		// "<idx>: <iface> inet6 <addr>/<len> scope global ..."
+		if len(fields) < 4 || fields[2] != "inet6" || want[fields[3]] {
+			continue
+		}
+		if out, err := exec.Command("ip", "-6", "address", "del", fields[3], "dev", iface).CombinedOutput(); err != nil {
+			errs = append(errs, s.fail("address delete", fields[3], err, out))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteInterface runs wg-quick down and falls back to deleting the link.
+func (s ShellDataplane) DeleteInterface(iface, confPath string) error {
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return nil
+	}
+	if err := exec.Command("wg-quick", "down", confPath).Run(); err == nil {
+		return nil
+	}
+	if out, err := exec.Command("ip", "link", "del", iface).CombinedOutput(); err != nil {
+		return s.fail("link delete", iface, err, out)
+	}
+	return nil
+}
+
+func routeArgs(verb string, r Route) []string {
+	dst := r.Dst
+	if isDefault(dst) {
+		dst = "default"
+	}
+	args := ipArgs(r.V6(), "route", verb, dst)
+	if r.Via != "" {
+		args = append(args, "via", r.Via)
+	}
+	if r.Dev != "" {
+		args = append(args, "dev", r.Dev)
+	}
+	if r.Via == "" && verb == "replace" {
+		args = append(args, "scope", "link")
+	}
+	if r.Table != 0 && r.Table != MainTable {
+		args = append(args, "table", strconv.Itoa(r.Table))
+	}
+	return args
+}
+
+func (s ShellDataplane) ReplaceRoute(r Route) error {
+	if out, err := exec.Command("ip", routeArgs("replace", r)...).CombinedOutput(); err != nil {
+		return s.fail("route replace", r.String(), err, out)
+	}
+	return nil
+}
+
+func (s ShellDataplane) DeleteRoute(r Route) error {
+	if out, err := exec.Command("ip", routeArgs("del", r)...).CombinedOutput(); err != nil {
+		return s.fail("route delete", r.String(), err, out)
+	}
+	return nil
+}
+
+func (s ShellDataplane) Routes(v6 bool, table int, dev string) ([]Route, error) {
+	args := ipArgs(v6, "route", "show")
+	if table != 0 && table != MainTable {
+		args = append(args, "table", strconv.Itoa(table))
+	}
+	if dev != "" {
+		args = append(args, "dev", dev)
+	}
+	out, err := exec.Command("ip", args...).Output()
+	if err != nil {
+		return nil, s.fail("route list", strings.Join(args, " "), err, nil)
+	}
+	return parseRoutes(string(out), v6, table, dev), nil
+}
+
+// parseRoutes reads `ip route show` output. ip omits the dev of a dev-filtered listing and
+// prints host routes without a mask.
+func parseRoutes(out string, v6 bool, table int, dev string) []Route {
+	var routes []Route
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		r := Route{Dst: fields[0], Dev: dev, Table: table}
+		switch {
+		case r.Dst == "default" && v6:
+			r.Dst = "::/0"
+		case r.Dst == "default":
+			r.Dst = "0.0.0.0/0"
+		case net.ParseIP(r.Dst) != nil:
+			r.Dst = hostPrefix(r.Dst)
+		case !strings.Contains(r.Dst, "/"):
+			// route types such as unreachable/blackhole
+			continue
+		}
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "via":
+				r.Via = fields[i+1]
+			case "dev":
+				r.Dev = fields[i+1]
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+func (s ShellDataplane) FlushTable(table int) error {
+	var errs []error
+	for _, v6 := range []bool{false, true} {
+		if out, err := exec.Command("ip", ipArgs(v6, "route", "flush", "table", strconv.Itoa(table))...).CombinedOutput(); err != nil {
+			errs = append(errs, s.fail("route flush", fmt.Sprintf("table %d", table), err, out))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s ShellDataplane) AddRule(r Rule) error {
+	args := ipArgs(r.family6(), "rule", "add")
+	if r.From != "" {
+		args = append(args, "from", r.From)
+	}
+	if r.To != "" {
+		args = append(args, "to", r.To)
+	}
+	args = append(args, "lookup", strconv.Itoa(r.Table), "priority", strconv.Itoa(r.Priority))
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "File exists") {
+		return s.fail("rule add", r.String(), err, out)
+	}
+	return nil
+}
+
+func (s ShellDataplane) DeleteRules(priority int) error {
+	prio := strconv.Itoa(priority)
+	for _, v6 := range []bool{false, true} {
+		// several rules can share a priority; delete until none are left
+		for i := 0; i < 256; i++ {
+			if exec.Command("ip", ipArgs(v6, "rule", "del", "priority", prio)...).Run() != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s ShellDataplane) FlushRouteCache() error {
+	_ = exec.Command("ip", "route", "flush", "cache").Run()
+	_ = exec.Command("ip", "-6", "route", "flush", "cache").Run()
+	return nil
+}
+
+// ipArgs prefixes an ip(8) argument list with -6 for IPv6 routes and rules.
+func ipArgs(v6 bool, args ...string) []string {
+	if v6 {
+		return append([]string{"-6"}, args...)
+	}
+	return args
+}
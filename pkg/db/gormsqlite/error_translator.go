@@ -0,0 +1,27 @@
+package gormsqlite
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// The error codes to map sqlite errors to gorm errors, here is a reference about error codes for sqlite https://www.sqlite.org/rescode.html.
+var errCodes = map[int]error{
+	1555: gorm.ErrDuplicatedKey,
+	2067: gorm.ErrDuplicatedKey,
+	787:  gorm.ErrForeignKeyViolated,
+}
+
+// Translate it will translate the error to native gorm errors.
+// modernc.org/sqlite errors report the extended result code through Code().
+func (dialector Dialector) Translate(err error) error {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return err
+	}
+	if translatedErr, found := errCodes[coded.Code()]; found {
+		return translatedErr
+	}
+	return err
+}
@@ -15,12 +15,17 @@ import (
 	"peer-wan/pkg/model"
 )
 
-// Init connects to MySQL and runs migrations.
+// Init connects to MySQL (or SQLite when DB_DRIVER=sqlite) and runs migrations.
 // Env:
 //
+//	DB_DRIVER=mysql|sqlite (default mysql)
 //	MYSQL_DSN or MYSQL_HOST, MYSQL_PORT, MYSQL_USER, MYSQL_PASS, MYSQL_DB
+//	SQLITE_PATH (default /var/lib/peer-wan/controller.db)
 func Init() (*gorm.DB, error) {
 	_ = loadDotEnv()
+	if strings.EqualFold(getenv("DB_DRIVER", "mysql"), "sqlite") {
+		return initSQLite(getenv("SQLITE_PATH", defaultSQLitePath))
+	}
 	host := getenv("MYSQL_HOST", "127.0.0.1")
 	port := getenv("MYSQL_PORT", "3306")
 	user := getenv("MYSQL_USER", "root")
@@ -60,6 +65,14 @@ func Init() (*gorm.DB, error) {
 	return db, nil
 }
 
+// OpenMySQL opens a MySQL connection for an explicit DSN without running migrations
+// (used by tooling such as `controller migrate`).
+func OpenMySQL(dsn string) (*gorm.DB, error) {
+	return gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+}
+
 func getenv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"peer-wan/pkg/db/gormsqlite"
+	"peer-wan/pkg/model"
+
+	_ "modernc.org/sqlite"
+)
+
+const defaultSQLitePath = "/var/lib/peer-wan/controller.db"
+
+// initSQLite opens a single-file database through the pure-Go modernc driver so
+// CGO_ENABLED=0 builds keep working.
+func initSQLite(path string) (*gorm.DB, error) {
+	db, err := OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&model.User{}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenSQLite opens (and creates if missing) a SQLite database without running migrations.
+func OpenSQLite(path string) (*gorm.DB, error) {
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create sqlite dir: %w", err)
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout=5000&_pragma=journal_mode=WAL&_pragma=foreign_keys=1"
+	db, err := gorm.Open(gormsqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serializes writers; a single connection avoids "database is locked" churn.
+	sqlDB.SetMaxOpenConns(1)
+	return db, nil
+}
@@ -3,6 +3,7 @@ package frr
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 
 	"peer-wan/pkg/model"
@@ -18,6 +19,8 @@ type BGPConfig struct {
 // - localASN: ASN for this node
 // - neighbors: map of neighbor overlay IP -> ASN (typically same ASN for iBGP)
 // - advertized: list of prefixes to announce
+// Peers with an IPv6 overlay address get a second session over it that carries the
+// ipv6 unicast address-family; IPv6 prefixes are announced there.
 func RenderBGP(localASN int, routerID string, sourceInterface string, neighbors map[string]int, advertised []string, plan model.Plan) (BGPConfig, error) {
 	if localASN == 0 {
 		localASN = 65000
@@ -37,14 +40,52 @@ func RenderBGP(localASN int, routerID string, sourceInterface string, neighbors
 		fmt.Fprintf(&b, " neighbor %s remote-as %d\n", ip, asn)
 		fmt.Fprintf(&b, " neighbor %s update-source %s\n", ip, sourceInterface)
 	}
+	neighbors6 := NeighborOverlayIP6s(plan.Peers)
+	for _, ip := range neighbors6 {
+		fmt.Fprintf(&b, " neighbor %s remote-as %d\n", ip, localASN)
+		fmt.Fprintf(&b, " neighbor %s update-source %s\n", ip, sourceInterface)
+	}
+	var advertised6 []string
 	for _, pfx := range advertised {
+		if policy.IsIPv6(pfx) {
+			advertised6 = append(advertised6, pfx)
+			continue
+		}
 		fmt.Fprintf(&b, " network %s\n", pfx)
 	}
+	// hub-spoke: a hub reflects routes between the spokes it peers with
+	clients, clients6 := reflectorClients(neighbors, plan.Peers)
+	if len(clients) > 0 || len(neighbors6) > 0 {
+		b.WriteString(" address-family ipv4 unicast\n")
+		for _, ip := range clients {
+			fmt.Fprintf(&b, "  neighbor %s route-reflector-client\n", ip)
+		}
+		for _, ip := range neighbors6 {
+			fmt.Fprintf(&b, "  no neighbor %s activate\n", ip)
+		}
+		b.WriteString(" exit-address-family\n")
+	}
+	if len(neighbors6) > 0 {
+		b.WriteString(" address-family ipv6 unicast\n")
+		for _, ip := range neighbors6 {
+			fmt.Fprintf(&b, "  neighbor %s activate\n", ip)
+		}
+		for _, ip := range clients6 {
+			fmt.Fprintf(&b, "  neighbor %s route-reflector-client\n", ip)
+		}
+		for _, pfx := range advertised6 {
+			fmt.Fprintf(&b, "  network %s\n", pfx)
+		}
+		b.WriteString(" exit-address-family\n")
+	}
 	// policy: default route via egress peer overlay, policy rules as static routes
 	if plan.EgressPeerID != "" && len(plan.Peers) > 0 {
 		if nextHop := overlayForPeer(plan.EgressPeerID, plan.Peers); nextHop != "" {
 			fmt.Fprintf(&b, " ip route 0.0.0.0/0 %s\n", stripMask(nextHop))
 		}
+		if nextHop := overlay6ForPeer(plan.EgressPeerID, plan.Peers); nextHop != "" {
+			fmt.Fprintf(&b, " ipv6 route ::/0 %s\n", stripMask(nextHop))
+		}
 	}
 	for _, pr := range plan.PolicyRules {
 		if pr.ViaNode == "" && len(pr.Path) == 0 {
@@ -55,12 +96,15 @@ func RenderBGP(localASN int, routerID string, sourceInterface string, neighbors
 			nextID = pr.Path[0]
 		}
 		nh := stripMask(overlayForPeer(nextID, plan.Peers))
-		if nh == "" {
-			continue
-		}
+		nh6 := stripMask(overlay6ForPeer(nextID, plan.Peers))
 		targets := policy.Expand(pr)
 		for _, t := range targets {
-			fmt.Fprintf(&b, " ip route %s %s\n", t, nh)
+			switch {
+			case policy.IsIPv6(t) && nh6 != "":
+				fmt.Fprintf(&b, " ipv6 route %s %s\n", t, nh6)
+			case !policy.IsIPv6(t) && nh != "":
+				fmt.Fprintf(&b, " ip route %s %s\n", t, nh)
+			}
 		}
 	}
 	b.WriteString("!\n")
@@ -89,7 +133,18 @@ func resolveDomain(domain string) []string {
 	return out
 }
 
+// relayedVia returns the relay carrying peer id's prefixes, or id itself.
+func relayedVia(id string, peers []model.Peer) string {
+	for _, p := range peers {
+		if p.ID == id && p.Relay != "" {
+			return p.Relay
+		}
+	}
+	return id
+}
+
 func overlayForPeer(id string, peers []model.Peer) string {
+	id = relayedVia(id, peers)
 	for _, p := range peers {
 		if p.ID == id {
 			for _, ip := range p.AllowedIPs {
@@ -100,6 +155,35 @@ func overlayForPeer(id string, peers []model.Peer) string {
 	return ""
 }
 
+func overlay6ForPeer(id string, peers []model.Peer) string {
+	id = relayedVia(id, peers)
+	for _, p := range peers {
+		if p.ID == id {
+			return p.OverlayIP6
+		}
+	}
+	return ""
+}
+
+// reflectorClients returns the IPv4 and IPv6 neighbors that are spokes, sorted. Only hubs
+// have spoke peers, so a non-empty result also means the local node is a hub.
+func reflectorClients(neighbors map[string]int, peers []model.Peer) (v4, v6 []string) {
+	for _, p := range peers {
+		if p.Role != model.RoleSpoke || len(p.AllowedIPs) == 0 || p.Relay != "" {
+			continue
+		}
+		if _, ok := neighbors[p.AllowedIPs[0]]; ok {
+			v4 = append(v4, p.AllowedIPs[0])
+		}
+		if p.OverlayIP6 != "" {
+			v6 = append(v6, stripMask(p.OverlayIP6))
+		}
+	}
+	sort.Strings(v4)
+	sort.Strings(v6)
+	return v4, v6
+}
+
 // NeighborOverlayIPs derives neighbor IPs from peers' AllowedIPs by picking the first entry.
 // Assumes AllowedIPs contain the overlay /32 of the peer.
 func NeighborOverlayIPs(peers []model.Peer) map[string]int {
@@ -112,3 +196,16 @@ func NeighborOverlayIPs(peers []model.Peer) map[string]int {
 	}
 	return res
 }
+
+// NeighborOverlayIP6s lists the IPv6 overlay addresses of dual-stack peers, sorted.
+// Relayed peers get no session, like on IPv4 where they have no AllowedIPs.
+func NeighborOverlayIP6s(peers []model.Peer) []string {
+	var res []string
+	for _, p := range peers {
+		if p.OverlayIP6 != "" && p.Relay == "" {
+			res = append(res, stripMask(p.OverlayIP6))
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,343 @@
+package ipam
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"peer-wan/pkg/model"
+)
+
+// Conflict kinds reported by Conflicts.
+const (
+	ConflictPoolOverlap = "pool-overlap" // two pools overlap
+	ConflictNodeCIDR    = "node-cidr"    // a node's routed CIDR overlaps a pool
+	ConflictBypassCIDR  = "bypass-cidr"  // a node's bypass CIDR overlaps a pool
+	ConflictDuplicateIP = "duplicate-ip" // two nodes share an overlay address (informational)
+	ConflictReservation = "reservation"  // a reserved address is held by another node
+	ConflictOutsidePool = "outside-pool" // an overlay address is not in any pool (informational)
+)
+
+// Allocation is one overlay address in use.
+type Allocation struct {
+	NodeID   string `json:"nodeId"`
+	IP       string `json:"ip"`
+	Pool     string `json:"pool,omitempty"` // containing pool; empty when outside every pool
+	Reserved bool   `json:"reserved"`
+}
+
+// Conflict describes an overlap between the address plan and the nodes.
+type Conflict struct {
+	Kind   string `json:"kind"`
+	NodeID string `json:"nodeId,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// Blocking reports whether c is caused by the pools or reservations themselves, so a
+// configuration producing it must be refused. Duplicate and out-of-pool node addresses
+// predate the configuration and are only reported.
+func (c Conflict) Blocking() bool {
+	return c.Kind != ConflictOutsidePool && c.Kind != ConflictDuplicateIP
+}
+
+// Pools returns the configured pools, or the default pool.
+func Pools(cfg model.IPAMConfig) []string {
+	if len(cfg.Pools) == 0 {
+		return []string{model.DefaultOverlayPool}
+	}
+	return cfg.Pools
+}
+
+func parsePools(cfg model.IPAMConfig) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range Pools(cfg) {
+		if pfx, err := netip.ParsePrefix(p); err == nil && pfx.Addr().Is4() {
+			out = append(out, pfx.Masked())
+		}
+	}
+	return out
+}
+
+// parseAddr accepts "a.b.c.d" and "a.b.c.d/32".
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if p.Bits() != p.Addr().BitLen() {
+			return netip.Addr{}, fmt.Errorf("%s is not a host address", s)
+		}
+		return p.Addr(), nil
+	}
+	return netip.ParseAddr(s)
+}
+
+// Validate checks that pools are non-overlapping IPv4 CIDRs and that every reservation is a
+// unique address inside a pool, for a single node.
+func Validate(cfg model.IPAMConfig) error {
+	var pools []netip.Prefix
+	for _, p := range cfg.Pools {
+		pfx, err := netip.ParsePrefix(p)
+		if err != nil || !pfx.Addr().Is4() {
+			return fmt.Errorf("pool %q must be an IPv4 CIDR", p)
+		}
+		if pfx.Bits() > 30 {
+			return fmt.Errorf("pool %q is too small", p)
+		}
+		for _, q := range pools {
+			if q.Overlaps(pfx) {
+				return fmt.Errorf("pool %s overlaps %s", p, q)
+			}
+		}
+		pools = append(pools, pfx.Masked())
+	}
+	if len(pools) == 0 {
+		pools = parsePools(cfg)
+	}
+	byNode := map[string]bool{}
+	byIP := map[netip.Addr]string{}
+	for _, r := range cfg.Reservations {
+		if r.NodeID == "" {
+			return fmt.Errorf("reservation %q has no nodeId", r.IP)
+		}
+		if byNode[r.NodeID] {
+			return fmt.Errorf("node %s has more than one reservation", r.NodeID)
+		}
+		byNode[r.NodeID] = true
+		ip, err := parseAddr(r.IP)
+		if err != nil || !ip.Is4() {
+			return fmt.Errorf("reservation %q of %s must be an IPv4 address", r.IP, r.NodeID)
+		}
+		if other, ok := byIP[ip]; ok {
+			return fmt.Errorf("address %s is reserved for both %s and %s", ip, other, r.NodeID)
+		}
+		byIP[ip] = r.NodeID
+		if poolOf(pools, ip) == "" {
+			return fmt.Errorf("reservation %s of %s is outside every pool", ip, r.NodeID)
+		}
+	}
+	return nil
+}
+
+func poolOf(pools []netip.Prefix, ip netip.Addr) string {
+	for _, p := range pools {
+		if p.Contains(ip) {
+			return p.String()
+		}
+	}
+	return ""
+}
+
+// PoolFor returns the pool containing the overlay address ip ("" when none does).
+func PoolFor(cfg model.IPAMConfig, ip string) string {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return poolOf(parsePools(cfg), addr)
+}
+
+// Reserved returns the reserved address of nodeID as a /32, or "".
+func Reserved(cfg model.IPAMConfig, nodeID string) string {
+	for _, r := range cfg.Reservations {
+		if r.NodeID != nodeID {
+			continue
+		}
+		if ip, err := parseAddr(r.IP); err == nil {
+			return ip.String() + "/32"
+		}
+	}
+	return ""
+}
+
+// Holder returns the node (other than nodeID) whose overlay address is ip.
+func Holder(nodes []model.Node, nodeID, ip string) string {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	for _, n := range nodes {
+		if n.ID == nodeID {
+			continue
+		}
+		if other, err := parseAddr(n.OverlayIP); err == nil && other == addr {
+			return n.ID
+		}
+	}
+	return ""
+}
+
+// Allocate returns the overlay address (/32) for nodeID: its reservation if it has one,
+// otherwise the first address of the pools that no node holds and no other node reserved.
+// Addresses ending in .0 or .255 are skipped.
+func Allocate(cfg model.IPAMConfig, nodes []model.Node, nodeID string) (string, error) {
+	if ip := Reserved(cfg, nodeID); ip != "" {
+		return ip, nil
+	}
+	used := map[netip.Addr]bool{}
+	for _, n := range nodes {
+		if n.ID == nodeID {
+			continue
+		}
+		if ip, err := parseAddr(n.OverlayIP); err == nil {
+			used[ip] = true
+		}
+	}
+	for _, r := range cfg.Reservations {
+		if ip, err := parseAddr(r.IP); err == nil && r.NodeID != nodeID {
+			used[ip] = true
+		}
+	}
+	for _, pool := range parsePools(cfg) {
+		for ip := pool.Addr(); pool.Contains(ip); ip = ip.Next() {
+			last := ip.As4()[3]
+			if last == 0 || last == 255 || used[ip] {
+				continue
+			}
+			return ip.String() + "/32", nil
+		}
+	}
+	return "", fmt.Errorf("overlay pools %s are exhausted", strings.Join(Pools(cfg), ","))
+}
+
+// Allocations lists the overlay address of every node, sorted by address.
+func Allocations(cfg model.IPAMConfig, nodes []model.Node) []Allocation {
+	pools := parsePools(cfg)
+	out := []Allocation{}
+	for _, n := range nodes {
+		ip, err := parseAddr(n.OverlayIP)
+		if err != nil {
+			continue
+		}
+		out = append(out, Allocation{
+			NodeID:   n.ID,
+			IP:       ip.String(),
+			Pool:     poolOf(pools, ip),
+			Reserved: Reserved(cfg, n.ID) == ip.String()+"/32",
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := netip.ParseAddr(out[i].IP)
+		b, _ := netip.ParseAddr(out[j].IP)
+		return a.Less(b)
+	})
+	return out
+}
+
+// Free counts the allocatable addresses left in every pool.
+func Free(cfg model.IPAMConfig, nodes []model.Node) map[string]int {
+	pools := parsePools(cfg)
+	out := map[string]int{}
+	for _, pool := range pools {
+		out[pool.String()] = allocatable(pool)
+	}
+	held := map[netip.Addr]bool{}
+	for _, n := range nodes {
+		if ip, err := parseAddr(n.OverlayIP); err == nil {
+			held[ip] = true
+		}
+	}
+	for _, r := range cfg.Reservations {
+		if ip, err := parseAddr(r.IP); err == nil {
+			held[ip] = true
+		}
+	}
+	for ip := range held {
+		if !ip.Is4() {
+			continue
+		}
+		if last := ip.As4()[3]; last == 0 || last == 255 {
+			continue
+		}
+		if p := poolOf(pools, ip); p != "" {
+			out[p]--
+		}
+	}
+	return out
+}
+
+// allocatable is the number of addresses of p that do not end in .0 or .255.
+func allocatable(p netip.Prefix) int {
+	size := 1 << (32 - p.Bits())
+	if p.Bits() <= 24 {
+		return size - 2*(size/256)
+	}
+	n := 0
+	for ip := p.Addr(); p.Contains(ip); ip = ip.Next() {
+		if last := ip.As4()[3]; last != 0 && last != 255 {
+			n++
+		}
+	}
+	return n
+}
+
+// Overlapping returns the prefixes that overlap one of the pools.
+func Overlapping(cfg model.IPAMConfig, prefixes []string) []string {
+	pools := parsePools(cfg)
+	var out []string
+	for _, s := range prefixes {
+		pfx, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		for _, p := range pools {
+			if p.Overlaps(pfx) {
+				out = append(out, s)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Conflicts checks the address plan against the nodes: overlapping pools, routed and bypass
+// CIDRs inside a pool, shared overlay addresses, reservations held by another node and
+// overlay addresses outside every pool.
+func Conflicts(cfg model.IPAMConfig, nodes []model.Node) []Conflict {
+	out := []Conflict{}
+	pools := parsePools(cfg)
+	for i := range pools {
+		for j := i + 1; j < len(pools); j++ {
+			if pools[i].Overlaps(pools[j]) {
+				out = append(out, Conflict{Kind: ConflictPoolOverlap, Prefix: pools[j].String(), Detail: "overlaps pool " + pools[i].String()})
+			}
+		}
+	}
+	sorted := append([]model.Node(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	holders := map[netip.Addr]string{}
+	for _, n := range sorted {
+		for _, c := range Overlapping(cfg, n.CIDRs) {
+			out = append(out, Conflict{Kind: ConflictNodeCIDR, NodeID: n.ID, Prefix: c, Detail: "routed CIDR overlaps the overlay pool"})
+		}
+		for _, c := range Overlapping(cfg, n.BypassCIDRs) {
+			out = append(out, Conflict{Kind: ConflictBypassCIDR, NodeID: n.ID, Prefix: c, Detail: "bypass CIDR overlaps the overlay pool"})
+		}
+		ip, err := parseAddr(n.OverlayIP)
+		if err != nil {
+			continue
+		}
+		if other, ok := holders[ip]; ok {
+			out = append(out, Conflict{Kind: ConflictDuplicateIP, NodeID: n.ID, Prefix: ip.String(), Detail: "overlay address also used by " + other})
+		} else {
+			holders[ip] = n.ID
+		}
+		if poolOf(pools, ip) == "" {
+			out = append(out, Conflict{Kind: ConflictOutsidePool, NodeID: n.ID, Prefix: ip.String(), Detail: "overlay address is outside every pool"})
+		}
+	}
+	for _, r := range cfg.Reservations {
+		ip, err := parseAddr(r.IP)
+		if err != nil {
+			continue
+		}
+		if holder, ok := holders[ip]; ok && holder != r.NodeID {
+			out = append(out, Conflict{Kind: ConflictReservation, NodeID: holder, Prefix: ip.String(), Detail: "address is reserved for " + r.NodeID})
+		}
+	}
+	return out
+}
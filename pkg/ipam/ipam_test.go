@@ -0,0 +1,133 @@
+package ipam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"peer-wan/pkg/model"
+)
+
+func holding(id, ip string) model.Node {
+	return model.Node{ID: id, OverlayIP: ip}
+}
+
+func TestAllocate(t *testing.T) {
+	small := []string{"192.168.1.0/29"}
+	tests := []struct {
+		name    string
+		cfg     model.IPAMConfig
+		nodes   []model.Node
+		node    string
+		want    string
+		wantErr string
+	}{
+		{"default pool", model.IPAMConfig{}, nil, "x", "10.10.0.1/32", ""},
+		{"first free address", model.IPAMConfig{Pools: small}, []model.Node{holding("a", "192.168.1.1/32"), holding("b", "192.168.1.3")}, "x", "192.168.1.2/32", ""},
+		{"own address is free", model.IPAMConfig{Pools: small}, []model.Node{holding("x", "192.168.1.1/32")}, "x", "192.168.1.1/32", ""},
+		{"reservation honoured", model.IPAMConfig{Pools: small, Reservations: []model.IPReservation{{NodeID: "x", IP: "192.168.1.6"}}},
+			[]model.Node{holding("x", "192.168.1.1/32")}, "x", "192.168.1.6/32", ""},
+		{"reserved for another node", model.IPAMConfig{Pools: small, Reservations: []model.IPReservation{{NodeID: "y", IP: "192.168.1.1/32"}}},
+			[]model.Node{holding("a", "192.168.1.2/32")}, "x", "192.168.1.3/32", ""},
+		{"skips .255 and .0", model.IPAMConfig{Pools: []string{"10.0.0.252/30", "10.0.1.0/30"}},
+			[]model.Node{holding("a", "10.0.0.252/32"), holding("b", "10.0.0.253/32"), holding("c", "10.0.0.254/32")}, "x", "10.0.1.1/32", ""},
+		{"next pool", model.IPAMConfig{Pools: []string{"192.168.1.0/30", "192.168.2.0/30"}},
+			[]model.Node{holding("a", "192.168.1.1/32"), holding("b", "192.168.1.2/32"), holding("c", "192.168.1.3/32")}, "x", "192.168.2.1/32", ""},
+		{"exhausted", model.IPAMConfig{Pools: []string{"10.0.0.252/30"}, Reservations: []model.IPReservation{{NodeID: "y", IP: "10.0.0.254"}}},
+			[]model.Node{holding("a", "10.0.0.252/32"), holding("b", "10.0.0.253/32")}, "x", "", "overlay pools 10.0.0.252/30 are exhausted"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Allocate(tc.cfg, tc.nodes, tc.node)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Allocate = %q, %v; want error %q", got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("Allocate = %q, %v; want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	res := func(rs ...model.IPReservation) []model.IPReservation { return rs }
+	tests := []struct {
+		name    string
+		cfg     model.IPAMConfig
+		wantErr string // substring; "" = valid
+	}{
+		{"empty", model.IPAMConfig{}, ""},
+		{"disjoint pools", model.IPAMConfig{Pools: []string{"10.0.0.0/24", "10.0.1.0/24"}}, ""},
+		{"overlapping pools", model.IPAMConfig{Pools: []string{"10.0.0.0/16", "10.0.1.0/24"}}, "overlaps"},
+		{"same pool twice", model.IPAMConfig{Pools: []string{"10.0.0.0/24", "10.0.0.0/24"}}, "overlaps"},
+		{"ipv6 pool", model.IPAMConfig{Pools: []string{"fd00::/64"}}, "must be an IPv4 CIDR"},
+		{"pool too small", model.IPAMConfig{Pools: []string{"10.0.0.0/31"}}, "too small"},
+		{"reservation in pool", model.IPAMConfig{Pools: []string{"10.0.0.0/24"}, Reservations: res(model.IPReservation{NodeID: "a", IP: "10.0.0.5/32"})}, ""},
+		{"reservation in default pool", model.IPAMConfig{Reservations: res(model.IPReservation{NodeID: "a", IP: "10.10.3.4"})}, ""},
+		{"reservation outside pools", model.IPAMConfig{Pools: []string{"10.0.0.0/24"}, Reservations: res(model.IPReservation{NodeID: "a", IP: "10.0.1.5"})}, "outside every pool"},
+		{"reservation outside default pool", model.IPAMConfig{Reservations: res(model.IPReservation{NodeID: "a", IP: "10.11.0.1"})}, "outside every pool"},
+		{"reservation not a host", model.IPAMConfig{Reservations: res(model.IPReservation{NodeID: "a", IP: "10.10.0.0/24"})}, "must be an IPv4 address"},
+		{"reservation without node", model.IPAMConfig{Reservations: res(model.IPReservation{IP: "10.10.0.1"})}, "has no nodeId"},
+		{"two reservations for a node", model.IPAMConfig{Reservations: res(model.IPReservation{NodeID: "a", IP: "10.10.0.1"}, model.IPReservation{NodeID: "a", IP: "10.10.0.2"})}, "more than one reservation"},
+		{"address reserved twice", model.IPAMConfig{Reservations: res(model.IPReservation{NodeID: "a", IP: "10.10.0.1"}, model.IPReservation{NodeID: "b", IP: "10.10.0.1/32"})}, "reserved for both"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(tc.cfg)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Validate = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	pool := []string{"10.0.0.0/24"}
+	type found struct {
+		kind, node, prefix string
+		blocking           bool
+	}
+	tests := []struct {
+		name  string
+		cfg   model.IPAMConfig
+		nodes []model.Node
+		want  []found
+	}{
+		{"clean", model.IPAMConfig{Pools: pool, Reservations: []model.IPReservation{{NodeID: "a", IP: "10.0.0.1"}}},
+			[]model.Node{{ID: "a", OverlayIP: "10.0.0.1/32", CIDRs: []string{"192.168.0.0/24"}}}, nil},
+		{"overlapping pools", model.IPAMConfig{Pools: []string{"10.0.0.0/16", "10.0.1.0/24"}}, nil,
+			[]found{{ConflictPoolOverlap, "", "10.0.1.0/24", true}}},
+		{"routed and bypass CIDRs in the pool", model.IPAMConfig{Pools: pool},
+			[]model.Node{{ID: "a", OverlayIP: "10.0.0.1/32", CIDRs: []string{"10.0.0.1/32", "10.0.0.128/25", "192.168.0.0/24"}, BypassCIDRs: []string{"10.0.0.0/8"}}},
+			[]found{{ConflictNodeCIDR, "a", "10.0.0.1/32", true}, {ConflictNodeCIDR, "a", "10.0.0.128/25", true}, {ConflictBypassCIDR, "a", "10.0.0.0/8", true}}},
+		{"shared overlay address", model.IPAMConfig{Pools: pool},
+			[]model.Node{holding("b", "10.0.0.1"), holding("a", "10.0.0.1/32")},
+			[]found{{ConflictDuplicateIP, "b", "10.0.0.1", false}}},
+		{"reservation held by another node", model.IPAMConfig{Pools: pool, Reservations: []model.IPReservation{{NodeID: "b", IP: "10.0.0.1/32"}}},
+			[]model.Node{holding("a", "10.0.0.1/32"), holding("b", "10.0.0.2/32")},
+			[]found{{ConflictReservation, "a", "10.0.0.1", true}}},
+		{"address outside every pool", model.IPAMConfig{Pools: pool},
+			[]model.Node{holding("a", "10.1.0.1/32")},
+			[]found{{ConflictOutsidePool, "a", "10.1.0.1", false}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []found
+			for _, c := range Conflicts(tc.cfg, tc.nodes) {
+				got = append(got, found{c.Kind, c.NodeID, c.Prefix, c.Blocking()})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Conflicts = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
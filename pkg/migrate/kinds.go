@@ -0,0 +1,409 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"sort"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/snapshot"
+	"peer-wan/pkg/store"
+)
+
+// kind copies and verifies one entity kind. Kinds are handled one after the other and,
+// where the store lists them per node, node by node, so a migration holds one kind (or
+// one node's share of it) in memory rather than the whole store.
+type kind struct {
+	name string
+	// copy writes the kind from src into dst; nil when another kind writes it.
+	copy func(src, dst store.NodeStore, nodes []model.Node) error
+	// digest counts and hashes the kind in st after stripping what each store manages
+	// itself (revisions, config version strings, task UpdatedAt) and normalizing timestamps.
+	digest func(st store.NodeStore, nodes []model.Node) (entityDigest, error)
+}
+
+type entityDigest struct {
+	entity string
+	count  int
+	hash   string
+}
+
+// kinds lists every entity kind in copy order: plan history before the latest plans
+// (saving history moves the latest plan along) and audit last.
+var kinds = []kind{
+	{name: "nodes", copy: copyNodes, digest: digestNodes},
+	{name: "planHistory", copy: copyPlanHistory, digest: perNode(func(st store.NodeStore, n model.Node, d *digester) error {
+		hist, err := st.ListPlanHistory(n.ID, 0)
+		for _, p := range hist {
+			p.CreatedAt = normTime(p.CreatedAt)
+			d.add(p)
+		}
+		return err
+	})},
+	{name: "plans", copy: copyPlans, digest: perNode(func(st store.NodeStore, n model.Node, d *digester) error {
+		p, ok, err := st.GetPlan(n.ID)
+		if ok {
+			p.CreatedAt = normTime(p.CreatedAt)
+			d.add(p)
+		}
+		return err
+	})},
+	{name: "planVersion", copy: func(src, dst store.NodeStore, _ []model.Node) error {
+		v, err := src.GetGlobalPlanVersion()
+		if err != nil {
+			return err
+		}
+		return dst.SetGlobalPlanVersion(v)
+	}, digest: func(st store.NodeStore, _ []model.Node) (entityDigest, error) {
+		v, err := st.GetGlobalPlanVersion()
+		return single(v), err
+	}},
+	{name: "settings", copy: func(src, dst store.NodeStore, _ []model.Node) error {
+		s, err := src.GetSettings()
+		if err != nil {
+			return err
+		}
+		return dst.UpdateSettings(s)
+	}, digest: func(st store.NodeStore, _ []model.Node) (entityDigest, error) {
+		s, err := st.GetSettings()
+		return single(s), err
+	}},
+	{name: "routingState", copy: func(src, dst store.NodeStore, _ []model.Node) error {
+		rs, ok, err := src.GetRoutingState()
+		if err != nil || !ok {
+			return err
+		}
+		return dst.SaveRoutingState(rs)
+	}, digest: func(st store.NodeStore, _ []model.Node) (entityDigest, error) {
+		d := newDigester()
+		rs, ok, err := st.GetRoutingState()
+		if ok {
+			rs.UpdatedAt = normTime(rs.UpdatedAt)
+			d.add(rs)
+		}
+		return d.result(), err
+	}},
+	{name: "tasks", copy: func(src, dst store.NodeStore, _ []model.Node) error {
+		tasks, err := src.ListTasks("", 0)
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			if err := dst.SaveTask(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, digest: func(st store.NodeStore, _ []model.Node) (entityDigest, error) {
+		tasks, err := st.ListTasks("", 0)
+		if err != nil {
+			return entityDigest{}, err
+		}
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+		d := newDigester()
+		for _, t := range tasks {
+			t.CreatedAt, t.UpdatedAt = normTime(t.CreatedAt), time.Time{}
+			d.add(t)
+		}
+		return d.result(), nil
+	}},
+	{name: "policyStatus", copy: func(src, dst store.NodeStore, nodes []model.Node) error {
+		for _, n := range nodes {
+			logs, err := src.ListPolicyStatus(n.ID, 0)
+			if err != nil {
+				return err
+			}
+			for _, l := range logs {
+				if err := dst.SavePolicyStatus(l); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}, digest: perNode(func(st store.NodeStore, n model.Node, d *digester) error {
+		logs, err := st.ListPolicyStatus(n.ID, 0)
+		for _, l := range logs {
+			l.Timestamp = normTime(l.Timestamp)
+			d.add(l)
+		}
+		return err
+	})},
+	{name: "policyDiag", copy: func(src, dst store.NodeStore, nodes []model.Node) error {
+		for _, n := range nodes {
+			diags, err := src.ListPolicyDiag(n.ID, 0)
+			if err != nil {
+				return err
+			}
+			for _, r := range diags {
+				if err := dst.SavePolicyDiag(r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}, digest: perNode(func(st store.NodeStore, n model.Node, d *digester) error {
+		diags, err := st.ListPolicyDiag(n.ID, 0)
+		for _, r := range diags {
+			r.Timestamp = normTime(r.Timestamp)
+			d.add(r)
+		}
+		return err
+	})},
+	{name: "health", copy: copyHealth, digest: func(st store.NodeStore, nodes []model.Node) (entityDigest, error) {
+		current, err := currentHealth(st)
+		if err != nil {
+			return entityDigest{}, err
+		}
+		d := newDigester()
+		for _, n := range nodes {
+			if h, ok := current[n.ID]; ok {
+				h.Timestamp = normTime(h.Timestamp)
+				d.add(h)
+			}
+		}
+		return d.result(), nil
+	}},
+	// written with health; the latest report counts as history even when retention
+	// already dropped it there, since saving it on the target appends it again
+	{name: "healthHistory", digest: func(st store.NodeStore, nodes []model.Node) (entityDigest, error) {
+		current, err := currentHealth(st)
+		if err != nil {
+			return entityDigest{}, err
+		}
+		d := newDigester()
+		for _, n := range nodes {
+			hist, err := st.ListHealthHistory(n.ID, time.Time{})
+			if err != nil {
+				return entityDigest{}, err
+			}
+			if h, ok := current[n.ID]; ok && (len(hist) == 0 || !normTime(hist[len(hist)-1].Timestamp).Equal(normTime(h.Timestamp))) {
+				hist = append(hist, h)
+			}
+			for _, h := range hist {
+				h.Timestamp = normTime(h.Timestamp)
+				d.add(h)
+			}
+		}
+		return d.result(), nil
+	}},
+	{name: "healthSeries", copy: func(src, dst store.NodeStore, nodes []model.Node) error {
+		for _, n := range nodes {
+			for _, step := range store.HealthSeriesSteps {
+				buckets, err := src.ListHealthBuckets(n.ID, step, time.Time{}, time.Time{})
+				if err != nil {
+					return err
+				}
+				if len(buckets) == 0 {
+					continue
+				}
+				if err := dst.SaveHealthBuckets(buckets); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}, digest: perNode(func(st store.NodeStore, n model.Node, d *digester) error {
+		for _, step := range store.HealthSeriesSteps {
+			buckets, err := st.ListHealthBuckets(n.ID, step, time.Time{}, time.Time{})
+			if err != nil {
+				return err
+			}
+			for _, b := range buckets {
+				b.Start = normTime(b.Start)
+				d.add(b)
+			}
+		}
+		return nil
+	})},
+	{name: "linkKeys", copy: func(src, dst store.NodeStore, _ []model.Node) error {
+		keys, err := src.ListLinkKeys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := dst.SaveLinkKey(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, digest: func(st store.NodeStore, _ []model.Node) (entityDigest, error) {
+		keys, err := st.ListLinkKeys()
+		d := newDigester()
+		for _, k := range keys {
+			k.StagedAt, k.RotatedAt = normTime(k.StagedAt), normTime(k.RotatedAt)
+			d.add(k)
+		}
+		return d.result(), err
+	}},
+	{name: "audit", copy: func(src, dst store.NodeStore, _ []model.Node) error {
+		entries, err := src.ListAudit(0)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := dst.AppendAudit(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, digest: func(st store.NodeStore, _ []model.Node) (entityDigest, error) {
+		entries, err := st.ListAudit(0)
+		return entityDigest{count: len(entries), hash: tailHash(entries, len(entries))}, err
+	}},
+}
+
+func copyNodes(_, dst store.NodeStore, nodes []model.Node) error {
+	for _, n := range nodes {
+		n.Revision = 0
+		if _, err := dst.UpsertNode(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func digestNodes(_ store.NodeStore, nodes []model.Node) (entityDigest, error) {
+	type nodeWithSecrets struct {
+		model.Node
+		PrivateKey     string `json:"privateKey"`
+		ProvisionToken string `json:"provisionToken"`
+	}
+	d := newDigester()
+	for _, n := range nodes {
+		priv, tok := n.PrivateKey, n.ProvisionToken
+		n.Revision, n.Version, n.ConfigVersion = 0, "", ""
+		d.add(nodeWithSecrets{Node: n, PrivateKey: priv, ProvisionToken: tok})
+	}
+	return d.result(), nil
+}
+
+func copyPlanHistory(src, dst store.NodeStore, nodes []model.Node) error {
+	for _, n := range nodes {
+		hist, err := src.ListPlanHistory(n.ID, 0)
+		if err != nil {
+			return err
+		}
+		for _, p := range hist {
+			if err := dst.SavePlan(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyPlans saves the latest plans the copied history does not already end with.
+func copyPlans(src, dst store.NodeStore, nodes []model.Node) error {
+	for _, n := range nodes {
+		p, ok, err := src.GetPlan(n.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if cur, ok, err := dst.GetPlan(n.ID); err != nil {
+			return err
+		} else if ok && cur.Version == p.Version {
+			continue
+		}
+		if err := dst.SavePlan(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyHealth(src, dst store.NodeStore, nodes []model.Node) error {
+	current, err := currentHealth(src)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		hist, err := src.ListHealthHistory(n.ID, time.Time{})
+		if err != nil {
+			return err
+		}
+		h, ok := current[n.ID]
+		if err := snapshot.RestoreHealth(dst, hist, h, ok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func currentHealth(st store.NodeStore) (map[string]model.HealthReport, error) {
+	list, err := st.ListHealth()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]model.HealthReport, len(list))
+	for _, h := range list {
+		out[h.NodeID] = h
+	}
+	return out, nil
+}
+
+// perNode builds a digest that visits the nodes in order.
+func perNode(add func(st store.NodeStore, n model.Node, d *digester) error) func(store.NodeStore, []model.Node) (entityDigest, error) {
+	return func(st store.NodeStore, nodes []model.Node) (entityDigest, error) {
+		d := newDigester()
+		for _, n := range nodes {
+			if err := add(st, n, d); err != nil {
+				return entityDigest{}, err
+			}
+		}
+		return d.result(), nil
+	}
+}
+
+func single(v interface{}) entityDigest {
+	d := newDigester()
+	d.add(v)
+	return d.result()
+}
+
+// digester hashes a stream of entities without holding them.
+type digester struct {
+	h     hash.Hash
+	enc   *json.Encoder
+	count int
+}
+
+func newDigester() *digester {
+	h := sha256.New()
+	return &digester{h: h, enc: json.NewEncoder(h)}
+}
+
+func (d *digester) add(v interface{}) {
+	_ = d.enc.Encode(v)
+	d.count++
+}
+
+func (d *digester) result() entityDigest {
+	return entityDigest{count: d.count, hash: hex.EncodeToString(d.h.Sum(nil)[:8])}
+}
+
+// tailHash hashes the last n audit entries.
+func tailHash(entries []model.AuditEntry, n int) string {
+	if n > len(entries) {
+		return ""
+	}
+	d := newDigester()
+	for _, e := range entries[len(entries)-n:] {
+		e.Timestamp = normTime(e.Timestamp)
+		d.add(e)
+	}
+	return d.result().hash
+}
+
+// normTime drops sub-second precision and zone, which SQL backends do not preserve.
+func normTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.UTC().Truncate(time.Second)
+}
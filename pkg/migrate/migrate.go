@@ -0,0 +1,204 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/snapshot"
+	"peer-wan/pkg/store"
+)
+
+// Options controls a migration run.
+type Options struct {
+	DryRun bool // read the source and check the target, write nothing
+	// Replace allows a target store that already has nodes. They are deleted once the
+	// source has been read in full, so the copy can be verified entity by entity.
+	Replace bool
+}
+
+// Check is the verification result for one entity kind.
+type Check struct {
+	Entity string `json:"entity"`
+	Source int    `json:"source"`
+	Target int    `json:"target"`
+	Hash   string `json:"hash,omitempty"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report summarizes a migration.
+type Report struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	DryRun bool    `json:"dryRun"`
+	Checks []Check `json:"checks"`
+}
+
+// OK reports whether every check passed.
+func (r *Report) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Run copies every entity kind from one endpoint to the other through the NodeStore
+// interface and verifies counts and content hashes afterwards. Kinds are copied one at a
+// time (see kinds); snapshot archives are read into and written from a memory store.
+// Node identities, WireGuard keys and overlay IPs are carried over unchanged.
+func Run(from, to *Endpoint, opts Options) (*Report, error) {
+	box, err := secret.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{From: from.URL, To: to.URL, DryRun: opts.DryRun}
+	src, err := open(from, box)
+	if err != nil {
+		return nil, fmt.Errorf("read source: %w", err)
+	}
+	srcDigest, err := digest(src)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+
+	dst := to.Store
+	if to.File != "" {
+		dst = store.NewMemoryStore()
+	}
+	existing, err := dst.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("target not reachable: %w", err)
+	}
+	if len(existing) > 0 && !opts.Replace {
+		return nil, fmt.Errorf("%w: %d nodes present; use --replace to overwrite", snapshot.ErrTargetNotEmpty, len(existing))
+	}
+	if opts.DryRun {
+		for _, d := range srcDigest {
+			rep.Checks = append(rep.Checks, Check{Entity: d.entity, Source: d.count, Hash: d.hash, OK: true, Detail: "dry-run"})
+		}
+		return rep, nil
+	}
+
+	for _, n := range existing {
+		if err := dst.DeleteNode(n.ID); err != nil {
+			return nil, fmt.Errorf("clear target node %s: %w", n.ID, err)
+		}
+	}
+	nodes, err := sortedNodes(src)
+	if err != nil {
+		return nil, fmt.Errorf("read source: %w", err)
+	}
+	for _, k := range kinds {
+		if k.copy == nil {
+			continue
+		}
+		if err := k.copy(src, dst, nodes); err != nil {
+			return nil, fmt.Errorf("write target %s: %w", k.name, err)
+		}
+	}
+	if to.File != "" {
+		snap, err := snapshot.Export(dst, box)
+		if err != nil {
+			return nil, fmt.Errorf("write target: %w", err)
+		}
+		if err := writeFile(to.File, snap); err != nil {
+			return nil, fmt.Errorf("write target: %w", err)
+		}
+		if dst, err = open(to, box); err != nil {
+			return nil, fmt.Errorf("read back target: %w", err)
+		}
+	}
+
+	dstDigest, err := digest(dst)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	for i, s := range srcDigest {
+		d := dstDigest[i]
+		c := Check{Entity: s.entity, Source: s.count, Target: d.count, Hash: s.hash, OK: s.count == d.count && s.hash == d.hash}
+		if s.entity == "audit" {
+			// audit is append-only; the target may hold older entries of its own
+			entries, err := dst.ListAudit(0)
+			if err != nil {
+				return nil, fmt.Errorf("target: %w", err)
+			}
+			c.OK = d.count >= s.count && s.hash == tailHash(entries, s.count)
+		}
+		if !c.OK {
+			c.Detail = "mismatch: target hash " + d.hash
+		}
+		rep.Checks = append(rep.Checks, c)
+	}
+	return rep, nil
+}
+
+// open returns the store behind ep; an archive is restored into a memory store.
+func open(ep *Endpoint, box *secret.Box) (store.NodeStore, error) {
+	if ep.File == "" {
+		return ep.Store, nil
+	}
+	f, err := os.Open(ep.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap, err := snapshot.Read(f)
+	if err != nil {
+		return nil, err
+	}
+	mem := store.NewMemoryStore()
+	if err := snapshot.Restore(mem, snap, box, snapshot.RestoreOptions{}); err != nil {
+		return nil, err
+	}
+	return mem, nil
+}
+
+func writeFile(path string, snap *snapshot.Snapshot) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := snapshot.Write(f, snap); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// digest counts and hashes every entity kind of st, kind by kind.
+func digest(st store.NodeStore) ([]entityDigest, error) {
+	nodes, err := sortedNodes(st)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]entityDigest, 0, len(kinds))
+	for _, k := range kinds {
+		d, err := k.digest(st, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.name, err)
+		}
+		d.entity = k.name
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func sortedNodes(st store.NodeStore) ([]model.Node, error) {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
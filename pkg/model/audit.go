@@ -10,3 +10,16 @@ type AuditEntry struct {
 	Detail    string    `json:"detail,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
+
+// AuditQuery selects audit entries by exact actor, action and target (empty = any).
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	HistoryPage
+}
+
+// Match reports whether e passes the actor/action/target filters.
+func (q AuditQuery) Match(e AuditEntry) bool {
+	return (q.Actor == "" || e.Actor == q.Actor) && (q.Action == "" || e.Action == q.Action) && (q.Target == "" || e.Target == q.Target)
+}
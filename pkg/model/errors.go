@@ -0,0 +1,7 @@
+package model
+
+import "errors"
+
+// ErrRevisionConflict is returned by stores when a write carries a stale Node.Revision.
+// It lives here (not in pkg/store) so backends in other packages, e.g. Consul, can return it.
+var ErrRevisionConflict = errors.New("revision conflict")
@@ -10,6 +10,35 @@ type HealthReport struct {
 	PacketLoss map[string]float64 `json:"packetLoss,omitempty"`
 	FRRState   map[string]string  `json:"frrState,omitempty"` // neighbor -> state
 	Timestamp  time.Time          `json:"timestamp"`
+
+	// peer id -> endpoint with a recent WireGuard handshake, reported by agents
+	ActiveEndpoints map[string]string `json:"activeEndpoints,omitempty"`
+	// peer ids with a recent WireGuard handshake, including peers without a known endpoint
+	Handshakes []string `json:"handshakes,omitempty"`
+	// peer id -> generation of the staged preshared key the agent holds
+	StagedKeys map[string]int `json:"stagedKeys,omitempty"`
+	// peer id -> next public key of a rotating peer the agent holds as a standby entry
+	StagedPeerKeys map[string]string `json:"stagedPeerKeys,omitempty"`
+	// peer id -> runtime state of the peer read from the WireGuard interface
+	WireGuard map[string]WireGuardPeerStats `json:"wireguard,omitempty"`
+
+	// reported while the node rotates its own key: the public key its interface runs, the
+	// generated next key with a proof of possession, and peers with a handshake since the
+	// key last changed
+	PublicKey     string   `json:"publicKey,omitempty"`
+	NextPublicKey string   `json:"nextPublicKey,omitempty"`
+	NextKeyProof  string   `json:"nextKeyProof,omitempty"`
+	KeyHandshakes []string `json:"keyHandshakes,omitempty"`
+}
+
+// WireGuardPeerStats is what the node's WireGuard interface reports for one peer.
+type WireGuardPeerStats struct {
+	PublicKey     string    `json:"publicKey"`
+	LastHandshake time.Time `json:"lastHandshake"` // zero when the peer never completed a handshake
+	RxBytes       int64     `json:"rxBytes"`
+	TxBytes       int64     `json:"txBytes"`
+	Endpoint      string    `json:"endpoint,omitempty"` // current endpoint, after roaming
+	AllowedIPs    []string  `json:"allowedIPs,omitempty"`
 }
 
 // HealthSample is a thin wrapper used for history responses.
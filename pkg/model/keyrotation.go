@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// Phases of a node key rotation.
+const (
+	KeyRotationGenerate = "generate" // the agent generates a next key and reports it with a proof
+	KeyRotationStage    = "stage"    // neighbours hold the next key as a standby peer entry
+	KeyRotationSwitch   = "switch"   // the agent moves its interface to the next key
+	KeyRotationVerify   = "verify"   // the next key is committed; waiting for a handshake under it
+	KeyRotationRollback = "rollback" // the agent moves its interface back to the previous key
+)
+
+// KeyRotation is a node key rotation in flight, tracked by task TaskID.
+type KeyRotation struct {
+	TaskID            string    `json:"taskId"`
+	Phase             string    `json:"phase"`
+	NextPublicKey     string    `json:"nextPublicKey,omitempty"`
+	PreviousPublicKey string    `json:"previousPublicKey"`
+	Confirmed         []string  `json:"confirmed,omitempty"` // neighbours holding NextPublicKey
+	StartedAt         time.Time `json:"startedAt"`
+	PhaseAt           time.Time `json:"phaseAt"` // when Phase was entered
+}
+
+// StagedPublicKey returns the next public key neighbours hold as a standby peer entry
+// while n rotates its key, or "".
+func (n Node) StagedPublicKey() string {
+	if r := n.KeyRotation; r != nil && (r.Phase == KeyRotationStage || r.Phase == KeyRotationSwitch) {
+		return r.NextPublicKey
+	}
+	return ""
+}
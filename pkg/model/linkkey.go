@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// LinkKey is the WireGuard preshared key shared by nodes A and B (A < B). Keys are
+// stored sealed by a secret.Box. A rotation first stages Next on both ends and only
+// promotes it once both have acknowledged holding it.
+type LinkKey struct {
+	A          string    `json:"a"`
+	B          string    `json:"b"`
+	Key        string    `json:"key,omitempty"`      // sealed key in use; empty before the first commit
+	Generation int       `json:"generation"`         // generation of Key, 0 = none
+	Next       string    `json:"next,omitempty"`     // sealed staged key, generation Generation+1
+	Staged     []string  `json:"staged,omitempty"`   // ends that acknowledged Next
+	StagedAt   time.Time `json:"stagedAt,omitzero"`  // when Next was generated
+	RotatedAt  time.Time `json:"rotatedAt,omitzero"` // when Key was committed
+}
+
+// LinkKeyPair orders two node ids the way LinkKey stores them.
+func LinkKeyPair(a, b string) (string, string) {
+	if b < a {
+		return b, a
+	}
+	return a, b
+}
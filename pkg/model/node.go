@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 // Node captures registered node state and desired overlay properties.
 type Node struct {
 	ID                  string            `json:"id"`
@@ -7,9 +9,11 @@ type Node struct {
 	Endpoints           []string          `json:"endpoints"`
 	CIDRs               []string          `json:"cidrs"`
 	ConfigVersion       string            `json:"configVersion"`
-	Version             string            `json:"version"` // monotonically increasing config version (string)
+	Version             string            `json:"version"`  // monotonically increasing config version (string)
+	Revision            int64             `json:"revision"` // store revision; writes must carry the revision they read (optimistic concurrency)
 	ListenPort          int               `json:"listenPort,omitempty"`
 	OverlayIP           string            `json:"overlayIp,omitempty"`
+	OverlayIP6          string            `json:"overlayIp6,omitempty"` // IPv6 overlay address (/128) when dual-stack is enabled
 	ASN                 int               `json:"asn,omitempty"`
 	RouterID            string            `json:"routerId,omitempty"`
 	EgressPeerID        string            `json:"egressPeerId,omitempty"`
@@ -20,4 +24,14 @@ type Node struct {
 	PrivateKey          string            `json:"-"`                             // stored only for bootstrap
 	ProvisionToken      string            `json:"-"`                             // one-time token
 	PeerEndpoints       map[string]string `json:"peerEndpoints,omitempty"`       // overrides target node endpoint per peer
+	Role                string            `json:"role,omitempty"`                // hub/spoke in hub-spoke topology; empty = spoke
+	Labels              map[string]string `json:"labels,omitempty"`              // free-form key/value labels matched by peering intents
+	LinkEndpoints       map[string]string `json:"linkEndpoints,omitempty"`       // peer id -> that peer's endpoint last reported working from this node
+	Relay               bool              `json:"relay,omitempty"`               // relay-capable: forwards traffic between nodes that cannot reach each other
+	KeyOrigin           string            `json:"keyOrigin,omitempty"`           // KeyOriginAgent once the agent proved it holds the private key; empty = controller-generated
+	KeyRotation         *KeyRotation      `json:"keyRotation,omitempty"`         // key rotation in flight
+	KeyRotatedAt        time.Time         `json:"keyRotatedAt,omitzero"`         // when the last key rotation completed
 }
+
+// KeyOriginAgent marks a node whose WireGuard private key exists only on the node itself.
+const KeyOriginAgent = "agent"
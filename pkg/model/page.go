@@ -0,0 +1,49 @@
+package model
+
+import "time"
+
+// HistoryPage selects one page of a time-ordered history. Pages walk from newest to
+// oldest: a page holds at most Limit entries with Since <= ts < Until (zero = unbounded)
+// that come after the previous page, i.e. entries older than Before plus those stamped
+// exactly Before once the Skip newest of them are passed. A zero Before starts at the
+// newest entry; Limit <= 0 returns everything that is left.
+type HistoryPage struct {
+	Limit  int
+	Since  time.Time
+	Until  time.Time
+	Before time.Time
+	Skip   int
+}
+
+// newer reports whether ts lies past Until or the cursor.
+func (p HistoryPage) newer(ts time.Time) bool {
+	return (!p.Until.IsZero() && !ts.Before(p.Until)) || (!p.Before.IsZero() && ts.After(p.Before))
+}
+
+// older reports whether ts lies before Since.
+func (p HistoryPage) older(ts time.Time) bool {
+	return !p.Since.IsZero() && ts.Before(p.Since)
+}
+
+// SelectPage applies p to sorted, which holds the matching entries oldest first with ties
+// in insertion order. It returns the page oldest first and whether older entries remain.
+func SelectPage[T any](sorted []T, ts func(T) time.Time, p HistoryPage) ([]T, bool) {
+	i := len(sorted) - 1
+	for i >= 0 && p.newer(ts(sorted[i])) {
+		i--
+	}
+	if !p.Before.IsZero() {
+		for skip := p.Skip; skip > 0 && i >= 0 && ts(sorted[i]).Equal(p.Before); skip-- {
+			i--
+		}
+	}
+	page := []T{}
+	for ; i >= 0 && (p.Limit <= 0 || len(page) < p.Limit) && !p.older(ts(sorted[i])); i-- {
+		page = append(page, sorted[i])
+	}
+	more := i >= 0 && !p.older(ts(sorted[i]))
+	for l, r := 0, len(page)-1; l < r; l, r = l+1, r-1 {
+		page[l], page[r] = page[r], page[l]
+	}
+	return page, more
+}
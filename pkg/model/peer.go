@@ -5,6 +5,17 @@ type Peer struct {
 	ID         string   `json:"id"`
 	PublicKey  string   `json:"publicKey"`
 	Endpoint   string   `json:"endpoint,omitempty"`
+	Endpoints  []string `json:"endpoints,omitempty"` // all candidates in preferred order; Endpoint is the first
 	AllowedIPs []string `json:"allowedIPs"`
+	OverlayIP6 string   `json:"overlayIp6,omitempty"` // peer's IPv6 overlay address, next hop for IPv6 routes
 	Keepalive  int      `json:"keepaliveSeconds,omitempty"`
+	Role       string   `json:"role,omitempty"`  // peer's hub/spoke role; set only in hub-spoke topology
+	Relay      string   `json:"relay,omitempty"` // relay carrying this peer's prefixes; the entry itself only waits for a direct handshake
+
+	// per-link preshared key, filled in only when a plan is delivered to its node
+	PresharedKey     string `json:"presharedKey,omitempty"`
+	KeyGeneration    int    `json:"keyGeneration,omitempty"`    // generation of PresharedKey
+	NextPresharedKey string `json:"nextPresharedKey,omitempty"` // staged key (generation KeyGeneration+1), not in use yet
+
+	NextPublicKey string `json:"nextPublicKey,omitempty"` // peer's next key while it rotates; held as a standby entry without allowed IPs
 }
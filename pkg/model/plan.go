@@ -18,3 +18,9 @@ type Plan struct {
 	BypassCIDRs         []string          `json:"bypassCidrs,omitempty"`
 	DefaultRouteNextHop string            `json:"defaultRouteNextHop,omitempty"`
 }
+
+// PlanHistoryQuery selects a node's plan history. Pages are ordered by CreatedAt.
+type PlanHistoryQuery struct {
+	NodeID string
+	HistoryPage
+}
@@ -6,10 +6,19 @@ type PolicyRule struct {
 	ViaNode string   `json:"viaNode"`           // peer/node ID to egress from (kept for backward compatibility)
 	Path    []string `json:"path,omitempty"`    // ordered hop list; last element is egress
 	Domains []string `json:"domains,omitempty"` // optional: domain list to resolve and add as host routes
+	// Egress or EgressSelector (label selector, best reachable match) let the controller
+	// compute Path over the peer graph; only used when Path is empty.
+	Egress         string `json:"egress,omitempty"`
+	EgressSelector string `json:"egressSelector,omitempty"`
 }
 
-// Validate returns true if the prefix and via node are present.
+// Validate returns true if the prefix and a target (via node, path or egress) are present.
 func (p PolicyRule) Validate() bool {
-	hasTarget := p.ViaNode != "" || len(p.Path) > 0
+	hasTarget := p.ViaNode != "" || len(p.Path) > 0 || p.Egress != "" || p.EgressSelector != ""
 	return (p.Prefix != "" || len(p.Domains) > 0) && hasTarget
 }
+
+// AutoPath reports whether the controller computes the hop sequence of p.
+func (p PolicyRule) AutoPath() bool {
+	return len(p.Path) == 0 && (p.Egress != "" || p.EgressSelector != "")
+}
@@ -16,3 +16,9 @@ type PolicyDiagReport struct {
 	Checks    []PolicyDiagCheck `json:"checks"`
 	Timestamp time.Time         `json:"timestamp"`
 }
+
+// PolicyDiagQuery selects a node's diagnostic reports.
+type PolicyDiagQuery struct {
+	NodeID string
+	HistoryPage
+}
@@ -11,3 +11,15 @@ type PolicyInstallLog struct {
 	Logs      []string  `json:"logs,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
+
+// PolicyStatusQuery selects a node's install logs, optionally of one status (empty = any).
+type PolicyStatusQuery struct {
+	NodeID string
+	Status string
+	HistoryPage
+}
+
+// Match reports whether l passes the status filter.
+func (q PolicyStatusQuery) Match(l PolicyInstallLog) bool {
+	return q.Status == "" || l.Status == q.Status
+}
@@ -0,0 +1,58 @@
+package model
+
+import "time"
+
+// RoutingState is the health-driven state plans are built from: the damping state
+// machines of nodes and links, the route chosen for every auto-path rule and the active
+// member of every egress group per source. The controller computing plans saves it as
+// it changes, so a restarted or newly elected one continues from it instead of starting
+// with every link up and every path unset.
+type RoutingState struct {
+	Links     []LinkState            `json:"links,omitempty"`
+	BGP       map[string]StickyState `json:"bgp,omitempty"`       // reporter|neighbor
+	AutoPaths map[string]AutoPath    `json:"autoPaths,omitempty"` // node|rule key
+	Egress    []EgressSelection      `json:"egress,omitempty"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+}
+
+// LinkState is one damping state machine (see package damping). To is empty for the
+// state of node From itself.
+type LinkState struct {
+	ID           string     `json:"id"`
+	From         string     `json:"from"`
+	To           string     `json:"to,omitempty"`
+	State        string     `json:"state"`
+	Suppressed   bool       `json:"suppressed,omitempty"`
+	Penalty      float64    `json:"penalty"`
+	Flaps        int        `json:"flaps,omitempty"`
+	Since        time.Time  `json:"since"`
+	HoldUntil    *time.Time `json:"holdUntil,omitempty"`
+	LatencyMs    int        `json:"latencyMs,omitempty"`
+	PacketLoss   float64    `json:"packetLoss,omitempty"`
+	Bad          int        `json:"bad,omitempty"`  // consecutive bad samples
+	Good         int        `json:"good,omitempty"` // consecutive good samples
+	Decayed      time.Time  `json:"decayed"`        // when Penalty was last decayed
+	Planned      bool       `json:"planned,omitempty"`
+	LatencyKnown bool       `json:"latencyKnown,omitempty"`
+}
+
+// StickyState is a value that only changes once a new one was seen Count times in a row.
+type StickyState struct {
+	Value   string `json:"value"`
+	Pending string `json:"pending,omitempty"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// AutoPath is the route an auto-path rule currently uses.
+type AutoPath struct {
+	Hops []string `json:"hops"`
+	Cost float64  `json:"cost"`
+}
+
+// EgressSelection is the member of an egress group a source node uses.
+type EgressSelection struct {
+	Group   string `json:"group"`
+	Source  string `json:"source"`
+	Member  string `json:"member"`
+	Healthy bool   `json:"healthy"` // false: no member was usable and Member is the fallback
+}
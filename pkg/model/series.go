@@ -0,0 +1,38 @@
+package model
+
+import "time"
+
+// HealthBucket aggregates the latency/loss samples one node reported for one peer
+// over [Start, Start+Step). Steps are "1m", "5m" and "1h"; coarser buckets are rolled
+// up from finer ones using Hist, so percentiles stay mergeable.
+type HealthBucket struct {
+	NodeID    string    `json:"nodeId"`
+	Peer      string    `json:"peer"` // probed overlay IP, as in HealthReport.LatencyMs
+	Step      string    `json:"step"`
+	Start     time.Time `json:"start"`
+	Samples   int       `json:"samples"`
+	MinMs     float64   `json:"minMs"`
+	AvgMs     float64   `json:"avgMs"`
+	P50Ms     float64   `json:"p50Ms"`
+	P95Ms     float64   `json:"p95Ms"`
+	MaxMs     float64   `json:"maxMs"`
+	LossRatio float64   `json:"lossRatio"` // mean packet loss, 0..1
+
+	// LatencySamples counts samples that produced a latency (fully lost probes do not).
+	LatencySamples int `json:"latencySamples"`
+	// Hist counts latency samples per series.LatencyBounds bin.
+	Hist []uint32 `json:"hist,omitempty"`
+}
+
+// SeriesStepDuration maps a stored bucket step ("1m", "5m", "1h") to its width.
+func SeriesStepDuration(step string) (time.Duration, bool) {
+	switch step {
+	case "1m":
+		return time.Minute, true
+	case "5m":
+		return 5 * time.Minute, true
+	case "1h":
+		return time.Hour, true
+	}
+	return 0, false
+}
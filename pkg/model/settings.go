@@ -1,5 +1,12 @@
 package model
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // GeoIPConfig controls GeoIP source/caching.
 type GeoIPConfig struct {
 	SourceV4 string `json:"sourceV4"`
@@ -13,8 +20,225 @@ type DiagConfig struct {
 	PingInterval string `json:"pingInterval"` // e.g., "3s"
 }
 
+// RetentionPolicy bounds one history collection by age and/or count.
+// An empty MaxAge or zero MaxCount inherits the controller default;
+// MaxAge "0" or MaxCount -1 disables that bound.
+type RetentionPolicy struct {
+	MaxAge   string `json:"maxAge,omitempty"`   // e.g. "24h", "30d"
+	MaxCount int    `json:"maxCount,omitempty"` // per node for per-node collections
+}
+
+// RetentionConfig holds the retention enforced by the controller janitor.
+type RetentionConfig struct {
+	Audit         RetentionPolicy `json:"audit"`
+	Tasks         RetentionPolicy `json:"tasks"`
+	PolicyStatus  RetentionPolicy `json:"policyStatus"`  // per node
+	PolicyDiag    RetentionPolicy `json:"policyDiag"`    // per node
+	PlanHistory   RetentionPolicy `json:"planHistory"`   // per node
+	HealthHistory RetentionPolicy `json:"healthHistory"` // per node, raw samples
+	// rolled-up health buckets per step, counted per node
+	HealthSeries1m RetentionPolicy `json:"healthSeries1m"`
+	HealthSeries5m RetentionPolicy `json:"healthSeries5m"`
+	HealthSeries1h RetentionPolicy `json:"healthSeries1h"`
+}
+
+// HealthSeries returns the policy for buckets of the given step.
+func (c RetentionConfig) HealthSeries(step string) RetentionPolicy {
+	switch step {
+	case "1m":
+		return c.HealthSeries1m
+	case "5m":
+		return c.HealthSeries5m
+	case "1h":
+		return c.HealthSeries1h
+	}
+	return RetentionPolicy{}
+}
+
+// RetentionStats counts entries removed by one retention pass.
+type RetentionStats struct {
+	Audit         int `json:"audit"`
+	Tasks         int `json:"tasks"`
+	PolicyStatus  int `json:"policyStatus"`
+	PolicyDiag    int `json:"policyDiag"`
+	PlanHistory   int `json:"planHistory"`
+	HealthHistory int `json:"healthHistory"`
+	HealthSeries  int `json:"healthSeries"`
+}
+
+// Total is the number of removed entries across all collections.
+func (s RetentionStats) Total() int {
+	return s.Audit + s.Tasks + s.PolicyStatus + s.PolicyDiag + s.PlanHistory + s.HealthHistory + s.HealthSeries
+}
+
+// Topology modes, node roles and intent preferences.
+const (
+	TopologyMesh     = "mesh"
+	TopologyHubSpoke = "hub-spoke"
+	TopologyIntent   = "intent"
+
+	RoleHub   = "hub"
+	RoleSpoke = "spoke"
+
+	PreferLatency = "latency" // lowest measured latency first
+	PreferStable  = "stable"  // fixed hash order, does not follow latency changes
+)
+
+// PeeringIntent peers every node matching From with nodes matching To.
+// Selectors are comma-separated label terms (key=value, key!=value, key, !key);
+// an empty selector or "*" matches every node.
+type PeeringIntent struct {
+	ID         string `json:"id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	MaxPeers   int    `json:"maxPeers,omitempty"`   // per From node; 0 = all matching nodes
+	Preference string `json:"preference,omitempty"` // latency (default) or stable, picks the MaxPeers
+}
+
+// TopologyConfig selects how the controller connects nodes.
+type TopologyConfig struct {
+	Mode    string          `json:"mode"`              // mesh (default), hub-spoke or intent
+	Intents []PeeringIntent `json:"intents,omitempty"` // evaluated in intent mode
+}
+
+// DefaultOverlayPool is the IPv4 overlay pool used when none is configured.
+const DefaultOverlayPool = "10.10.0.0/16"
+
+// IPReservation pins the IPv4 overlay address of one node.
+type IPReservation struct {
+	NodeID string `json:"nodeId"`
+	IP     string `json:"ip"` // bare address or /32
+}
+
+// IPAMConfig holds the IPv4 overlay pools addresses are allocated from and the static
+// reservations that take precedence over allocation.
+type IPAMConfig struct {
+	Pools        []string        `json:"pools,omitempty"` // IPv4 CIDRs; empty = DefaultOverlayPool
+	Reservations []IPReservation `json:"reservations,omitempty"`
+}
+
+// DefaultOverlay6Prefix is the ULA pool IPv6 overlay addresses are taken from.
+const DefaultOverlay6Prefix = "fd10:10::/64"
+
+// IPv6Config enables the dual-stack overlay. Every node's IPv6 overlay address is the
+// prefix with the node's IPv4 overlay address in the low 32 bits.
+type IPv6Config struct {
+	Enabled bool   `json:"enabled"`
+	Prefix  string `json:"prefix,omitempty"` // /96 or shorter; empty = DefaultOverlay6Prefix
+}
+
+// DampingConfig tunes how health reports turn into plan changes: a link only goes down
+// after sustained loss and only comes back after sustained recovery, a hold-down and
+// enough decay of its flap penalty. Zero values take the defaults.
+type DampingConfig struct {
+	Disabled          bool    `json:"disabled,omitempty"`          // plan from raw health
+	LossThreshold     float64 `json:"lossThreshold,omitempty"`     // packet loss % that makes a probe bad
+	DownAfter         int     `json:"downAfter,omitempty"`         // consecutive bad reports before a link goes down
+	UpAfter           int     `json:"upAfter,omitempty"`           // consecutive good reports before it comes back
+	HoldDown          string  `json:"holdDown,omitempty"`          // minimum time a link stays down, e.g. "30s"
+	Penalty           float64 `json:"penalty,omitempty"`           // added to the flap penalty on every down transition
+	SuppressAt        float64 `json:"suppressAt,omitempty"`        // penalty that keeps a link down once it flapped
+	ReuseAt           float64 `json:"reuseAt,omitempty"`           // penalty a suppressed link must decay below
+	HalfLife          string  `json:"halfLife,omitempty"`          // flap penalty half-life, e.g. "5m"
+	LatencyHysteresis float64 `json:"latencyHysteresis,omitempty"` // relative latency change plans follow, e.g. 0.2
+}
+
+// Egress group modes.
+const (
+	EgressFailover = "failover" // first healthy member in order (primary/backup)
+	EgressWeighted = "weighted" // sources spread over the healthy members by weight
+)
+
+// EgressGroupPrefix marks a reference to an egress group where a node id is expected
+// (egressPeerId, defaultRouteNextHop, a rule's viaNode or egress), e.g. "group:exits".
+const EgressGroupPrefix = "group:"
+
+// EgressGroupRef returns the group id named by ref, if ref references a group.
+func EgressGroupRef(ref string) (string, bool) {
+	return strings.CutPrefix(ref, EgressGroupPrefix)
+}
+
+// EgressMember is one egress node of a group.
+type EgressMember struct {
+	NodeID string `json:"nodeId"`
+	Weight int    `json:"weight,omitempty"` // weighted mode; 0 counts as 1
+}
+
+// EgressGroup is a set of interchangeable egress nodes; the controller resolves references
+// to the member that is active for each source node.
+type EgressGroup struct {
+	ID      string         `json:"id"`
+	Mode    string         `json:"mode,omitempty"` // failover (default) or weighted
+	Members []EgressMember `json:"members"`        // failover: in priority order
+}
+
+// PresharedKeyConfig controls the per-link WireGuard preshared keys. Every pair of
+// peered nodes gets its own key; rotation stages the next key on both ends before
+// either switches, so tunnels stay up.
+type PresharedKeyConfig struct {
+	Enabled     bool   `json:"enabled"`
+	RotateEvery string `json:"rotateEvery,omitempty"` // key lifetime, e.g. "24h"; empty = 24h, "0" = never rotate
+}
+
+// NodeKeyConfig controls where WireGuard private keys come from. With AgentGenerated
+// agents generate their keypair locally and prove possession of it; the controller then
+// neither generates, stores nor returns private keys. RotateEvery schedules rotations of
+// agent-held node keys (e.g. "720h"); empty or "0" rotates only on request.
+type NodeKeyConfig struct {
+	AgentGenerated bool   `json:"agentGenerated"`
+	RotateEvery    string `json:"rotateEvery,omitempty"`
+}
+
 // Settings is a bag for global controller settings.
 type Settings struct {
-	GeoIP GeoIPConfig `json:"geoip"`
-	Diag  DiagConfig  `json:"diag"`
+	GeoIP     GeoIPConfig     `json:"geoip"`
+	Diag      DiagConfig      `json:"diag"`
+	Retention RetentionConfig `json:"retention"`
+	Topology  TopologyConfig  `json:"topology"`
+	IPv6      IPv6Config      `json:"ipv6"`
+	IPAM      IPAMConfig      `json:"ipam"`
+	Damping   DampingConfig   `json:"damping"`
+	// egress groups referenced as "group:<id>"
+	EgressGroups  []EgressGroup      `json:"egressGroups,omitempty"`
+	PresharedKeys PresharedKeyConfig `json:"presharedKeys"`
+	NodeKeys      NodeKeyConfig      `json:"nodeKeys"`
+}
+
+// Limits resolves p into the oldest timestamp to keep (zero time: no age bound)
+// and the maximum entry count (0: no count bound).
+func (p RetentionPolicy) Limits(now time.Time) (time.Time, int, error) {
+	age, err := ParseRetentionAge(p.MaxAge)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var cutoff time.Time
+	if age > 0 {
+		cutoff = now.Add(-age)
+	}
+	count := p.MaxCount
+	if count < 0 {
+		count = 0
+	}
+	return cutoff, count, nil
+}
+
+// ParseRetentionAge parses a Go duration, additionally accepting whole days ("30d").
+// Empty and "0" mean no age bound.
+func ParseRetentionAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid retention age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid retention age %q", s)
+	}
+	return d, nil
 }
@@ -23,3 +23,36 @@ type Task struct {
 	CreatedAt     time.Time  `json:"createdAt"`
 	UpdatedAt     time.Time  `json:"updatedAt"`
 }
+
+// TaskQuery selects tasks by the node they addressed (NodeID or one of Targets), type and
+// status (Status or OverallStatus); empty fields match any. Pages are ordered by CreatedAt.
+type TaskQuery struct {
+	NodeID string
+	Type   string
+	Status string
+	HistoryPage
+}
+
+// Match reports whether t passes the node/type/status filters.
+func (q TaskQuery) Match(t Task) bool {
+	if q.Type != "" && t.Type != q.Type {
+		return false
+	}
+	if q.Status != "" && t.Status != q.Status && t.OverallStatus != q.Status {
+		return false
+	}
+	return q.NodeID == "" || t.Addresses(q.NodeID)
+}
+
+// Addresses reports whether the task addressed nodeID (single-node or multi-target tasks).
+func (t Task) Addresses(nodeID string) bool {
+	if t.NodeID == nodeID {
+		return true
+	}
+	for _, id := range t.Targets {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
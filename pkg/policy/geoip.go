@@ -34,6 +34,21 @@ func DefaultCacheDir() string { return defaultCacheDir() }
 func DefaultSourceV4() string { return defaultSourceV4() }
 func DefaultSourceV6() string { return defaultSourceV6() }
 
+// DefaultSettings returns the controller settings in effect before any have been saved.
+func DefaultSettings() model.Settings {
+	return model.Settings{
+		GeoIP: model.GeoIPConfig{
+			CacheDir: defaultCacheDir(),
+			SourceV4: defaultSourceV4(),
+			SourceV6: defaultSourceV6(),
+			CacheTTL: "24h",
+		},
+		Diag: model.DiagConfig{
+			PingInterval: "3s",
+		},
+	}
+}
+
 // SetConfig overrides GeoIP sources/cache based on controller settings.
 func SetConfig(cfg model.GeoIPConfig) {
 	if cfg.CacheDir != "" {
@@ -52,7 +67,8 @@ func SetConfig(cfg model.GeoIPConfig) {
 	}
 }
 
-// Expand returns normalized prefixes (/32 for IPv4) for a rule, resolving domains and geoip:CC/geoip6:CC.
+// Expand returns normalized prefixes (/32 for IPv4, /128 for IPv6 hosts) for a rule, resolving
+// domains (A and AAAA) and geoip:CC/geoip6:CC.
 func Expand(pr model.PolicyRule) []string {
 	if !pr.Validate() {
 		return nil
@@ -82,21 +98,17 @@ func Expand(pr model.PolicyRule) []string {
 				add(p)
 			}
 		default:
-			pfx := pr.Prefix
-			if !strings.Contains(pfx, "/") {
-				pfx = pr.Prefix + "/32"
-			}
-			if _, _, err := net.ParseCIDR(pfx); err == nil {
-				add(pfx)
+			if _, _, err := net.ParseCIDR(pr.Prefix); err == nil {
+				add(pr.Prefix)
 			} else if ip := net.ParseIP(pr.Prefix); ip != nil { // bare IP without mask
-				add(ip.String() + "/32")
+				add(HostPrefix(ip.String()))
 			}
 		}
 	}
 
 	for _, d := range pr.Domains {
 		for _, ip := range resolveDomain(d) {
-			add(ip + "/32")
+			add(HostPrefix(ip))
 		}
 	}
 	return out
@@ -160,6 +172,23 @@ func parseCIDRs(content string) []string {
 	return out
 }
 
+// HostPrefix returns the single-address prefix of ip: /32 for IPv4, /128 for IPv6.
+func HostPrefix(ip string) string {
+	if IsIPv6(ip) {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// IsIPv6 reports whether an address or prefix (with or without mask) is IPv6.
+func IsIPv6(s string) bool {
+	if i := strings.Index(s, "/"); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() == nil
+}
+
 func resolveDomain(domain string) []string {
 	out := []string{}
 	ipList, err := net.LookupIP(domain)
@@ -169,6 +198,8 @@ func resolveDomain(domain string) []string {
 	for _, ip := range ipList {
 		if v4 := ip.To4(); v4 != nil {
 			out = append(out, v4.String())
+		} else if ip.To16() != nil {
+			out = append(out, ip.String())
 		}
 	}
 	return out
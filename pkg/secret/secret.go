@@ -0,0 +1,99 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const sealedPrefix = "v1:"
+
+// ErrDecrypt is returned when a sealed value cannot be opened with the configured key.
+var ErrDecrypt = errors.New("secret: decrypt failed (wrong key or corrupted data)")
+
+// Box seals small secrets (WireGuard private keys, provision tokens) with AES-256-GCM.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox builds a Box from a 32-byte key.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret: key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// FromEnv builds a Box from SECRET_KEY (base64 of 32 bytes, or any passphrase which is hashed).
+// Without SECRET_KEY the key is derived from JWT_SECRET so existing deployments keep working;
+// set SECRET_KEY explicitly to be able to rotate the JWT secret independently.
+func FromEnv() (*Box, error) {
+	return NewBox(KeyFromEnv())
+}
+
+// KeyFromEnv returns the 32-byte key FromEnv would use.
+func KeyFromEnv() []byte {
+	if raw := strings.TrimSpace(os.Getenv("SECRET_KEY")); raw != "" {
+		if b, err := base64.StdEncoding.DecodeString(raw); err == nil && len(b) == 32 {
+			return b
+		}
+		sum := sha256.Sum256([]byte(raw))
+		return sum[:]
+	}
+	jwt := os.Getenv("JWT_SECRET")
+	if jwt == "" {
+		jwt = "change-me-secret"
+	}
+	sum := sha256.Sum256([]byte("peer-wan-secret:" + jwt))
+	return sum[:]
+}
+
+// Seal encrypts plain; empty input stays empty so optional fields round-trip unchanged.
+func (b *Box) Seal(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := b.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Open decrypts a value produced by Seal.
+func (b *Box) Open(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", fmt.Errorf("secret: unknown format")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("secret: decode: %w", err)
+	}
+	ns := b.aead.NonceSize()
+	if len(raw) < ns {
+		return "", ErrDecrypt
+	}
+	plain, err := b.aead.Open(nil, raw[:ns], raw[ns:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
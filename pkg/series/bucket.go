@@ -0,0 +1,212 @@
+package series
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// LatencyBounds are the upper edges (ms, inclusive) of the latency histogram kept in
+// every bucket. A final open-ended bin collects everything slower than the last bound.
+var LatencyBounds = []float64{0, 1, 2, 3, 5, 7, 10, 15, 20, 30, 40, 50, 75, 100, 150, 200, 300, 400, 500, 750, 1000, 1500, 2000, 3000, 5000}
+
+// fullLoss is the packet loss (percent) at which a probe carries no usable latency.
+const fullLoss = 100
+
+func histBin(ms float64) int {
+	return sort.SearchFloat64s(LatencyBounds, ms)
+}
+
+// accumulator collects raw samples of one peer in one bucket.
+type accumulator struct {
+	latencies []float64
+	lossSum   float64
+	samples   int
+}
+
+func (a *accumulator) add(ms float64, hasLatency bool, lossPct float64) {
+	a.samples++
+	a.lossSum += math.Min(math.Max(lossPct, 0), fullLoss)
+	if hasLatency && lossPct < fullLoss {
+		a.latencies = append(a.latencies, ms)
+	}
+}
+
+// bucket finalises the accumulator; percentiles are exact since every sample is known.
+func (a *accumulator) bucket(nodeID, peer, step string, start time.Time) model.HealthBucket {
+	b := model.HealthBucket{
+		NodeID:         nodeID,
+		Peer:           peer,
+		Step:           step,
+		Start:          start,
+		Samples:        a.samples,
+		LatencySamples: len(a.latencies),
+		Hist:           make([]uint32, len(LatencyBounds)+1),
+	}
+	if a.samples > 0 {
+		b.LossRatio = a.lossSum / float64(a.samples) / fullLoss
+	}
+	if len(a.latencies) == 0 {
+		return b
+	}
+	sort.Float64s(a.latencies)
+	sum := 0.0
+	for _, ms := range a.latencies {
+		sum += ms
+		b.Hist[histBin(ms)]++
+	}
+	b.MinMs = a.latencies[0]
+	b.MaxMs = a.latencies[len(a.latencies)-1]
+	b.AvgMs = sum / float64(len(a.latencies))
+	b.P50Ms = exactQuantile(a.latencies, 0.50)
+	b.P95Ms = exactQuantile(a.latencies, 0.95)
+	return b
+}
+
+// exactQuantile uses nearest rank on sorted values.
+func exactQuantile(sorted []float64, q float64) float64 {
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// FromReports builds 1m buckets from raw health reports of one node. Reports outside
+// [from, to) are ignored. A peer counts one sample per report that mentions it in
+// either LatencyMs or PacketLoss.
+func FromReports(nodeID string, reports []model.HealthReport, from, to time.Time) []model.HealthBucket {
+	type key struct {
+		peer  string
+		start int64
+	}
+	acc := map[key]*accumulator{}
+	for _, r := range reports {
+		if r.Timestamp.Before(from) || !r.Timestamp.Before(to) {
+			continue
+		}
+		start := r.Timestamp.Truncate(time.Minute).Unix()
+		peers := map[string]bool{}
+		for p := range r.LatencyMs {
+			peers[p] = true
+		}
+		for p := range r.PacketLoss {
+			peers[p] = true
+		}
+		for p := range peers {
+			k := key{p, start}
+			a := acc[k]
+			if a == nil {
+				a = &accumulator{}
+				acc[k] = a
+			}
+			ms, ok := r.LatencyMs[p]
+			a.add(float64(ms), ok, r.PacketLoss[p])
+		}
+	}
+	out := make([]model.HealthBucket, 0, len(acc))
+	for k, a := range acc {
+		out = append(out, a.bucket(nodeID, k.peer, "1m", time.Unix(k.start, 0).UTC()))
+	}
+	sortBuckets(out)
+	return out
+}
+
+// Merge combines buckets of the same node and peer into one bucket of step starting at
+// start. Averages and loss are weighted by sample counts; percentiles are estimated from
+// the merged histogram and clamped to the observed min/max.
+func Merge(step string, start time.Time, in []model.HealthBucket) model.HealthBucket {
+	out := model.HealthBucket{Step: step, Start: start, Hist: make([]uint32, len(LatencyBounds)+1)}
+	latSum, lossSum := 0.0, 0.0
+	for i, b := range in {
+		if i == 0 {
+			out.NodeID, out.Peer = b.NodeID, b.Peer
+		}
+		out.Samples += b.Samples
+		lossSum += b.LossRatio * float64(b.Samples)
+		if b.LatencySamples == 0 {
+			continue
+		}
+		if out.LatencySamples == 0 || b.MinMs < out.MinMs {
+			out.MinMs = b.MinMs
+		}
+		if b.MaxMs > out.MaxMs {
+			out.MaxMs = b.MaxMs
+		}
+		out.LatencySamples += b.LatencySamples
+		latSum += b.AvgMs * float64(b.LatencySamples)
+		for j := 0; j < len(b.Hist) && j < len(out.Hist); j++ {
+			out.Hist[j] += b.Hist[j]
+		}
+	}
+	if out.Samples > 0 {
+		out.LossRatio = lossSum / float64(out.Samples)
+	}
+	if out.LatencySamples > 0 {
+		out.AvgMs = latSum / float64(out.LatencySamples)
+		out.P50Ms = histQuantile(out.Hist, 0.50, out.MinMs, out.MaxMs)
+		out.P95Ms = histQuantile(out.Hist, 0.95, out.MinMs, out.MaxMs)
+	}
+	return out
+}
+
+// histQuantile interpolates linearly inside the bin holding the q-th sample.
+func histQuantile(hist []uint32, q, min, max float64) float64 {
+	total := uint64(0)
+	for _, c := range hist {
+		total += uint64(c)
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	cum := 0.0
+	for i, c := range hist {
+		if c == 0 {
+			continue
+		}
+		if cum+float64(c) >= rank {
+			lo, hi := min, max
+			if i > 0 {
+				lo = LatencyBounds[i-1]
+			}
+			if i < len(LatencyBounds) {
+				hi = LatencyBounds[i]
+			}
+			v := lo + (hi-lo)*(rank-cum)/float64(c)
+			return math.Min(math.Max(v, min), max)
+		}
+		cum += float64(c)
+	}
+	return max
+}
+
+// Rollup merges finer buckets into buckets of step, grouped by peer and step window.
+func Rollup(step string, width time.Duration, in []model.HealthBucket) []model.HealthBucket {
+	type key struct {
+		peer  string
+		start int64
+	}
+	groups := map[key][]model.HealthBucket{}
+	for _, b := range in {
+		k := key{b.Peer, b.Start.Truncate(width).Unix()}
+		groups[k] = append(groups[k], b)
+	}
+	out := make([]model.HealthBucket, 0, len(groups))
+	for k, list := range groups {
+		out = append(out, Merge(step, time.Unix(k.start, 0).UTC(), list))
+	}
+	sortBuckets(out)
+	return out
+}
+
+func sortBuckets(list []model.HealthBucket) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Start.Equal(list[j].Start) {
+			return list[i].Start.Before(list[j].Start)
+		}
+		return list[i].Peer < list[j].Peer
+	})
+}
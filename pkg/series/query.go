@@ -0,0 +1,159 @@
+package series
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+const (
+	// maxAutoPoints is the per-peer point budget step=auto picks a width for.
+	maxAutoPoints = 720
+	// MaxPoints caps explicit steps so a wide range at 1m cannot exhaust memory.
+	MaxPoints = 10000
+)
+
+// Query selects one node's series. Peers empty means every peer the node probed.
+// Step is "auto"/"" or a duration that is a multiple of a stored step ("1m", "15m", "1d").
+type Query struct {
+	NodeID string
+	Peers  []string
+	Step   string
+	From   time.Time
+	To     time.Time
+}
+
+// Series is the result for one peer: buckets of the resolved step, oldest first, and
+// a summary merged over the whole range.
+type Series struct {
+	Peer    string               `json:"peer"`
+	Points  []model.HealthBucket `json:"points"`
+	Summary model.HealthBucket   `json:"summary"`
+}
+
+// Fetch resolves q.Step, reads the stored buckets that serve it and merges them into
+// the requested width. It returns the resolved step with the series.
+func Fetch(st store.NodeStore, q Query, retention model.RetentionConfig, now time.Time) (string, []Series, error) {
+	if !q.From.Before(q.To) {
+		return "", nil, fmt.Errorf("from must be before to")
+	}
+	width, source, err := resolveStep(q.Step, q.From, q.To, retention, now)
+	if err != nil {
+		return "", nil, err
+	}
+	sourceWidth, _ := model.SeriesStepDuration(source)
+	buckets, err := st.ListHealthBuckets(q.NodeID, source, q.From.Truncate(sourceWidth), q.To)
+	if err != nil {
+		return "", nil, err
+	}
+	want := map[string]bool{}
+	for _, p := range q.Peers {
+		want[p] = true
+	}
+	byPeer := map[string][]model.HealthBucket{}
+	for _, b := range buckets {
+		if len(want) > 0 && !want[b.Peer] {
+			continue
+		}
+		byPeer[b.Peer] = append(byPeer[b.Peer], b)
+	}
+	step := formatStep(width)
+	out := make([]Series, 0, len(byPeer))
+	for peer, list := range byPeer {
+		points := list
+		if width != sourceWidth {
+			points = Rollup(step, width, list)
+		}
+		s := Series{Peer: peer, Points: make([]model.HealthBucket, len(points))}
+		for i, p := range points {
+			p.Hist = nil
+			s.Points[i] = p
+		}
+		s.Summary = Merge(step, q.From, list)
+		s.Summary.Step = ""
+		s.Summary.Hist = nil
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return step, out, nil
+}
+
+// resolveStep returns the output width and the stored step it is built from. For auto
+// it picks the finest stored step that still has data at from and keeps the point count
+// within maxAutoPoints.
+func resolveStep(step string, from, to time.Time, retention model.RetentionConfig, now time.Time) (time.Duration, string, error) {
+	span := to.Sub(from)
+	if step == "" || step == "auto" {
+		for i, s := range store.HealthSeriesSteps {
+			w, _ := model.SeriesStepDuration(s)
+			last := i == len(store.HealthSeriesSteps)-1
+			if cutoff, _, err := retention.HealthSeries(s).Limits(now); err == nil && !cutoff.IsZero() && from.Before(cutoff) && !last {
+				continue
+			}
+			if span/w > maxAutoPoints && !last {
+				continue
+			}
+			return w, s, nil
+		}
+	}
+	// same syntax as retention ages, so "1d" works
+	w, err := model.ParseRetentionAge(step)
+	if err != nil || w <= 0 {
+		return 0, "", fmt.Errorf("invalid step %q", step)
+	}
+	// coarsest stored step dividing w
+	source := ""
+	for _, s := range store.HealthSeriesSteps {
+		sw, _ := model.SeriesStepDuration(s)
+		if w%sw == 0 {
+			source = s
+		}
+	}
+	if source == "" {
+		return 0, "", fmt.Errorf("step %q must be a multiple of one of %v", step, store.HealthSeriesSteps)
+	}
+	if span/w > MaxPoints {
+		return 0, "", fmt.Errorf("step %q yields more than %d points for this range", step, MaxPoints)
+	}
+	return w, source, nil
+}
+
+func formatStep(w time.Duration) string {
+	switch {
+	case w%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", w/(24*time.Hour))
+	case w%time.Hour == 0:
+		return fmt.Sprintf("%dh", w/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", w/time.Minute)
+	}
+}
+
+// ToReports renders 1m buckets in the raw HealthReport shape (average latency, loss in
+// percent) so history consumers keep working past the raw retention window.
+func ToReports(nodeID string, buckets []model.HealthBucket) []model.HealthReport {
+	byStart := map[int64]*model.HealthReport{}
+	var starts []int64
+	for _, b := range buckets {
+		k := b.Start.Unix()
+		r := byStart[k]
+		if r == nil {
+			r = &model.HealthReport{NodeID: nodeID, Status: "up", LatencyMs: map[string]int{}, PacketLoss: map[string]float64{}, Timestamp: b.Start}
+			byStart[k] = r
+			starts = append(starts, k)
+		}
+		if b.LatencySamples > 0 {
+			r.LatencyMs[b.Peer] = int(b.AvgMs + 0.5)
+		}
+		r.PacketLoss[b.Peer] = b.LossRatio * fullLoss
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	out := make([]model.HealthReport, 0, len(starts))
+	for _, k := range starts {
+		out = append(out, *byStart[k])
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package series
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/store"
+)
+
+// grace delays closing a minute so reports stamped just before the boundary have arrived.
+const grace = 30 * time.Second
+
+// level describes one rung of the rollup ladder: buckets of step are built from source
+// ("" = raw health history). lookback bounds the search for the last stored bucket
+// when a rollup (re)starts.
+type level struct {
+	step     string
+	width    time.Duration
+	source   string
+	lookback time.Duration
+}
+
+var levels = []level{
+	{step: "1m", width: time.Minute, lookback: 2 * time.Hour},
+	{step: "5m", width: 5 * time.Minute, source: "1m", lookback: 24 * time.Hour},
+	{step: "1h", width: time.Hour, source: "5m", lookback: 7 * 24 * time.Hour},
+}
+
+// Roller turns raw health reports into 1m buckets and folds those into 5m and 1h ones.
+// It keeps per-node watermarks (the start of the next bucket to build at each step) in
+// memory and recovers them from the stored series after a restart or leader change.
+type Roller struct {
+	st         store.NodeStore
+	watermarks map[string]map[string]time.Time // node -> step -> next start
+}
+
+// NewRoller returns a Roller writing into st.
+func NewRoller(st store.NodeStore) *Roller {
+	return &Roller{st: st, watermarks: map[string]map[string]time.Time{}}
+}
+
+// Reset forgets watermarks so the next pass reloads them from the store.
+func (r *Roller) Reset() {
+	r.watermarks = map[string]map[string]time.Time{}
+}
+
+// Run closes every bucket that ended before now-grace, for every node.
+func (r *Roller) Run(now time.Time) error {
+	nodes, err := r.st.ListNodes()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		seen[n.ID] = true
+		if err := r.runNode(n.ID, now); err != nil {
+			log.Printf("health rollup %s: %v", n.ID, err)
+		}
+	}
+	for id := range r.watermarks {
+		if !seen[id] {
+			delete(r.watermarks, id)
+		}
+	}
+	return nil
+}
+
+func (r *Roller) runNode(nodeID string, now time.Time) error {
+	wm := r.watermarks[nodeID]
+	if wm == nil {
+		wm = map[string]time.Time{}
+		r.watermarks[nodeID] = wm
+	}
+	closed := now.Add(-grace)
+	for _, lv := range levels {
+		next, ok := wm[lv.step]
+		if !ok {
+			var err error
+			if next, err = r.initialWatermark(nodeID, lv, now, wm); err != nil {
+				return err
+			}
+		}
+		// a step window closes once the source has been rolled past its end
+		end := closed.Truncate(lv.width)
+		if lv.source != "" {
+			end = wm[lv.source].Truncate(lv.width)
+		}
+		if !next.Before(end) {
+			wm[lv.step] = next
+			continue
+		}
+		var out []model.HealthBucket
+		if lv.source == "" {
+			reports, err := r.st.ListHealthHistory(nodeID, next)
+			if err != nil {
+				return err
+			}
+			out = FromReports(nodeID, reports, next, end)
+		} else {
+			src, err := r.st.ListHealthBuckets(nodeID, lv.source, next, end)
+			if err != nil {
+				return err
+			}
+			out = Rollup(lv.step, lv.width, src)
+		}
+		if len(out) > 0 {
+			if err := r.st.SaveHealthBuckets(out); err != nil {
+				return err
+			}
+		}
+		wm[lv.step] = end
+	}
+	return nil
+}
+
+// initialWatermark resumes after the newest stored bucket of lv, or starts at the
+// source's watermark (raw history: the lookback window) when there is none.
+func (r *Roller) initialWatermark(nodeID string, lv level, now time.Time, wm map[string]time.Time) (time.Time, error) {
+	existing, err := r.st.ListHealthBuckets(nodeID, lv.step, now.Add(-lv.lookback), time.Time{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(existing) > 0 {
+		return existing[len(existing)-1].Start.Add(lv.width), nil
+	}
+	if lv.source == "" {
+		return now.Add(-lv.lookback).Truncate(lv.width), nil
+	}
+	src, err := r.st.ListHealthBuckets(nodeID, lv.source, now.Add(-lv.lookback), time.Time{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(src) > 0 {
+		return src[0].Start.Truncate(lv.width), nil
+	}
+	return wm[lv.source].Truncate(lv.width), nil
+}
+
+// StartRollup runs a Roller every minute until ctx is done. When active is non-nil
+// passes are skipped while it returns false, and watermarks are reloaded once it
+// becomes true again (another replica may have rolled up in between).
+func StartRollup(ctx context.Context, st store.NodeStore, active func() bool) {
+	r := NewRoller(st)
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		wasActive := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				if active != nil && !active() {
+					wasActive = false
+					continue
+				}
+				if !wasActive {
+					r.Reset()
+					wasActive = true
+				}
+				if err := r.Run(now); err != nil {
+					log.Printf("health rollup failed: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,109 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/store"
+)
+
+const (
+	filePrefix = "peer-wan-snapshot-"
+	fileSuffix = ".json.gz"
+)
+
+// WriteFile exports st into dir as a timestamped archive and returns its path.
+// The file is written to a temp name and renamed so readers never see partial archives.
+func WriteFile(st store.NodeStore, box *secret.Box, dir string) (string, error) {
+	snap, err := Export(st, box)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	name := filePrefix + snap.CreatedAt.Format("20060102T150405Z") + fileSuffix
+	path := filepath.Join(dir, name)
+	tmp, err := os.CreateTemp(dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := Write(tmp, snap); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Prune keeps the newest retain archives in dir and removes the rest.
+func Prune(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), filePrefix) && strings.HasSuffix(e.Name(), fileSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) <= retain {
+		return nil
+	}
+	// timestamped names sort chronologically
+	sort.Strings(names)
+	for _, name := range names[:len(names)-retain] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// StartScheduler writes a snapshot into dir every interval, keeping the newest retain files.
+func StartScheduler(ctx context.Context, st store.NodeStore, box *secret.Box, dir string, interval time.Duration, retain int) {
+	if dir == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				path, err := WriteFile(st, box, dir)
+				if err != nil {
+					log.Printf("scheduled snapshot failed: %v", err)
+					continue
+				}
+				log.Printf("snapshot written: %s", path)
+				if err := Prune(dir, retain); err != nil {
+					log.Printf("snapshot retention failed: %v", err)
+				}
+			}
+		}
+	}()
+}
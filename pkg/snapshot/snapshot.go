@@ -0,0 +1,600 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/secret"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/version"
+)
+
+const (
+	// Format identifies peer-wan snapshot archives.
+	Format = "peer-wan-snapshot"
+	// FormatVersion is bumped whenever Snapshot changes incompatibly. Version 2 added
+	// health, health series, policy diagnostics and the routing state.
+	FormatVersion = 2
+)
+
+// ErrTargetNotEmpty is returned by Restore when the target has nodes and Replace is not set.
+var ErrTargetNotEmpty = errors.New("target store is not empty")
+
+// Snapshot is the backend independent content of a NodeStore.
+type Snapshot struct {
+	CreatedAt         time.Time                           `json:"createdAt"`
+	BuildVersion      string                              `json:"buildVersion,omitempty"`
+	Nodes             []Node                              `json:"nodes"`
+	Plans             []model.Plan                        `json:"plans"`
+	PlanHistory       map[string][]model.Plan             `json:"planHistory"`
+	GlobalPlanVersion int64                               `json:"globalPlanVersion"`
+	Settings          model.Settings                      `json:"settings"`
+	Audit             []model.AuditEntry                  `json:"audit"`
+	Tasks             []model.Task                        `json:"tasks"`
+	PolicyStatus      map[string][]model.PolicyInstallLog `json:"policyStatus,omitempty"`
+	// preshared keys stay sealed with the controller key they were written with
+	LinkKeys      []model.LinkKey                     `json:"linkKeys,omitempty"`
+	PolicyDiag    map[string][]model.PolicyDiagReport `json:"policyDiag,omitempty"`
+	Health        []model.HealthReport                `json:"health,omitempty"` // latest report per node
+	HealthHistory map[string][]model.HealthReport     `json:"healthHistory,omitempty"`
+	HealthSeries  []model.HealthBucket                `json:"healthSeries,omitempty"` // every stored step
+	Routing       *model.RoutingState                 `json:"routing,omitempty"`
+}
+
+// Node is a node with its secrets sealed by a secret.Box (model.Node hides them from JSON).
+type Node struct {
+	model.Node
+	SealedPrivateKey     string `json:"sealedPrivateKey,omitempty"`
+	SealedProvisionToken string `json:"sealedProvisionToken,omitempty"`
+}
+
+// envelope is the on-disk wrapper; Checksum covers the exact Payload bytes.
+type envelope struct {
+	Format   string          `json:"format"`
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Summary counts what a snapshot contains (used in API responses and logs).
+type Summary struct {
+	Nodes       int `json:"nodes"`
+	Plans       int `json:"plans"`
+	PlanHistory int `json:"planHistory"`
+	Audit       int `json:"audit"`
+	Tasks       int `json:"tasks"`
+}
+
+// Summary reports entity counts of s.
+func (s *Snapshot) Summary() Summary {
+	sum := Summary{Nodes: len(s.Nodes), Plans: len(s.Plans), Audit: len(s.Audit), Tasks: len(s.Tasks)}
+	for _, h := range s.PlanHistory {
+		sum.PlanHistory += len(h)
+	}
+	return sum
+}
+
+// Export reads all content of st. Node secrets are sealed with box.
+func Export(st store.NodeStore, box *secret.Box) (*Snapshot, error) {
+	nodes, err := st.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	snap := &Snapshot{
+		CreatedAt:     time.Now().UTC(),
+		BuildVersion:  version.Build,
+		PlanHistory:   map[string][]model.Plan{},
+		PolicyStatus:  map[string][]model.PolicyInstallLog{},
+		PolicyDiag:    map[string][]model.PolicyDiagReport{},
+		HealthHistory: map[string][]model.HealthReport{},
+	}
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		entry := Node{Node: n}
+		if entry.SealedPrivateKey, err = box.Seal(n.PrivateKey); err != nil {
+			return nil, fmt.Errorf("seal node %s: %w", n.ID, err)
+		}
+		if entry.SealedProvisionToken, err = box.Seal(n.ProvisionToken); err != nil {
+			return nil, fmt.Errorf("seal node %s: %w", n.ID, err)
+		}
+		snap.Nodes = append(snap.Nodes, entry)
+		known[n.ID] = true
+
+		if p, ok, err := st.GetPlan(n.ID); err != nil {
+			return nil, fmt.Errorf("get plan %s: %w", n.ID, err)
+		} else if ok {
+			snap.Plans = append(snap.Plans, p)
+		}
+		hist, err := st.ListPlanHistory(n.ID, 0)
+		if err != nil {
+			return nil, fmt.Errorf("plan history %s: %w", n.ID, err)
+		}
+		if len(hist) > 0 {
+			snap.PlanHistory[n.ID] = hist
+		}
+		logs, err := st.ListPolicyStatus(n.ID, 0)
+		if err != nil {
+			return nil, fmt.Errorf("policy status %s: %w", n.ID, err)
+		}
+		if len(logs) > 0 {
+			snap.PolicyStatus[n.ID] = logs
+		}
+		diags, err := st.ListPolicyDiag(n.ID, 0)
+		if err != nil {
+			return nil, fmt.Errorf("policy diag %s: %w", n.ID, err)
+		}
+		if len(diags) > 0 {
+			snap.PolicyDiag[n.ID] = diags
+		}
+		health, err := st.ListHealthHistory(n.ID, time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("health history %s: %w", n.ID, err)
+		}
+		if len(health) > 0 {
+			snap.HealthHistory[n.ID] = health
+		}
+		for _, step := range store.HealthSeriesSteps {
+			buckets, err := st.ListHealthBuckets(n.ID, step, time.Time{}, time.Time{})
+			if err != nil {
+				return nil, fmt.Errorf("health series %s/%s: %w", n.ID, step, err)
+			}
+			snap.HealthSeries = append(snap.HealthSeries, buckets...)
+		}
+	}
+	current, err := st.ListHealth()
+	if err != nil {
+		return nil, fmt.Errorf("health: %w", err)
+	}
+	for _, h := range current {
+		if known[h.NodeID] {
+			snap.Health = append(snap.Health, h)
+		}
+	}
+	sort.Slice(snap.Health, func(i, j int) bool { return snap.Health[i].NodeID < snap.Health[j].NodeID })
+	if snap.GlobalPlanVersion, err = st.GetGlobalPlanVersion(); err != nil {
+		return nil, fmt.Errorf("plan version: %w", err)
+	}
+	if snap.Settings, err = st.GetSettings(); err != nil {
+		return nil, fmt.Errorf("settings: %w", err)
+	}
+	if snap.Audit, err = st.ListAudit(0); err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	if snap.Tasks, err = st.ListTasks("", 0); err != nil {
+		return nil, fmt.Errorf("tasks: %w", err)
+	}
+	if snap.LinkKeys, err = st.ListLinkKeys(); err != nil {
+		return nil, fmt.Errorf("link keys: %w", err)
+	}
+	if rs, ok, err := st.GetRoutingState(); err != nil {
+		return nil, fmt.Errorf("routing state: %w", err)
+	} else if ok {
+		snap.Routing = &rs
+	}
+	return snap, nil
+}
+
+// Write encodes snap as a gzip-compressed, checksummed archive.
+func Write(w io.Writer, snap *Snapshot) error {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(payload)
+	env := envelope{Format: Format, Version: FormatVersion, Checksum: "sha256:" + hex.EncodeToString(sum[:]), Payload: payload}
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(env); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// Read decodes and verifies an archive written by Write.
+func Read(r io.Reader) (*Snapshot, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a snapshot archive: %w", err)
+	}
+	defer zr.Close()
+	var env envelope
+	if err := json.NewDecoder(zr).Decode(&env); err != nil {
+		return nil, fmt.Errorf("decode snapshot: %w", err)
+	}
+	if env.Format != Format {
+		return nil, fmt.Errorf("unexpected archive format %q", env.Format)
+	}
+	if env.Version < 1 || env.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d (supported <= %d)", env.Version, FormatVersion)
+	}
+	// compact so the checksum is independent of how the envelope encoder laid out the payload
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, env.Payload); err != nil {
+		return nil, fmt.Errorf("decode snapshot payload: %w", err)
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	if got := "sha256:" + hex.EncodeToString(sum[:]); got != env.Checksum {
+		return nil, fmt.Errorf("snapshot checksum mismatch: archive says %s, content is %s", env.Checksum, got)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(env.Payload, &snap); err != nil {
+		return nil, fmt.Errorf("decode snapshot payload: %w", err)
+	}
+	return &snap, nil
+}
+
+// RestoreOptions controls how Restore treats a non-empty target.
+type RestoreOptions struct {
+	// Replace makes a target that already has nodes match the snapshot. The snapshot is
+	// written over what is there first; nodes and link keys it does not have are only
+	// deleted afterwards, so a restore failing halfway never leaves the target emptier
+	// than before. History of nodes on both sides is merged, entries already present are
+	// not written again. Without Replace, Restore refuses a store that already has nodes.
+	Replace bool
+}
+
+// ErrInvalidSnapshot is returned by Restore when the archive contradicts itself; nothing
+// has been written then.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Restore loads snap into st. Secrets are opened with box, so it must use the key the
+// snapshot was sealed with. Audit entries are appended to whatever the target already has.
+func Restore(st store.NodeStore, snap *Snapshot, box *secret.Box, opts RestoreOptions) error {
+	// check the whole archive and open every secret before touching the target
+	nodes, err := openNodes(snap, box)
+	if err != nil {
+		return err
+	}
+	if err := check(snap, nodes); err != nil {
+		return err
+	}
+
+	list, err := st.ListNodes()
+	if err != nil {
+		return fmt.Errorf("list target nodes: %w", err)
+	}
+	if len(list) > 0 && !opts.Replace {
+		return fmt.Errorf("%w: %d nodes present; use replace to overwrite", ErrTargetNotEmpty, len(list))
+	}
+	existing := make(map[string]model.Node, len(list))
+	for _, n := range list {
+		existing[n.ID] = n
+	}
+
+	for _, n := range nodes {
+		// overwrite a node the target already has at its current revision
+		n.Revision = existing[n.ID].Revision
+		if _, err := st.UpsertNode(n); err != nil {
+			return fmt.Errorf("restore node %s: %w", n.ID, err)
+		}
+	}
+	if err := restorePlans(st, snap, existing); err != nil {
+		return err
+	}
+	if err := st.SetGlobalPlanVersion(snap.GlobalPlanVersion); err != nil {
+		return fmt.Errorf("restore plan version: %w", err)
+	}
+	if err := st.UpdateSettings(snap.Settings); err != nil {
+		return fmt.Errorf("restore settings: %w", err)
+	}
+	for _, t := range snap.Tasks {
+		if err := st.SaveTask(t); err != nil {
+			return fmt.Errorf("restore task %s: %w", t.ID, err)
+		}
+	}
+	for _, k := range snap.LinkKeys {
+		if err := st.SaveLinkKey(k); err != nil {
+			return fmt.Errorf("restore link key %s-%s: %w", k.A, k.B, err)
+		}
+	}
+	for nodeID, logs := range snap.PolicyStatus {
+		have := map[int64]bool{}
+		if _, ok := existing[nodeID]; ok {
+			old, err := st.ListPolicyStatus(nodeID, 0)
+			if err != nil {
+				return fmt.Errorf("list policy status %s: %w", nodeID, err)
+			}
+			for _, l := range old {
+				have[l.Timestamp.UnixNano()] = true
+			}
+		}
+		for _, l := range logs {
+			if have[l.Timestamp.UnixNano()] {
+				continue
+			}
+			if err := st.SavePolicyStatus(l); err != nil {
+				return fmt.Errorf("restore policy status %s: %w", l.NodeID, err)
+			}
+		}
+	}
+	for nodeID, diags := range snap.PolicyDiag {
+		have := map[int64]bool{}
+		if _, ok := existing[nodeID]; ok {
+			old, err := st.ListPolicyDiag(nodeID, 0)
+			if err != nil {
+				return fmt.Errorf("list policy diag %s: %w", nodeID, err)
+			}
+			for _, d := range old {
+				have[d.Timestamp.UnixNano()] = true
+			}
+		}
+		for _, d := range diags {
+			if have[d.Timestamp.UnixNano()] {
+				continue
+			}
+			if err := st.SavePolicyDiag(d); err != nil {
+				return fmt.Errorf("restore policy diag %s: %w", d.NodeID, err)
+			}
+		}
+	}
+	if err := restoreHealth(st, snap, nodes, existing); err != nil {
+		return err
+	}
+	if len(snap.HealthSeries) > 0 {
+		if err := st.SaveHealthBuckets(snap.HealthSeries); err != nil {
+			return fmt.Errorf("restore health series: %w", err)
+		}
+	}
+	if snap.Routing != nil {
+		if err := st.SaveRoutingState(*snap.Routing); err != nil {
+			return fmt.Errorf("restore routing state: %w", err)
+		}
+	}
+	for _, e := range snap.Audit {
+		if err := st.AppendAudit(e); err != nil {
+			return fmt.Errorf("restore audit: %w", err)
+		}
+	}
+
+	// everything is written; only now drop what the snapshot does not have
+	keep := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		keep[n.ID] = true
+	}
+	for id := range existing {
+		if keep[id] {
+			continue
+		}
+		if err := st.DeleteNode(id); err != nil {
+			return fmt.Errorf("remove node %s: %w", id, err)
+		}
+	}
+	if len(existing) > 0 {
+		keys := make(map[string]bool, len(snap.LinkKeys))
+		for _, k := range snap.LinkKeys {
+			keys[k.A+"|"+k.B] = true
+		}
+		current, err := st.ListLinkKeys()
+		if err != nil {
+			return fmt.Errorf("list link keys: %w", err)
+		}
+		for _, k := range current {
+			if keys[k.A+"|"+k.B] {
+				continue
+			}
+			if err := st.DeleteLinkKey(k.A, k.B); err != nil {
+				return fmt.Errorf("remove link key %s-%s: %w", k.A, k.B, err)
+			}
+		}
+	}
+	return nil
+}
+
+// openNodes returns the snapshot nodes with their secrets opened.
+func openNodes(snap *Snapshot, box *secret.Box) ([]model.Node, error) {
+	nodes := make([]model.Node, 0, len(snap.Nodes))
+	for _, entry := range snap.Nodes {
+		n := entry.Node
+		var err error
+		if n.PrivateKey, err = box.Open(entry.SealedPrivateKey); err != nil {
+			return nil, fmt.Errorf("node %s private key: %w", n.ID, err)
+		}
+		if n.ProvisionToken, err = box.Open(entry.SealedProvisionToken); err != nil {
+			return nil, fmt.Errorf("node %s provision token: %w", n.ID, err)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// check reports the first entity of snap that refers to a node the snapshot does not
+// have, or that a store would refuse.
+func check(snap *Snapshot, nodes []model.Node) error {
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if n.ID == "" || known[n.ID] {
+			return fmt.Errorf("%w: empty or duplicate node id %q", ErrInvalidSnapshot, n.ID)
+		}
+		known[n.ID] = true
+	}
+	ref := func(what, id string) error {
+		if !known[id] {
+			return fmt.Errorf("%w: %s of unknown node %q", ErrInvalidSnapshot, what, id)
+		}
+		return nil
+	}
+	for _, p := range snap.Plans {
+		if err := ref("plan", p.NodeID); err != nil {
+			return err
+		}
+	}
+	for id, hist := range snap.PlanHistory {
+		for _, p := range hist {
+			if p.NodeID != id {
+				return fmt.Errorf("%w: plan %d of %q filed under %q", ErrInvalidSnapshot, p.Version, p.NodeID, id)
+			}
+		}
+		if err := ref("plan history", id); err != nil {
+			return err
+		}
+	}
+	for id, logs := range snap.PolicyStatus {
+		for _, l := range logs {
+			if l.NodeID != id {
+				return fmt.Errorf("%w: policy status of %q filed under %q", ErrInvalidSnapshot, l.NodeID, id)
+			}
+		}
+		if err := ref("policy status", id); err != nil {
+			return err
+		}
+	}
+	for id, diags := range snap.PolicyDiag {
+		for _, d := range diags {
+			if d.NodeID != id {
+				return fmt.Errorf("%w: policy diagnostics of %q filed under %q", ErrInvalidSnapshot, d.NodeID, id)
+			}
+		}
+		if err := ref("policy diagnostics", id); err != nil {
+			return err
+		}
+	}
+	for _, h := range snap.Health {
+		if err := ref("health", h.NodeID); err != nil {
+			return err
+		}
+	}
+	for id, hist := range snap.HealthHistory {
+		for _, h := range hist {
+			if h.NodeID != id {
+				return fmt.Errorf("%w: health report of %q filed under %q", ErrInvalidSnapshot, h.NodeID, id)
+			}
+		}
+		if err := ref("health history", id); err != nil {
+			return err
+		}
+	}
+	for _, b := range snap.HealthSeries {
+		if _, ok := model.SeriesStepDuration(b.Step); !ok {
+			return fmt.Errorf("%w: health bucket step %q", ErrInvalidSnapshot, b.Step)
+		}
+		if err := ref("health series", b.NodeID); err != nil {
+			return err
+		}
+	}
+	for _, k := range snap.LinkKeys {
+		if a, b := model.LinkKeyPair(k.A, k.B); a != k.A || b != k.B || a == b {
+			return fmt.Errorf("%w: link key pair %s-%s", ErrInvalidSnapshot, k.A, k.B)
+		}
+		if err := ref("link key", k.A); err != nil {
+			return err
+		}
+		if err := ref("link key", k.B); err != nil {
+			return err
+		}
+	}
+	for _, t := range snap.Tasks {
+		if t.ID == "" {
+			return fmt.Errorf("%w: task without id", ErrInvalidSnapshot)
+		}
+	}
+	if err := store.ValidateRetention(snap.Settings.Retention); err != nil {
+		return fmt.Errorf("%w: settings: %v", ErrInvalidSnapshot, err)
+	}
+	return nil
+}
+
+// restorePlans writes the plan history and latest plan of every node, skipping plan
+// versions a node the target already has holds.
+func restorePlans(st store.NodeStore, snap *Snapshot, existing map[string]model.Node) error {
+	latest := make(map[string]model.Plan, len(snap.Plans))
+	for _, p := range snap.Plans {
+		latest[p.NodeID] = p
+	}
+	for nodeID, hist := range snap.PlanHistory {
+		have := map[int64]bool{}
+		if _, ok := existing[nodeID]; ok {
+			old, err := st.ListPlanHistory(nodeID, 0)
+			if err != nil {
+				return fmt.Errorf("list plan history %s: %w", nodeID, err)
+			}
+			for _, p := range old {
+				have[p.Version] = true
+			}
+		}
+		for _, p := range hist {
+			if have[p.Version] {
+				continue
+			}
+			if err := st.SavePlan(p); err != nil {
+				return fmt.Errorf("restore plan history %s/%d: %w", nodeID, p.Version, err)
+			}
+		}
+	}
+	for _, p := range latest {
+		if cur, ok, err := st.GetPlan(p.NodeID); err != nil {
+			return fmt.Errorf("get plan %s: %w", p.NodeID, err)
+		} else if ok && cur.Version == p.Version {
+			// history already ended with it
+			continue
+		}
+		if err := st.SavePlan(p); err != nil {
+			return fmt.Errorf("restore plan %s: %w", p.NodeID, err)
+		}
+	}
+	return nil
+}
+
+// restoreHealth writes the health history and latest report of every node. For nodes the
+// target already has, reports it holds are skipped.
+func restoreHealth(st store.NodeStore, snap *Snapshot, nodes []model.Node, existing map[string]model.Node) error {
+	current := make(map[string]model.HealthReport, len(snap.Health))
+	for _, h := range snap.Health {
+		current[h.NodeID] = h
+	}
+	for _, n := range nodes {
+		hist := snap.HealthHistory[n.ID]
+		h, hasCurrent := current[n.ID]
+		if _, ok := existing[n.ID]; ok {
+			old, err := st.ListHealthHistory(n.ID, time.Time{})
+			if err != nil {
+				return fmt.Errorf("list health history %s: %w", n.ID, err)
+			}
+			have := make(map[int64]bool, len(old))
+			for _, r := range old {
+				have[r.Timestamp.UnixNano()] = true
+			}
+			fresh := make([]model.HealthReport, 0, len(hist))
+			for _, r := range hist {
+				if !have[r.Timestamp.UnixNano()] {
+					fresh = append(fresh, r)
+				}
+			}
+			hist = fresh
+			if len(old) > 0 && hasCurrent && old[len(old)-1].Timestamp.Equal(h.Timestamp) && len(hist) == 0 {
+				// the target's latest report already is the snapshot's
+				hasCurrent = false
+			}
+		}
+		if err := RestoreHealth(st, hist, h, hasCurrent); err != nil {
+			return fmt.Errorf("restore health %s: %w", n.ID, err)
+		}
+	}
+	return nil
+}
+
+// RestoreHealth writes one node's health history, oldest first, and then its latest
+// report unless that already ended the history. SaveHealth appends every report to the
+// history, so this reproduces both without duplicates.
+func RestoreHealth(st store.NodeStore, history []model.HealthReport, current model.HealthReport, hasCurrent bool) error {
+	history = append([]model.HealthReport(nil), history...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Timestamp.Before(history[j].Timestamp) })
+	for _, h := range history {
+		if err := st.SaveHealth(h); err != nil {
+			return err
+		}
+	}
+	if !hasCurrent || (len(history) > 0 && history[len(history)-1].Timestamp.Equal(current.Timestamp)) {
+		return nil
+	}
+	return st.SaveHealth(current)
+}
@@ -0,0 +1,46 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"peer-wan/pkg/db"
+	"peer-wan/pkg/store"
+	"peer-wan/pkg/store/storetest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.NodeStore {
+		return store.NewMemoryStore()
+	})
+}
+
+func TestDurableMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.NodeStore {
+		st, err := store.OpenDurableMemoryStore(t.TempDir(), store.DurableOptions{Fsync: store.FsyncNever})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.Close() })
+		return st
+	})
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.NodeStore {
+		gdb, err := db.OpenSQLite(filepath.Join(t.TempDir(), "peer-wan.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := store.NewSQLStore(gdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if sqlDB, err := gdb.DB(); err == nil {
+				sqlDB.Close()
+			}
+		})
+		return st
+	})
+}
@@ -10,3 +10,6 @@ import (
 func NewConsulStore(addr string) NodeStore {
 	return consul.NewStore(addr)
 }
+
+// ConsulEnabled reports whether this binary was built with Consul support.
+func ConsulEnabled() bool { return true }
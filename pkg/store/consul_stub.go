@@ -12,4 +12,7 @@ func NewConsulStore(addr string) NodeStore {
 	return NewMemoryStore()
 }
 
+// ConsulEnabled reports whether this binary was built with Consul support.
+func ConsulEnabled() bool { return false }
+
 // StartWatch/LeaderGuard are no-ops for non-consul builds; not implemented here to avoid duplicate methods.
@@ -13,12 +13,17 @@ import (
 )
 
 // MemoryStore is a simple in-memory implementation, intended for dev/demo.
+// Opened with OpenDurableMemoryStore every mutation is also written to a local
+// write-ahead log, so state survives restarts (see memory_wal.go).
 type MemoryStore struct {
 	mu                sync.RWMutex
+	wal               *wal
 	nodes             map[string]model.Node
 	version           map[string]int
 	health            map[string]model.HealthReport
 	healthHistory     map[string][]model.HealthReport
+	series            map[string][]model.HealthBucket // nodeID|step -> buckets ordered by start, peer
+	linkKeys          map[string]model.LinkKey        // a|b
 	policyStatus      map[string][]model.PolicyInstallLog
 	policyDiag        map[string][]model.PolicyDiagReport
 	tasks             map[string]model.Task
@@ -27,6 +32,7 @@ type MemoryStore struct {
 	history           map[string][]model.Plan
 	globalPlanVersion int64
 	settings          model.Settings
+	routing           *model.RoutingState
 }
 
 func NewMemoryStore() *MemoryStore {
@@ -35,37 +41,50 @@ func NewMemoryStore() *MemoryStore {
 		version:       make(map[string]int),
 		health:        make(map[string]model.HealthReport),
 		healthHistory: make(map[string][]model.HealthReport),
+		series:        make(map[string][]model.HealthBucket),
+		linkKeys:      make(map[string]model.LinkKey),
 		policyStatus:  make(map[string][]model.PolicyInstallLog),
 		policyDiag:    make(map[string][]model.PolicyDiagReport),
 		tasks:         make(map[string]model.Task),
 		plans:         make(map[string]model.Plan),
 		history:       make(map[string][]model.Plan),
-		settings: model.Settings{
-			GeoIP: model.GeoIPConfig{
-				CacheDir: policy.DefaultCacheDir(),
-				SourceV4: policy.DefaultSourceV4(),
-				SourceV6: policy.DefaultSourceV6(),
-				CacheTTL: "24h",
-			},
-			Diag: model.DiagConfig{
-				PingInterval: "3s",
-			},
-		},
+		settings:      defaultSettings(),
 	}
 }
 
+// defaultSettings mirrors the controller defaults used when nothing has been saved yet.
+func defaultSettings() model.Settings {
+	return policy.DefaultSettings()
+}
+
 func (m *MemoryStore) UpsertNode(n model.Node) (model.Node, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	current := m.version[n.ID]
-	next := current + 1
+	if n.Revision != m.nodes[n.ID].Revision {
+		return n, ErrConflict
+	}
+	next := m.version[n.ID] + 1
 	n.Version = versionString(next)
 	n.ConfigVersion = versionString(next)
-	m.nodes[n.ID] = n
-	m.version[n.ID] = next
+	n.Revision++
+	rec := nodeRecord{Node: walNode{Node: n, PrivateKey: n.PrivateKey, ProvisionToken: n.ProvisionToken}, Version: next}
+	if err := m.commit(opNodePut, rec); err != nil {
+		return n, err
+	}
+	m.applyNodePut(rec)
 	return n, nil
 }
 
+func (m *MemoryStore) applyNodePut(rec nodeRecord) {
+	n := rec.Node.Node
+	n.PrivateKey = rec.Node.PrivateKey
+	n.ProvisionToken = rec.Node.ProvisionToken
+	m.nodes[n.ID] = n
+	if rec.Version > 0 {
+		m.version[n.ID] = rec.Version
+	}
+}
+
 func (m *MemoryStore) ListNodes() ([]model.Node, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -83,6 +102,44 @@ func (m *MemoryStore) GetNode(id string) (model.Node, bool, error) {
 	return n, ok, nil
 }
 
+// DeleteNode removes a node together with its plans, health, policy logs, tasks and link keys.
+func (m *MemoryStore) DeleteNode(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[id]; !ok {
+		return fmt.Errorf("node not found")
+	}
+	if err := m.commit(opNodeDelete, id); err != nil {
+		return err
+	}
+	m.applyNodeDelete(id)
+	return nil
+}
+
+func (m *MemoryStore) applyNodeDelete(id string) {
+	delete(m.nodes, id)
+	delete(m.version, id)
+	delete(m.plans, id)
+	delete(m.history, id)
+	delete(m.health, id)
+	delete(m.healthHistory, id)
+	for _, step := range HealthSeriesSteps {
+		delete(m.series, seriesKey(id, step))
+	}
+	delete(m.policyStatus, id)
+	delete(m.policyDiag, id)
+	for tid, t := range m.tasks {
+		if t.NodeID == id {
+			delete(m.tasks, tid)
+		}
+	}
+	for kid, k := range m.linkKeys {
+		if k.A == id || k.B == id {
+			delete(m.linkKeys, kid)
+		}
+	}
+}
+
 // LeaderGuard is a no-op leader hook for memory store; it simply runs cb once.
 func (m *MemoryStore) LeaderGuard(ctx context.Context, _ string, _ time.Duration, cb func(context.Context)) {
 	if cb != nil {
@@ -100,20 +157,19 @@ func versionString(v int) string {
 func (m *MemoryStore) SaveHealth(h model.HealthReport) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.health[h.NodeID] = h
-	// append history and prune older than 24h
-	cutoff := time.Now().Add(-24 * time.Hour)
-	hist := append(m.healthHistory[h.NodeID], h)
-	keep := hist[:0]
-	for _, item := range hist {
-		if item.Timestamp.After(cutoff) {
-			keep = append(keep, item)
-		}
+	if err := m.commit(opHealth, h); err != nil {
+		return err
 	}
-	m.healthHistory[h.NodeID] = keep
+	m.applyHealth(h)
 	return nil
 }
 
+// applyHealth records the latest report and appends it to history; ApplyRetention bounds the history.
+func (m *MemoryStore) applyHealth(h model.HealthReport) {
+	m.health[h.NodeID] = h
+	m.healthHistory[h.NodeID] = append(m.healthHistory[h.NodeID], h)
+}
+
 func (m *MemoryStore) ListHealth() ([]model.HealthReport, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -140,6 +196,14 @@ func (m *MemoryStore) ListHealthHistory(nodeID string, since time.Time) ([]model
 func (m *MemoryStore) PruneHealthBefore(cutoff time.Time) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := m.commit(opHealthPrune, cutoff); err != nil {
+		return err
+	}
+	m.applyHealthPrune(cutoff)
+	return nil
+}
+
+func (m *MemoryStore) applyHealthPrune(cutoff time.Time) {
 	for nodeID, hist := range m.healthHistory {
 		keep := hist[:0]
 		for _, h := range hist {
@@ -149,12 +213,112 @@ func (m *MemoryStore) PruneHealthBefore(cutoff time.Time) error {
 		}
 		m.healthHistory[nodeID] = keep
 	}
+}
+
+func (m *MemoryStore) SaveHealthBuckets(buckets []model.HealthBucket) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.commit(opSeries, buckets); err != nil {
+		return err
+	}
+	m.applySeries(buckets)
 	return nil
 }
 
+func (m *MemoryStore) applySeries(buckets []model.HealthBucket) {
+	for _, b := range buckets {
+		key := seriesKey(b.NodeID, b.Step)
+		list := m.series[key]
+		i := sort.Search(len(list), func(i int) bool {
+			return !bucketLess(list[i], b)
+		})
+		if i < len(list) && list[i].Start.Equal(b.Start) && list[i].Peer == b.Peer {
+			list[i] = b
+			continue
+		}
+		list = append(list, model.HealthBucket{})
+		copy(list[i+1:], list[i:])
+		list[i] = b
+		m.series[key] = list
+	}
+}
+
+func (m *MemoryStore) ListHealthBuckets(nodeID, step string, from, to time.Time) ([]model.HealthBucket, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := m.series[seriesKey(nodeID, step)]
+	i := sort.Search(len(list), func(i int) bool { return !list[i].Start.Before(from) })
+	var out []model.HealthBucket
+	for ; i < len(list) && (to.IsZero() || list[i].Start.Before(to)); i++ {
+		out = append(out, list[i])
+	}
+	return out, nil
+}
+
+func seriesKey(nodeID, step string) string { return nodeID + "|" + step }
+
+func bucketLess(a, b model.HealthBucket) bool {
+	if !a.Start.Equal(b.Start) {
+		return a.Start.Before(b.Start)
+	}
+	return a.Peer < b.Peer
+}
+
+func (m *MemoryStore) SaveLinkKey(k model.LinkKey) error {
+	k.Staged = append([]string(nil), k.Staged...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.commit(opLinkKey, k); err != nil {
+		return err
+	}
+	m.linkKeys[linkKeyID(k.A, k.B)] = k
+	return nil
+}
+
+func (m *MemoryStore) ListLinkKeys() ([]model.LinkKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]model.LinkKey, 0, len(m.linkKeys))
+	for _, k := range m.linkKeys {
+		k.Staged = append([]string(nil), k.Staged...)
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].A != out[j].A {
+			return out[i].A < out[j].A
+		}
+		return out[i].B < out[j].B
+	})
+	return out, nil
+}
+
+func (m *MemoryStore) DeleteLinkKey(a, b string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.linkKeys[linkKeyID(a, b)]; !ok {
+		return nil
+	}
+	if err := m.commit(opLinkKeyDelete, model.LinkKey{A: a, B: b}); err != nil {
+		return err
+	}
+	delete(m.linkKeys, linkKeyID(a, b))
+	return nil
+}
+
+func linkKeyID(a, b string) string { return a + "|" + b }
+
 func (m *MemoryStore) AppendAudit(entry model.AuditEntry) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if err := m.commit(opAudit, entry); err != nil {
+		return err
+	}
 	m.audit = append(m.audit, entry)
 	return nil
 }
@@ -173,20 +337,42 @@ func (m *MemoryStore) ListAudit(limit int) ([]model.AuditEntry, error) {
 	return out, nil
 }
 
+func (m *MemoryStore) QueryAudit(q model.AuditQuery) ([]model.AuditEntry, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	page, more := queryPage(m.audit, func(e model.AuditEntry) time.Time { return e.Timestamp }, q.Match, q.HistoryPage)
+	return page, more, nil
+}
+
+// queryPage applies p to the items keep accepts, ordered by ts with ties in slice order.
+func queryPage[T any](items []T, ts func(T) time.Time, keep func(T) bool, p model.HistoryPage) ([]T, bool) {
+	var matched []T
+	for _, it := range items {
+		if keep == nil || keep(it) {
+			matched = append(matched, it)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return ts(matched[i]).Before(ts(matched[j])) })
+	return model.SelectPage(matched, ts, p)
+}
+
 func (m *MemoryStore) SavePolicyStatus(l model.PolicyInstallLog) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if l.Timestamp.IsZero() {
 		l.Timestamp = time.Now()
 	}
-	list := append(m.policyStatus[l.NodeID], l)
-	if len(list) > 50 {
-		list = list[len(list)-50:]
+	if err := m.commit(opPolicyStatus, l); err != nil {
+		return err
 	}
-	m.policyStatus[l.NodeID] = list
+	m.applyPolicyStatus(l)
 	return nil
 }
 
+func (m *MemoryStore) applyPolicyStatus(l model.PolicyInstallLog) {
+	m.policyStatus[l.NodeID] = append(m.policyStatus[l.NodeID], l)
+}
+
 func (m *MemoryStore) ListPolicyStatus(nodeID string, limit int) ([]model.PolicyInstallLog, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -202,20 +388,30 @@ func (m *MemoryStore) ListPolicyStatus(nodeID string, limit int) ([]model.Policy
 	return out, nil
 }
 
+func (m *MemoryStore) QueryPolicyStatus(q model.PolicyStatusQuery) ([]model.PolicyInstallLog, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	page, more := queryPage(m.policyStatus[q.NodeID], func(l model.PolicyInstallLog) time.Time { return l.Timestamp }, q.Match, q.HistoryPage)
+	return page, more, nil
+}
+
 func (m *MemoryStore) SavePolicyDiag(d model.PolicyDiagReport) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if d.Timestamp.IsZero() {
 		d.Timestamp = time.Now()
 	}
-	list := append(m.policyDiag[d.NodeID], d)
-	if len(list) > 20 {
-		list = list[len(list)-20:]
+	if err := m.commit(opPolicyDiag, d); err != nil {
+		return err
 	}
-	m.policyDiag[d.NodeID] = list
+	m.applyPolicyDiag(d)
 	return nil
 }
 
+func (m *MemoryStore) applyPolicyDiag(d model.PolicyDiagReport) {
+	m.policyDiag[d.NodeID] = append(m.policyDiag[d.NodeID], d)
+}
+
 func (m *MemoryStore) ListPolicyDiag(nodeID string, limit int) ([]model.PolicyDiagReport, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -234,6 +430,13 @@ func (m *MemoryStore) ListPolicyDiag(nodeID string, limit int) ([]model.PolicyDi
 	return out, nil
 }
 
+func (m *MemoryStore) QueryPolicyDiag(q model.PolicyDiagQuery) ([]model.PolicyDiagReport, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	page, more := queryPage(m.policyDiag[q.NodeID], func(d model.PolicyDiagReport) time.Time { return d.Timestamp }, nil, q.HistoryPage)
+	return page, more, nil
+}
+
 func (m *MemoryStore) SaveTask(t model.Task) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -241,6 +444,9 @@ func (m *MemoryStore) SaveTask(t model.Task) error {
 		t.CreatedAt = time.Now()
 	}
 	t.UpdatedAt = time.Now()
+	if err := m.commit(opTask, t); err != nil {
+		return err
+	}
 	m.tasks[t.ID] = t
 	return nil
 }
@@ -268,18 +474,37 @@ func (m *MemoryStore) ListTasks(nodeID string, limit int) ([]model.Task, error)
 	return out, nil
 }
 
+func (m *MemoryStore) QueryTasks(q model.TaskQuery) ([]model.Task, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tasks := make([]model.Task, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		tasks = append(tasks, t)
+	}
+	// ties in ID order, like the SQL store
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	page, more := queryPage(tasks, func(t model.Task) time.Time { return t.CreatedAt }, q.Match, q.HistoryPage)
+	return page, more, nil
+}
+
 func (m *MemoryStore) SavePlan(p model.Plan) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.plans[p.NodeID] = p
-	h := append(m.history[p.NodeID], p)
-	if len(h) > 20 {
-		h = h[len(h)-20:]
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now()
 	}
-	m.history[p.NodeID] = h
+	if err := m.commit(opPlan, p); err != nil {
+		return err
+	}
+	m.applyPlan(p)
 	return nil
 }
 
+func (m *MemoryStore) applyPlan(p model.Plan) {
+	m.plans[p.NodeID] = p
+	m.history[p.NodeID] = append(m.history[p.NodeID], p)
+}
+
 func (m *MemoryStore) GetPlan(nodeID string) (model.Plan, bool, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -297,23 +522,45 @@ func (m *MemoryStore) ListPlanHistory(nodeID string, limit int) ([]model.Plan, e
 	return append([]model.Plan(nil), h[len(h)-limit:]...), nil
 }
 
+func (m *MemoryStore) QueryPlanHistory(q model.PlanHistoryQuery) ([]model.Plan, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	page, more := queryPage(m.history[q.NodeID], func(p model.Plan) time.Time { return p.CreatedAt }, nil, q.HistoryPage)
+	return page, more, nil
+}
+
 func (m *MemoryStore) RollbackPlan(nodeID string, version int64) (model.Plan, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	h := m.history[nodeID]
-	for _, p := range h {
+	for _, p := range m.history[nodeID] {
 		if p.Version == version {
-			m.plans[nodeID] = p
-			m.globalPlanVersion = version
+			rec := rollbackRecord{NodeID: nodeID, Version: version}
+			if err := m.commit(opRollback, rec); err != nil {
+				return model.Plan{}, err
+			}
+			m.applyRollback(rec)
 			return p, nil
 		}
 	}
 	return model.Plan{}, fmt.Errorf("version not found")
 }
 
+func (m *MemoryStore) applyRollback(rec rollbackRecord) {
+	for _, p := range m.history[rec.NodeID] {
+		if p.Version == rec.Version {
+			m.plans[rec.NodeID] = p
+			m.globalPlanVersion = rec.Version
+			return
+		}
+	}
+}
+
 func (m *MemoryStore) SetGlobalPlanVersion(v int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := m.commit(opPlanVersion, v); err != nil {
+		return err
+	}
 	m.globalPlanVersion = v
 	return nil
 }
@@ -324,22 +571,49 @@ func (m *MemoryStore) GetGlobalPlanVersion() (int64, error) {
 	return m.globalPlanVersion, nil
 }
 
-func (m *MemoryStore) UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string) error {
+func (m *MemoryStore) UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string, revision int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	n, ok := m.nodes[nodeID]
 	if !ok {
 		return fmt.Errorf("node not found")
 	}
+	if n.Revision != revision {
+		return ErrConflict
+	}
+	n.Revision++
 	n.EgressPeerID = egressPeer
 	n.PolicyRules = rules
 	n.DefaultRoute = defaultRoute
 	n.BypassCIDRs = bypass
 	n.DefaultRouteNextHop = defaultRouteNextHop
-	m.nodes[nodeID] = n
+	rec := nodeRecord{Node: walNode{Node: n, PrivateKey: n.PrivateKey, ProvisionToken: n.ProvisionToken}}
+	if err := m.commit(opNodePut, rec); err != nil {
+		return err
+	}
+	m.applyNodePut(rec)
 	return nil
 }
 
+func (m *MemoryStore) SaveRoutingState(rs model.RoutingState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.commit(opRoutingState, rs); err != nil {
+		return err
+	}
+	m.routing = &rs
+	return nil
+}
+
+func (m *MemoryStore) GetRoutingState() (model.RoutingState, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.routing == nil {
+		return model.RoutingState{}, false, nil
+	}
+	return *m.routing, true, nil
+}
+
 func (m *MemoryStore) GetSettings() (model.Settings, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -349,6 +623,69 @@ func (m *MemoryStore) GetSettings() (model.Settings, error) {
 func (m *MemoryStore) UpdateSettings(s model.Settings) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := m.commit(opSettings, s); err != nil {
+		return err
+	}
 	m.settings = s
 	return nil
 }
+
+// ApplyRetention drops history entries outside cfg (see DefaultRetention).
+func (m *MemoryStore) ApplyRetention(cfg model.RetentionConfig, now time.Time) (model.RetentionStats, error) {
+	if err := ValidateRetention(cfg); err != nil {
+		return model.RetentionStats{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec := retentionRecord{Config: cfg, Now: now}
+	if err := m.commit(opRetention, rec); err != nil {
+		return model.RetentionStats{}, err
+	}
+	return m.applyRetention(rec), nil
+}
+
+func (m *MemoryStore) applyRetention(rec retentionRecord) model.RetentionStats {
+	var stats model.RetentionStats
+	cfg, now := rec.Config, rec.Now
+	var n int
+	m.audit, stats.Audit = retain(m.audit, func(e model.AuditEntry) time.Time { return e.Timestamp }, cfg.Audit, now)
+
+	tasks := make([]model.Task, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].CreatedAt.Before(tasks[j].CreatedAt) })
+	kept, dropped := retain(tasks, taskActivity, cfg.Tasks, now)
+	if dropped > 0 {
+		m.tasks = make(map[string]model.Task, len(kept))
+		for _, t := range kept {
+			m.tasks[t.ID] = t
+		}
+		stats.Tasks = dropped
+	}
+
+	for id, list := range m.policyStatus {
+		m.policyStatus[id], n = retain(list, func(l model.PolicyInstallLog) time.Time { return l.Timestamp }, cfg.PolicyStatus, now)
+		stats.PolicyStatus += n
+	}
+	for id, list := range m.policyDiag {
+		m.policyDiag[id], n = retain(list, func(d model.PolicyDiagReport) time.Time { return d.Timestamp }, cfg.PolicyDiag, now)
+		stats.PolicyDiag += n
+	}
+	for id, list := range m.history {
+		m.history[id], n = retain(list, func(p model.Plan) time.Time { return p.CreatedAt }, cfg.PlanHistory, now)
+		stats.PlanHistory += n
+	}
+	for id, list := range m.healthHistory {
+		m.healthHistory[id], n = retain(list, func(h model.HealthReport) time.Time { return h.Timestamp }, cfg.HealthHistory, now)
+		stats.HealthHistory += n
+	}
+	for key, list := range m.series {
+		if len(list) == 0 {
+			continue
+		}
+		m.series[key], n = retain(list, func(b model.HealthBucket) time.Time { return b.Start }, cfg.HealthSeries(list[0].Step), now)
+		stats.HealthSeries += n
+	}
+	return stats
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// lockDir only creates the lock file on platforms without flock.
+func lockDir(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+}
+
+func unlockDir(f *os.File) {
+	f.Close()
+}
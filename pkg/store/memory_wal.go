@@ -0,0 +1,600 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// Durable memory store layout inside the data dir:
+//
+//	LOCK         flock held while a controller has the directory open
+//	memory.snap  compacted state as of sequence N (one framed record)
+//	memory.wal   framed records with sequence > N, appended on every mutation
+//
+// A frame is 4 bytes little-endian payload length, 4 bytes CRC-32C of the payload,
+// then the JSON payload. Replay applies the snapshot, then every WAL record newer
+// than it; a crash between writing a new snapshot and truncating the WAL is harmless.
+const (
+	walFile      = "memory.wal"
+	snapFile     = "memory.snap"
+	lockFile     = "LOCK"
+	frameHeader  = 8
+	maxFrameSize = 256 << 20
+)
+
+// WAL operations. Records carry post-mutation values so replay is deterministic.
+const (
+	opNodePut       = "node.put"
+	opNodeDelete    = "node.delete"
+	opPlan          = "plan.save"
+	opRollback      = "plan.rollback"
+	opPlanVersion   = "plan.version"
+	opPolicyStatus  = "policy.status"
+	opPolicyDiag    = "policy.diag"
+	opTask          = "task.save"
+	opHealth        = "health.save"
+	opHealthPrune   = "health.prune"
+	opAudit         = "audit.append"
+	opSettings      = "settings.update"
+	opRetention     = "retention.apply"
+	opSeries        = "health.series"
+	opLinkKey       = "linkkey.save"
+	opLinkKeyDelete = "linkkey.delete"
+	opRoutingState  = "routing.save"
+)
+
+// FsyncMode controls when WAL appends are flushed to stable storage.
+type FsyncMode string
+
+const (
+	// FsyncAlways syncs after every record; an acknowledged write survives power loss.
+	FsyncAlways FsyncMode = "always"
+	// FsyncInterval syncs in the background every DurableOptions.FsyncInterval.
+	FsyncInterval FsyncMode = "interval"
+	// FsyncNever leaves flushing to the OS; survives process crashes but not power loss.
+	FsyncNever FsyncMode = "never"
+)
+
+// ParseFsyncMode validates a --wal-fsync value.
+func ParseFsyncMode(s string) (FsyncMode, error) {
+	switch m := FsyncMode(s); m {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return m, nil
+	case "":
+		return FsyncAlways, nil
+	}
+	return "", fmt.Errorf("invalid fsync mode %q (always|interval|never)", s)
+}
+
+// DurableOptions tunes the memory store write-ahead log.
+type DurableOptions struct {
+	Fsync           FsyncMode
+	FsyncInterval   time.Duration // default 1s, used with FsyncInterval
+	CompactInterval time.Duration // default 10m; rewrite the snapshot and truncate the WAL
+	CompactBytes    int64         // default 64MiB; compact early once the WAL grows past this
+	// Repair truncates the WAL at the first corrupt record instead of refusing to start.
+	// Records after the corruption are lost.
+	Repair bool
+}
+
+// ErrWALCorrupt is returned by OpenDurableMemoryStore when a checksum or decode check fails
+// somewhere other than a torn final record.
+var ErrWALCorrupt = errors.New("memory store data corrupt")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walNode struct {
+	model.Node
+	// model.Node hides secrets from JSON; the log must keep them
+	PrivateKey     string `json:"privateKey,omitempty"`
+	ProvisionToken string `json:"provisionToken,omitempty"`
+}
+
+type nodeRecord struct {
+	Node    walNode `json:"node"`
+	Version int     `json:"version,omitempty"`
+}
+
+type rollbackRecord struct {
+	NodeID  string `json:"nodeId"`
+	Version int64  `json:"version"`
+}
+
+type retentionRecord struct {
+	Config model.RetentionConfig `json:"config"`
+	Now    time.Time             `json:"now"`
+}
+
+type walRecord struct {
+	Seq  uint64          `json:"seq"`
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+// memoryState is the compacted snapshot content.
+type memoryState struct {
+	Seq               uint64                              `json:"seq"`
+	Nodes             []walNode                           `json:"nodes"`
+	Versions          map[string]int                      `json:"versions"`
+	Health            map[string]model.HealthReport       `json:"health"`
+	HealthHistory     map[string][]model.HealthReport     `json:"healthHistory"`
+	Series            map[string][]model.HealthBucket     `json:"series,omitempty"`
+	LinkKeys          map[string]model.LinkKey            `json:"linkKeys,omitempty"`
+	PolicyStatus      map[string][]model.PolicyInstallLog `json:"policyStatus"`
+	PolicyDiag        map[string][]model.PolicyDiagReport `json:"policyDiag"`
+	Tasks             map[string]model.Task               `json:"tasks"`
+	Audit             []model.AuditEntry                  `json:"audit"`
+	Plans             map[string]model.Plan               `json:"plans"`
+	History           map[string][]model.Plan             `json:"history"`
+	GlobalPlanVersion int64                               `json:"globalPlanVersion"`
+	Settings          model.Settings                      `json:"settings"`
+	Routing           *model.RoutingState                 `json:"routing,omitempty"`
+}
+
+type wal struct {
+	dir    string
+	opts   DurableOptions
+	f      *os.File
+	lock   *os.File
+	seq    uint64
+	size   int64
+	broken error
+
+	compactCh chan struct{}
+	stop      chan struct{}
+	done      sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenDurableMemoryStore opens (or creates) a MemoryStore persisted in dir.
+// The directory is locked for the lifetime of the store; call Close to flush and release it.
+func OpenDurableMemoryStore(dir string, opts DurableOptions) (*MemoryStore, error) {
+	if opts.Fsync == "" {
+		opts.Fsync = FsyncAlways
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.CompactInterval <= 0 {
+		opts.CompactInterval = 10 * time.Minute
+	}
+	if opts.CompactBytes <= 0 {
+		opts.CompactBytes = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	m := NewMemoryStore()
+	w := &wal{dir: dir, opts: opts, lock: lock, compactCh: make(chan struct{}, 1), stop: make(chan struct{})}
+	if err := m.replay(w); err != nil {
+		unlockDir(lock)
+		return nil, err
+	}
+	m.wal = w
+	w.done.Add(1)
+	go m.walLoop()
+	return m, nil
+}
+
+// Close writes a final snapshot, closes the WAL and releases the directory lock.
+// Later writes fail. It is a no-op for a store without a data dir.
+func (m *MemoryStore) Close() error {
+	m.mu.RLock()
+	w := m.wal
+	m.mu.RUnlock()
+	if w == nil {
+		return nil
+	}
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		w.done.Wait()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		w.closeErr = m.compactLocked()
+		if err := w.f.Close(); w.closeErr == nil {
+			w.closeErr = err
+		}
+		unlockDir(w.lock)
+		w.broken = errWALClosed
+	})
+	return w.closeErr
+}
+
+var errWALClosed = errors.New("store closed")
+
+// commit appends one record to the WAL. Callers hold m.mu and apply the change only on success.
+func (m *MemoryStore) commit(op string, v interface{}) error {
+	w := m.wal
+	if w == nil {
+		return nil
+	}
+	if w.broken != nil {
+		return fmt.Errorf("memory store wal unavailable: %w", w.broken)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(walRecord{Seq: w.seq + 1, Op: op, Data: data})
+	if err != nil {
+		return err
+	}
+	frame := encodeFrame(payload)
+	if _, err := w.f.Write(frame); err != nil {
+		// drop a partially written frame so later records stay readable
+		if terr := w.f.Truncate(w.size); terr != nil {
+			w.broken = err
+		}
+		return fmt.Errorf("wal append: %w", err)
+	}
+	if w.opts.Fsync == FsyncAlways {
+		if err := w.f.Sync(); err != nil {
+			// the record may or may not be durable; stop accepting writes rather than guess
+			w.broken = err
+			return fmt.Errorf("wal sync: %w", err)
+		}
+	}
+	w.seq++
+	w.size += int64(len(frame))
+	if w.size >= w.opts.CompactBytes {
+		select {
+		case w.compactCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) walLoop() {
+	w := m.wal
+	defer w.done.Done()
+	compact := time.NewTicker(w.opts.CompactInterval)
+	defer compact.Stop()
+	var syncC <-chan time.Time
+	if w.opts.Fsync == FsyncInterval {
+		t := time.NewTicker(w.opts.FsyncInterval)
+		defer t.Stop()
+		syncC = t.C
+	}
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-syncC:
+			if err := w.f.Sync(); err != nil {
+				log.Printf("memory store wal sync failed: %v", err)
+			}
+		case <-compact.C:
+			m.compact()
+		case <-w.compactCh:
+			m.compact()
+		}
+	}
+}
+
+func (m *MemoryStore) compact() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.compactLocked(); err != nil {
+		log.Printf("memory store compaction failed: %v", err)
+	}
+}
+
+// compactLocked writes the full state as a new snapshot and empties the WAL.
+func (m *MemoryStore) compactLocked() error {
+	w := m.wal
+	if w.broken != nil {
+		return w.broken
+	}
+	payload, err := json.Marshal(m.stateLocked(w.seq))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(w.dir, snapFile), encodeFrame(payload)); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	// every record is now covered by the snapshot; replay skips them even if truncation fails
+	if err := w.f.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	w.size = 0
+	return w.f.Sync()
+}
+
+func (m *MemoryStore) stateLocked(seq uint64) memoryState {
+	st := memoryState{
+		Seq:               seq,
+		Versions:          m.version,
+		Health:            m.health,
+		HealthHistory:     m.healthHistory,
+		Series:            m.series,
+		LinkKeys:          m.linkKeys,
+		PolicyStatus:      m.policyStatus,
+		PolicyDiag:        m.policyDiag,
+		Tasks:             m.tasks,
+		Audit:             m.audit,
+		Plans:             m.plans,
+		History:           m.history,
+		GlobalPlanVersion: m.globalPlanVersion,
+		Settings:          m.settings,
+		Routing:           m.routing,
+	}
+	for _, n := range m.nodes {
+		st.Nodes = append(st.Nodes, walNode{Node: n, PrivateKey: n.PrivateKey, ProvisionToken: n.ProvisionToken})
+	}
+	return st
+}
+
+func (m *MemoryStore) loadState(st memoryState) {
+	for _, n := range st.Nodes {
+		m.applyNodePut(nodeRecord{Node: n})
+	}
+	for id, v := range st.Versions {
+		m.version[id] = v
+	}
+	copyMap(m.health, st.Health)
+	copyMap(m.healthHistory, st.HealthHistory)
+	copyMap(m.series, st.Series)
+	copyMap(m.linkKeys, st.LinkKeys)
+	copyMap(m.policyStatus, st.PolicyStatus)
+	copyMap(m.policyDiag, st.PolicyDiag)
+	copyMap(m.tasks, st.Tasks)
+	copyMap(m.plans, st.Plans)
+	copyMap(m.history, st.History)
+	m.audit = st.Audit
+	m.globalPlanVersion = st.GlobalPlanVersion
+	m.settings = st.Settings
+	m.routing = st.Routing
+}
+
+func copyMap[V any](dst, src map[string]V) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// replay loads the snapshot and WAL from w.dir into m and leaves w.f open for appends.
+func (m *MemoryStore) replay(w *wal) error {
+	snapPath := filepath.Join(w.dir, snapFile)
+	if raw, err := os.ReadFile(snapPath); err == nil {
+		payload, n, ferr := decodeFrame(raw)
+		if ferr != nil || n != len(raw) {
+			return fmt.Errorf("%w: %s: bad frame", ErrWALCorrupt, snapPath)
+		}
+		var st memoryState
+		if err := json.Unmarshal(payload, &st); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrWALCorrupt, snapPath, err)
+		}
+		m.loadState(st)
+		w.seq = st.Seq
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	walPath := filepath.Join(w.dir, walFile)
+	// O_APPEND keeps writes at the end after truncation (torn tail, compaction)
+	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	snapSeq := w.seq
+	off, applied := 0, 0
+	for off < len(raw) {
+		payload, n, ferr := decodeFrame(raw[off:])
+		if errors.Is(ferr, errTornFrame) {
+			log.Printf("memory store: dropping torn record at %s offset %d (%d bytes)", walPath, off, len(raw)-off)
+			break
+		}
+		if ferr == nil {
+			var rec walRecord
+			if ferr = json.Unmarshal(payload, &rec); ferr == nil {
+				if rec.Seq <= w.seq && rec.Seq > snapSeq {
+					ferr = fmt.Errorf("sequence %d after %d", rec.Seq, w.seq)
+				} else if rec.Seq > snapSeq {
+					ferr = m.applyRecord(rec)
+					w.seq = rec.Seq
+					applied++
+				}
+			}
+		}
+		if ferr != nil {
+			if !w.opts.Repair {
+				f.Close()
+				return fmt.Errorf("%w: %s offset %d: %v (start the controller with --wal-repair to truncate here)", ErrWALCorrupt, walPath, off, ferr)
+			}
+			log.Printf("memory store: truncating %s at corrupt record offset %d: %v", walPath, off, ferr)
+			break
+		}
+		off += n
+	}
+	if off < len(raw) {
+		if err := f.Truncate(int64(off)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w.f = f
+	w.size = int64(off)
+	if applied > 0 || snapSeq > 0 {
+		log.Printf("memory store: restored %s (snapshot seq %d, %d wal records)", w.dir, snapSeq, applied)
+	}
+	return nil
+}
+
+func (m *MemoryStore) applyRecord(rec walRecord) error {
+	var err error
+	switch rec.Op {
+	case opNodePut:
+		var v nodeRecord
+		if err = json.Unmarshal(rec.Data, &v); err == nil {
+			m.applyNodePut(v)
+		}
+	case opNodeDelete:
+		var id string
+		if err = json.Unmarshal(rec.Data, &id); err == nil {
+			m.applyNodeDelete(id)
+		}
+	case opPlan:
+		var p model.Plan
+		if err = json.Unmarshal(rec.Data, &p); err == nil {
+			m.applyPlan(p)
+		}
+	case opRollback:
+		var v rollbackRecord
+		if err = json.Unmarshal(rec.Data, &v); err == nil {
+			m.applyRollback(v)
+		}
+	case opPlanVersion:
+		err = json.Unmarshal(rec.Data, &m.globalPlanVersion)
+	case opPolicyStatus:
+		var l model.PolicyInstallLog
+		if err = json.Unmarshal(rec.Data, &l); err == nil {
+			m.applyPolicyStatus(l)
+		}
+	case opPolicyDiag:
+		var d model.PolicyDiagReport
+		if err = json.Unmarshal(rec.Data, &d); err == nil {
+			m.applyPolicyDiag(d)
+		}
+	case opTask:
+		var t model.Task
+		if err = json.Unmarshal(rec.Data, &t); err == nil {
+			m.tasks[t.ID] = t
+		}
+	case opHealth:
+		var h model.HealthReport
+		if err = json.Unmarshal(rec.Data, &h); err == nil {
+			m.applyHealth(h)
+		}
+	case opSeries:
+		var v []model.HealthBucket
+		if err = json.Unmarshal(rec.Data, &v); err == nil {
+			m.applySeries(v)
+		}
+	case opLinkKey:
+		var k model.LinkKey
+		if err = json.Unmarshal(rec.Data, &k); err == nil {
+			m.linkKeys[linkKeyID(k.A, k.B)] = k
+		}
+	case opLinkKeyDelete:
+		var k model.LinkKey
+		if err = json.Unmarshal(rec.Data, &k); err == nil {
+			delete(m.linkKeys, linkKeyID(k.A, k.B))
+		}
+	case opHealthPrune:
+		var cutoff time.Time
+		if err = json.Unmarshal(rec.Data, &cutoff); err == nil {
+			m.applyHealthPrune(cutoff)
+		}
+	case opAudit:
+		var e model.AuditEntry
+		if err = json.Unmarshal(rec.Data, &e); err == nil {
+			m.audit = append(m.audit, e)
+		}
+	case opRetention:
+		var v retentionRecord
+		if err = json.Unmarshal(rec.Data, &v); err == nil {
+			m.applyRetention(v)
+		}
+	case opSettings:
+		var s model.Settings
+		if err = json.Unmarshal(rec.Data, &s); err == nil {
+			m.settings = s
+		}
+	case opRoutingState:
+		var rs model.RoutingState
+		if err = json.Unmarshal(rec.Data, &rs); err == nil {
+			m.routing = &rs
+		}
+	default:
+		err = fmt.Errorf("unknown op %q", rec.Op)
+	}
+	if err != nil {
+		return fmt.Errorf("record %d (%s): %w", rec.Seq, rec.Op, err)
+	}
+	return nil
+}
+
+var errTornFrame = errors.New("torn frame")
+
+func encodeFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeader+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeader:], payload)
+	return frame
+}
+
+// decodeFrame returns the payload of the frame at the start of b and the frame length.
+// errTornFrame means b ends inside the frame, i.e. the last write never completed.
+// A complete frame with a bad checksum is only treated as torn when it is the last one.
+func decodeFrame(b []byte) ([]byte, int, error) {
+	if len(b) < frameHeader {
+		return nil, 0, errTornFrame
+	}
+	size := int(binary.LittleEndian.Uint32(b[0:4]))
+	if size > maxFrameSize {
+		return nil, 0, fmt.Errorf("frame length %d exceeds limit", size)
+	}
+	if frameHeader+size > len(b) {
+		return nil, 0, errTornFrame
+	}
+	payload := b[frameHeader : frameHeader+size]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(b[4:8]) {
+		if frameHeader+size == len(b) {
+			return nil, 0, errTornFrame
+		}
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+	return payload, frameHeader + size, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// persist the rename itself
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
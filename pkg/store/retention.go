@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"peer-wan/pkg/model"
+)
+
+// HealthSeriesSteps lists the bucket widths the health rollup maintains, finest first.
+var HealthSeriesSteps = []string{"1m", "5m", "1h"}
+
+// DefaultRetention is applied to every collection whose settings leave a bound unset.
+// Per-node counts match the caps the stores used to enforce on write.
+func DefaultRetention() model.RetentionConfig {
+	return model.RetentionConfig{
+		Audit:        model.RetentionPolicy{MaxAge: "90d", MaxCount: 100000},
+		Tasks:        model.RetentionPolicy{MaxAge: "30d", MaxCount: 1000},
+		PolicyStatus: model.RetentionPolicy{MaxAge: "0", MaxCount: 50},
+		PolicyDiag:   model.RetentionPolicy{MaxAge: "0", MaxCount: 20},
+		PlanHistory:  model.RetentionPolicy{MaxAge: "0", MaxCount: 20},
+		// raw samples only feed the 1m rollup; charts and reports read the series
+		HealthHistory:  model.RetentionPolicy{MaxAge: "2h", MaxCount: -1},
+		HealthSeries1m: model.RetentionPolicy{MaxAge: "2d", MaxCount: -1},
+		HealthSeries5m: model.RetentionPolicy{MaxAge: "14d", MaxCount: -1},
+		HealthSeries1h: model.RetentionPolicy{MaxAge: "400d", MaxCount: -1},
+	}
+}
+
+// EffectiveRetention fills unset bounds of cfg from DefaultRetention.
+func EffectiveRetention(cfg model.RetentionConfig) model.RetentionConfig {
+	def := DefaultRetention()
+	merge := func(p, d model.RetentionPolicy) model.RetentionPolicy {
+		if p.MaxAge == "" {
+			p.MaxAge = d.MaxAge
+		}
+		if p.MaxCount == 0 {
+			p.MaxCount = d.MaxCount
+		}
+		return p
+	}
+	return model.RetentionConfig{
+		Audit:          merge(cfg.Audit, def.Audit),
+		Tasks:          merge(cfg.Tasks, def.Tasks),
+		PolicyStatus:   merge(cfg.PolicyStatus, def.PolicyStatus),
+		PolicyDiag:     merge(cfg.PolicyDiag, def.PolicyDiag),
+		PlanHistory:    merge(cfg.PlanHistory, def.PlanHistory),
+		HealthHistory:  merge(cfg.HealthHistory, def.HealthHistory),
+		HealthSeries1m: merge(cfg.HealthSeries1m, def.HealthSeries1m),
+		HealthSeries5m: merge(cfg.HealthSeries5m, def.HealthSeries5m),
+		HealthSeries1h: merge(cfg.HealthSeries1h, def.HealthSeries1h),
+	}
+}
+
+// ValidateRetention reports the first unparsable bound in cfg.
+func ValidateRetention(cfg model.RetentionConfig) error {
+	for name, p := range map[string]model.RetentionPolicy{
+		"audit": cfg.Audit, "tasks": cfg.Tasks, "policyStatus": cfg.PolicyStatus,
+		"policyDiag": cfg.PolicyDiag, "planHistory": cfg.PlanHistory, "healthHistory": cfg.HealthHistory,
+		"healthSeries1m": cfg.HealthSeries1m, "healthSeries5m": cfg.HealthSeries5m, "healthSeries1h": cfg.HealthSeries1h,
+	} {
+		if _, _, err := p.Limits(time.Now()); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if p.MaxCount < -1 {
+			return fmt.Errorf("%s: maxCount must be -1 (unlimited), 0 (default) or positive", name)
+		}
+	}
+	return nil
+}
+
+// retain drops entries of an oldest-first slice that are older than the policy cutoff
+// and then all but the newest MaxCount. It returns the kept entries and the number dropped.
+func retain[T any](items []T, ts func(T) time.Time, p model.RetentionPolicy, now time.Time) ([]T, int) {
+	cutoff, maxCount, err := p.Limits(now)
+	if err != nil {
+		return items, 0
+	}
+	keep := items[:0:0]
+	for _, it := range items {
+		if cutoff.IsZero() || !ts(it).Before(cutoff) {
+			keep = append(keep, it)
+		}
+	}
+	if maxCount > 0 && len(keep) > maxCount {
+		keep = keep[len(keep)-maxCount:]
+	}
+	return keep, len(items) - len(keep)
+}
+
+// taskActivity ages tasks by their last update so long-running tasks are not dropped early.
+func taskActivity(t model.Task) time.Time {
+	if !t.UpdatedAt.IsZero() {
+		return t.UpdatedAt
+	}
+	return t.CreatedAt
+}
+
+// RunRetention applies the retention configured in st's settings once.
+func RunRetention(st NodeStore, now time.Time) (model.RetentionStats, error) {
+	settings, err := st.GetSettings()
+	if err != nil {
+		return model.RetentionStats{}, fmt.Errorf("load settings: %w", err)
+	}
+	return st.ApplyRetention(EffectiveRetention(settings.Retention), now)
+}
+
+// StartJanitor enforces retention every interval until ctx is done. When active is
+// non-nil passes are skipped while it returns false (e.g. on non-leader replicas).
+func StartJanitor(ctx context.Context, st NodeStore, interval time.Duration, active func() bool) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				if active != nil && !active() {
+					continue
+				}
+				stats, err := RunRetention(st, now)
+				if err != nil {
+					log.Printf("retention janitor failed: %v", err)
+					continue
+				}
+				if stats.Total() > 0 {
+					log.Printf("retention janitor removed %d entries (audit=%d tasks=%d policyStatus=%d policyDiag=%d planHistory=%d healthHistory=%d healthSeries=%d)",
+						stats.Total(), stats.Audit, stats.Tasks, stats.PolicyStatus, stats.PolicyDiag, stats.PlanHistory, stats.HealthHistory, stats.HealthSeries)
+				}
+			}
+		}
+	}()
+}
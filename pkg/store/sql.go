@@ -0,0 +1,1048 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"peer-wan/pkg/model"
+)
+
+// SQLStore persists controller state through GORM (MySQL or SQLite).
+// Entities are kept as JSON documents next to the columns needed for lookups,
+// which keeps the schema stable while model structs evolve.
+type SQLStore struct {
+	db *gorm.DB
+}
+
+type sqlNode struct {
+	ID             string `gorm:"primaryKey;size:128"`
+	Seq            int
+	Data           string `gorm:"type:longtext"`
+	PrivateKey     string `gorm:"type:text"`
+	ProvisionToken string `gorm:"size:128"`
+	Revision       int64  `gorm:"not null;default:0"`
+	UpdatedAt      time.Time
+}
+
+type sqlPlan struct {
+	NodeID    string `gorm:"primaryKey;size:128"`
+	Version   int64
+	Data      string `gorm:"type:longtext"`
+	CreatedAt time.Time
+}
+
+type sqlPlanHistory struct {
+	ID        uint      `gorm:"primaryKey"`
+	NodeID    string    `gorm:"size:128;index:idx_plan_history_node;index:idx_plan_history_created"`
+	Version   int64     `gorm:"index:idx_plan_history_node"`
+	Data      string    `gorm:"type:longtext"`
+	CreatedAt time.Time `gorm:"index:idx_plan_history_created"`
+}
+
+type sqlPolicyStatus struct {
+	ID        uint      `gorm:"primaryKey"`
+	NodeID    string    `gorm:"size:128;index:idx_policy_status_node"`
+	Timestamp time.Time `gorm:"index:idx_policy_status_node"`
+	Status    string    `gorm:"size:32"`
+	Data      string    `gorm:"type:longtext"`
+}
+
+type sqlPolicyDiag struct {
+	ID        uint      `gorm:"primaryKey"`
+	NodeID    string    `gorm:"size:128;index:idx_policy_diag_node"`
+	Timestamp time.Time `gorm:"index:idx_policy_diag_node"`
+	Data      string    `gorm:"type:longtext"`
+}
+
+type sqlTask struct {
+	ID            string    `gorm:"primaryKey;size:64"`
+	NodeID        string    `gorm:"size:128;index"`
+	TaskType      string    `gorm:"size:64;index"`
+	Status        string    `gorm:"size:32"`
+	OverallStatus string    `gorm:"size:32"`
+	Targets       string    `gorm:"type:text"` // ",a,b," of NodeID and Targets, for LIKE lookups
+	CreatedAt     time.Time `gorm:"index"`
+	UpdatedAt     time.Time `gorm:"index"`
+	Data          string    `gorm:"type:longtext"`
+}
+
+func newSQLTask(t model.Task, data string) sqlTask {
+	ids := append([]string{t.NodeID}, t.Targets...)
+	targets := ","
+	for _, id := range ids {
+		if id != "" {
+			targets += id + ","
+		}
+	}
+	return sqlTask{
+		ID:            t.ID,
+		NodeID:        t.NodeID,
+		TaskType:      t.Type,
+		Status:        t.Status,
+		OverallStatus: t.OverallStatus,
+		Targets:       targets,
+		CreatedAt:     t.CreatedAt,
+		UpdatedAt:     t.UpdatedAt,
+		Data:          data,
+	}
+}
+
+type sqlHealth struct {
+	NodeID    string `gorm:"primaryKey;size:128"`
+	Timestamp time.Time
+	Data      string `gorm:"type:longtext"`
+}
+
+type sqlHealthHistory struct {
+	ID        uint      `gorm:"primaryKey"`
+	NodeID    string    `gorm:"size:128;index:idx_health_history_node"`
+	Timestamp time.Time `gorm:"index:idx_health_history_node;index"`
+	Data      string    `gorm:"type:longtext"`
+}
+
+type sqlHealthSeries struct {
+	ID     uint      `gorm:"primaryKey"`
+	NodeID string    `gorm:"size:128;uniqueIndex:idx_health_series_key,priority:1"`
+	Step   string    `gorm:"size:8;uniqueIndex:idx_health_series_key,priority:2"`
+	Start  time.Time `gorm:"uniqueIndex:idx_health_series_key,priority:3;index"`
+	Peer   string    `gorm:"size:64;uniqueIndex:idx_health_series_key,priority:4"`
+	Data   string    `gorm:"type:text"`
+}
+
+type sqlLinkKey struct {
+	A         string `gorm:"primaryKey;size:128"`
+	B         string `gorm:"primaryKey;size:128"`
+	Data      string `gorm:"type:text"`
+	UpdatedAt time.Time
+}
+
+type sqlAudit struct {
+	ID        uint      `gorm:"primaryKey"`
+	Actor     string    `gorm:"size:128;index"`
+	Action    string    `gorm:"size:64;index"`
+	Target    string    `gorm:"size:128;index"`
+	Detail    string    `gorm:"type:text"`
+	Timestamp time.Time `gorm:"index"`
+}
+
+// sqlMeta holds singleton values (settings, global plan version).
+type sqlMeta struct {
+	Key   string `gorm:"primaryKey;size:64"`
+	Value string `gorm:"type:longtext"`
+}
+
+func (sqlNode) TableName() string          { return "peer_wan_nodes" }
+func (sqlPlan) TableName() string          { return "peer_wan_plans" }
+func (sqlPlanHistory) TableName() string   { return "peer_wan_plan_history" }
+func (sqlPolicyStatus) TableName() string  { return "peer_wan_policy_status" }
+func (sqlPolicyDiag) TableName() string    { return "peer_wan_policy_diag" }
+func (sqlTask) TableName() string          { return "peer_wan_tasks" }
+func (sqlHealth) TableName() string        { return "peer_wan_health" }
+func (sqlHealthHistory) TableName() string { return "peer_wan_health_history" }
+func (sqlHealthSeries) TableName() string  { return "peer_wan_health_series" }
+func (sqlLinkKey) TableName() string       { return "peer_wan_link_keys" }
+func (sqlAudit) TableName() string         { return "peer_wan_audit" }
+func (sqlMeta) TableName() string          { return "peer_wan_meta" }
+
+const (
+	metaSettings    = "settings"
+	metaPlanVersion = "plan_version"
+	metaRouting     = "routing_state"
+)
+
+// NewSQLStore wraps an open GORM connection and applies pending schema migrations.
+func NewSQLStore(db *gorm.DB) (*SQLStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("sql store requires a database connection")
+	}
+	if err := migrateSQL(db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// Ping reports readiness for health/info endpoints.
+func (s *SQLStore) Ping() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Ping()
+}
+
+func (s *SQLStore) UpsertNode(n model.Node) (model.Node, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var row sqlNode
+		err := tx.Where("id = ?", n.ID).Take(&row).Error
+		found := err == nil
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		next := row.Seq + 1
+		n.Version = versionString(next)
+		n.ConfigVersion = versionString(next)
+		return writeNodeCAS(tx, n, next, found)
+	})
+	if err != nil {
+		return n, err
+	}
+	n.Revision++
+	return n, nil
+}
+
+func (s *SQLStore) ListNodes() ([]model.Node, error) {
+	var rows []sqlNode
+	if err := s.db.Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.Node, 0, len(rows))
+	for _, r := range rows {
+		n, err := rowToNode(r)
+		if err != nil {
+			return nil, fmt.Errorf("decode node %s: %w", r.ID, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (s *SQLStore) GetNode(id string) (model.Node, bool, error) {
+	var row sqlNode
+	err := s.db.Where("id = ?", id).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return model.Node{}, false, nil
+	}
+	if err != nil {
+		return model.Node{}, false, err
+	}
+	n, err := rowToNode(row)
+	if err != nil {
+		return model.Node{}, false, err
+	}
+	return n, true, nil
+}
+
+// DeleteNode removes a node together with its plans, health, policy logs, tasks and link keys.
+func (s *SQLStore) DeleteNode(id string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ?", id).Delete(&sqlNode{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("node not found")
+		}
+		for _, table := range []interface{}{
+			&sqlPlan{}, &sqlPlanHistory{}, &sqlHealth{}, &sqlHealthHistory{},
+			&sqlPolicyStatus{}, &sqlPolicyDiag{}, &sqlTask{}, &sqlHealthSeries{},
+		} {
+			if err := tx.Where("node_id = ?", id).Delete(table).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("a = ? OR b = ?", id, id).Delete(&sqlLinkKey{}).Error
+	})
+}
+
+func (s *SQLStore) UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string, revision int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var row sqlNode
+		err := tx.Where("id = ?", nodeID).Take(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("node not found")
+		}
+		if err != nil {
+			return err
+		}
+		n, err := rowToNode(row)
+		if err != nil {
+			return err
+		}
+		n.EgressPeerID = egressPeer
+		n.PolicyRules = rules
+		n.DefaultRoute = defaultRoute
+		n.BypassCIDRs = bypass
+		n.DefaultRouteNextHop = defaultRouteNextHop
+		n.Revision = revision
+		return writeNodeCAS(tx, n, row.Seq, true)
+	})
+}
+
+// writeNodeCAS stores n only if the stored revision still equals n.Revision
+// (UPDATE ... WHERE revision = ?), bumping it by one; otherwise ErrConflict.
+func writeNodeCAS(tx *gorm.DB, n model.Node, seq int, exists bool) error {
+	n.Revision++
+	row := nodeToRow(n, seq)
+	if !exists {
+		if n.Revision != 1 {
+			return ErrConflict
+		}
+		if err := tx.Create(row).Error; err != nil {
+			// lost an insert race against another writer
+			var cnt int64
+			if errCnt := tx.Model(&sqlNode{}).Where("id = ?", n.ID).Count(&cnt).Error; errCnt == nil && cnt > 0 {
+				return ErrConflict
+			}
+			return err
+		}
+		return nil
+	}
+	res := tx.Model(&sqlNode{}).Where("id = ? AND revision = ?", n.ID, n.Revision-1).Updates(map[string]interface{}{
+		"seq":             row.Seq,
+		"data":            row.Data,
+		"private_key":     row.PrivateKey,
+		"provision_token": row.ProvisionToken,
+		"revision":        row.Revision,
+		"updated_at":      row.UpdatedAt,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *SQLStore) SavePlan(p model.Plan) error {
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now()
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		latest := sqlPlan{NodeID: p.NodeID, Version: p.Version, Data: string(b), CreatedAt: p.CreatedAt}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&latest).Error; err != nil {
+			return err
+		}
+		return tx.Create(&sqlPlanHistory{NodeID: p.NodeID, Version: p.Version, Data: string(b), CreatedAt: p.CreatedAt}).Error
+	})
+}
+
+func (s *SQLStore) GetPlan(nodeID string) (model.Plan, bool, error) {
+	var row sqlPlan
+	err := s.db.Where("node_id = ?", nodeID).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return model.Plan{}, false, nil
+	}
+	if err != nil {
+		return model.Plan{}, false, err
+	}
+	var p model.Plan
+	if err := json.Unmarshal([]byte(row.Data), &p); err != nil {
+		return model.Plan{}, false, err
+	}
+	return p, true, nil
+}
+
+func (s *SQLStore) ListPlanHistory(nodeID string, limit int) ([]model.Plan, error) {
+	var rows []sqlPlanHistory
+	if err := latestByNode(s.db, nodeID, limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.Plan, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var p model.Plan
+		if err := json.Unmarshal([]byte(rows[i].Data), &p); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) QueryPlanHistory(q model.PlanHistoryQuery) ([]model.Plan, bool, error) {
+	rows, more, err := pageRows[sqlPlanHistory](s.db.Model(&sqlPlanHistory{}).Where("node_id = ?", q.NodeID), "created_at", q.HistoryPage)
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]model.Plan, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var p model.Plan
+		if err := json.Unmarshal([]byte(rows[i].Data), &p); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out, more, nil
+}
+
+func (s *SQLStore) RollbackPlan(nodeID string, version int64) (model.Plan, error) {
+	var p model.Plan
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var row sqlPlanHistory
+		err := tx.Where("node_id = ? AND version = ?", nodeID, version).Order("id DESC").Take(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("version not found")
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(row.Data), &p); err != nil {
+			return err
+		}
+		latest := sqlPlan{NodeID: nodeID, Version: p.Version, Data: row.Data, CreatedAt: p.CreatedAt}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&latest).Error; err != nil {
+			return err
+		}
+		return putMeta(tx, metaPlanVersion, strconv.FormatInt(version, 10))
+	})
+	if err != nil {
+		return model.Plan{}, err
+	}
+	return p, nil
+}
+
+func (s *SQLStore) SetGlobalPlanVersion(v int64) error {
+	return putMeta(s.db, metaPlanVersion, strconv.FormatInt(v, 10))
+}
+
+func (s *SQLStore) GetGlobalPlanVersion() (int64, error) {
+	val, ok, err := getMeta(s.db, metaPlanVersion)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+func (s *SQLStore) SavePolicyStatus(l model.PolicyInstallLog) error {
+	if l.Timestamp.IsZero() {
+		l.Timestamp = time.Now()
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.db.Create(&sqlPolicyStatus{NodeID: l.NodeID, Timestamp: l.Timestamp, Status: l.Status, Data: string(b)}).Error
+}
+
+func (s *SQLStore) ListPolicyStatus(nodeID string, limit int) ([]model.PolicyInstallLog, error) {
+	var rows []sqlPolicyStatus
+	if err := latestByNode(s.db, nodeID, limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.PolicyInstallLog, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var l model.PolicyInstallLog
+		if err := json.Unmarshal([]byte(rows[i].Data), &l); err == nil {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) QueryPolicyStatus(q model.PolicyStatusQuery) ([]model.PolicyInstallLog, bool, error) {
+	db := s.db.Model(&sqlPolicyStatus{}).Where("node_id = ?", q.NodeID)
+	if q.Status != "" {
+		db = db.Where("status = ?", q.Status)
+	}
+	rows, more, err := pageRows[sqlPolicyStatus](db, "timestamp", q.HistoryPage)
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]model.PolicyInstallLog, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var l model.PolicyInstallLog
+		if err := json.Unmarshal([]byte(rows[i].Data), &l); err == nil {
+			out = append(out, l)
+		}
+	}
+	return out, more, nil
+}
+
+func (s *SQLStore) SavePolicyDiag(d model.PolicyDiagReport) error {
+	if d.Timestamp.IsZero() {
+		d.Timestamp = time.Now()
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return s.db.Create(&sqlPolicyDiag{NodeID: d.NodeID, Timestamp: d.Timestamp, Data: string(b)}).Error
+}
+
+func (s *SQLStore) ListPolicyDiag(nodeID string, limit int) ([]model.PolicyDiagReport, error) {
+	var rows []sqlPolicyDiag
+	if err := latestByNode(s.db, nodeID, limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.PolicyDiagReport, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var d model.PolicyDiagReport
+		if err := json.Unmarshal([]byte(rows[i].Data), &d); err == nil {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) QueryPolicyDiag(q model.PolicyDiagQuery) ([]model.PolicyDiagReport, bool, error) {
+	rows, more, err := pageRows[sqlPolicyDiag](s.db.Model(&sqlPolicyDiag{}).Where("node_id = ?", q.NodeID), "timestamp", q.HistoryPage)
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]model.PolicyDiagReport, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var d model.PolicyDiagReport
+		if err := json.Unmarshal([]byte(rows[i].Data), &d); err == nil {
+			out = append(out, d)
+		}
+	}
+	return out, more, nil
+}
+
+func (s *SQLStore) SaveTask(t model.Task) error {
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	t.UpdatedAt = time.Now()
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	row := newSQLTask(t, string(b))
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
+
+func (s *SQLStore) GetTask(id string) (model.Task, bool, error) {
+	var row sqlTask
+	err := s.db.Where("id = ?", id).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return model.Task{}, false, nil
+	}
+	if err != nil {
+		return model.Task{}, false, err
+	}
+	var t model.Task
+	if err := json.Unmarshal([]byte(row.Data), &t); err != nil {
+		return model.Task{}, false, err
+	}
+	return t, true, nil
+}
+
+func (s *SQLStore) ListTasks(nodeID string, limit int) ([]model.Task, error) {
+	q := s.db.Order("created_at DESC")
+	if nodeID != "" {
+		q = q.Where("node_id = ?", nodeID)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	var rows []sqlTask
+	if err := q.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.Task, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var t model.Task
+		if err := json.Unmarshal([]byte(rows[i].Data), &t); err == nil {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) QueryTasks(q model.TaskQuery) ([]model.Task, bool, error) {
+	db := s.db.Model(&sqlTask{})
+	if q.NodeID != "" {
+		db = db.Where("targets LIKE ? ESCAPE '!'", "%,"+escapeLike(q.NodeID)+",%")
+	}
+	if q.Type != "" {
+		db = db.Where("task_type = ?", q.Type)
+	}
+	if q.Status != "" {
+		db = db.Where("(status = ? OR overall_status = ?)", q.Status, q.Status)
+	}
+	rows, more, err := pageRows[sqlTask](db, "created_at", q.HistoryPage)
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]model.Task, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		var t model.Task
+		if err := json.Unmarshal([]byte(rows[i].Data), &t); err == nil {
+			out = append(out, t)
+		}
+	}
+	return out, more, nil
+}
+
+func (s *SQLStore) SaveHealth(h model.HealthReport) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		latest := sqlHealth{NodeID: h.NodeID, Timestamp: h.Timestamp, Data: string(b)}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&latest).Error; err != nil {
+			return err
+		}
+		return tx.Create(&sqlHealthHistory{NodeID: h.NodeID, Timestamp: h.Timestamp, Data: string(b)}).Error
+	})
+}
+
+func (s *SQLStore) ListHealth() ([]model.HealthReport, error) {
+	var rows []sqlHealth
+	if err := s.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.HealthReport, 0, len(rows))
+	for _, r := range rows {
+		var h model.HealthReport
+		if err := json.Unmarshal([]byte(r.Data), &h); err == nil {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) ListHealthHistory(nodeID string, since time.Time) ([]model.HealthReport, error) {
+	var rows []sqlHealthHistory
+	err := s.db.Where("node_id = ? AND timestamp >= ?", nodeID, since).Order("timestamp ASC, id ASC").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	out := make([]model.HealthReport, 0, len(rows))
+	for _, r := range rows {
+		var h model.HealthReport
+		if err := json.Unmarshal([]byte(r.Data), &h); err == nil {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) PruneHealthBefore(cutoff time.Time) error {
+	return s.db.Where("timestamp < ?", cutoff).Delete(&sqlHealthHistory{}).Error
+}
+
+func (s *SQLStore) SaveHealthBuckets(buckets []model.HealthBucket) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	rows := make([]sqlHealthSeries, 0, len(buckets))
+	for _, b := range buckets {
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, sqlHealthSeries{NodeID: b.NodeID, Step: b.Step, Start: b.Start, Peer: b.Peer, Data: string(data)})
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}, {Name: "step"}, {Name: "start"}, {Name: "peer"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data"}),
+	}).CreateInBatches(rows, 200).Error
+}
+
+func (s *SQLStore) ListHealthBuckets(nodeID, step string, from, to time.Time) ([]model.HealthBucket, error) {
+	q := s.db.Where("node_id = ? AND step = ? AND start >= ?", nodeID, step, from)
+	if !to.IsZero() {
+		q = q.Where("start < ?", to)
+	}
+	var rows []sqlHealthSeries
+	if err := q.Order("start ASC, peer ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.HealthBucket, 0, len(rows))
+	for _, r := range rows {
+		var b model.HealthBucket
+		if err := json.Unmarshal([]byte(r.Data), &b); err == nil {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) SaveLinkKey(k model.LinkKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	row := sqlLinkKey{A: k.A, B: k.B, Data: string(data), UpdatedAt: time.Now()}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "a"}, {Name: "b"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at"}),
+	}).Create(&row).Error
+}
+
+func (s *SQLStore) ListLinkKeys() ([]model.LinkKey, error) {
+	var rows []sqlLinkKey
+	if err := s.db.Order("a ASC, b ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.LinkKey, 0, len(rows))
+	for _, r := range rows {
+		var k model.LinkKey
+		if err := json.Unmarshal([]byte(r.Data), &k); err == nil {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+func (s *SQLStore) DeleteLinkKey(a, b string) error {
+	return s.db.Where("a = ? AND b = ?", a, b).Delete(&sqlLinkKey{}).Error
+}
+
+func (s *SQLStore) AppendAudit(entry model.AuditEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	row := sqlAudit{
+		Actor:     entry.Actor,
+		Action:    entry.Action,
+		Target:    entry.Target,
+		Detail:    entry.Detail,
+		Timestamp: entry.Timestamp,
+	}
+	return s.db.Create(&row).Error
+}
+
+func (s *SQLStore) ListAudit(limit int) ([]model.AuditEntry, error) {
+	q := s.db.Order("id DESC")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	var rows []sqlAudit
+	if err := q.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]model.AuditEntry, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		r := rows[i]
+		out = append(out, model.AuditEntry{
+			Actor:     r.Actor,
+			Action:    r.Action,
+			Target:    r.Target,
+			Detail:    r.Detail,
+			Timestamp: r.Timestamp,
+		})
+	}
+	return out, nil
+}
+
+func (s *SQLStore) QueryAudit(q model.AuditQuery) ([]model.AuditEntry, bool, error) {
+	db := s.db.Model(&sqlAudit{})
+	if q.Actor != "" {
+		db = db.Where("actor = ?", q.Actor)
+	}
+	if q.Action != "" {
+		db = db.Where("action = ?", q.Action)
+	}
+	if q.Target != "" {
+		db = db.Where("target = ?", q.Target)
+	}
+	rows, more, err := pageRows[sqlAudit](db, "timestamp", q.HistoryPage)
+	if err != nil {
+		return nil, false, err
+	}
+	out := make([]model.AuditEntry, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		r := rows[i]
+		out = append(out, model.AuditEntry{
+			Actor:     r.Actor,
+			Action:    r.Action,
+			Target:    r.Target,
+			Detail:    r.Detail,
+			Timestamp: r.Timestamp,
+		})
+	}
+	return out, more, nil
+}
+
+// pageRows loads the page p of the rows db selects, ordered by the time column col and
+// then id, newest first. It reads at most p.Limit+1 rows to tell whether more remain.
+func pageRows[R any](db *gorm.DB, col string, p model.HistoryPage) ([]R, bool, error) {
+	if !p.Since.IsZero() {
+		db = db.Where(col+" >= ?", p.Since)
+	}
+	if !p.Until.IsZero() {
+		db = db.Where(col+" < ?", p.Until)
+	}
+	db = db.Session(&gorm.Session{})
+	want := -1
+	if p.Limit > 0 {
+		want = p.Limit + 1
+	}
+	var rows []R
+	if !p.Before.IsZero() {
+		// the entries stamped exactly Before that the previous page did not reach
+		if err := db.Where(col+" = ?", p.Before).Order("id DESC").Offset(p.Skip).Limit(want).Find(&rows).Error; err != nil {
+			return nil, false, err
+		}
+		db = db.Where(col+" < ?", p.Before)
+	}
+	if want < 0 || len(rows) < want {
+		var older []R
+		limit := want
+		if limit > 0 {
+			limit -= len(rows)
+		}
+		if err := db.Order(col + " DESC").Order("id DESC").Limit(limit).Find(&older).Error; err != nil {
+			return nil, false, err
+		}
+		rows = append(rows, older...)
+	}
+	if p.Limit > 0 && len(rows) > p.Limit {
+		return rows[:p.Limit], true, nil
+	}
+	return rows, false, nil
+}
+
+// escapeLike escapes s for a LIKE pattern using '!' as the escape character.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func (s *SQLStore) SaveRoutingState(rs model.RoutingState) error {
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	return putMeta(s.db, metaRouting, string(b))
+}
+
+func (s *SQLStore) GetRoutingState() (model.RoutingState, bool, error) {
+	val, ok, err := getMeta(s.db, metaRouting)
+	if err != nil || !ok {
+		return model.RoutingState{}, false, err
+	}
+	var rs model.RoutingState
+	if err := json.Unmarshal([]byte(val), &rs); err != nil {
+		return model.RoutingState{}, false, err
+	}
+	return rs, true, nil
+}
+
+func (s *SQLStore) GetSettings() (model.Settings, error) {
+	val, ok, err := getMeta(s.db, metaSettings)
+	if err != nil {
+		return model.Settings{}, err
+	}
+	if !ok {
+		return defaultSettings(), nil
+	}
+	var cfg model.Settings
+	if err := json.Unmarshal([]byte(val), &cfg); err != nil {
+		return model.Settings{}, err
+	}
+	return cfg, nil
+}
+
+func (s *SQLStore) UpdateSettings(cfg model.Settings) error {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return putMeta(s.db, metaSettings, string(b))
+}
+
+func nodeToRow(n model.Node, seq int) *sqlNode {
+	b, _ := json.Marshal(n)
+	return &sqlNode{
+		ID:             n.ID,
+		Seq:            seq,
+		Data:           string(b),
+		PrivateKey:     n.PrivateKey,
+		ProvisionToken: n.ProvisionToken,
+		Revision:       n.Revision,
+		UpdatedAt:      time.Now(),
+	}
+}
+
+func rowToNode(r sqlNode) (model.Node, error) {
+	var n model.Node
+	if err := json.Unmarshal([]byte(r.Data), &n); err != nil {
+		return model.Node{}, err
+	}
+	n.PrivateKey = r.PrivateKey
+	n.ProvisionToken = r.ProvisionToken
+	n.Revision = r.Revision
+	return n, nil
+}
+
+// latestByNode selects the newest rows of a per-node collection (caller reverses to oldest-first).
+func latestByNode(db *gorm.DB, nodeID string, limit int) *gorm.DB {
+	q := db.Where("node_id = ?", nodeID).Order("id DESC")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	return q
+}
+
+// trimByNode keeps only the newest keep rows for nodeID in the given per-node table.
+func trimByNode(tx *gorm.DB, table interface{}, nodeID string, keep int) (int, error) {
+	var ids []uint
+	err := tx.Model(table).Where("node_id = ?", nodeID).Order("id DESC").Offset(keep).Limit(1).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	res := tx.Where("node_id = ? AND id <= ?", nodeID, ids[0]).Delete(table)
+	return int(res.RowsAffected), res.Error
+}
+
+// ApplyRetention deletes rows outside cfg; per-node counts are enforced node by node.
+func (s *SQLStore) ApplyRetention(cfg model.RetentionConfig, now time.Time) (model.RetentionStats, error) {
+	var stats model.RetentionStats
+	if err := ValidateRetention(cfg); err != nil {
+		return stats, err
+	}
+	var err error
+	if stats.Audit, err = s.retainTable(&sqlAudit{}, "timestamp", false, cfg.Audit, now); err != nil {
+		return stats, fmt.Errorf("audit: %w", err)
+	}
+	if stats.Tasks, err = s.retainTasks(cfg.Tasks, now); err != nil {
+		return stats, fmt.Errorf("tasks: %w", err)
+	}
+	if stats.PolicyStatus, err = s.retainTable(&sqlPolicyStatus{}, "timestamp", true, cfg.PolicyStatus, now); err != nil {
+		return stats, fmt.Errorf("policy status: %w", err)
+	}
+	if stats.PolicyDiag, err = s.retainTable(&sqlPolicyDiag{}, "timestamp", true, cfg.PolicyDiag, now); err != nil {
+		return stats, fmt.Errorf("policy diag: %w", err)
+	}
+	if stats.PlanHistory, err = s.retainTable(&sqlPlanHistory{}, "created_at", true, cfg.PlanHistory, now); err != nil {
+		return stats, fmt.Errorf("plan history: %w", err)
+	}
+	if stats.HealthHistory, err = s.retainTable(&sqlHealthHistory{}, "timestamp", true, cfg.HealthHistory, now); err != nil {
+		return stats, fmt.Errorf("health history: %w", err)
+	}
+	for _, step := range HealthSeriesSteps {
+		n, err := s.retainSeries(step, cfg.HealthSeries(step), now)
+		stats.HealthSeries += n
+		if err != nil {
+			return stats, fmt.Errorf("health series %s: %w", step, err)
+		}
+	}
+	return stats, nil
+}
+
+// retainTable applies p to an append-only table with an autoincrement id.
+func (s *SQLStore) retainTable(table interface{}, tsColumn string, perNode bool, p model.RetentionPolicy, now time.Time) (int, error) {
+	cutoff, maxCount, err := p.Limits(now)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	if !cutoff.IsZero() {
+		res := s.db.Where(tsColumn+" < ?", cutoff).Delete(table)
+		if res.Error != nil {
+			return removed, res.Error
+		}
+		removed += int(res.RowsAffected)
+	}
+	if maxCount <= 0 {
+		return removed, nil
+	}
+	if !perNode {
+		var ids []uint
+		if err := s.db.Model(table).Order("id DESC").Offset(maxCount).Limit(1).Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+			return removed, err
+		}
+		res := s.db.Where("id <= ?", ids[0]).Delete(table)
+		return removed + int(res.RowsAffected), res.Error
+	}
+	var nodeIDs []string
+	if err := s.db.Model(table).Distinct("node_id").Pluck("node_id", &nodeIDs).Error; err != nil {
+		return removed, err
+	}
+	for _, id := range nodeIDs {
+		n, err := trimByNode(s.db, table, id, maxCount)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// retainSeries applies p to the buckets of one step; counts are per node.
+func (s *SQLStore) retainSeries(step string, p model.RetentionPolicy, now time.Time) (int, error) {
+	cutoff, maxCount, err := p.Limits(now)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	if !cutoff.IsZero() {
+		res := s.db.Where("step = ? AND start < ?", step, cutoff).Delete(&sqlHealthSeries{})
+		if res.Error != nil {
+			return removed, res.Error
+		}
+		removed += int(res.RowsAffected)
+	}
+	if maxCount <= 0 {
+		return removed, nil
+	}
+	var nodeIDs []string
+	if err := s.db.Model(&sqlHealthSeries{}).Where("step = ?", step).Distinct("node_id").Pluck("node_id", &nodeIDs).Error; err != nil {
+		return removed, err
+	}
+	for _, id := range nodeIDs {
+		var ids []uint
+		err := s.db.Model(&sqlHealthSeries{}).Where("node_id = ? AND step = ?", id, step).Order("start DESC, id DESC").Offset(maxCount).Limit(1).Pluck("id", &ids).Error
+		if err != nil {
+			return removed, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		var boundary sqlHealthSeries
+		if err := s.db.Where("id = ?", ids[0]).Take(&boundary).Error; err != nil {
+			return removed, err
+		}
+		// whole time slots only, so every peer of a slot is kept or dropped together
+		res := s.db.Where("node_id = ? AND step = ? AND start < ?", id, step, boundary.Start).Delete(&sqlHealthSeries{})
+		if res.Error != nil {
+			return removed, res.Error
+		}
+		removed += int(res.RowsAffected)
+	}
+	return removed, nil
+}
+
+func (s *SQLStore) retainTasks(p model.RetentionPolicy, now time.Time) (int, error) {
+	cutoff, maxCount, err := p.Limits(now)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	if !cutoff.IsZero() {
+		res := s.db.Where("updated_at < ?", cutoff).Delete(&sqlTask{})
+		if res.Error != nil {
+			return removed, res.Error
+		}
+		removed += int(res.RowsAffected)
+	}
+	if maxCount <= 0 {
+		return removed, nil
+	}
+	// the oldest task still inside the count bound; everything created before it goes
+	var boundary []time.Time
+	if err := s.db.Model(&sqlTask{}).Order("created_at DESC").Offset(maxCount-1).Limit(1).Pluck("created_at", &boundary).Error; err != nil || len(boundary) == 0 {
+		return removed, err
+	}
+	res := s.db.Where("created_at < ?", boundary[0]).Delete(&sqlTask{})
+	return removed + int(res.RowsAffected), res.Error
+}
+
+func getMeta(db *gorm.DB, key string) (string, bool, error) {
+	var row sqlMeta
+	err := db.Where(&sqlMeta{Key: key}).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return row.Value, true, nil
+}
+
+func putMeta(db *gorm.DB, key, value string) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&sqlMeta{Key: key, Value: value}).Error
+}
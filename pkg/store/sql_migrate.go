@@ -0,0 +1,161 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"peer-wan/pkg/model"
+)
+
+// sqlMigration is a single forward-only schema step. Steps are applied in order
+// and recorded in peer_wan_schema_migrations so restarts only run new ones.
+type sqlMigration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+type sqlSchemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:128"`
+	AppliedAt time.Time
+}
+
+func (sqlSchemaMigration) TableName() string { return "peer_wan_schema_migrations" }
+
+// sqlMigrations lists every schema change of the SQL store. Append only; never edit a released step.
+var sqlMigrations = []sqlMigration{
+	{
+		Version: 1,
+		Name:    "initial node store schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(
+				&sqlNode{},
+				&sqlPlan{},
+				&sqlPlanHistory{},
+				&sqlPolicyStatus{},
+				&sqlPolicyDiag{},
+				&sqlTask{},
+				&sqlHealth{},
+				&sqlHealthHistory{},
+				&sqlAudit{},
+				&sqlMeta{},
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "node revision for optimistic concurrency",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&sqlNode{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "task activity time for retention",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&sqlTask{}); err != nil {
+				return err
+			}
+			return tx.Model(&sqlTask{}).Where("updated_at IS NULL").Update("updated_at", gorm.Expr("created_at")).Error
+		},
+	},
+	{
+		Version: 4,
+		Name:    "health time-series buckets",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&sqlHealthSeries{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "per-link preshared keys",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&sqlLinkKey{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "task filter columns for paged queries",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&sqlTask{}); err != nil {
+				return err
+			}
+			var rows []sqlTask
+			return tx.FindInBatches(&rows, 500, func(*gorm.DB, int) error {
+				for _, r := range rows {
+					var t model.Task
+					if err := json.Unmarshal([]byte(r.Data), &t); err != nil {
+						continue
+					}
+					row := newSQLTask(t, r.Data)
+					err := tx.Model(&sqlTask{}).Where("id = ?", r.ID).Updates(map[string]interface{}{
+						"task_type":      row.TaskType,
+						"status":         row.Status,
+						"overall_status": row.OverallStatus,
+						"targets":        row.Targets,
+					}).Error
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}).Error
+		},
+	},
+	{
+		Version: 7,
+		Name:    "paged plan history and policy status queries",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&sqlPlanHistory{}, &sqlPolicyStatus{}); err != nil {
+				return err
+			}
+			var rows []sqlPolicyStatus
+			return tx.FindInBatches(&rows, 500, func(*gorm.DB, int) error {
+				for _, r := range rows {
+					var l model.PolicyInstallLog
+					if err := json.Unmarshal([]byte(r.Data), &l); err != nil {
+						continue
+					}
+					if err := tx.Model(&sqlPolicyStatus{}).Where("id = ?", r.ID).Update("status", l.Status).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			}).Error
+		},
+	},
+}
+
+// migrateSQL brings the schema up to the latest version.
+func migrateSQL(db *gorm.DB) error {
+	if err := db.AutoMigrate(&sqlSchemaMigration{}); err != nil {
+		return fmt.Errorf("create migration table: %w", err)
+	}
+	var applied []sqlSchemaMigration
+	if err := db.Find(&applied).Error; err != nil {
+		return fmt.Errorf("load applied migrations: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+	for _, m := range sqlMigrations {
+		if done[m.Version] {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&sqlSchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
@@ -6,34 +6,70 @@ import (
 	"peer-wan/pkg/model"
 )
 
+// ErrConflict is returned by UpsertNode/UpdatePolicy when the node changed since it was read.
+// Callers should reload the node, re-apply their change and retry, or surface the conflict.
+var ErrConflict = model.ErrRevisionConflict
+
 // NodeStore defines the persistence layer for node state.
 // Later this can be backed by Consul KV, but we start with an in-memory impl.
+//
+// Node writes are optimistic: UpsertNode expects n.Revision to equal the stored revision
+// (0 for a node that does not exist yet) and UpdatePolicy takes the expected revision
+// explicitly. Both return ErrConflict on mismatch; on success the revision is incremented.
 type NodeStore interface {
 	UpsertNode(model.Node) (model.Node, error)
 	ListNodes() ([]model.Node, error)
 	GetNode(id string) (model.Node, bool, error)
+	DeleteNode(id string) error
 	SavePlan(model.Plan) error
 	GetPlan(nodeID string) (model.Plan, bool, error)
 	ListPlanHistory(nodeID string, limit int) ([]model.Plan, error)
+	// QueryPlanHistory returns one page of a node's plan history oldest first and whether older ones remain.
+	QueryPlanHistory(model.PlanHistoryQuery) ([]model.Plan, bool, error)
 	RollbackPlan(nodeID string, version int64) (model.Plan, error)
 	SetGlobalPlanVersion(int64) error
 	GetGlobalPlanVersion() (int64, error)
-	UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string) error
+	UpdatePolicy(nodeID string, egressPeer string, rules []model.PolicyRule, defaultRoute bool, bypass []string, defaultRouteNextHop string, revision int64) error
 	SavePolicyStatus(model.PolicyInstallLog) error
 	ListPolicyStatus(nodeID string, limit int) ([]model.PolicyInstallLog, error)
+	// QueryPolicyStatus returns one page of a node's install logs oldest first and whether older ones remain.
+	QueryPolicyStatus(model.PolicyStatusQuery) ([]model.PolicyInstallLog, bool, error)
 	SavePolicyDiag(model.PolicyDiagReport) error
 	ListPolicyDiag(nodeID string, limit int) ([]model.PolicyDiagReport, error)
+	// QueryPolicyDiag returns one page of a node's diagnostic reports oldest first and whether older ones remain.
+	QueryPolicyDiag(model.PolicyDiagQuery) ([]model.PolicyDiagReport, bool, error)
 	SaveTask(model.Task) error
 	GetTask(id string) (model.Task, bool, error)
 	ListTasks(nodeID string, limit int) ([]model.Task, error)
+	// QueryTasks returns one page of matching tasks oldest first and whether older ones remain.
+	QueryTasks(model.TaskQuery) ([]model.Task, bool, error)
 	SaveHealth(model.HealthReport) error
 	ListHealth() ([]model.HealthReport, error)
 	ListHealthHistory(nodeID string, since time.Time) ([]model.HealthReport, error)
 	PruneHealthBefore(time.Time) error
+	// SaveHealthBuckets upserts rolled-up health buckets keyed by node, peer, step and start.
+	SaveHealthBuckets([]model.HealthBucket) error
+	// ListHealthBuckets returns a node's buckets of one step with from <= Start < to (zero to = open), oldest first.
+	ListHealthBuckets(nodeID, step string, from, to time.Time) ([]model.HealthBucket, error)
+	// SaveLinkKey upserts the preshared key of the pair k.A, k.B (A < B).
+	SaveLinkKey(k model.LinkKey) error
+	// ListLinkKeys returns every link key ordered by A, B.
+	ListLinkKeys() ([]model.LinkKey, error)
+	// DeleteLinkKey removes the key of a pair; a missing key is not an error.
+	DeleteLinkKey(a, b string) error
+	// SaveRoutingState replaces the health-driven routing state of the controller computing plans.
+	SaveRoutingState(model.RoutingState) error
+	// GetRoutingState returns the saved routing state; ok is false before the first save.
+	GetRoutingState() (model.RoutingState, bool, error)
 	AppendAudit(model.AuditEntry) error
 	ListAudit(limit int) ([]model.AuditEntry, error)
+	// QueryAudit returns one page of matching audit entries oldest first and whether older ones remain.
+	QueryAudit(model.AuditQuery) ([]model.AuditEntry, bool, error)
 	GetSettings() (model.Settings, error)
 	UpdateSettings(model.Settings) error
+	// ApplyRetention drops history (audit, tasks, policy status/diag, plan and health
+	// history) outside cfg. History writes are not capped; the janitor calls this periodically.
+	ApplyRetention(cfg model.RetentionConfig, now time.Time) (model.RetentionStats, error)
 }
 
 // NewMemory is a helper to construct the in-memory implementation without importing it directly.
@@ -0,0 +1,939 @@
+// Package storetest is a conformance suite for store.NodeStore implementations.
+//
+// Every backend runs the same behavioural checks from its own _test.go file:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.NodeStore { return newStore(t) })
+//	}
+//
+// The factory must return an empty store; each subtest gets its own.
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/policy"
+	"peer-wan/pkg/store"
+)
+
+// Factory returns a fresh, empty store. Cleanup belongs in t.Cleanup.
+type Factory func(t *testing.T) store.NodeStore
+
+// Run executes the whole suite against stores built by newStore.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, st store.NodeStore)
+	}{
+		{"NodeCRUD", testNodeCRUD},
+		{"NodeRevisions", testNodeRevisions},
+		{"UpdatePolicy", testUpdatePolicy},
+		{"DeleteNode", testDeleteNode},
+		{"PlanVersioning", testPlanVersioning},
+		{"PlanRollback", testPlanRollback},
+		{"PolicyHistoryLimits", testPolicyHistoryLimits},
+		{"QueryPlanHistory", testQueryPlanHistory},
+		{"QueryPolicyHistory", testQueryPolicyHistory},
+		{"Tasks", testTasks},
+		{"QueryTasks", testQueryTasks},
+		{"Audit", testAudit},
+		{"QueryAudit", testQueryAudit},
+		{"Health", testHealth},
+		{"HealthBuckets", testHealthBuckets},
+		{"LinkKeys", testLinkKeys},
+		{"RoutingState", testRoutingState},
+		{"Settings", testSettings},
+		{"Retention", testRetention},
+		{"ConcurrentWriters", testConcurrentWriters},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+// base is a fixed, second-aligned time so backends that truncate precision still compare equal.
+var base = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func mustUpsert(t *testing.T, st store.NodeStore, n model.Node) model.Node {
+	t.Helper()
+	out, err := st.UpsertNode(n)
+	if err != nil {
+		t.Fatalf("UpsertNode(%s): %v", n.ID, err)
+	}
+	return out
+}
+
+func mustGet(t *testing.T, st store.NodeStore, id string) model.Node {
+	t.Helper()
+	n, ok, err := st.GetNode(id)
+	if err != nil || !ok {
+		t.Fatalf("GetNode(%s) = ok %v, err %v", id, ok, err)
+	}
+	return n
+}
+
+func testNodeCRUD(t *testing.T, st store.NodeStore) {
+	if _, ok, err := st.GetNode("missing"); ok || err != nil {
+		t.Fatalf("GetNode(missing) = ok %v, err %v; want false, nil", ok, err)
+	}
+	in := model.Node{
+		ID:             "edge-1",
+		PublicKey:      "pub",
+		Endpoints:      []string{"203.0.113.1:51820"},
+		CIDRs:          []string{"10.10.1.0/24"},
+		OverlayIP:      "10.200.0.1/32",
+		ListenPort:     51820,
+		ASN:            65001,
+		PrivateKey:     "priv",
+		ProvisionToken: "tok",
+		PeerEndpoints:  map[string]string{"edge-2": "198.51.100.2:51820"},
+	}
+	out := mustUpsert(t, st, in)
+	if out.Revision != 1 {
+		t.Errorf("revision after create = %d, want 1", out.Revision)
+	}
+	if out.Version != "v0.0.1" || out.ConfigVersion != "v0.0.1" {
+		t.Errorf("version after create = %q/%q, want v0.0.1", out.Version, out.ConfigVersion)
+	}
+	got := mustGet(t, st, "edge-1")
+	if got.PublicKey != "pub" || got.OverlayIP != "10.200.0.1/32" || got.ListenPort != 51820 || got.ASN != 65001 {
+		t.Errorf("GetNode lost fields: %+v", got)
+	}
+	if got.PrivateKey != "priv" || got.ProvisionToken != "tok" {
+		t.Errorf("secrets not persisted: privateKey %q provisionToken %q", got.PrivateKey, got.ProvisionToken)
+	}
+	if got.PeerEndpoints["edge-2"] != "198.51.100.2:51820" {
+		t.Errorf("peerEndpoints = %v", got.PeerEndpoints)
+	}
+	if got.Revision != 1 || got.Version != "v0.0.1" {
+		t.Errorf("stored revision/version = %d/%q", got.Revision, got.Version)
+	}
+
+	mustUpsert(t, st, model.Node{ID: "edge-2", PublicKey: "pub2"})
+	nodes, err := st.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("ListNodes = %d nodes, want 2", len(nodes))
+	}
+	for _, n := range nodes {
+		if n.ID == "edge-1" && n.PrivateKey != "priv" {
+			t.Errorf("ListNodes dropped secrets of edge-1")
+		}
+	}
+}
+
+func testNodeRevisions(t *testing.T, st store.NodeStore) {
+	n := mustUpsert(t, st, model.Node{ID: "n1"})
+	if _, err := st.UpsertNode(model.Node{ID: "n1"}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("create over existing node: err %v, want ErrConflict", err)
+	}
+	if _, err := st.UpsertNode(model.Node{ID: "n2", Revision: 3}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("non-zero revision for new node: err %v, want ErrConflict", err)
+	}
+	n.ListenPort = 51821
+	n2 := mustUpsert(t, st, n)
+	if n2.Revision != 2 || n2.Version != "v0.0.2" || n2.ConfigVersion != "v0.0.2" {
+		t.Errorf("after update revision/version = %d/%q/%q, want 2/v0.0.2", n2.Revision, n2.Version, n2.ConfigVersion)
+	}
+	// stale write
+	n.ListenPort = 1
+	if _, err := st.UpsertNode(n); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale write: err %v, want ErrConflict", err)
+	}
+	if got := mustGet(t, st, "n1"); got.ListenPort != 51821 || got.Revision != 2 {
+		t.Errorf("stale write leaked: %+v", got)
+	}
+}
+
+func testUpdatePolicy(t *testing.T, st store.NodeStore) {
+	n := mustUpsert(t, st, model.Node{ID: "n1", PrivateKey: "priv"})
+	rules := []model.PolicyRule{{Prefix: "0.0.0.0/0", ViaNode: "n2"}}
+	if err := st.UpdatePolicy("n1", "n2", rules, true, []string{"192.168.0.0/16"}, "n3", n.Revision+1); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("UpdatePolicy with wrong revision: err %v, want ErrConflict", err)
+	}
+	if err := st.UpdatePolicy("n1", "n2", rules, true, []string{"192.168.0.0/16"}, "n3", n.Revision); err != nil {
+		t.Fatalf("UpdatePolicy: %v", err)
+	}
+	got := mustGet(t, st, "n1")
+	if got.EgressPeerID != "n2" || !got.DefaultRoute || got.DefaultRouteNextHop != "n3" || len(got.BypassCIDRs) != 1 || len(got.PolicyRules) != 1 {
+		t.Errorf("policy not stored: %+v", got)
+	}
+	if got.Revision != n.Revision+1 {
+		t.Errorf("revision after UpdatePolicy = %d, want %d", got.Revision, n.Revision+1)
+	}
+	if got.Version != n.Version {
+		t.Errorf("UpdatePolicy changed config version %q -> %q", n.Version, got.Version)
+	}
+	if got.PrivateKey != "priv" {
+		t.Errorf("UpdatePolicy dropped private key")
+	}
+	if err := st.UpdatePolicy("missing", "", nil, false, nil, "", 0); err == nil {
+		t.Errorf("UpdatePolicy on missing node succeeded")
+	}
+}
+
+func testDeleteNode(t *testing.T, st store.NodeStore) {
+	mustUpsert(t, st, model.Node{ID: "n1"})
+	mustUpsert(t, st, model.Node{ID: "n10"}) // shares the "n1" prefix
+	for _, id := range []string{"n1", "n10"} {
+		if err := st.SavePlan(model.Plan{NodeID: id, Version: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.SaveHealth(model.HealthReport{NodeID: id, Timestamp: base}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.SavePolicyStatus(model.PolicyInstallLog{NodeID: id, Status: "success", Timestamp: base}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.SaveTask(model.Task{ID: "task-" + id, NodeID: id, Type: "policy_apply", CreatedAt: base}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.SaveHealthBuckets([]model.HealthBucket{{NodeID: id, Peer: "10.0.0.9", Step: "1m", Start: base, Samples: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustUpsert(t, st, model.Node{ID: "n0"})
+	for _, k := range []model.LinkKey{{A: "n0", B: "n1", Generation: 1}, {A: "n1", B: "n10", Generation: 1}, {A: "n0", B: "n10", Generation: 1}} {
+		if err := st.SaveLinkKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.DeleteNode("n1"); err != nil {
+		t.Fatalf("DeleteNode: %v", err)
+	}
+	if _, ok, _ := st.GetNode("n1"); ok {
+		t.Errorf("node still present")
+	}
+	if _, ok, _ := st.GetPlan("n1"); ok {
+		t.Errorf("plan still present")
+	}
+	if h, _ := st.ListPlanHistory("n1", 0); len(h) != 0 {
+		t.Errorf("plan history still present: %d", len(h))
+	}
+	if h, _ := st.ListHealthHistory("n1", time.Time{}); len(h) != 0 {
+		t.Errorf("health history still present: %d", len(h))
+	}
+	if l, _ := st.ListPolicyStatus("n1", 0); len(l) != 0 {
+		t.Errorf("policy status still present: %d", len(l))
+	}
+	if _, ok, _ := st.GetTask("task-n1"); ok {
+		t.Errorf("task still present")
+	}
+	if b, _ := st.ListHealthBuckets("n1", "1m", time.Time{}, time.Time{}); len(b) != 0 {
+		t.Errorf("health buckets still present: %d", len(b))
+	}
+	if keys, _ := st.ListLinkKeys(); len(keys) != 1 || keys[0].A != "n0" || keys[0].B != "n10" {
+		t.Errorf("link keys after delete = %+v, want only n0-n10", keys)
+	}
+	// the neighbour sharing the id prefix is untouched
+	if _, ok, _ := st.GetNode("n10"); !ok {
+		t.Errorf("n10 deleted with n1")
+	}
+	if h, _ := st.ListPlanHistory("n10", 0); len(h) != 1 {
+		t.Errorf("n10 plan history = %d, want 1", len(h))
+	}
+	if _, ok, _ := st.GetTask("task-n10"); !ok {
+		t.Errorf("n10 task deleted with n1")
+	}
+	if err := st.DeleteNode("n1"); err == nil {
+		t.Errorf("deleting a missing node succeeded")
+	}
+}
+
+func testPlanVersioning(t *testing.T, st store.NodeStore) {
+	if _, ok, err := st.GetPlan("n1"); ok || err != nil {
+		t.Fatalf("GetPlan(missing) = ok %v, err %v", ok, err)
+	}
+	// more than nine versions so lexical key order would differ from numeric order
+	for v := int64(1); v <= 12; v++ {
+		p := model.Plan{NodeID: "n1", Version: v, ConfigVersion: fmt.Sprintf("v0.0.%d", v), Routes: []string{fmt.Sprintf("10.%d.0.0/16", v)}}
+		if err := st.SavePlan(p); err != nil {
+			t.Fatalf("SavePlan(%d): %v", v, err)
+		}
+	}
+	p, ok, err := st.GetPlan("n1")
+	if err != nil || !ok || p.Version != 12 {
+		t.Fatalf("GetPlan = %d ok %v err %v, want 12", p.Version, ok, err)
+	}
+	if p.CreatedAt.IsZero() {
+		t.Errorf("SavePlan did not stamp CreatedAt")
+	}
+	hist, err := st.ListPlanHistory("n1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 12 {
+		t.Fatalf("history = %d entries, want 12", len(hist))
+	}
+	for i, h := range hist {
+		if h.Version != int64(i+1) {
+			t.Fatalf("history[%d].Version = %d, want oldest first (%d)", i, h.Version, i+1)
+		}
+	}
+	hist, _ = st.ListPlanHistory("n1", 3)
+	if len(hist) != 3 || hist[0].Version != 10 || hist[2].Version != 12 {
+		t.Errorf("history limit 3 = %v, want versions 10..12", planVersions(hist))
+	}
+	if err := st.SetGlobalPlanVersion(42); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := st.GetGlobalPlanVersion(); err != nil || v != 42 {
+		t.Errorf("GetGlobalPlanVersion = %d, %v; want 42", v, err)
+	}
+}
+
+func testPlanRollback(t *testing.T, st store.NodeStore) {
+	for v := int64(1); v <= 3; v++ {
+		if err := st.SavePlan(model.Plan{NodeID: "n1", Version: v, Routes: []string{fmt.Sprintf("r%d", v)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SetGlobalPlanVersion(3); err != nil {
+		t.Fatal(err)
+	}
+	p, err := st.RollbackPlan("n1", 2)
+	if err != nil {
+		t.Fatalf("RollbackPlan: %v", err)
+	}
+	if p.Version != 2 || len(p.Routes) != 1 || p.Routes[0] != "r2" {
+		t.Errorf("RollbackPlan returned %+v", p)
+	}
+	cur, _, _ := st.GetPlan("n1")
+	if cur.Version != 2 || cur.Routes[0] != "r2" {
+		t.Errorf("current plan after rollback = v%d %v, want v2", cur.Version, cur.Routes)
+	}
+	if v, _ := st.GetGlobalPlanVersion(); v != 2 {
+		t.Errorf("global plan version after rollback = %d, want 2", v)
+	}
+	// rollback re-points the current plan; it does not append to history
+	if hist, _ := st.ListPlanHistory("n1", 0); len(hist) != 3 {
+		t.Errorf("history after rollback = %v, want 3 entries", planVersions(hist))
+	}
+	if _, err := st.RollbackPlan("n1", 99); err == nil {
+		t.Errorf("rollback to unknown version succeeded")
+	}
+	if _, err := st.RollbackPlan("other", 1); err == nil {
+		t.Errorf("rollback of another node's version succeeded")
+	}
+}
+
+func planVersions(ps []model.Plan) []int64 {
+	out := make([]int64, len(ps))
+	for i, p := range ps {
+		out[i] = p.Version
+	}
+	return out
+}
+
+func testPolicyHistoryLimits(t *testing.T, st store.NodeStore) {
+	for i := 0; i < 5; i++ {
+		ts := base.Add(time.Duration(i) * time.Second)
+		if err := st.SavePolicyStatus(model.PolicyInstallLog{NodeID: "n1", Status: fmt.Sprintf("s%d", i), Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.SavePolicyDiag(model.PolicyDiagReport{NodeID: "n1", Summary: fmt.Sprintf("d%d", i), Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SavePolicyStatus(model.PolicyInstallLog{NodeID: "n2", Status: "other", Timestamp: base}); err != nil {
+		t.Fatal(err)
+	}
+	all, _ := st.ListPolicyStatus("n1", 0)
+	if len(all) != 5 || all[0].Status != "s0" || all[4].Status != "s4" {
+		t.Errorf("ListPolicyStatus(0) = %d entries, want 5 oldest first", len(all))
+	}
+	last, _ := st.ListPolicyStatus("n1", 2)
+	if len(last) != 2 || last[0].Status != "s3" || last[1].Status != "s4" {
+		t.Errorf("ListPolicyStatus(2) = %+v, want s3,s4", last)
+	}
+	diag, _ := st.ListPolicyDiag("n1", 3)
+	if len(diag) != 3 || diag[0].Summary != "d2" || diag[2].Summary != "d4" {
+		t.Errorf("ListPolicyDiag(3) = %d entries, want d2..d4", len(diag))
+	}
+	if l, _ := st.ListPolicyStatus("n1", 100); len(l) != 5 {
+		t.Errorf("limit above size = %d entries, want 5", len(l))
+	}
+	// zero timestamps are stamped on save
+	if err := st.SavePolicyDiag(model.PolicyDiagReport{NodeID: "n3"}); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := st.ListPolicyDiag("n3", 0); len(d) != 1 || d[0].Timestamp.IsZero() {
+		t.Errorf("SavePolicyDiag did not stamp the timestamp: %+v", d)
+	}
+}
+
+func testTasks(t *testing.T, st store.NodeStore) {
+	if _, ok, err := st.GetTask("missing"); ok || err != nil {
+		t.Fatalf("GetTask(missing) = ok %v, err %v", ok, err)
+	}
+	for i := 0; i < 4; i++ {
+		node := "n1"
+		if i%2 == 1 {
+			node = "n2"
+		}
+		task := model.Task{ID: fmt.Sprintf("t%d", i), NodeID: node, Type: "policy_apply", Status: "pending", CreatedAt: base.Add(time.Duration(i) * time.Second)}
+		if err := st.SaveTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	task, ok, err := st.GetTask("t0")
+	if err != nil || !ok {
+		t.Fatalf("GetTask(t0) = ok %v, err %v", ok, err)
+	}
+	if task.UpdatedAt.IsZero() {
+		t.Errorf("SaveTask did not stamp UpdatedAt")
+	}
+	task.Status = "success"
+	if err := st.SaveTask(task); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := st.GetTask("t0"); got.Status != "success" || !got.CreatedAt.Equal(base) {
+		t.Errorf("updated task = %q created %v", got.Status, got.CreatedAt)
+	}
+	all, _ := st.ListTasks("", 0)
+	if len(all) != 4 || all[0].ID != "t0" || all[3].ID != "t3" {
+		t.Errorf("ListTasks(all) = %v, want t0..t3 oldest first", taskIDs(all))
+	}
+	n1, _ := st.ListTasks("n1", 0)
+	if len(n1) != 2 || n1[0].ID != "t0" || n1[1].ID != "t2" {
+		t.Errorf("ListTasks(n1) = %v, want t0,t2", taskIDs(n1))
+	}
+	lim, _ := st.ListTasks("", 2)
+	if len(lim) != 2 || lim[0].ID != "t2" || lim[1].ID != "t3" {
+		t.Errorf("ListTasks limit 2 = %v, want t2,t3", taskIDs(lim))
+	}
+}
+
+func taskIDs(ts []model.Task) []string {
+	out := make([]string, len(ts))
+	for i, t := range ts {
+		out[i] = t.ID
+	}
+	return out
+}
+
+func testAudit(t *testing.T, st store.NodeStore) {
+	for i := 0; i < 5; i++ {
+		e := model.AuditEntry{Actor: "admin", Action: "update", Target: fmt.Sprintf("n%d", i), Timestamp: base.Add(time.Duration(i) * time.Second)}
+		if err := st.AppendAudit(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, _ := st.ListAudit(0)
+	if len(all) != 5 || all[0].Target != "n0" || all[4].Target != "n4" {
+		t.Errorf("ListAudit(0) = %d entries, want 5 oldest first", len(all))
+	}
+	last, _ := st.ListAudit(2)
+	if len(last) != 2 || last[0].Target != "n3" || last[1].Target != "n4" {
+		t.Errorf("ListAudit(2) = %+v, want n3,n4", last)
+	}
+	if err := st.AppendAudit(model.AuditEntry{Actor: "admin", Action: "noop", Target: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	all, _ = st.ListAudit(0)
+	if len(all) != 6 || all[5].Timestamp.IsZero() {
+		t.Errorf("AppendAudit did not stamp the timestamp")
+	}
+}
+
+// nextPage moves p past page (oldest first) the way the API cursor does.
+func nextPage[T any](p model.HistoryPage, page []T, ts func(T) time.Time) model.HistoryPage {
+	oldest := ts(page[0])
+	skip := 0
+	for _, it := range page {
+		if ts(it).Equal(oldest) {
+			skip++
+		}
+	}
+	if p.Before.Equal(oldest) {
+		skip += p.Skip
+	}
+	p.Before, p.Skip = oldest, skip
+	return p
+}
+
+// walkPages follows a query page by page and renders each page's ids joined by "|".
+func walkPages[T any](t *testing.T, p model.HistoryPage, query func(model.HistoryPage) ([]T, bool, error), ts func(T) time.Time, id func(T) string) string {
+	t.Helper()
+	var pages []string
+	for n := 0; n < 10; n++ {
+		page, more, err := query(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(page))
+		for i, it := range page {
+			ids[i] = id(it)
+		}
+		pages = append(pages, strings.Join(ids, ","))
+		if !more {
+			break
+		}
+		p = nextPage(p, page, ts)
+	}
+	return strings.Join(pages, "|")
+}
+
+func testQueryPlanHistory(t *testing.T, st store.NodeStore) {
+	// versions 4 and 5 share a creation time; ties go in save order
+	offsets := []int{0, 1, 2, 3, 3, 5}
+	for i, off := range offsets {
+		p := model.Plan{NodeID: "n1", Version: int64(i + 1), CreatedAt: base.Add(time.Duration(off) * time.Second)}
+		if err := st.SavePlan(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SavePlan(model.Plan{NodeID: "n2", Version: 7, CreatedAt: base.Add(4 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	walk := func(q model.PlanHistoryQuery) string {
+		return walkPages(t, q.HistoryPage, func(p model.HistoryPage) ([]model.Plan, bool, error) {
+			q.HistoryPage = p
+			return st.QueryPlanHistory(q)
+		}, func(p model.Plan) time.Time { return p.CreatedAt }, func(p model.Plan) string { return fmt.Sprint(p.Version) })
+	}
+	cases := []struct {
+		q    model.PlanHistoryQuery
+		want string
+	}{
+		{model.PlanHistoryQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Limit: 2}}, "5,6|3,4|1,2"},
+		{model.PlanHistoryQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Limit: 4}}, "3,4,5,6|1,2"},
+		{model.PlanHistoryQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Since: base.Add(2 * time.Second), Until: base.Add(5 * time.Second)}}, "3,4,5"},
+		{model.PlanHistoryQuery{NodeID: "n2"}, "7"},
+		{model.PlanHistoryQuery{NodeID: "missing", HistoryPage: model.HistoryPage{Limit: 2}}, ""},
+	}
+	for _, c := range cases {
+		if got := walk(c.q); got != c.want {
+			t.Errorf("QueryPlanHistory(%+v) pages = %q, want %q", c.q, got, c.want)
+		}
+	}
+}
+
+func testQueryPolicyHistory(t *testing.T, st store.NodeStore) {
+	for i := 0; i < 5; i++ {
+		ts := base.Add(time.Duration(i) * time.Second)
+		status := "success"
+		if i%2 == 1 {
+			status = "failed"
+		}
+		if err := st.SavePolicyStatus(model.PolicyInstallLog{NodeID: "n1", Version: fmt.Sprint(i), Status: status, Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.SavePolicyDiag(model.PolicyDiagReport{NodeID: "n1", Summary: fmt.Sprint(i), Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SavePolicyStatus(model.PolicyInstallLog{NodeID: "n2", Version: "x", Status: "failed", Timestamp: base}); err != nil {
+		t.Fatal(err)
+	}
+	walkStatus := func(q model.PolicyStatusQuery) string {
+		return walkPages(t, q.HistoryPage, func(p model.HistoryPage) ([]model.PolicyInstallLog, bool, error) {
+			q.HistoryPage = p
+			return st.QueryPolicyStatus(q)
+		}, func(l model.PolicyInstallLog) time.Time { return l.Timestamp }, func(l model.PolicyInstallLog) string { return l.Version })
+	}
+	statusCases := []struct {
+		q    model.PolicyStatusQuery
+		want string
+	}{
+		{model.PolicyStatusQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Limit: 2}}, "3,4|1,2|0"},
+		{model.PolicyStatusQuery{NodeID: "n1", Status: "failed", HistoryPage: model.HistoryPage{Limit: 1}}, "3|1"},
+		{model.PolicyStatusQuery{NodeID: "n1", Status: "success", HistoryPage: model.HistoryPage{Until: base.Add(4 * time.Second)}}, "0,2"},
+		{model.PolicyStatusQuery{NodeID: "n2"}, "x"},
+	}
+	for _, c := range statusCases {
+		if got := walkStatus(c.q); got != c.want {
+			t.Errorf("QueryPolicyStatus(%+v) pages = %q, want %q", c.q, got, c.want)
+		}
+	}
+	walkDiag := func(q model.PolicyDiagQuery) string {
+		return walkPages(t, q.HistoryPage, func(p model.HistoryPage) ([]model.PolicyDiagReport, bool, error) {
+			q.HistoryPage = p
+			return st.QueryPolicyDiag(q)
+		}, func(d model.PolicyDiagReport) time.Time { return d.Timestamp }, func(d model.PolicyDiagReport) string { return d.Summary })
+	}
+	diagCases := []struct {
+		q    model.PolicyDiagQuery
+		want string
+	}{
+		{model.PolicyDiagQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Limit: 3}}, "2,3,4|0,1"},
+		{model.PolicyDiagQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Since: base.Add(3 * time.Second)}}, "3,4"},
+		{model.PolicyDiagQuery{NodeID: "n2"}, ""},
+	}
+	for _, c := range diagCases {
+		if got := walkDiag(c.q); got != c.want {
+			t.Errorf("QueryPolicyDiag(%+v) pages = %q, want %q", c.q, got, c.want)
+		}
+	}
+}
+
+func testQueryTasks(t *testing.T, st store.NodeStore) {
+	// t3 and t4 share a creation time; ties go by id
+	offsets := []int{0, 1, 2, 3, 3, 5}
+	for i, off := range offsets {
+		task := model.Task{ID: fmt.Sprintf("t%d", i), NodeID: "n1", Type: "policy_apply", Status: "success", CreatedAt: base.Add(time.Duration(off) * time.Second)}
+		switch i {
+		case 1:
+			task.NodeID, task.Targets = "", []string{"n2", "n_3"}
+		case 2:
+			task.Status, task.OverallStatus = "running", "failed"
+		case 5:
+			task.Type = "policy_diag"
+		}
+		if err := st.SaveTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk := func(q model.TaskQuery) string {
+		return walkPages(t, q.HistoryPage, func(p model.HistoryPage) ([]model.Task, bool, error) {
+			q.HistoryPage = p
+			return st.QueryTasks(q)
+		}, func(t model.Task) time.Time { return t.CreatedAt }, func(t model.Task) string { return t.ID })
+	}
+	cases := []struct {
+		q    model.TaskQuery
+		want string
+	}{
+		{model.TaskQuery{HistoryPage: model.HistoryPage{Limit: 2}}, "t4,t5|t2,t3|t0,t1"},
+		{model.TaskQuery{HistoryPage: model.HistoryPage{Limit: 4}}, "t2,t3,t4,t5|t0,t1"},
+		{model.TaskQuery{}, "t0,t1,t2,t3,t4,t5"},
+		{model.TaskQuery{NodeID: "n2"}, "t1"},
+		{model.TaskQuery{NodeID: "n_3"}, "t1"},
+		{model.TaskQuery{NodeID: "n%"}, ""},
+		{model.TaskQuery{NodeID: "n1", HistoryPage: model.HistoryPage{Limit: 1}}, "t5|t4|t3|t2|t0"},
+		{model.TaskQuery{Type: "policy_diag"}, "t5"},
+		{model.TaskQuery{Status: "failed"}, "t2"},
+		{model.TaskQuery{Status: "success", Type: "policy_apply", HistoryPage: model.HistoryPage{Limit: 3}}, "t1,t3,t4|t0"},
+		{model.TaskQuery{HistoryPage: model.HistoryPage{Since: base.Add(2 * time.Second), Until: base.Add(5 * time.Second)}}, "t2,t3,t4"},
+	}
+	for _, c := range cases {
+		if got := walk(c.q); got != c.want {
+			t.Errorf("QueryTasks(%+v) pages = %q, want %q", c.q, got, c.want)
+		}
+	}
+}
+
+func testQueryAudit(t *testing.T, st store.NodeStore) {
+	// n3 and n4 share a timestamp; ties go in append order
+	offsets := []int{0, 1, 2, 3, 3, 5}
+	for i, off := range offsets {
+		e := model.AuditEntry{Actor: "admin", Action: "update", Target: fmt.Sprintf("n%d", i), Timestamp: base.Add(time.Duration(off) * time.Second)}
+		if i%2 == 1 {
+			e.Actor = "ops"
+		}
+		if err := st.AppendAudit(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk := func(q model.AuditQuery) string {
+		return walkPages(t, q.HistoryPage, func(p model.HistoryPage) ([]model.AuditEntry, bool, error) {
+			q.HistoryPage = p
+			return st.QueryAudit(q)
+		}, func(e model.AuditEntry) time.Time { return e.Timestamp }, func(e model.AuditEntry) string { return e.Target })
+	}
+	cases := []struct {
+		q    model.AuditQuery
+		want string
+	}{
+		{model.AuditQuery{HistoryPage: model.HistoryPage{Limit: 2}}, "n4,n5|n2,n3|n0,n1"},
+		{model.AuditQuery{HistoryPage: model.HistoryPage{Limit: 1}}, "n5|n4|n3|n2|n1|n0"},
+		{model.AuditQuery{Actor: "ops", HistoryPage: model.HistoryPage{Limit: 2}}, "n3,n5|n1"},
+		{model.AuditQuery{Target: "n2"}, "n2"},
+		{model.AuditQuery{Action: "delete"}, ""},
+		{model.AuditQuery{HistoryPage: model.HistoryPage{Since: base.Add(2 * time.Second), Until: base.Add(5 * time.Second)}}, "n2,n3,n4"},
+	}
+	for _, c := range cases {
+		if got := walk(c.q); got != c.want {
+			t.Errorf("QueryAudit(%+v) pages = %q, want %q", c.q, got, c.want)
+		}
+	}
+}
+
+func testHealth(t *testing.T, st store.NodeStore) {
+	for i := 0; i < 3; i++ {
+		h := model.HealthReport{
+			NodeID:     "n1",
+			Status:     "up",
+			LatencyMs:  map[string]int{"10.0.0.2": 10 + i},
+			PacketLoss: map[string]float64{"10.0.0.2": 0},
+			Timestamp:  base.Add(time.Duration(i) * time.Minute),
+			WireGuard: map[string]model.WireGuardPeerStats{
+				"n2": {PublicKey: "pk2", LastHandshake: base, RxBytes: int64(i), Endpoint: "203.0.113.2:51820", AllowedIPs: []string{"10.0.0.2/32"}},
+			},
+		}
+		if err := st.SaveHealth(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SaveHealth(model.HealthReport{NodeID: "n2", Status: "down", Timestamp: base}); err != nil {
+		t.Fatal(err)
+	}
+	latest, _ := st.ListHealth()
+	if len(latest) != 2 {
+		t.Fatalf("ListHealth = %d reports, want one per node", len(latest))
+	}
+	for _, h := range latest {
+		if h.NodeID == "n1" && h.LatencyMs["10.0.0.2"] != 12 {
+			t.Errorf("ListHealth(n1) is not the latest report: %+v", h)
+		}
+	}
+	hist, _ := st.ListHealthHistory("n1", base.Add(time.Minute))
+	if len(hist) != 2 || !hist[0].Timestamp.Equal(base.Add(time.Minute)) || !hist[1].Timestamp.Equal(base.Add(2*time.Minute)) {
+		t.Errorf("ListHealthHistory(since, inclusive) = %d entries", len(hist))
+	} else if wg := hist[1].WireGuard["n2"]; wg.RxBytes != 2 || wg.Endpoint != "203.0.113.2:51820" || !wg.LastHandshake.Equal(base) {
+		t.Errorf("history lost the wireguard telemetry: %+v", hist[1].WireGuard)
+	}
+	if err := st.PruneHealthBefore(base.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if hist, _ := st.ListHealthHistory("n1", time.Time{}); len(hist) != 1 {
+		t.Errorf("after prune history = %d entries, want 1", len(hist))
+	}
+}
+
+func testHealthBuckets(t *testing.T, st store.NodeStore) {
+	var in []model.HealthBucket
+	for i := 0; i < 3; i++ {
+		for _, peer := range []string{"10.0.0.3", "10.0.0.2"} {
+			in = append(in, model.HealthBucket{NodeID: "n1", Peer: peer, Step: "1m", Start: base.Add(time.Duration(i) * time.Minute), Samples: 2, AvgMs: float64(i)})
+		}
+	}
+	if err := st.SaveHealthBuckets(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SaveHealthBuckets([]model.HealthBucket{{NodeID: "n1", Peer: "10.0.0.2", Step: "5m", Start: base, Samples: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.ListHealthBuckets("n1", "1m", base, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6 {
+		t.Fatalf("ListHealthBuckets = %d, want 6", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Start.Before(got[i-1].Start) {
+			t.Fatalf("buckets not ordered by start")
+		}
+	}
+	// re-saving a bucket replaces it
+	if err := st.SaveHealthBuckets([]model.HealthBucket{{NodeID: "n1", Peer: "10.0.0.2", Step: "1m", Start: base, Samples: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = st.ListHealthBuckets("n1", "1m", base, base.Add(time.Minute))
+	if len(got) != 2 {
+		t.Fatalf("range [base, base+1m) = %d buckets, want 2", len(got))
+	}
+	for _, b := range got {
+		if b.Peer == "10.0.0.2" && b.Samples != 7 {
+			t.Errorf("upsert did not replace bucket: samples %d", b.Samples)
+		}
+	}
+	if got, _ := st.ListHealthBuckets("n1", "5m", time.Time{}, time.Time{}); len(got) != 1 || got[0].Samples != 10 {
+		t.Errorf("5m buckets = %+v", got)
+	}
+}
+
+func testLinkKeys(t *testing.T, st store.NodeStore) {
+	if keys, err := st.ListLinkKeys(); err != nil || len(keys) != 0 {
+		t.Fatalf("ListLinkKeys(empty) = %v, %v", keys, err)
+	}
+	for _, k := range []model.LinkKey{
+		{A: "n2", B: "n3", Key: "v1:k23", Generation: 1, RotatedAt: base},
+		{A: "n1", B: "n3", Key: "v1:k13", Generation: 2, Next: "v1:n13", Staged: []string{"n1"}, StagedAt: base},
+		{A: "n1", B: "n2", Next: "v1:n12", StagedAt: base},
+	} {
+		if err := st.SaveLinkKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := st.ListLinkKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("ListLinkKeys = %d keys, want 3", len(keys))
+	}
+	if keys[0].B != "n2" || keys[1].B != "n3" || keys[2].A != "n2" {
+		t.Errorf("keys not ordered by pair: %+v", keys)
+	}
+	k := keys[1]
+	if k.Key != "v1:k13" || k.Generation != 2 || k.Next != "v1:n13" || len(k.Staged) != 1 || !k.StagedAt.Equal(base) {
+		t.Errorf("round trip = %+v", k)
+	}
+	// saving a pair again replaces it
+	if err := st.SaveLinkKey(model.LinkKey{A: "n1", B: "n3", Key: "v1:n13", Generation: 3, RotatedAt: base}); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = st.ListLinkKeys()
+	if len(keys) != 3 || keys[1].Generation != 3 || keys[1].Next != "" || len(keys[1].Staged) != 0 {
+		t.Errorf("after replace = %+v", keys)
+	}
+	if err := st.DeleteLinkKey("n1", "n2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteLinkKey("n1", "n2"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+	if keys, _ = st.ListLinkKeys(); len(keys) != 2 {
+		t.Errorf("after delete = %d keys, want 2", len(keys))
+	}
+}
+
+func testRoutingState(t *testing.T, st store.NodeStore) {
+	if _, ok, err := st.GetRoutingState(); err != nil || ok {
+		t.Fatalf("GetRoutingState(empty) = ok %v, err %v", ok, err)
+	}
+	hold := base.Add(30 * time.Second)
+	rs := model.RoutingState{
+		Links: []model.LinkState{
+			{ID: "n1", From: "n1", State: "up", Since: base, Decayed: base},
+			{ID: "n1>n2", From: "n1", To: "n2", State: "down", Penalty: 1000, Flaps: 1, Since: base, HoldUntil: &hold, Bad: 3, Decayed: base},
+		},
+		BGP:       map[string]model.StickyState{"n1|10.0.0.2": {Value: "Established", Pending: "Idle", Count: 1}},
+		AutoPaths: map[string]model.AutoPath{"n1|0.0.0.0/0||n3|": {Hops: []string{"n2", "n3"}, Cost: 42}},
+		Egress:    []model.EgressSelection{{Group: "g", Source: "n1", Member: "n3", Healthy: true}},
+		UpdatedAt: base,
+	}
+	if err := st.SaveRoutingState(rs); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := st.GetRoutingState()
+	if err != nil || !ok {
+		t.Fatalf("GetRoutingState = ok %v, err %v", ok, err)
+	}
+	if len(got.Links) != 2 || got.Links[1].HoldUntil == nil || !got.Links[1].HoldUntil.Equal(hold) || got.Links[1].Bad != 3 ||
+		got.BGP["n1|10.0.0.2"] != rs.BGP["n1|10.0.0.2"] || len(got.AutoPaths["n1|0.0.0.0/0||n3|"].Hops) != 2 ||
+		len(got.Egress) != 1 || got.Egress[0] != rs.Egress[0] || !got.UpdatedAt.Equal(base) {
+		t.Errorf("round trip = %+v", got)
+	}
+	// saving replaces the whole state
+	if err := st.SaveRoutingState(model.RoutingState{UpdatedAt: base.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ = st.GetRoutingState(); len(got.Links) != 0 || len(got.Egress) != 0 || !got.UpdatedAt.Equal(base.Add(time.Minute)) {
+		t.Errorf("after replace = %+v", got)
+	}
+}
+
+func testSettings(t *testing.T, st store.NodeStore) {
+	s, err := st.GetSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := policy.DefaultSettings()
+	if s.GeoIP != def.GeoIP || s.Diag != def.Diag {
+		t.Errorf("fresh settings = %+v, want defaults %+v", s, def)
+	}
+	s.Diag.PingInterval = "10s"
+	s.Retention.Audit = model.RetentionPolicy{MaxAge: "7d", MaxCount: 10}
+	if err := st.UpdateSettings(s); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.GetSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Diag.PingInterval != "10s" || got.Retention.Audit != s.Retention.Audit || got.GeoIP != def.GeoIP {
+		t.Errorf("settings round trip = %+v", got)
+	}
+}
+
+func testRetention(t *testing.T, st store.NodeStore) {
+	now := base.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute)
+		if err := st.SavePolicyStatus(model.PolicyInstallLog{NodeID: "n1", Status: fmt.Sprintf("s%d", i), Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.AppendAudit(model.AuditEntry{Actor: "a", Action: "x", Target: fmt.Sprintf("t%d", i), Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := store.EffectiveRetention(model.RetentionConfig{
+		PolicyStatus: model.RetentionPolicy{MaxAge: "0", MaxCount: 2},
+		// cutoff now-57m = base+3m: the first three entries are older
+		Audit: model.RetentionPolicy{MaxAge: "57m", MaxCount: -1},
+	})
+	stats, err := st.ApplyRetention(cfg, now)
+	if err != nil {
+		t.Fatalf("ApplyRetention: %v", err)
+	}
+	if stats.PolicyStatus != 3 || stats.Audit != 3 {
+		t.Errorf("removed policyStatus=%d audit=%d, want 3 and 3", stats.PolicyStatus, stats.Audit)
+	}
+	if l, _ := st.ListPolicyStatus("n1", 0); len(l) != 2 || l[0].Status != "s3" {
+		t.Errorf("policy status after retention = %d entries", len(l))
+	}
+	if a, _ := st.ListAudit(0); len(a) != 2 || a[0].Target != "t3" {
+		t.Errorf("audit after retention = %d entries", len(a))
+	}
+	// a second pass has nothing left to do
+	if stats, _ := st.ApplyRetention(cfg, now); stats.Total() != 0 {
+		t.Errorf("second pass removed %d entries", stats.Total())
+	}
+}
+
+// testConcurrentWriters has several goroutines increment a node field through
+// read-modify-write loops. Optimistic concurrency must neither lose nor duplicate updates.
+func testConcurrentWriters(t *testing.T, st store.NodeStore) {
+	mustUpsert(t, st, model.Node{ID: "hot"})
+	const writers, perWriter = 4, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				for attempt := 0; ; attempt++ {
+					if attempt > 1000 {
+						errs <- fmt.Errorf("writer %d: too many conflicts", w)
+						return
+					}
+					n, ok, err := st.GetNode("hot")
+					if err != nil || !ok {
+						errs <- fmt.Errorf("writer %d: GetNode ok=%v err=%v", w, ok, err)
+						return
+					}
+					n.ListenPort++
+					if _, err := st.UpsertNode(n); err == nil {
+						break
+					} else if !errors.Is(err, store.ErrConflict) {
+						errs <- fmt.Errorf("writer %d: %v", w, err)
+						return
+					}
+				}
+				if err := st.AppendAudit(model.AuditEntry{Actor: fmt.Sprintf("w%d", w), Action: "inc", Target: "hot"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	n := mustGet(t, st, "hot")
+	if n.ListenPort != writers*perWriter {
+		t.Errorf("counter = %d, want %d (lost updates)", n.ListenPort, writers*perWriter)
+	}
+	if n.Revision != 1+writers*perWriter {
+		t.Errorf("revision = %d, want %d", n.Revision, 1+writers*perWriter)
+	}
+	if a, _ := st.ListAudit(0); len(a) != writers*perWriter {
+		t.Errorf("audit entries = %d, want %d", len(a), writers*perWriter)
+	}
+}
@@ -0,0 +1,75 @@
+package topology
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// AggregatePrefixes returns the smallest set of CIDRs covering exactly the addresses of
+// prefixes: covered prefixes are dropped and sibling halves are merged into their parent.
+// Bare addresses are treated as host routes; unparsable entries are passed through.
+func AggregatePrefixes(prefixes []string) []string {
+	var parsed []netip.Prefix
+	var other []string
+	for _, s := range prefixes {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			a, errAddr := netip.ParseAddr(s)
+			if errAddr != nil {
+				other = append(other, s)
+				continue
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		parsed = append(parsed, p.Masked())
+	}
+	for {
+		merged := mergeOnce(parsed)
+		if len(merged) == len(parsed) {
+			break
+		}
+		parsed = merged
+	}
+	out := make([]string, 0, len(parsed)+len(other))
+	for _, p := range parsed {
+		out = append(out, p.String())
+	}
+	return append(out, other...)
+}
+
+// mergeOnce sorts prefixes, drops those covered by an earlier one and merges adjacent siblings.
+func mergeOnce(in []netip.Prefix) []netip.Prefix {
+	sort.Slice(in, func(i, j int) bool {
+		if c := in[i].Addr().Compare(in[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return in[i].Bits() < in[j].Bits()
+	})
+	out := make([]netip.Prefix, 0, len(in))
+	for _, p := range in {
+		if n := len(out); n > 0 {
+			last := out[n-1]
+			if last.Addr().Is4() == p.Addr().Is4() && last.Bits() <= p.Bits() && last.Contains(p.Addr()) {
+				continue
+			}
+			if parent, ok := siblings(last, p); ok {
+				out[n-1] = parent
+				continue
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// siblings reports whether a and b are the two halves of one parent prefix.
+func siblings(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().Is4() != b.Addr().Is4() {
+		return netip.Prefix{}, false
+	}
+	parent, err := a.Addr().Prefix(a.Bits() - 1)
+	if err != nil || !parent.Contains(b.Addr()) || a.Addr() == b.Addr() {
+		return netip.Prefix{}, false
+	}
+	return parent, true
+}
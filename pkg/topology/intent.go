@@ -0,0 +1,209 @@
+package topology
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"peer-wan/pkg/model"
+)
+
+// selectorTerm is one comma-separated term of a label selector.
+type selectorTerm struct {
+	key    string
+	value  string
+	negate bool // key!=value, or !key when hasVal is false
+	hasVal bool
+}
+
+// Selector matches node labels.
+type Selector struct {
+	terms []selectorTerm
+}
+
+// ParseSelector parses "key=value,key!=value,key,!key". Empty and "*" match every node.
+func ParseSelector(s string) (Selector, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return Selector{}, nil
+	}
+	var sel Selector
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		var t selectorTerm
+		switch {
+		case strings.Contains(raw, "!="):
+			k, v, _ := strings.Cut(raw, "!=")
+			t = selectorTerm{key: strings.TrimSpace(k), value: strings.TrimSpace(v), negate: true, hasVal: true}
+		case strings.Contains(raw, "="):
+			k, v, _ := strings.Cut(raw, "=")
+			t = selectorTerm{key: strings.TrimSpace(k), value: strings.TrimSpace(strings.TrimPrefix(v, "=")), hasVal: true}
+		case strings.HasPrefix(raw, "!"):
+			t = selectorTerm{key: strings.TrimSpace(raw[1:]), negate: true}
+		default:
+			t = selectorTerm{key: raw}
+		}
+		if t.key == "" {
+			return Selector{}, fmt.Errorf("invalid selector term %q", raw)
+		}
+		sel.terms = append(sel.terms, t)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every term of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, t := range s.terms {
+		v, ok := labels[t.key]
+		switch {
+		case t.hasVal && t.negate:
+			if ok && v == t.value {
+				return false
+			}
+		case t.hasVal:
+			if !ok || v != t.value {
+				return false
+			}
+		case t.negate:
+			if ok {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidateIntent checks selectors, limits and preference of one intent.
+func ValidateIntent(in model.PeeringIntent) error {
+	if strings.TrimSpace(in.ID) == "" {
+		return fmt.Errorf("intent id is required")
+	}
+	if _, err := ParseSelector(in.From); err != nil {
+		return fmt.Errorf("intent %s: from: %w", in.ID, err)
+	}
+	if _, err := ParseSelector(in.To); err != nil {
+		return fmt.Errorf("intent %s: to: %w", in.ID, err)
+	}
+	if in.MaxPeers < 0 {
+		return fmt.Errorf("intent %s: maxPeers must be >= 0", in.ID)
+	}
+	switch in.Preference {
+	case "", model.PreferLatency, model.PreferStable:
+	default:
+		return fmt.Errorf("intent %s: preference must be latency or stable", in.ID)
+	}
+	return nil
+}
+
+// ValidateIntents validates every intent and rejects duplicate ids.
+func ValidateIntents(intents []model.PeeringIntent) error {
+	seen := map[string]bool{}
+	for _, in := range intents {
+		if err := ValidateIntent(in); err != nil {
+			return err
+		}
+		if seen[in.ID] {
+			return fmt.Errorf("duplicate intent id %s", in.ID)
+		}
+		seen[in.ID] = true
+	}
+	return nil
+}
+
+// Edges evaluates intents into an undirected adjacency set keyed by node id.
+// Each node matching From is linked to the MaxPeers best nodes matching To (all of them
+// when MaxPeers is 0); the link is added for both ends since WireGuard peering is mutual.
+// Nodes that cannot be planned (no key/CIDRs) or are reported down are not selected.
+func Edges(nodes []model.Node, health map[string]model.HealthReport, intents []model.PeeringIntent) map[string]map[string]bool {
+	edges := map[string]map[string]bool{}
+	link := func(a, b string) {
+		if edges[a] == nil {
+			edges[a] = map[string]bool{}
+		}
+		if edges[b] == nil {
+			edges[b] = map[string]bool{}
+		}
+		edges[a][b] = true
+		edges[b][a] = true
+	}
+	var eligible []model.Node
+	for _, n := range nodes {
+		if len(n.CIDRs) == 0 || n.PublicKey == "" {
+			continue
+		}
+		if h, ok := health[n.ID]; ok && h.Status == "down" {
+			continue
+		}
+		eligible = append(eligible, n)
+	}
+	for _, in := range intents {
+		from, errFrom := ParseSelector(in.From)
+		to, errTo := ParseSelector(in.To)
+		if errFrom != nil || errTo != nil {
+			continue
+		}
+		for _, a := range eligible {
+			if !from.Matches(a.Labels) {
+				continue
+			}
+			var cands []model.Node
+			for _, b := range eligible {
+				if b.ID != a.ID && to.Matches(b.Labels) {
+					cands = append(cands, b)
+				}
+			}
+			if in.MaxPeers > 0 && len(cands) > in.MaxPeers {
+				rankCandidates(a, cands, health, in.Preference)
+				cands = cands[:in.MaxPeers]
+			}
+			for _, b := range cands {
+				link(a.ID, b.ID)
+			}
+		}
+	}
+	return edges
+}
+
+// rankCandidates orders cands best-first for a according to pref.
+func rankCandidates(a model.Node, cands []model.Node, health map[string]model.HealthReport, pref string) {
+	if pref == model.PreferStable {
+		// rendezvous hashing: adding or removing a node moves few selections
+		key := func(b model.Node) uint64 {
+			h := fnv.New64a()
+			h.Write([]byte(a.ID + "|" + b.ID))
+			return h.Sum64()
+		}
+		sort.SliceStable(cands, func(i, j int) bool { return key(cands[i]) < key(cands[j]) })
+		return
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		li, lj := LinkLatency(a, cands[i], health), LinkLatency(a, cands[j], health)
+		if li != lj {
+			return li < lj
+		}
+		return cands[i].ID < cands[j].ID
+	})
+}
+
+// LinkLatency returns the latest measured latency between a and b in ms, preferring a's
+// own probe of b. Unmeasured links get the same high default BuildPeerPlan uses.
+func LinkLatency(a, b model.Node, health map[string]model.HealthReport) int {
+	if ms, ok := health[a.ID].LatencyMs[overlayAddr(b)]; ok {
+		return ms
+	}
+	if ms, ok := health[b.ID].LatencyMs[overlayAddr(a)]; ok {
+		return ms
+	}
+	return 100000
+}
+
+// overlayAddr strips the mask from a node's overlay IP, as used in health reports.
+func overlayAddr(n model.Node) string {
+	ip, _, _ := strings.Cut(n.OverlayIP, "/")
+	return ip
+}
@@ -0,0 +1,237 @@
+package topology
+
+import (
+	"container/heap"
+	"sort"
+
+	"peer-wan/pkg/model"
+)
+
+const (
+	// unmeasuredLinkMs is the latency assumed for adjacent nodes without a probe result.
+	unmeasuredLinkMs = 1000
+	// lossPenaltyMs is added per percent of packet loss.
+	lossPenaltyMs = 20
+)
+
+// Route is a hop sequence from a source node (excluded) to its egress (last hop).
+type Route struct {
+	Hops []string `json:"hops"`
+	Cost float64  `json:"cost"`
+}
+
+// Graph is the weighted peer graph: nodes that would be planned and the links
+// the topology lets them peer over, weighted by LinkCost. Pairs that need a relay
+// have no link; the relay carrying them is remembered instead.
+type Graph struct {
+	nodes  map[string]model.Node
+	adj    map[string]map[string]float64
+	relays map[string]map[string]string
+}
+
+// NewGraph builds the graph of plannable, not-down nodes under opts.
+func NewGraph(nodes []model.Node, health map[string]model.HealthReport, opts Options) *Graph {
+	if opts.Mode == model.TopologyIntent && opts.edges == nil {
+		opts = opts.Resolve(nodes, health)
+	}
+	g := &Graph{nodes: map[string]model.Node{}, adj: map[string]map[string]float64{}, relays: map[string]map[string]string{}}
+	var usable []model.Node
+	for _, n := range nodes {
+		if len(n.CIDRs) == 0 || n.PublicKey == "" {
+			continue
+		}
+		if h, ok := health[n.ID]; ok && h.Status == "down" {
+			continue
+		}
+		usable = append(usable, n)
+		g.nodes[n.ID] = n
+		g.adj[n.ID] = map[string]float64{}
+	}
+	for i, a := range usable {
+		for _, b := range usable[i+1:] {
+			if !opts.Adjacent(a, b) {
+				continue
+			}
+			if NeedsRelay(a, b, health) {
+				if relay := PickRelay(a, b, usable, health, opts); relay != "" {
+					g.relay(a.ID, b.ID, relay)
+				}
+				continue
+			}
+			if cost, ok := LinkCost(a, b, health); ok {
+				g.adj[a.ID][b.ID] = cost
+				g.adj[b.ID][a.ID] = cost
+			}
+		}
+	}
+	return g
+}
+
+func (g *Graph) relay(a, b, relay string) {
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		if g.relays[pair[0]] == nil {
+			g.relays[pair[0]] = map[string]string{}
+		}
+		g.relays[pair[0]][pair[1]] = relay
+	}
+}
+
+// WithRelays returns src -> hops with the relay inserted between every pair of
+// consecutive nodes that cannot reach each other.
+func (g *Graph) WithRelays(src string, hops []string) []string {
+	out := make([]string, 0, len(hops))
+	from := src
+	for _, id := range hops {
+		if relay := g.relays[from][id]; relay != "" {
+			out = append(out, relay)
+		}
+		out = append(out, id)
+		from = id
+	}
+	return out
+}
+
+// RelayedPairs lists the pairs that need a relay as "a>b via relay" (a < b), sorted.
+func (g *Graph) RelayedPairs() []string {
+	var out []string
+	for a, m := range g.relays {
+		for b, relay := range m {
+			if a < b {
+				out = append(out, a+">"+b+" via "+relay)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Linked reports whether a and b peer over a usable link or through a relay.
+func (g *Graph) Linked(a, b string) bool {
+	if _, ok := g.adj[a][b]; ok {
+		return true
+	}
+	return g.relays[a][b] != ""
+}
+
+// Node returns a node of the graph.
+func (g *Graph) Node(id string) (model.Node, bool) {
+	n, ok := g.nodes[id]
+	return n, ok
+}
+
+// LinkCost weighs the link a-b from the latest health reports: latency plus a loss
+// penalty, preferring a's own probe of b over b's probe of a. A link with 100% loss
+// is unusable.
+func LinkCost(a, b model.Node, health map[string]model.HealthReport) (float64, bool) {
+	latency, loss, ok := probe(health[a.ID], overlayAddr(b))
+	if !ok {
+		latency, loss, ok = probe(health[b.ID], overlayAddr(a))
+	}
+	if !ok {
+		return unmeasuredLinkMs, true
+	}
+	if loss >= 100 {
+		return 0, false
+	}
+	return float64(latency) + loss*lossPenaltyMs, true
+}
+
+// probe returns what h reports about the peer at ip.
+func probe(h model.HealthReport, ip string) (int, float64, bool) {
+	ms, hasLatency := h.LatencyMs[ip]
+	loss, hasLoss := h.PacketLoss[ip]
+	if !hasLatency && !hasLoss {
+		return 0, 0, false
+	}
+	if !hasLatency {
+		ms = unmeasuredLinkMs
+	}
+	return ms, loss, true
+}
+
+// ShortestPath finds the cheapest route from src to any node accepted by match (src
+// itself is never a target). Ties go to the lexically smaller egress.
+func (g *Graph) ShortestPath(src string, match func(model.Node) bool) (Route, bool) {
+	if _, ok := g.nodes[src]; !ok {
+		return Route{}, false
+	}
+	dist := map[string]float64{src: 0}
+	prev := map[string]string{}
+	done := map[string]bool{}
+	pq := &pathQueue{{id: src}}
+	var best string
+	for pq.Len() > 0 {
+		cur := heap.Pop(pq).(pathItem)
+		if done[cur.id] {
+			continue
+		}
+		done[cur.id] = true
+		if cur.id != src && match(g.nodes[cur.id]) {
+			best = cur.id
+			break
+		}
+		next := make([]string, 0, len(g.adj[cur.id]))
+		for id := range g.adj[cur.id] {
+			next = append(next, id)
+		}
+		sort.Strings(next)
+		for _, id := range next {
+			d := cur.dist + g.adj[cur.id][id]
+			if old, seen := dist[id]; !seen || d < old {
+				dist[id] = d
+				prev[id] = cur.id
+				heap.Push(pq, pathItem{id: id, dist: d})
+			}
+		}
+	}
+	if best == "" {
+		return Route{}, false
+	}
+	var hops []string
+	for id := best; id != src; id = prev[id] {
+		hops = append([]string{id}, hops...)
+	}
+	return Route{Hops: hops, Cost: dist[best]}, true
+}
+
+// PathCost sums the link costs along src -> hops; false if any link is missing or unusable.
+func (g *Graph) PathCost(src string, hops []string) (float64, bool) {
+	if len(hops) == 0 {
+		return 0, false
+	}
+	total := 0.0
+	from := src
+	for _, id := range hops {
+		cost, ok := g.adj[from][id]
+		if !ok {
+			return 0, false
+		}
+		total += cost
+		from = id
+	}
+	return total, true
+}
+
+type pathItem struct {
+	id   string
+	dist float64
+}
+
+// pathQueue is a min-heap on dist, then id for deterministic ties.
+type pathQueue []pathItem
+
+func (q pathQueue) Len() int { return len(q) }
+func (q pathQueue) Less(i, j int) bool {
+	if q[i].dist != q[j].dist {
+		return q[i].dist < q[j].dist
+	}
+	return q[i].id < q[j].id
+}
+func (q pathQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *pathQueue) Push(x interface{}) { *q = append(*q, x.(pathItem)) }
+func (q *pathQueue) Pop() interface{} {
+	old := *q
+	it := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return it
+}
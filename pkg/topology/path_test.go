@@ -0,0 +1,150 @@
+package topology
+
+import (
+	"reflect"
+	"testing"
+
+	"peer-wan/pkg/model"
+)
+
+func testNode(id, ip string, endpoint, relay bool) model.Node {
+	n := model.Node{ID: id, OverlayIP: ip + "/32", CIDRs: []string{ip + "/32"}, PublicKey: "key-" + id, Relay: relay}
+	if endpoint {
+		n.Endpoints = []string{ip + ":51820"}
+	}
+	return n
+}
+
+// probes records from's probe of to in health.
+func probes(health map[string]model.HealthReport, from, to model.Node, ms int, loss float64) {
+	h := health[from.ID]
+	h.NodeID = from.ID
+	if h.LatencyMs == nil {
+		h.LatencyMs, h.PacketLoss = map[string]int{}, map[string]float64{}
+	}
+	h.LatencyMs[overlayAddr(to)] = ms
+	h.PacketLoss[overlayAddr(to)] = loss
+	health[from.ID] = h
+}
+
+func TestLinkCost(t *testing.T) {
+	a, b := testNode("a", "10.0.0.1", true, false), testNode("b", "10.0.0.2", true, false)
+	tests := []struct {
+		name   string
+		health func(map[string]model.HealthReport)
+		want   float64
+		usable bool
+	}{
+		{"unmeasured", func(map[string]model.HealthReport) {}, unmeasuredLinkMs, true},
+		{"latency", func(h map[string]model.HealthReport) { probes(h, a, b, 30, 0) }, 30, true},
+		{"loss penalty", func(h map[string]model.HealthReport) { probes(h, a, b, 30, 5) }, 30 + 5*lossPenaltyMs, true},
+		{"total loss", func(h map[string]model.HealthReport) { probes(h, a, b, 30, 100) }, 0, false},
+		{"peer's probe", func(h map[string]model.HealthReport) { probes(h, b, a, 40, 0) }, 40, true},
+		{"own probe first", func(h map[string]model.HealthReport) { probes(h, a, b, 30, 0); probes(h, b, a, 40, 100) }, 30, true},
+		{"loss without latency", func(h map[string]model.HealthReport) {
+			h["a"] = model.HealthReport{NodeID: "a", PacketLoss: map[string]float64{"10.0.0.2": 2}}
+		}, unmeasuredLinkMs + 2*lossPenaltyMs, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			health := map[string]model.HealthReport{}
+			tc.health(health)
+			cost, ok := LinkCost(a, b, health)
+			if ok != tc.usable || cost != tc.want {
+				t.Fatalf("LinkCost = %v, %v; want %v, %v", cost, ok, tc.want, tc.usable)
+			}
+		})
+	}
+}
+
+func TestShortestPath(t *testing.T) {
+	a, b, c, d := testNode("a", "10.0.0.1", true, false), testNode("b", "10.0.0.2", true, false),
+		testNode("c", "10.0.0.3", true, false), testNode("d", "10.0.0.4", true, false)
+	nodes := []model.Node{d, c, b, a}
+	// a-b-d and a-c-d cost 20 each, a-d 50 directly; other pairs are unmeasured
+	square := func(h map[string]model.HealthReport) {
+		probes(h, a, b, 10, 0)
+		probes(h, b, d, 10, 0)
+		probes(h, a, c, 10, 0)
+		probes(h, c, d, 10, 0)
+		probes(h, a, d, 50, 0)
+	}
+	id := func(ids ...string) func(model.Node) bool {
+		return func(n model.Node) bool {
+			for _, want := range ids {
+				if n.ID == want {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	tests := []struct {
+		name   string
+		health func(map[string]model.HealthReport)
+		src    string
+		match  func(model.Node) bool
+		want   []string
+		cost   float64
+	}{
+		{"equal paths break ties by id", square, "a", id("d"), []string{"b", "d"}, 20},
+		{"equal egresses break ties by id", square, "a", id("c", "b"), []string{"b"}, 10},
+		{"source is never a target", square, "a", id("a"), nil, 0},
+		{"loss penalty", func(h map[string]model.HealthReport) { square(h); probes(h, a, b, 10, 1) }, "a", id("d"), []string{"c", "d"}, 20},
+		{"total loss drops the link", func(h map[string]model.HealthReport) { square(h); probes(h, a, b, 10, 100) }, "a", id("b"), []string{"c", "d", "b"}, 30},
+		{"down node is skipped", func(h map[string]model.HealthReport) {
+			square(h)
+			h["b"] = model.HealthReport{NodeID: "b", Status: "down"}
+		}, "a", id("d"), []string{"c", "d"}, 20},
+		{"down node is not a target", func(h map[string]model.HealthReport) {
+			square(h)
+			h["b"] = model.HealthReport{NodeID: "b", Status: "down"}
+		}, "a", id("b"), nil, 0},
+		{"down source", func(h map[string]model.HealthReport) {
+			square(h)
+			h["b"] = model.HealthReport{NodeID: "b", Status: "down"}
+		}, "b", id("d"), nil, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			health := map[string]model.HealthReport{}
+			tc.health(health)
+			g := NewGraph(nodes, health, Options{})
+			route, ok := g.ShortestPath(tc.src, tc.match)
+			if ok != (tc.want != nil) || !reflect.DeepEqual(route.Hops, tc.want) || route.Cost != tc.cost {
+				t.Fatalf("ShortestPath = %+v, %v; want hops %v cost %v", route, ok, tc.want, tc.cost)
+			}
+		})
+	}
+}
+
+func TestWithRelays(t *testing.T) {
+	// a and b are both behind NAT; r is a relay with an endpoint, s has one but does not relay
+	a, b := testNode("a", "10.0.0.1", false, false), testNode("b", "10.0.0.2", false, false)
+	r, s := testNode("r", "10.0.0.9", true, true), testNode("s", "10.0.0.8", true, false)
+	tests := []struct {
+		name   string
+		nodes  []model.Node
+		health map[string]model.HealthReport
+		hops   []string
+		want   []string
+		linked bool // a-b, directly or relayed
+	}{
+		{"relay inserted", []model.Node{a, b, r}, nil, []string{"b"}, []string{"r", "b"}, true},
+		{"reachable hop kept", []model.Node{a, b, r}, nil, []string{"r", "b"}, []string{"r", "b"}, true},
+		{"handshake proves direct path", []model.Node{a, b, r},
+			map[string]model.HealthReport{"a": {NodeID: "a", Handshakes: []string{"b"}}}, []string{"b"}, []string{"b"}, true},
+		{"no relay-capable node", []model.Node{a, b, s}, nil, []string{"s", "b"}, []string{"s", "b"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGraph(tc.nodes, tc.health, Options{})
+			if got := g.Linked("a", "b"); got != tc.linked {
+				t.Fatalf("Linked(a, b) = %v, want %v", got, tc.linked)
+			}
+			if got := g.WithRelays("a", tc.hops); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("WithRelays = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -6,15 +6,86 @@ import (
 	"peer-wan/pkg/model"
 )
 
-// BuildPeerPlan derives a simple full-mesh peer list for the target node.
-// It picks the first endpoint of each other node and only includes that node's
-// own overlay/CIDRs as AllowedIPs (others are redundant and can break wg routing).
-// Later this can evolve into intent-based or latency-aware plans.
-func BuildPeerPlan(targetID string, nodes []model.Node, health map[string]model.HealthReport) []model.Peer {
+// Options selects how BuildPeerPlan connects nodes.
+type Options struct {
+	// Mode is model.TopologyMesh (default), model.TopologyHubSpoke or model.TopologyIntent.
+	Mode string
+	// Intents decide adjacency in intent mode.
+	Intents []model.PeeringIntent
+
+	edges map[string]map[string]bool // resolved intent adjacency
+}
+
+// FromSettings derives plan options from the controller settings.
+func FromSettings(s model.Settings) Options {
+	return Options{Mode: s.Topology.Mode, Intents: s.Topology.Intents}
+}
+
+// Resolve evaluates the intents against the current nodes and health so Adjacent can
+// answer in intent mode. It is a no-op in the other modes; BuildPeerPlan resolves
+// unresolved options itself.
+func (o Options) Resolve(nodes []model.Node, health map[string]model.HealthReport) Options {
+	if o.Mode == model.TopologyIntent {
+		o.edges = Edges(nodes, health, o.Intents)
+	}
+	return o
+}
+
+func (o Options) hubSpoke() bool { return o.Mode == model.TopologyHubSpoke }
+
+// Role returns a node's effective role under o: empty in mesh mode, otherwise hub
+// for nodes marked hub and spoke for everything else.
+func (o Options) Role(n model.Node) string {
+	if !o.hubSpoke() {
+		return ""
+	}
+	if n.Role == model.RoleHub {
+		return model.RoleHub
+	}
+	return model.RoleSpoke
+}
+
+// Adjacent reports whether a and b peer directly under o. In hub-spoke mode spokes
+// only peer with hubs; hubs peer with each other and with every spoke. In intent mode
+// only pairs selected by the (resolved) intents peer.
+func (o Options) Adjacent(a, b model.Node) bool {
+	switch o.Mode {
+	case model.TopologyHubSpoke:
+		return o.Role(a) == model.RoleHub || o.Role(b) == model.RoleHub
+	case model.TopologyIntent:
+		return o.edges[a.ID][b.ID]
+	}
+	return true
+}
+
+// BuildPeerPlan derives the peer list for the target node.
+// Every endpoint of a peer is passed on as a failover candidate, the one the target last
+// reported working first, and only that node's own overlay/CIDRs are AllowedIPs
+// (others are redundant and can break wg routing).
+//
+// In mesh mode every node peers with every other. In hub-spoke mode a spoke peers
+// only with the hubs; the prefixes of the remote spokes are aggregated onto the
+// best hub (WireGuard allows each prefix on one peer only), so spoke-to-spoke
+// traffic transits that hub. Peers carry their role so agents can render hubs as
+// BGP route reflectors. In intent mode the peering intents select the peers.
+//
+// A target without endpoints cannot reach peers that have none either; their prefixes
+// are carried by a relay node (see PickRelay) until a direct handshake is reported.
+func BuildPeerPlan(targetID string, nodes []model.Node, health map[string]model.HealthReport, opts Options) []model.Peer {
+	if opts.Mode == model.TopologyIntent && opts.edges == nil {
+		opts = opts.Resolve(nodes, health)
+	}
 	type scored struct {
 		peer  model.Peer
 		score int // lower is better (latency)
 	}
+	target := model.Node{ID: targetID}
+	for _, n := range nodes {
+		if n.ID == targetID {
+			target = n
+			break
+		}
+	}
 	var peers []scored
 	for _, n := range nodes {
 		if n.ID == targetID {
@@ -23,6 +94,9 @@ func BuildPeerPlan(targetID string, nodes []model.Node, health map[string]model.
 		if len(n.CIDRs) == 0 || n.PublicKey == "" {
 			continue
 		}
+		if !opts.Adjacent(target, n) {
+			continue
+		}
 		score := 100000 // default high latency
 		if h, ok := health[n.ID]; ok {
 			if h.Status == "down" {
@@ -41,28 +115,21 @@ func BuildPeerPlan(targetID string, nodes []model.Node, health map[string]model.
 				}
 			}
 		}
+		endpoints := preferEndpoint(n.Endpoints, target.LinkEndpoints[n.ID])
 		endpoint := ""
-		if len(n.Endpoints) > 0 {
-			endpoint = n.Endpoints[0]
-		}
-		allowed := make([]string, 0, len(n.CIDRs)+1)
-		seen := make(map[string]bool, len(n.CIDRs)+1)
-		if n.OverlayIP != "" {
-			allowed = append(allowed, n.OverlayIP)
-			seen[n.OverlayIP] = true
-		}
-		for _, cidr := range n.CIDRs {
-			if !seen[cidr] {
-				allowed = append(allowed, cidr)
-				seen[cidr] = true
-			}
+		if len(endpoints) > 0 {
+			endpoint = endpoints[0]
 		}
 		peers = append(peers, scored{peer: model.Peer{
-			ID:         n.ID,
-			PublicKey:  n.PublicKey,
-			Endpoint:   endpoint,
-			AllowedIPs: allowed,
-			Keepalive:  25,
+			ID:            n.ID,
+			PublicKey:     n.PublicKey,
+			NextPublicKey: n.StagedPublicKey(),
+			Endpoint:      endpoint,
+			Endpoints:     endpoints,
+			AllowedIPs:    ownPrefixes(n),
+			OverlayIP6:    n.OverlayIP6,
+			Keepalive:     25,
+			Role:          opts.Role(n),
 		}, score: score})
 	}
 	sort.SliceStable(peers, func(i, j int) bool {
@@ -72,5 +139,75 @@ func BuildPeerPlan(targetID string, nodes []model.Node, health map[string]model.
 	for _, p := range peers {
 		out = append(out, p.peer)
 	}
+	if opts.Role(target) == model.RoleSpoke {
+		routeSpokesViaHub(target, nodes, out, opts)
+	}
+	routeViaRelays(target, nodes, out, health, opts)
 	return out
 }
+
+// preferEndpoint returns endpoints with working moved to the front, if it is one of them.
+func preferEndpoint(endpoints []string, working string) []string {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if ep == working {
+			out = append(out, ep)
+		}
+	}
+	for _, ep := range endpoints {
+		if ep != working {
+			out = append(out, ep)
+		}
+	}
+	return out
+}
+
+// ownPrefixes lists a node's overlay addresses (IPv4 first, then IPv6) followed by its
+// CIDRs, without duplicates.
+func ownPrefixes(n model.Node) []string {
+	allowed := make([]string, 0, len(n.CIDRs)+2)
+	seen := make(map[string]bool, len(n.CIDRs)+2)
+	for _, ip := range []string{n.OverlayIP, n.OverlayIP6} {
+		if ip != "" && !seen[ip] {
+			allowed = append(allowed, ip)
+			seen[ip] = true
+		}
+	}
+	for _, cidr := range n.CIDRs {
+		if !seen[cidr] {
+			allowed = append(allowed, cidr)
+			seen[cidr] = true
+		}
+	}
+	return allowed
+}
+
+// routeSpokesViaHub appends the aggregated prefixes of every other spoke to the first
+// (best scored) hub in peers. Prefixes a hub already owns are left to that hub.
+func routeSpokesViaHub(target model.Node, nodes []model.Node, peers []model.Peer, opts Options) {
+	if len(peers) == 0 {
+		return
+	}
+	owned := map[string]bool{}
+	for _, p := range peers {
+		for _, ip := range p.AllowedIPs {
+			owned[ip] = true
+		}
+	}
+	var remote []string
+	for _, n := range nodes {
+		if n.ID == target.ID || opts.Role(n) != model.RoleSpoke || len(n.CIDRs) == 0 {
+			continue
+		}
+		for _, pfx := range ownPrefixes(n) {
+			if !owned[pfx] {
+				remote = append(remote, pfx)
+			}
+		}
+	}
+	primary := &peers[0]
+	primary.AllowedIPs = append(primary.AllowedIPs, AggregatePrefixes(remote)...)
+}
@@ -0,0 +1,93 @@
+package topology
+
+import (
+	"peer-wan/pkg/model"
+)
+
+// Handshaken reports whether a or b saw a recent WireGuard handshake with the other.
+func Handshaken(a, b model.Node, health map[string]model.HealthReport) bool {
+	for _, id := range health[a.ID].Handshakes {
+		if id == b.ID {
+			return true
+		}
+	}
+	for _, id := range health[b.ID].Handshakes {
+		if id == a.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsRelay reports whether a and b cannot open a tunnel to each other: neither has an
+// endpoint (both behind NAT/CGNAT) and no handshake between them proved a direct path,
+// e.g. over a manual per-peer endpoint.
+func NeedsRelay(a, b model.Node, health map[string]model.HealthReport) bool {
+	return len(a.Endpoints) == 0 && len(b.Endpoints) == 0 && !Handshaken(a, b, health)
+}
+
+// usableRelay reports whether r can carry traffic: relay-capable, reachable and planned.
+func usableRelay(r model.Node, health map[string]model.HealthReport) bool {
+	if !r.Relay || len(r.Endpoints) == 0 || len(r.CIDRs) == 0 || r.PublicKey == "" {
+		return false
+	}
+	return health[r.ID].Status != "down"
+}
+
+// PickRelay returns the relay for traffic between a and b when they need one: the usable
+// relay both peer with under opts that has the cheapest a-relay-b link cost, ties going to
+// the smaller id. It returns "" when a and b talk directly or no relay qualifies.
+func PickRelay(a, b model.Node, nodes []model.Node, health map[string]model.HealthReport, opts Options) string {
+	if !NeedsRelay(a, b, health) {
+		return ""
+	}
+	best, bestCost := "", 0.0
+	for _, r := range nodes {
+		if r.ID == a.ID || r.ID == b.ID || !usableRelay(r, health) {
+			continue
+		}
+		if !opts.Adjacent(a, r) || !opts.Adjacent(r, b) {
+			continue
+		}
+		ca, ok := LinkCost(a, r, health)
+		if !ok {
+			continue
+		}
+		cb, ok := LinkCost(r, b, health)
+		if !ok {
+			continue
+		}
+		if cost := ca + cb; best == "" || cost < bestCost || (cost == bestCost && r.ID < best) {
+			best, bestCost = r.ID, cost
+		}
+	}
+	return best
+}
+
+// routeViaRelays moves the prefixes of every peer the target cannot reach onto the relay
+// picked for the pair. The direct entry stays, without AllowedIPs and marked with its
+// relay, so a handshake over a manual endpoint can still prove the direct path; the next
+// plan then drops the relay.
+func routeViaRelays(target model.Node, nodes []model.Node, peers []model.Peer, health map[string]model.HealthReport, opts Options) {
+	if len(target.Endpoints) > 0 {
+		return
+	}
+	byID := make(map[string]model.Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	index := make(map[string]int, len(peers))
+	for i, p := range peers {
+		index[p.ID] = i
+	}
+	for i := range peers {
+		relay := PickRelay(target, byID[peers[i].ID], nodes, health, opts)
+		j, ok := index[relay]
+		if relay == "" || !ok {
+			continue
+		}
+		peers[j].AllowedIPs = append(peers[j].AllowedIPs, peers[i].AllowedIPs...)
+		peers[i].AllowedIPs = nil
+		peers[i].Relay = relay
+	}
+}
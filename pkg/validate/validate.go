@@ -0,0 +1,476 @@
+package validate
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"peer-wan/pkg/model"
+	"peer-wan/pkg/topology"
+)
+
+// Issue kinds reported by Run.
+const (
+	KindSiteOverlap   = "site-overlap"         // two nodes route overlapping site CIDRs
+	KindAllowedIPs    = "allowedips-collision" // one node would allow the same prefix on two peers
+	KindSiteShadowed  = "site-shadowed"        // a policy prefix takes part of a site subnet to another peer
+	KindUnknownNode   = "unknown-node"         // a policy names a node (or selector) that matches nothing
+	KindUnhealthyNode = "unhealthy-node"       // a policy relies on a node that is down or not planned
+	KindRoutingLoop   = "routing-loop"         // forwarding for a prefix returns to a node it already crossed
+	KindShadowedRule  = "shadowed-rule"        // a rule is duplicated or overridden by another rule of the node
+)
+
+// Issue severities. Errors break traffic once applied; warnings are worth a look.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Issue is one finding of the validation engine.
+type Issue struct {
+	Kind     string   `json:"kind"`
+	Severity string   `json:"severity"`
+	NodeID   string   `json:"nodeId,omitempty"`
+	Rule     *int     `json:"rule,omitempty"` // index into the node's policy rules
+	Prefix   string   `json:"prefix,omitempty"`
+	Nodes    []string `json:"nodes,omitempty"` // other nodes involved: peers, hops or the loop
+	Detail   string   `json:"detail"`
+}
+
+// Key identifies an issue independent of its wording and rule index, so reports of two
+// states can be compared.
+func (i Issue) Key() string {
+	return strings.Join([]string{i.Kind, i.NodeID, i.Prefix, strings.Join(i.Nodes, ",")}, "|")
+}
+
+// Involves reports whether the issue concerns nodeID.
+func (i Issue) Involves(nodeID string) bool {
+	if i.NodeID == nodeID {
+		return true
+	}
+	for _, id := range i.Nodes {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// Report is the outcome of a validation run.
+type Report struct {
+	Valid    bool    `json:"valid"` // no error-severity issue
+	Errors   int     `json:"errors"`
+	Warnings int     `json:"warnings"`
+	Issues   []Issue `json:"issues"`
+}
+
+// Input is the controller state to validate.
+type Input struct {
+	Nodes   []model.Node
+	Health  map[string]model.HealthReport
+	Options topology.Options
+	// Rules are the per-node policy rules as plans carry them: auto paths resolved and a hop
+	// rule at every node along a path, ViaNode naming the next hop.
+	Rules map[string][]model.PolicyRule
+}
+
+// Run checks site prefixes, the AllowedIPs every node would render, policy references,
+// forwarding loops and rule shadowing. Only literal prefixes are checked; geoip and domain
+// rules depend on data resolved by the agents.
+func Run(in Input) Report {
+	nodes := append([]model.Node(nil), in.Nodes...)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	if in.Options.Mode == model.TopologyIntent {
+		in.Options = in.Options.Resolve(nodes, in.Health)
+	}
+	var issues []Issue
+	issues = append(issues, siteOverlaps(nodes)...)
+	issues = append(issues, allowedIPs(nodes, in)...)
+	issues = append(issues, references(nodes, in)...)
+	issues = append(issues, loops(nodes, in.Rules)...)
+	issues = append(issues, shadowedRules(nodes)...)
+
+	rep := Report{Issues: []Issue{}}
+	seen := map[string]bool{}
+	for _, is := range issues {
+		k := is.Key() + "|" + is.Detail
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		rep.Issues = append(rep.Issues, is)
+		if is.Severity == SeverityError {
+			rep.Errors++
+		} else {
+			rep.Warnings++
+		}
+	}
+	sort.SliceStable(rep.Issues, func(i, j int) bool {
+		a, b := rep.Issues[i], rep.Issues[j]
+		if a.Severity != b.Severity {
+			return a.Severity == SeverityError
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.NodeID < b.NodeID
+	})
+	rep.Valid = rep.Errors == 0
+	return rep
+}
+
+// parsePrefix accepts CIDRs and bare addresses; geoip sets and junk yield false.
+func parsePrefix(s string) (netip.Prefix, bool) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		return p.Masked(), true
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(a, a.BitLen()), true
+}
+
+// covers reports whether a contains all of b.
+func covers(a, b netip.Prefix) bool {
+	return a.Bits() <= b.Bits() && a.Contains(b.Addr())
+}
+
+// special next hops that keep traffic on the node.
+func localHop(id string) bool {
+	return id == "" || id == "local" || id == "main"
+}
+
+// nextHop is the first node a rule of its owner sends traffic to.
+func nextHop(r model.PolicyRule) string {
+	if len(r.Path) > 0 {
+		return r.Path[0]
+	}
+	return r.ViaNode
+}
+
+func ruleIndex(i int) *int { return &i }
+
+// siteOverlaps reports pairs of nodes whose CIDRs overlap: WireGuard can allow a prefix
+// on one peer only, so one of the sites becomes unreachable.
+func siteOverlaps(nodes []model.Node) []Issue {
+	var out []Issue
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			for _, ca := range a.CIDRs {
+				pa, ok := parsePrefix(ca)
+				if !ok {
+					continue
+				}
+				for _, cb := range b.CIDRs {
+					if pb, ok := parsePrefix(cb); ok && pa.Overlaps(pb) {
+						out = append(out, Issue{
+							Kind: KindSiteOverlap, Severity: SeverityError, NodeID: b.ID, Prefix: pb.String(),
+							Nodes:  []string{a.ID},
+							Detail: fmt.Sprintf("site %s overlaps %s of node %s", pb, pa, a.ID),
+						})
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// allowed is one AllowedIPs entry a node would render.
+type allowed struct {
+	prefix netip.Prefix
+	peer   string
+	policy bool // added for a policy rule or the default route rather than owned by the peer
+}
+
+// allowedIPs rebuilds every node's peer plan plus the prefixes its agent adds for policy
+// rules and the default route, and reports prefixes that land on two peers. Overlaps
+// between sites are left to siteOverlaps.
+func allowedIPs(nodes []model.Node, in Input) []Issue {
+	var out []Issue
+	for _, n := range nodes {
+		peers := topology.BuildPeerPlan(n.ID, nodes, in.Health, in.Options)
+		planned := map[string]bool{}
+		var entries []allowed
+		for _, p := range peers {
+			planned[p.ID] = true
+			for _, s := range p.AllowedIPs {
+				if pfx, ok := parsePrefix(s); ok {
+					entries = append(entries, allowed{prefix: pfx, peer: p.ID})
+				}
+			}
+		}
+		for _, r := range in.Rules[n.ID] {
+			hop := nextHop(r)
+			if pfx, ok := parsePrefix(r.Prefix); ok && planned[hop] {
+				entries = append(entries, allowed{prefix: pfx, peer: hop, policy: true})
+			}
+		}
+		if n.DefaultRoute && planned[n.EgressPeerID] {
+			entries = append(entries, allowed{prefix: netip.MustParsePrefix("0.0.0.0/0"), peer: n.EgressPeerID, policy: true})
+		}
+		for i, a := range entries {
+			for _, b := range entries[i+1:] {
+				if a.peer == b.peer || (!a.policy && !b.policy) || !a.prefix.Overlaps(b.prefix) {
+					continue
+				}
+				switch {
+				case a.prefix == b.prefix:
+					out = append(out, Issue{
+						Kind: KindAllowedIPs, Severity: SeverityError, NodeID: n.ID, Prefix: a.prefix.String(),
+						Nodes:  sortedPair(a.peer, b.peer),
+						Detail: fmt.Sprintf("%s is allowed on peers %s and %s; WireGuard keeps it on one only", a.prefix, a.peer, b.peer),
+					})
+				case a.policy && !b.policy && covers(b.prefix, a.prefix):
+					out = append(out, shadowsSite(n.ID, a, b))
+				case b.policy && !a.policy && covers(a.prefix, b.prefix):
+					out = append(out, shadowsSite(n.ID, b, a))
+				}
+			}
+		}
+	}
+	return out
+}
+
+func shadowsSite(nodeID string, rule, site allowed) Issue {
+	return Issue{
+		Kind: KindSiteShadowed, Severity: SeverityError, NodeID: nodeID, Prefix: rule.prefix.String(),
+		Nodes:  sortedPair(rule.peer, site.peer),
+		Detail: fmt.Sprintf("policy prefix %s via %s takes part of %s owned by %s", rule.prefix, rule.peer, site.prefix, site.peer),
+	}
+}
+
+func sortedPair(a, b string) []string {
+	if b < a {
+		a, b = b, a
+	}
+	return []string{a, b}
+}
+
+// references checks the nodes every policy rule names: they must exist, and a node that is
+// down or cannot be planned (no CIDRs or public key) leaves the rule without a path.
+func references(nodes []model.Node, in Input) []Issue {
+	byID := map[string]model.Node{}
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	var graph *topology.Graph
+	var out []Issue
+	for _, n := range nodes {
+		for i, r := range n.PolicyRules {
+			refs := append([]string(nil), r.Path...)
+			if len(r.Path) == 0 && !localHop(r.ViaNode) {
+				refs = append(refs, r.ViaNode)
+			}
+			if r.Egress != "" {
+				refs = append(refs, r.Egress)
+			}
+			seen := map[string]bool{}
+			for _, id := range refs {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				ref, ok := byID[id]
+				switch {
+				case !ok:
+					out = append(out, Issue{
+						Kind: KindUnknownNode, Severity: SeverityError, NodeID: n.ID, Rule: ruleIndex(i), Prefix: r.Prefix,
+						Nodes: []string{id}, Detail: fmt.Sprintf("rule %d names unknown node %s", i, id),
+					})
+				case in.Health[id].Status == "down":
+					out = append(out, Issue{
+						Kind: KindUnhealthyNode, Severity: SeverityWarning, NodeID: n.ID, Rule: ruleIndex(i), Prefix: r.Prefix,
+						Nodes: []string{id}, Detail: fmt.Sprintf("rule %d relies on node %s, which is down", i, id),
+					})
+				case len(ref.CIDRs) == 0 || ref.PublicKey == "":
+					out = append(out, Issue{
+						Kind: KindUnhealthyNode, Severity: SeverityWarning, NodeID: n.ID, Rule: ruleIndex(i), Prefix: r.Prefix,
+						Nodes: []string{id}, Detail: fmt.Sprintf("rule %d relies on node %s, which is not planned (no CIDRs or public key)", i, id),
+					})
+				}
+			}
+			if !r.AutoPath() {
+				continue
+			}
+			if _, ok := byID[r.Egress]; r.Egress != "" && !ok {
+				continue // already reported
+			}
+			sel, err := topology.ParseSelector(r.EgressSelector)
+			if err != nil {
+				continue
+			}
+			match := func(c model.Node) bool {
+				return (r.Egress == "" || c.ID == r.Egress) && sel.Matches(c.Labels)
+			}
+			candidates := false
+			for _, c := range nodes {
+				if c.ID != n.ID && match(c) {
+					candidates = true
+					break
+				}
+			}
+			if !candidates {
+				out = append(out, Issue{
+					Kind: KindUnknownNode, Severity: SeverityError, NodeID: n.ID, Rule: ruleIndex(i), Prefix: r.Prefix,
+					Detail: fmt.Sprintf("egress of rule %d matches no node", i),
+				})
+				continue
+			}
+			if graph == nil {
+				graph = topology.NewGraph(nodes, in.Health, in.Options)
+			}
+			if _, ok := graph.ShortestPath(n.ID, match); !ok {
+				out = append(out, Issue{
+					Kind: KindUnhealthyNode, Severity: SeverityWarning, NodeID: n.ID, Rule: ruleIndex(i), Prefix: r.Prefix,
+					Detail: fmt.Sprintf("rule %d has no usable path to its egress", i),
+				})
+			}
+		}
+	}
+	return out
+}
+
+// hop is a forwarding entry: traffic for prefix leaves the node towards via.
+type hop struct {
+	prefix netip.Prefix
+	via    string
+}
+
+// loops follows the forwarding of every policy prefix (and default route) hop by hop,
+// each node using its longest matching entry, and reports cycles.
+func loops(nodes []model.Node, rules map[string][]model.PolicyRule) []Issue {
+	table := map[string][]hop{}
+	for _, n := range nodes {
+		for _, r := range rules[n.ID] {
+			if pfx, ok := parsePrefix(r.Prefix); ok && !localHop(nextHop(r)) {
+				table[n.ID] = append(table[n.ID], hop{prefix: pfx, via: nextHop(r)})
+			}
+		}
+		if n.DefaultRoute {
+			via := n.DefaultRouteNextHop
+			if via == "" {
+				via = n.EgressPeerID
+			}
+			if !localHop(via) {
+				table[n.ID] = append(table[n.ID], hop{prefix: netip.MustParsePrefix("0.0.0.0/0"), via: via})
+			}
+		}
+	}
+	lookup := func(node string, dst netip.Prefix) (hop, bool) {
+		best := hop{}
+		found := false
+		for _, h := range table[node] {
+			if covers(h.prefix, dst) && (!found || h.prefix.Bits() > best.prefix.Bits()) {
+				best, found = h, true
+			}
+		}
+		return best, found
+	}
+	var out []Issue
+	reported := map[string]bool{}
+	for _, n := range nodes {
+		for _, start := range table[n.ID] {
+			// trail[i] forwarded using matched[i]; the loop is reported under the most
+			// specific entry inside it, so one looping default route is reported once
+			trail := []string{n.ID}
+			matched := []netip.Prefix{start.prefix}
+			at := map[string]int{n.ID: 0}
+			next := start.via
+			for {
+				if i, ok := at[next]; ok {
+					cycle := append(append([]string(nil), trail[i:]...), next)
+					members := append([]string(nil), trail[i:]...)
+					sort.Strings(members)
+					pfx := matched[i]
+					for _, m := range matched[i:] {
+						if m.Bits() > pfx.Bits() {
+							pfx = m
+						}
+					}
+					key := pfx.String() + "|" + strings.Join(members, ",")
+					if !reported[key] {
+						reported[key] = true
+						out = append(out, Issue{
+							Kind: KindRoutingLoop, Severity: SeverityError, NodeID: trail[i], Prefix: pfx.String(),
+							Nodes:  members,
+							Detail: fmt.Sprintf("traffic for %s loops %s", pfx, strings.Join(cycle, " -> ")),
+						})
+					}
+					break
+				}
+				h, ok := lookup(next, start.prefix)
+				if !ok || localHop(h.via) {
+					break
+				}
+				at[next] = len(trail)
+				trail = append(trail, next)
+				matched = append(matched, h.prefix)
+				next = h.via
+			}
+		}
+	}
+	return out
+}
+
+// shadowedRules compares the configured rules of every node: a duplicate prefix sends
+// traffic to only one of its next hops, a longer prefix overrides part of a shorter one,
+// and a rule covered by one with the same next hop is redundant.
+func shadowedRules(nodes []model.Node) []Issue {
+	target := func(r model.PolicyRule) string {
+		if hop := nextHop(r); hop != "" {
+			return hop
+		}
+		if r.Egress != "" {
+			return r.Egress
+		}
+		return "selector " + r.EgressSelector
+	}
+	var out []Issue
+	for _, n := range nodes {
+		for i, a := range n.PolicyRules {
+			pa, ok := parsePrefix(a.Prefix)
+			if !ok {
+				continue
+			}
+			for j := i + 1; j < len(n.PolicyRules); j++ {
+				b := n.PolicyRules[j]
+				pb, ok := parsePrefix(b.Prefix)
+				if !ok || !pa.Overlaps(pb) {
+					continue
+				}
+				ta, tb := target(a), target(b)
+				is := Issue{Kind: KindShadowedRule, NodeID: n.ID, Severity: SeverityWarning}
+				switch {
+				case pa == pb && ta != tb:
+					is.Severity, is.Rule, is.Prefix = SeverityError, ruleIndex(j), pb.String()
+					is.Detail = fmt.Sprintf("rule %d and rule %d both route %s (via %s and %s); only one can win", i, j, pb, ta, tb)
+				case pa == pb:
+					is.Rule, is.Prefix = ruleIndex(j), pb.String()
+					is.Detail = fmt.Sprintf("rule %d duplicates rule %d", j, i)
+				default:
+					wide, narrow, wi, ni, wt, nt := pa, pb, i, j, ta, tb
+					if pb.Bits() < pa.Bits() {
+						wide, narrow, wi, ni, wt, nt = pb, pa, j, i, tb, ta
+					}
+					if wt == nt {
+						is.Rule, is.Prefix = ruleIndex(ni), narrow.String()
+						is.Detail = fmt.Sprintf("rule %d (%s) is redundant with rule %d (%s) via %s", ni, narrow, wi, wide, wt)
+					} else {
+						is.Rule, is.Prefix = ruleIndex(wi), wide.String()
+						is.Detail = fmt.Sprintf("rule %d (%s via %s) overrides part of rule %d (%s via %s)", ni, narrow, nt, wi, wide, wt)
+					}
+				}
+				out = append(out, is)
+			}
+		}
+	}
+	return out
+}
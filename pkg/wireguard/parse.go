@@ -0,0 +1,108 @@
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Config is the part of a wg-quick config the dataplane applies.
+type Config struct {
+	PrivateKey string
+	ListenPort int
+	Addresses  []string
+	MTU        int
+	Peers      []PeerConfig
+}
+
+// PeerConfig is one [Peer] section of a wg-quick config.
+type PeerConfig struct {
+	PublicKey    string
+	PresharedKey string
+	Endpoint     string
+	AllowedIPs   []string
+	Keepalive    int
+}
+
+// ParseConfig reads a wg-quick config as written by RenderConfig. Keys are matched
+// case-insensitively like wg-quick does; keys it does not apply are ignored.
+func ParseConfig(data string) (Config, error) {
+	var cfg Config
+	var peer *PeerConfig
+	section := ""
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			if section == "peer" {
+				cfg.Peers = append(cfg.Peers, PeerConfig{})
+				peer = &cfg.Peers[len(cfg.Peers)-1]
+			}
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return cfg, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key, val = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(val)
+		var err error
+		switch section {
+		case "interface":
+			switch key {
+			case "privatekey":
+				cfg.PrivateKey = val
+			case "listenport":
+				cfg.ListenPort, err = strconv.Atoi(val)
+			case "address":
+				cfg.Addresses = append(cfg.Addresses, splitList(val)...)
+			case "mtu":
+				cfg.MTU, err = strconv.Atoi(val)
+			}
+		case "peer":
+			switch key {
+			case "publickey":
+				peer.PublicKey = val
+			case "presharedkey":
+				peer.PresharedKey = val
+			case "endpoint":
+				peer.Endpoint = val
+			case "allowedips":
+				peer.AllowedIPs = append(peer.AllowedIPs, splitList(val)...)
+			case "persistentkeepalive":
+				if val != "off" {
+					peer.Keepalive, err = strconv.Atoi(val)
+				}
+			}
+		default:
+			return cfg, fmt.Errorf("line %d: %s outside of a section", lineNo, key)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("line %d: invalid %s: %w", lineNo, key, err)
+		}
+	}
+	for i, p := range cfg.Peers {
+		if p.PublicKey == "" {
+			return cfg, fmt.Errorf("peer %d has no public key", i+1)
+		}
+	}
+	return cfg, sc.Err()
+}
+
+func splitList(val string) []string {
+	var out []string
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
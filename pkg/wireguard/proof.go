@@ -0,0 +1,46 @@
+package wireguard
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Key proofs let an agent show it holds the private key behind the public key it registers
+// without sending it: both sides derive the X25519 secret of the node key and the
+// controller's proof key and MAC the node id and public key with it.
+
+func keyProofMAC(priv, peer wgtypes.Key, nodeID, nodePub string) ([]byte, error) {
+	shared, err := curve25519.X25519(priv[:], peer[:])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte("peer-wan-key-proof\x00" + nodeID + "\x00" + nodePub))
+	return mac.Sum(nil), nil
+}
+
+// KeyProof proves possession of priv to the holder of the proof key controllerPub.
+func KeyProof(priv, controllerPub wgtypes.Key, nodeID string) (string, error) {
+	sum, err := keyProofMAC(priv, controllerPub, nodeID, priv.PublicKey().String())
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// VerifyKeyProof checks a KeyProof for the node key pub with the controller's private proof key.
+func VerifyKeyProof(controllerPriv, pub wgtypes.Key, nodeID, proof string) bool {
+	got, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return false
+	}
+	want, err := keyProofMAC(controllerPriv, pub, nodeID, pub.String())
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, want)
+}
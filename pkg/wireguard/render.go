@@ -8,7 +8,7 @@ import (
 )
 
 // RenderConfig produces a wg-quick compatible config string for an interface.
-// It uses the node's OverlayIP as Address and ListenPort (if provided) and builds
+// It uses the node's OverlayIP (and OverlayIP6 when dual-stack) as Address and ListenPort (if provided) and builds
 // peers from the provided peer list.
 func RenderConfig(iface string, node model.Node, peers []model.Peer, privateKey string) (string, error) {
 	if iface == "" {
@@ -16,8 +16,14 @@ func RenderConfig(iface string, node model.Node, peers []model.Peer, privateKey
 	}
 	var b strings.Builder
 	b.WriteString("[Interface]\n")
-	if node.OverlayIP != "" {
-		fmt.Fprintf(&b, "Address = %s\n", node.OverlayIP)
+	var addrs []string
+	for _, ip := range []string{node.OverlayIP, node.OverlayIP6} {
+		if ip != "" {
+			addrs = append(addrs, ip)
+		}
+	}
+	if len(addrs) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", strings.Join(addrs, ", "))
 	}
 	if node.ListenPort > 0 {
 		fmt.Fprintf(&b, "ListenPort = %d\n", node.ListenPort)
@@ -30,6 +36,10 @@ func RenderConfig(iface string, node model.Node, peers []model.Peer, privateKey
 	for _, p := range peers {
 		b.WriteString("[Peer]\n")
 		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		if p.PresharedKey != "" {
+			// the staged NextPresharedKey is only held until the controller commits it
+			fmt.Fprintf(&b, "PresharedKey = %s\n", p.PresharedKey)
+		}
 		ep := p.Endpoint
 		if node.PeerEndpoints != nil {
 			if override, ok := node.PeerEndpoints[p.ID]; ok && override != "" {
@@ -46,6 +56,16 @@ func RenderConfig(iface string, node model.Node, peers []model.Peer, privateKey
 			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.Keepalive)
 		}
 		b.WriteString("\n")
+		if p.NextPublicKey != "" {
+			// standby entry for the peer's next key: it handshakes as soon as the peer switches,
+			// traffic stays with the current key until the controller commits the rotation
+			b.WriteString("[Peer]\n")
+			fmt.Fprintf(&b, "PublicKey = %s\n", p.NextPublicKey)
+			if p.PresharedKey != "" {
+				fmt.Fprintf(&b, "PresharedKey = %s\n", p.PresharedKey)
+			}
+			b.WriteString("\n")
+		}
 	}
 	return b.String(), nil
 }